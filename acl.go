@@ -0,0 +1,271 @@
+package basalt
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Category is a category of commands controlled by ACLs.
+type Category string
+
+// Categories of commands.
+const (
+	CategoryRead    Category = "read"    // read bitmaps
+	CategoryWrite   Category = "write"   // write bitmaps
+	CategoryAdmin   Category = "admin"   // persistence, backups, draining and migrations
+	CategoryCluster Category = "cluster" // raft status, metrics, membership and leadership, and writes forwarded by members
+)
+
+// DefaultUser is the user of clients not authenticated. Without it, clients must authenticate before any command.
+const DefaultUser = "default"
+
+// Errors for authentication and ACLs.
+var (
+	ErrAuthRequired = errors.New("authentication required")
+	ErrAuthFailed   = errors.New("invalid username-password pair or token")
+	ErrNoPermission = errors.New("no permissions to run the command on the keys")
+	ErrInvalidACL   = errors.New("invalid ACL")
+)
+
+// User is a user allowed to run commands of its categories on bitmaps whose names match its key patterns.
+type User struct {
+	Name string `json:"name"`
+	// Password authenticates redis connections by AUTH, it is plain text or `sha256:` followed by the hex digest.
+	Password string `json:"password,omitempty"`
+	// Tokens authenticate HTTP requests as bearer tokens and rpcx requests.
+	Tokens     []string   `json:"tokens,omitempty"`
+	Categories []Category `json:"categories"`
+	// Keys are glob patterns of bitmap names, `*` matches any sequence and `?` matches any character.
+	Keys []string `json:"keys,omitempty"`
+}
+
+// ACL is the users of a server.
+type ACL struct {
+	Users []*User `json:"users"`
+
+	users  map[string]*User
+	tokens map[string]*User
+}
+
+// LoadACL reads an ACL in JSON from the file.
+func LoadACL(path string) (*ACL, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseACL(data)
+}
+
+// ParseACL parses an ACL in JSON and validates it.
+func ParseACL(data []byte) (*ACL, error) {
+	var acl ACL
+	if err := json.Unmarshal(data, &acl); err != nil {
+		return nil, err
+	}
+	if err := acl.init(); err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+func (acl *ACL) init() error {
+	acl.users = make(map[string]*User, len(acl.Users))
+	acl.tokens = make(map[string]*User)
+	for _, u := range acl.Users {
+		if u.Name == "" {
+			return fmt.Errorf("%w: user without name", ErrInvalidACL)
+		}
+		if _, ok := acl.users[u.Name]; ok {
+			return fmt.Errorf("%w: duplicated user %s", ErrInvalidACL, u.Name)
+		}
+		acl.users[u.Name] = u
+		for _, c := range u.Categories {
+			switch c {
+			case CategoryRead, CategoryWrite, CategoryAdmin, CategoryCluster:
+			default:
+				return fmt.Errorf("%w: unknown category %q of user %s", ErrInvalidACL, c, u.Name)
+			}
+		}
+		for _, token := range u.Tokens {
+			if token == "" {
+				return fmt.Errorf("%w: empty token of user %s", ErrInvalidACL, u.Name)
+			}
+			if _, ok := acl.tokens[token]; ok {
+				return fmt.Errorf("%w: token of user %s is used by another user", ErrInvalidACL, u.Name)
+			}
+			acl.tokens[token] = u
+		}
+	}
+	return nil
+}
+
+// defaultUser returns the user of clients not authenticated, or nil if they are not allowed.
+// The default user is only used if it has no password and tokens.
+func (acl *ACL) defaultUser() *User {
+	u := acl.users[DefaultUser]
+	if u == nil || u.Password != "" || len(u.Tokens) > 0 {
+		return nil
+	}
+	return u
+}
+
+// Authenticate returns the user with the name and password.
+func (acl *ACL) Authenticate(name, password string) (*User, error) {
+	u := acl.users[name]
+	if u == nil || u.Password == "" || !u.checkPassword(password) {
+		return nil, ErrAuthFailed
+	}
+	return u, nil
+}
+
+// AuthenticateToken returns the user of the token, or the default user if token is empty.
+func (acl *ACL) AuthenticateToken(token string) (*User, error) {
+	if token == "" {
+		if u := acl.defaultUser(); u != nil {
+			return u, nil
+		}
+		return nil, ErrAuthRequired
+	}
+	u := acl.tokens[token]
+	if u == nil {
+		return nil, ErrAuthFailed
+	}
+	return u, nil
+}
+
+func (u *User) checkPassword(password string) bool {
+	if strings.HasPrefix(u.Password, "sha256:") {
+		sum := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(u.Password[len("sha256:"):]))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(u.Password)) == 1
+}
+
+// Allowed returns ErrNoPermission if the user can't run commands of the category on the named bitmaps.
+func (u *User) Allowed(c Category, keys ...string) error {
+	if u == nil {
+		return ErrAuthRequired
+	}
+	if !u.hasCategory(c) {
+		return ErrNoPermission
+	}
+	for _, key := range keys {
+		if !u.matchKey(key) {
+			return ErrNoPermission
+		}
+	}
+	return nil
+}
+
+func (u *User) hasCategory(c Category) bool {
+	for _, uc := range u.Categories {
+		if uc == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) matchKey(key string) bool {
+	for _, pattern := range u.Keys {
+		if matchGlob(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether name matches the pattern like Redis, `*` matches any sequence, `?` matches any character,
+// `[abc]`, `[a-z]` and `[^abc]` match a character of a set or not of it and `\` escapes the next character.
+// Other tokens match one character, so on a mismatch only the last `*` takes one more character and the rest of the
+// pattern is tried again, earlier ones could take the same characters. It takes at most len(pattern)*len(name) steps.
+func matchGlob(pattern, name string) bool {
+	p, n := 0, 0
+	star, starName := -1, 0 // position after the last `*` in the pattern, and where the name is tried after it
+	for n < len(name) {
+		matched := false
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				p++
+				star, starName = p, n
+				continue
+			case '?':
+				p, matched = p+1, true
+			case '[':
+				l, ok := matchClass(pattern[p+1:], name[n])
+				if ok {
+					// skip the closing `]`, an unclosed set ends at the end of the pattern
+					p, matched = p+1+l, true
+					if p < len(pattern) {
+						p++
+					}
+				}
+			case '\\':
+				if p+1 < len(pattern) {
+					p++
+				}
+				fallthrough
+			default:
+				if pattern[p] == name[n] {
+					p, matched = p+1, true
+				}
+			}
+		}
+		if matched {
+			n++
+			continue
+		}
+		if star < 0 {
+			return false
+		}
+		starName++
+		p, n = star, starName
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c with the set of a `[...]` pattern without its `[`, it returns the length of the set
+// without its `]`. An unclosed set ends at the end of the pattern.
+func matchClass(class string, c byte) (n int, match bool) {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		n++
+	}
+	for n < len(class) && class[n] != ']' {
+		switch {
+		case class[n] == '\\' && n+1 < len(class):
+			n++
+			match = match || class[n] == c
+		case n+2 < len(class) && class[n+1] == '-':
+			lo, hi := class[n], class[n+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			match = match || (lo <= c && c <= hi)
+			n += 2
+		default:
+			match = match || class[n] == c
+		}
+		n++
+	}
+	return n, match != negate
+}
+
+// SetACL enforces the ACL on all services, it must be invoked before Serve.
+// Raft groups hosted by the server share the ACL.
+func (s *Server) SetACL(acl *ACL) {
+	s.acl = acl
+	for _, g := range s.groups {
+		g.acl = acl
+	}
+}
@@ -0,0 +1,288 @@
+package basalt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testACL = `{"users":[
+	{"name":"admin","password":"sha256:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8","tokens":["admin-token"],
+	 "categories":["read","write","admin","cluster"],"keys":["*"]},
+	{"name":"ads","password":"secret","tokens":["ads-token"],"categories":["read","write"],"keys":["ads:*","shared"]},
+	{"name":"monitor","tokens":["monitor-token"],"categories":["cluster"],"keys":["*"]},
+	{"name":"ads-node","tokens":["ads-node-token"],"categories":["write","cluster"],"keys":["ads:*"]},
+	{"name":"default","categories":["read"],"keys":["public:*"]}]}`
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"*", "", true},
+		{"*", "a/b:c", true},
+		{"ads:*", "ads:1", true},
+		{"ads:*", "ads:", true},
+		{"ads:*", "ad", false},
+		{"ads:?", "ads:1", true},
+		{"ads:?", "ads:12", false},
+		{"*:2020*", "ads:20201231", true},
+		{"*:2020*", "ads:2019", false},
+		{"shared", "shared", true},
+		{"shared", "shared2", false},
+		{"h[ae]llo", "hello", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"h[ab", "hb", true},
+		{"a*b*c", "aXbYbc", true},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXcYb", false},
+		{"*?", "", false},
+		{"**a", "ba", true},
+		{"h\\", "h\\", true},
+		// backtracked only from the last `*`, it used to take exponential time
+		{strings.Repeat("*a", 30) + "*b", strings.Repeat("a", 100), false},
+	}
+	for _, c := range cases {
+		if got := matchGlob(c.pattern, c.name); got != c.match {
+			t.Errorf("expect %v of %q matching %q but got %v", c.match, c.name, c.pattern, got)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl, err := ParseACL([]byte(testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := acl.Authenticate("admin", "password"); err != nil {
+		t.Errorf("failed to authenticate by the sha256 password: %v", err)
+	}
+	if _, err := acl.Authenticate("ads", "secret"); err != nil {
+		t.Errorf("failed to authenticate by the password: %v", err)
+	}
+	for _, pair := range [][2]string{{"ads", "wrong"}, {"nobody", "secret"}, {"default", ""}} {
+		if _, err := acl.Authenticate(pair[0], pair[1]); err != ErrAuthFailed {
+			t.Errorf("expect ErrAuthFailed for %v but got %v", pair, err)
+		}
+	}
+
+	u, err := acl.AuthenticateToken("ads-token")
+	if err != nil || u.Name != "ads" {
+		t.Fatalf("failed to authenticate by the token: %v", err)
+	}
+	if err := u.Allowed(CategoryWrite, "ads:1", "shared"); err != nil {
+		t.Errorf("expect writes allowed but got %v", err)
+	}
+	if err := u.Allowed(CategoryWrite, "ads:1", "users"); err != ErrNoPermission {
+		t.Errorf("expect ErrNoPermission for other keys but got %v", err)
+	}
+	if err := u.Allowed(CategoryAdmin); err != ErrNoPermission {
+		t.Errorf("expect ErrNoPermission for admin commands but got %v", err)
+	}
+	if _, err := acl.AuthenticateToken("wrong"); err != ErrAuthFailed {
+		t.Errorf("expect ErrAuthFailed but got %v", err)
+	}
+	if u, err := acl.AuthenticateToken(""); err != nil || u.Name != DefaultUser {
+		t.Errorf("expect the default user but got %v", err)
+	}
+
+	acl, err = ParseACL([]byte(`{"users":[{"name":"default","password":"p","categories":["read"],"keys":["*"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acl.AuthenticateToken(""); err != ErrAuthRequired {
+		t.Errorf("expect ErrAuthRequired if the default user has a password but got %v", err)
+	}
+
+	for _, data := range []string{
+		`{"users":[{"categories":["read"]}]}`,
+		`{"users":[{"name":"a"},{"name":"a"}]}`,
+		`{"users":[{"name":"a","categories":["delete"]}]}`,
+		`{"users":[{"name":"a","tokens":["t"]},{"name":"b","tokens":["t"]}]}`,
+	} {
+		if _, err := ParseACL([]byte(data)); !errors.Is(err, ErrInvalidACL) {
+			t.Errorf("expect ErrInvalidACL for %s but got %v", data, err)
+		}
+	}
+}
+
+func TestServer_ACL(t *testing.T) {
+	acl, err := ParseACL([]byte(testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	s := NewServer(addr, NewBitmaps(), nil, "")
+	s.SetACL(acl)
+	s.ln = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.configListener(ctx, ln)
+	<-s.started
+
+	// redis
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	redis := func(args ...string) string {
+		var sb strings.Builder
+		sb.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+		for _, arg := range args {
+			sb.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+		}
+		if _, err := conn.Write([]byte(sb.String())); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(line)
+	}
+	for _, c := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"bmcard", "public:1"}, ":0"},
+		{[]string{"client", "id"}, ":"},
+		{[]string{"client", "list"}, "-NOPERM"},
+		{[]string{"bmadd", "public:1", "1"}, "-NOPERM"},
+		{[]string{"auth", "ads", "wrong"}, "-WRONGPASS"},
+		{[]string{"auth", "ads", "secret"}, "+OK"},
+		{[]string{"bmadd", "ads:1", "1"}, ":1"},
+		{[]string{"bminterstore", "ads:2", "ads:1", "shared"}, ":0"},
+		{[]string{"bminterstore", "ads:2", "ads:1", "users"}, "-NOPERM"},
+		{[]string{"bmcard", "public:1"}, "-NOPERM"},
+		{[]string{"bmsave"}, "-NOPERM"},
+		{[]string{"removenode", "2"}, "-NOPERM"},
+		{[]string{"auth", "password"}, "-WRONGPASS"},
+		{[]string{"auth", "admin", "password"}, "+OK"},
+		{[]string{"clusterinfo"}, "-ERR"},
+		{[]string{"client", "list"}, "$"}, // the last as only the first line of the reply is read
+	} {
+		if reply := redis(c.args...); !strings.HasPrefix(reply, c.reply) {
+			t.Errorf("expect %s for %v but got %s", c.reply, c.args, reply)
+		}
+	}
+
+	// http
+	for _, c := range []struct {
+		method, path, token string
+		status              int
+	}{
+		{http.MethodGet, "/card/public:1", "", http.StatusOK},
+		{http.MethodPost, "/add/ads:1/2", "", http.StatusForbidden},
+		{http.MethodPost, "/add/ads:1/2", "wrong", http.StatusUnauthorized},
+		{http.MethodPost, "/add/ads:1/2", "ads-token", http.StatusOK},
+		{http.MethodGet, "/inter/ads:1,users", "ads-token", http.StatusForbidden},
+		{http.MethodGet, "/export/json", "ads-token", http.StatusForbidden},
+		{http.MethodPost, "/drain", "ads-token", http.StatusForbidden},
+		{http.MethodGet, "/checksum", "admin-token", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(c.method, "http://"+addr+c.path, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("expect %d for %s %s but got %s", c.status, c.method, c.path, resp.Status)
+		}
+	}
+	if !s.bitmaps.Exists("ads:1", 2) {
+		t.Errorf("expect 2 added by http")
+	}
+	// bitmaps named in the body of csv and json can not be imported by the route checking only the named one
+	for _, c := range []struct {
+		path, body string
+		status     int
+	}{
+		{"/import/json/ads:1", `{"users":[1]}`, http.StatusBadRequest},
+		{"/import/csv/ads:1", "users,1\n", http.StatusBadRequest},
+		{"/import/ints/ads:3", "1\n", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr+c.path, strings.NewReader(c.body))
+		req.Header.Set("Authorization", "Bearer ads-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("expect %d for %s but got %s", c.status, c.path, resp.Status)
+		}
+	}
+	if s.bitmaps.Card("users") != 0 || s.bitmaps.Card("ads:3") != 1 {
+		t.Errorf("expect only ads:3 imported")
+	}
+
+	// rpcx
+	var f forwarder
+	call := func(token, method string, args interface{}) error {
+		c, err := f.conn(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.call("Bitmap", method, token, args)
+		if err != nil {
+			f.drop(addr, c)
+		}
+		return err
+	}
+	if err := call("ads-token", "Add", &BitmapValueRequest{Name: "ads:1", Value: 3}); err != nil {
+		t.Errorf("failed to add by rpcx: %v", err)
+	}
+	if err := call("ads-token", "Add", &BitmapValueRequest{Name: "users", Value: 3}); err == nil || err.Error() != ErrNoPermission.Error() {
+		t.Errorf("expect ErrNoPermission by rpcx but got %v", err)
+	}
+	if err := call("", "Forward", &ForwardRequest{OP: BmOpAdd, Value: "users,3"}); err == nil || err.Error() != ErrNoPermission.Error() {
+		t.Errorf("expect ErrNoPermission for forwarded writes of the default user but got %v", err)
+	}
+	// forwarded writes need the write category on the bitmaps they write
+	for _, c := range []struct {
+		token string
+		req   *ForwardRequest
+		err   error
+	}{
+		{"monitor-token", &ForwardRequest{OP: BmOpAdd, Value: "ads:1,5"}, ErrNoPermission},
+		{"ads-node-token", &ForwardRequest{OP: BmOpAdd, Value: "users,5"}, ErrNoPermission},
+		{"ads-node-token", &ForwardRequest{OP: BmOpDrop, Value: "users"}, ErrNoPermission},
+		{"ads-node-token", &ForwardRequest{OP: BmOpMulti, Value: `{"commands":[["bmadd","ads:1","5"],["bmdrop","users"]]}`}, ErrNoPermission},
+		{"ads-node-token", &ForwardRequest{OP: BmOpMulti, Value: `{"commands":[[]]}`}, ErrNotForwardable},
+		{"ads-node-token", &ForwardRequest{OP: BmOpFlush}, ErrNotForwardable},
+		{"ads-node-token", &ForwardRequest{OP: BmOpAdd, Value: "ads:1,5"}, ErrNotInCluster},
+	} {
+		if err := call(c.token, "Forward", c.req); err == nil || err.Error() != c.err.Error() {
+			t.Errorf("expect %v for forwarded %s %s but got %v", c.err, c.req.OP, c.req.Value, err)
+		}
+	}
+	if err := call("wrong", "Add", &BitmapValueRequest{Name: "ads:1", Value: 4}); err == nil || err.Error() != ErrAuthFailed.Error() {
+		t.Errorf("expect ErrAuthFailed by rpcx but got %v", err)
+	}
+	if !s.bitmaps.Exists("ads:1", 3) || s.bitmaps.Exists("users", 3) || s.bitmaps.Exists("ads:1", 4) {
+		t.Errorf("unexpected writes by rpcx")
+	}
+}
@@ -0,0 +1,349 @@
+package basalt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backupMagic starts every backup.
+var backupMagic = [8]byte{'B', 'A', 'S', 'A', 'L', 'T', 'B', 'K'}
+
+const backupVersion uint32 = 1
+
+// restoreChunkSize is the size of bitmaps staged by a raft entry when a backup is restored in a cluster.
+const restoreChunkSize = 4 << 20
+
+// Errors for backup and restore.
+var (
+	ErrInvalidBackup     = errors.New("invalid backup")
+	ErrBackupChecksum    = errors.New("backup checksum mismatch")
+	ErrRestoreUnverified = errors.New("restored state has not been verified")
+	ErrRestoreNotStaged  = errors.New("bitmaps of the restore are not staged")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// BackupHeader describes a point-in-time backup.
+type BackupHeader struct {
+	Index    uint64 // raft index the backup corresponds to, 0 if not in a cluster
+	Time     int64  // unix nano time when the backup is taken
+	Size     uint64 // size of the saved bitmaps
+	Checksum uint32 // crc32 (Castagnoli) of the saved bitmaps
+}
+
+// snapshot returns the saved bitmaps and the raft index they correspond to.
+func (s *Server) snapshot() ([]byte, uint64, error) {
+	if s.isSharded() {
+		return nil, 0, ErrShardedServer
+	}
+	if s.raft != nil {
+		return s.raft.consistentSnapshot()
+	}
+
+	var buf bytes.Buffer
+	err := s.bitmaps.Save(&buf)
+	return buf.Bytes(), 0, err
+}
+
+// Checksum returns the checksum of all bitmaps and the raft index it corresponds to.
+// Nodes with the same checksum at the same index have the same data.
+func (s *Server) Checksum() (uint32, uint64, error) {
+	data, index, err := s.snapshot()
+	if err != nil {
+		return 0, 0, err
+	}
+	return crc32.Checksum(data, crcTable), index, nil
+}
+
+// Backup takes a consistent snapshot of all bitmaps and writes it with its raft index to w.
+func (s *Server) Backup(w io.Writer) (BackupHeader, error) {
+	h, data, err := s.prepareBackup()
+	if err != nil {
+		return h, err
+	}
+	return h, writeBackup(w, h, data)
+}
+
+// prepareBackup takes a consistent snapshot of all bitmaps and returns the header of its backup.
+func (s *Server) prepareBackup() (BackupHeader, []byte, error) {
+	defer s.metrics.observePersistence(persistBackup, time.Now())
+
+	data, index, err := s.snapshot()
+	if err != nil {
+		return BackupHeader{}, nil, err
+	}
+
+	h := BackupHeader{
+		Index:    index,
+		Time:     time.Now().UnixNano(),
+		Size:     uint64(len(data)),
+		Checksum: crc32.Checksum(data, crcTable),
+	}
+	return h, data, nil
+}
+
+// backupSize returns the size of the backup with the header.
+func backupSize(h BackupHeader) int64 {
+	return int64(len(backupMagic)+binary.Size(backupVersion)+binary.Size(h)) + int64(h.Size)
+}
+
+// writeBackup writes the header of the backup and then streams the snapshot to w.
+func writeBackup(w io.Writer, h BackupHeader, data []byte) error {
+	bw := bufio.NewWriter(w)
+	bw.Write(backupMagic[:])
+	binary.Write(bw, binary.LittleEndian, backupVersion)
+	if err := binary.Write(bw, binary.LittleEndian, h); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// ReadBackup reads a backup written by Backup and validates its checksum.
+func ReadBackup(r io.Reader) (BackupHeader, []byte, error) {
+	var h BackupHeader
+
+	var magic [8]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil || magic != backupMagic {
+		return h, nil, ErrInvalidBackup
+	}
+	var version uint32
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil || version != backupVersion {
+		return h, nil, ErrInvalidBackup
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return h, nil, ErrInvalidBackup
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(h.Size)); err != nil {
+		return h, nil, ErrInvalidBackup
+	}
+	data := buf.Bytes()
+	if crc32.Checksum(data, crcTable) != h.Checksum {
+		return h, nil, ErrBackupChecksum
+	}
+
+	return h, data, nil
+}
+
+// RestoreBackup reseeds all bitmaps from a backup. In a cluster the bitmaps are staged by raft entries of at most
+// restoreChunkSize and then replace all bitmaps by one entry, so every node applies the same entries, and writes
+// are applied either before or after the restore, not to a partially restored state. Staged bitmaps are discarded
+// if the restore fails.
+// It waits up to timeout for the local state to match the checksum of the backup and returns the raft index
+// it matches at, other members can be verified by their checksums at the index. It returns ErrRestoreUnverified
+// if it does not match.
+func (s *Server) RestoreBackup(r io.Reader, timeout time.Duration) (BackupHeader, uint64, error) {
+	h, data, err := ReadBackup(r)
+	if err != nil {
+		return h, 0, err
+	}
+	if s.isSharded() {
+		return h, 0, ErrShardedServer
+	}
+	defer s.metrics.observePersistence(persistRestore, time.Now())
+
+	if s.bitmaps.writeCallback != nil {
+		err = s.proposeRestore(data, restoreChunkSize)
+	} else {
+		err = s.bitmaps.Restore(data, false)
+	}
+	if err != nil {
+		return h, 0, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		checksum, index, err := s.Checksum()
+		if err != nil {
+			return h, 0, err
+		}
+		if checksum == h.Checksum {
+			return h, index, nil
+		}
+		if time.Now().After(deadline) {
+			return h, 0, ErrRestoreUnverified
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// proposeRestore replaces all bitmaps with the saved ones through raft. The bitmaps are staged by entries of
+// at most chunkSize instead of one entry as large as the backup, a bitmap larger than it is staged by its own
+// entry. They replace all bitmaps once they are all staged, or are discarded if a proposal fails.
+func (s *Server) proposeRestore(data []byte, chunkSize uint64) (err error) {
+	restored := NewBitmaps()
+	if err := restored.Read(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	var rid [8]byte
+	if _, err := rand.Read(rid[:]); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(rid[:])
+	defer func() {
+		if err != nil {
+			s.bitmaps.writeCallback(BmOpAbort, id)
+		}
+	}()
+
+	var names []string
+	var size uint64
+	stage := func() error {
+		if len(names) == 0 {
+			return nil
+		}
+		var buf bytes.Buffer
+		if err := restored.saveBitmaps(&buf, names...); err != nil {
+			return err
+		}
+		names, size = nil, 0
+		return s.bitmaps.writeCallback(BmOpStage, id+","+buf.String())
+	}
+	keys := restored.Keys()
+	for _, name := range keys {
+		names = append(names, name)
+		size += restored.SerializedSize(name)
+		if size >= chunkSize {
+			if err := stage(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := stage(); err != nil {
+		return err
+	}
+	return s.bitmaps.writeCallback(BmOpCommit, id+","+strconv.Itoa(len(keys)))
+}
+
+// stagedRestore is the bitmaps staged by a restore, which replace all bitmaps when the restore is committed.
+type stagedRestore struct {
+	id      string
+	bitmaps *Bitmaps
+}
+
+func (st *stagedRestore) put(name string, b *Bitmap) {
+	st.bitmaps.mu.Lock()
+	old := st.bitmaps.bitmaps[name]
+	st.bitmaps.bitmaps[name] = b
+	st.bitmaps.mu.Unlock()
+	old.release()
+}
+
+func (st *stagedRestore) release() {
+	if st == nil {
+		return
+	}
+	for _, bm := range st.bitmaps.all() {
+		bm.release()
+	}
+}
+
+// stage returns the bitmaps staged by the restore, the ones staged by another restore are discarded.
+func (bs *Bitmaps) stage(id string) *stagedRestore {
+	bs.mu.Lock()
+	old := bs.staged
+	if old == nil || old.id != id {
+		staged := NewBitmaps()
+		staged.frozenDir = bs.frozenDir
+		bs.staged = &stagedRestore{id: id, bitmaps: staged}
+	} else {
+		old = nil
+	}
+	st := bs.staged
+	bs.mu.Unlock()
+
+	old.release()
+	return st
+}
+
+// applyStage stages bitmaps saved in a `id,data` value by the restore.
+func (bs *Bitmaps) applyStage(value string) error {
+	items := strings.SplitN(value, ",", 2)
+	if len(items) != 2 {
+		return ErrInvalidBackup
+	}
+	return bs.stage(items[0]).bitmaps.Read(strings.NewReader(items[1]))
+}
+
+// applyCommit replaces all bitmaps with the bitmaps staged by the restore of a `id,count` value, if all count
+// bitmaps are staged. Otherwise the staged bitmaps are discarded.
+func (bs *Bitmaps) applyCommit(value string) error {
+	items := strings.SplitN(value, ",", 2)
+	if len(items) != 2 {
+		return ErrInvalidBackup
+	}
+	count, err := strconv.Atoi(items[1])
+	if err != nil {
+		return err
+	}
+
+	bs.mu.Lock()
+	st := bs.staged
+	if st == nil || st.id != items[0] {
+		bs.mu.Unlock()
+		return ErrRestoreNotStaged
+	}
+	bs.staged = nil
+	bs.mu.Unlock()
+
+	restored := st.bitmaps.all()
+	if len(restored) != count {
+		st.release()
+		return fmt.Errorf("%w: %d of %d bitmaps", ErrRestoreNotStaged, len(restored), count)
+	}
+	for _, bm := range restored {
+		bm.mu.Lock()
+		bm.meta.Staged = ""
+		bm.mu.Unlock()
+	}
+	bs.replace(st.bitmaps.bitmaps)
+	return nil
+}
+
+// applyAbort discards the bitmaps staged by the restore.
+func (bs *Bitmaps) applyAbort(id string) {
+	bs.mu.Lock()
+	st := bs.staged
+	if st == nil || st.id != id {
+		bs.mu.Unlock()
+		return
+	}
+	bs.staged = nil
+	bs.mu.Unlock()
+	st.release()
+}
+
+// saveStaged saves the bitmaps staged by a restore, they are staged again when they are read.
+func (bs *Bitmaps) saveStaged(w io.Writer) error {
+	bs.mu.RLock()
+	st := bs.staged
+	bs.mu.RUnlock()
+	if st == nil {
+		return nil
+	}
+
+	for _, name := range st.bitmaps.Keys() {
+		st.bitmaps.mu.RLock()
+		bm := st.bitmaps.bitmaps[name]
+		st.bitmaps.mu.RUnlock()
+		if err := bs.saveRecord(w, name, bm, st.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package basalt
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServer_BackupRestore(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11}, false)
+	bms.AddMany("test2", []uint32{1, 2, 3, 20, 21}, false)
+	srv := NewServer(":0", bms, nil, "")
+
+	var buf bytes.Buffer
+	h, err := srv.Backup(&buf)
+	if err != nil {
+		t.Fatalf("failed to backup: %v", err)
+	}
+	data := buf.Bytes()
+
+	restored := NewBitmaps()
+	restored.Add("test3", 100, false)
+	restoredSrv := NewServer(":0", restored, nil, "")
+	rh, _, err := restoredSrv.RestoreBackup(bytes.NewReader(data), time.Second)
+	if err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if rh != h {
+		t.Errorf("expect header %+v but got %+v", h, rh)
+	}
+
+	if restored.Card("test3") != 0 {
+		t.Errorf("expect test3 removed by restore")
+	}
+	if restored.Card("test1") != 5 || !restored.Exists("test2", 21) {
+		t.Errorf("expect test1 and test2 restored")
+	}
+
+	checksum, _, err := restoredSrv.Checksum()
+	if err != nil {
+		t.Fatalf("failed to get checksum: %v", err)
+	}
+	if checksum != h.Checksum {
+		t.Errorf("expect checksum %d but got %d", h.Checksum, checksum)
+	}
+
+	data[len(data)-1]++
+	if _, _, err := restoredSrv.RestoreBackup(bytes.NewReader(data), time.Second); err != ErrBackupChecksum {
+		t.Errorf("expect ErrBackupChecksum but got %v", err)
+	}
+}
+
+func TestServer_RestoreBackupThroughRaft(t *testing.T) {
+	src := NewBitmaps()
+	for i := uint32(0); i < 5; i++ {
+		src.AddMany("test"+strconv.Itoa(int(i)), []uint32{i, i + 100, i + 1000}, false)
+	}
+	var buf bytes.Buffer
+	h, err := NewServer(":0", src, nil, "").Backup(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backupSize(h) != int64(buf.Len()) {
+		t.Errorf("expect backup size %d but got %d", buf.Len(), backupSize(h))
+	}
+	_, data, err := ReadBackup(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(":0", NewBitmaps(), nil, "")
+	s.bitmaps.Add("old", 1, false)
+	rs := &RaftServer{bmServer: s, migrations: make(map[string]*migration)}
+	var ops []OP
+	var snapshot []byte
+	fail := -1
+	s.bitmaps.writeCallback = func(op OP, value string) error {
+		if len(ops) == fail {
+			fail = -1
+			return ErrNoLeader
+		}
+		ops = append(ops, op)
+		rs.processOP(operaton{OP: op, Val: value})
+		if len(ops) == 2 {
+			// nothing is restored until the restore is committed
+			if s.bitmaps.Card("test0") != 0 || s.bitmaps.Card("old") != 1 {
+				t.Errorf("expect bitmaps staged without being restored")
+			}
+			var err error
+			if snapshot, err = rs.GetSnapshot(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}
+
+	// a failed restore discards the staged bitmaps and keeps the bitmaps
+	fail = 3
+	if err := s.proposeRestore(data, 2); err != ErrNoLeader {
+		t.Fatalf("expect ErrNoLeader but got %v", err)
+	}
+	if ops[len(ops)-1] != BmOpAbort || s.bitmaps.staged != nil || s.bitmaps.Card("old") != 1 || s.bitmaps.Card("test0") != 0 {
+		t.Errorf("expect the restore aborted but got %v", ops)
+	}
+
+	// a chunk smaller than any bitmap stages every bitmap by its own entry
+	ops = nil
+	if err := s.proposeRestore(data, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 6 || ops[0] != BmOpStage || ops[4] != BmOpStage || ops[5] != BmOpCommit {
+		t.Errorf("expect 5 stages and a commit but got %v", ops)
+	}
+	if checksum, _, _ := s.Checksum(); checksum != h.Checksum || s.bitmaps.Card("old") != 0 || s.bitmaps.staged != nil {
+		t.Errorf("expect checksum %d restored but got %d", h.Checksum, checksum)
+	}
+
+	// bitmaps staged when a snapshot is taken are staged again by the node recovering from it
+	recovered := NewServer(":0", NewBitmaps(), nil, "")
+	rrs := &RaftServer{bmServer: recovered, migrations: make(map[string]*migration)}
+	if err := rrs.recoverFromSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if recovered.bitmaps.Card("old") != 1 || recovered.bitmaps.Card("test0") != 0 || recovered.bitmaps.staged == nil {
+		t.Fatalf("expect the staged bitmaps recovered as staged")
+	}
+	if err := recovered.bitmaps.applyCommit(recovered.bitmaps.staged.id + ",5"); !errors.Is(err, ErrRestoreNotStaged) {
+		t.Errorf("expect an incomplete restore not committed but got %v", err)
+	}
+	if recovered.bitmaps.Card("old") != 1 || recovered.bitmaps.staged != nil {
+		t.Errorf("expect the bitmaps kept and the incomplete restore discarded")
+	}
+}
@@ -0,0 +1,184 @@
+package basalt
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"time"
+)
+
+const (
+	// DefaultBatchBytes is the default max size of the values of a batched entry.
+	DefaultBatchBytes = 512 * 1024
+	// maxInflightBatches is the max number of batches being proposed to raft at the same time.
+	maxInflightBatches = 4
+	// proposeTimeout is the timeout for raft to accept a batch.
+	proposeTimeout = 5 * time.Second
+	// opOverhead is the estimated size of an encoded operation besides its value.
+	opOverhead = 32
+)
+
+// BatchOptions controls how concurrent proposals are coalesced into raft entries.
+type BatchOptions struct {
+	// MaxBytes caps the size of values in a batch, a larger operation is proposed alone.
+	MaxBytes int
+	// MaxDelay is how long a proposal waits for more proposals to fill its batch.
+	// Zero means a batch only contains proposals queued while previous batches are being proposed.
+	MaxDelay time.Duration
+}
+
+// proposal is an operation waiting to be proposed, the error of proposing its batch is sent to done.
+type proposal struct {
+	op   operaton
+	done chan error
+}
+
+// batcher coalesces concurrent proposals into batched raft entries and pipelines the batches,
+// so callers are acknowledged individually once raft accepts their batch.
+type batcher struct {
+	opts      BatchOptions
+	propose   func(ctx context.Context, data []byte) error
+	proposalC chan *proposal
+	inflight  chan struct{}
+	donec     chan struct{} // closed when all batches are proposed after proposalC is closed
+}
+
+func newBatcher(opts BatchOptions, propose func(ctx context.Context, data []byte) error) *batcher {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultBatchBytes
+	}
+	b := &batcher{
+		opts:      opts,
+		propose:   propose,
+		proposalC: make(chan *proposal, 1024),
+		inflight:  make(chan struct{}, maxInflightBatches),
+		donec:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) run() {
+	defer func() {
+		// wait for in-flight batches
+		for i := 0; i < cap(b.inflight); i++ {
+			b.inflight <- struct{}{}
+		}
+		close(b.donec)
+	}()
+
+	var p *proposal
+	for {
+		if p == nil {
+			var ok bool
+			if p, ok = <-b.proposalC; !ok {
+				return
+			}
+		}
+		batch, next, ok := b.collect(p)
+
+		b.inflight <- struct{}{}
+		go func(batch []*proposal) {
+			defer func() { <-b.inflight }()
+			err := b.proposeBatch(batch)
+			for _, p := range batch {
+				p.done <- err
+			}
+		}(batch)
+
+		if !ok {
+			return
+		}
+		p = next
+	}
+}
+
+// collect collects proposals into a batch starting with p, it returns false if proposalC is closed.
+// A proposal that would make the batch exceed MaxBytes is returned as next to start the next batch.
+func (b *batcher) collect(p *proposal) (batch []*proposal, next *proposal, ok bool) {
+	batch = []*proposal{p}
+	size := len(p.op.Val) + opOverhead
+
+	var timeout <-chan time.Time
+	if b.opts.MaxDelay > 0 {
+		timer := time.NewTimer(b.opts.MaxDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for size < b.opts.MaxBytes {
+		if timeout == nil {
+			// only take the queued proposals
+			select {
+			case p, ok = <-b.proposalC:
+			default:
+				return batch, nil, true
+			}
+		} else {
+			select {
+			case p, ok = <-b.proposalC:
+			case <-timeout:
+				return batch, nil, true
+			}
+		}
+		if !ok {
+			return batch, nil, false
+		}
+
+		n := len(p.op.Val) + opOverhead
+		if size+n > b.opts.MaxBytes {
+			return batch, p, true
+		}
+		batch = append(batch, p)
+		size += n
+	}
+	return batch, nil, true
+}
+
+func (b *batcher) proposeBatch(batch []*proposal) error {
+	op := batch[0].op
+	if len(batch) > 1 {
+		op = operaton{OP: BmOpBatch, Time: time.Now().UnixNano(), Batch: make([]operaton, len(batch))}
+		for i, p := range batch {
+			op.Batch[i] = p.op
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(op); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+	defer cancel()
+	return b.propose(ctx, buf.Bytes())
+}
+
+// close stops accepting proposals and waits until the queued ones are proposed.
+func (b *batcher) close() {
+	close(b.proposalC)
+	<-b.donec
+}
+
+// ops returns operations in a batched entry, or the operation itself if it is not a batch.
+func (op operaton) ops() []operaton {
+	if op.OP == BmOpBatch {
+		return op.Batch
+	}
+	return []operaton{op}
+}
+
+// DecodeOperations decodes operations proposed to raft in an entry, which may be a batch.
+func DecodeOperations(data []byte) ([]OP, []string, error) {
+	op, err := decodeOperation(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	ops := op.ops()
+	kinds := make([]OP, len(ops))
+	values := make([]string, len(ops))
+	for i, o := range ops {
+		kinds[i], values[i] = o.OP, o.Val
+	}
+	return kinds, values, nil
+}
@@ -0,0 +1,203 @@
+package basalt
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProposer records proposed entries, each proposal costs latency like appending to the WAL.
+type fakeProposer struct {
+	mu      sync.Mutex
+	latency time.Duration
+	entries [][]byte
+	err     error
+}
+
+func (f *fakeProposer) propose(ctx context.Context, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+	f.entries = append(f.entries, data)
+	return f.err
+}
+
+func submit(b *batcher, op OP, value string) error {
+	p := &proposal{op: operaton{OP: op, Val: value}, done: make(chan error, 1)}
+	b.proposalC <- p
+	return <-p.done
+}
+
+func TestBatcher(t *testing.T) {
+	f := &fakeProposer{latency: time.Millisecond}
+	b := newBatcher(BatchOptions{MaxDelay: 5 * time.Millisecond}, f.propose)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := submit(b, BmOpAdd, "test,"+strconv.Itoa(i)); err != nil {
+				t.Errorf("failed to propose: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	b.close()
+
+	if len(f.entries) >= 100 {
+		t.Fatalf("expect proposals to be batched but got %d entries", len(f.entries))
+	}
+	var values []string
+	for _, data := range f.entries {
+		ops, vals, err := DecodeOperations(data)
+		if err != nil {
+			t.Fatalf("failed to decode entry: %v", err)
+		}
+		for i, op := range ops {
+			if op != BmOpAdd {
+				t.Fatalf("expect ADD but got %s", op)
+			}
+			values = append(values, vals[i])
+		}
+	}
+	if len(values) != 100 {
+		t.Fatalf("expect 100 operations but got %d", len(values))
+	}
+}
+
+func TestBatcher_MaxBytes(t *testing.T) {
+	f := &fakeProposer{}
+	b := newBatcher(BatchOptions{MaxBytes: 1, MaxDelay: time.Second}, f.propose)
+
+	start := time.Now()
+	if err := submit(b, BmOpAdd, "test,1"); err != nil {
+		t.Fatalf("failed to propose: %v", err)
+	}
+	if time.Since(start) >= time.Second {
+		t.Fatal("expect a full batch to be proposed without waiting")
+	}
+	b.close()
+}
+
+func TestBatcher_CollectMaxBytes(t *testing.T) {
+	// each proposal takes 20+opOverhead bytes, so two of them fit in a batch
+	b := &batcher{opts: BatchOptions{MaxBytes: 2*(20+opOverhead) + 10}, proposalC: make(chan *proposal, 4)}
+	var proposals []*proposal
+	for i := 0; i < 4; i++ {
+		p := &proposal{op: operaton{OP: BmOpAdd, Val: fmt.Sprintf("test,%015d", i)}}
+		proposals = append(proposals, p)
+		b.proposalC <- p
+	}
+
+	batch, next, ok := b.collect(<-b.proposalC)
+	if len(batch) != 2 || batch[1] != proposals[1] || next != proposals[2] || !ok {
+		t.Fatalf("expect 2 proposals in the batch and the third carried over but got %d, %v, %v", len(batch), next, ok)
+	}
+	batch, next, ok = b.collect(next)
+	if len(batch) != 2 || batch[0] != proposals[2] || next != nil || !ok {
+		t.Fatalf("expect the carried proposal to start the next batch but got %d, %v, %v", len(batch), next, ok)
+	}
+
+	// a proposal larger than MaxBytes is proposed alone
+	large := &proposal{op: operaton{OP: BmOpAdd, Val: strings.Repeat("x", b.opts.MaxBytes)}}
+	b.proposalC <- proposals[0]
+	batch, next, ok = b.collect(large)
+	if len(batch) != 1 || next != nil || !ok || len(b.proposalC) != 1 {
+		t.Fatalf("expect a large proposal to be batched alone but got %d, %v, %v", len(batch), next, ok)
+	}
+
+	close(b.proposalC)
+	batch, next, ok = b.collect(<-b.proposalC)
+	if len(batch) != 1 || next != nil || ok {
+		t.Fatalf("expect the last batch after proposalC is closed but got %d, %v, %v", len(batch), next, ok)
+	}
+}
+
+func TestBatcher_Error(t *testing.T) {
+	errDropped := errors.New("proposal dropped")
+	f := &fakeProposer{err: errDropped}
+	b := newBatcher(BatchOptions{}, f.propose)
+	defer b.close()
+
+	if err := submit(b, BmOpAdd, "test,1"); err != errDropped {
+		t.Fatalf("expect the error of the batch but got %v", err)
+	}
+}
+
+func TestDecodeOperations(t *testing.T) {
+	f := &fakeProposer{}
+	b := newBatcher(BatchOptions{}, f.propose)
+	err := b.proposeBatch([]*proposal{
+		{op: operaton{OP: BmOpAdd, Val: "test,1"}},
+		{op: operaton{OP: BmOpDrop, Val: "test"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.close()
+
+	ops, vals, err := DecodeOperations(f.entries[0])
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if len(ops) != 2 || ops[0] != BmOpAdd || vals[0] != "test,1" || ops[1] != BmOpDrop || vals[1] != "test" {
+		t.Fatalf("unexpected operations: %v %v", ops, vals)
+	}
+
+	// an entry of a single operation is not a batch
+	ops, vals, err = DecodeOperations(encodeOperation(t, operaton{OP: BmOpAdd, Val: "test,2"}))
+	if err != nil || len(ops) != 1 || ops[0] != BmOpAdd || vals[0] != "test,2" {
+		t.Fatalf("unexpected operations: %v %v %v", ops, vals, err)
+	}
+}
+
+func encodeOperation(t testing.TB, op operaton) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(op); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// benchmarkPropose proposes adds from concurrent callers, each raft entry costs 20µs.
+func benchmarkPropose(b *testing.B, opts BatchOptions) {
+	f := &fakeProposer{latency: 20 * time.Microsecond}
+	bt := newBatcher(opts, f.propose)
+	defer bt.close()
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if err := submit(bt, BmOpAdd, "test,"+strconv.Itoa(i)); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/float64(len(f.entries)), "ops/entry")
+}
+
+func BenchmarkPropose_Unbatched(b *testing.B) {
+	benchmarkPropose(b, BatchOptions{MaxBytes: 1})
+}
+
+func BenchmarkPropose_Batched(b *testing.B) {
+	benchmarkPropose(b, BatchOptions{})
+}
+
+func BenchmarkPropose_BatchedWithDelay(b *testing.B) {
+	benchmarkPropose(b, BatchOptions{MaxDelay: 100 * time.Microsecond})
+}
@@ -1,10 +1,17 @@
 package basalt
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/smallnest/log"
@@ -14,18 +21,72 @@ import (
 type OP byte
 
 const (
-	BmOpAdd     OP = 1
-	BmOpAddMany    = 2
-	BmOpRemove     = 3
-	BmOpDrop       = 4
-	BmOpClear      = 5
+	BmOpAdd      OP = 1
+	BmOpAddMany     = 2
+	BmOpRemove      = 3
+	BmOpDrop        = 4
+	BmOpClear       = 5
+	BmOpRestore     = 6
+	BmOpSetMeta     = 7
+	BmOpFreeze      = 8
+	BmOpThaw        = 9
+	BmOpBatch       = 10 // operations coalesced into one raft entry
+	BmOpPut         = 11 // put bitmaps copied from another raft group
+	BmOpMigrate     = 12 // fence writes to a bitmap being migrated to another raft group
+	BmOpMigrated    = 13 // delete a migrated bitmap and route it to its new raft group
+	BmOpMulti       = 14 // commands of a transaction applied atomically
+	BmOpFlush       = 15 // remove all bitmaps
+	BmOpReplayed    = 16 // remove writes kept by a migrated bitmap which are replayed to its new raft group
+	BmOpStage       = 17 // stage bitmaps of a restore
+	BmOpCommit      = 18 // replace all bitmaps with the staged ones of a restore
+	BmOpAbort       = 19 // discard the staged bitmaps of a restore
 )
 
+var opNames = map[OP]string{
+	BmOpAdd:      "ADD",
+	BmOpAddMany:  "ADDMANY",
+	BmOpRemove:   "REMOVE",
+	BmOpDrop:     "DROP",
+	BmOpClear:    "CLEAR",
+	BmOpRestore:  "RESTORE",
+	BmOpSetMeta:  "SETMETA",
+	BmOpFreeze:   "FREEZE",
+	BmOpThaw:     "THAW",
+	BmOpBatch:    "BATCH",
+	BmOpPut:      "PUT",
+	BmOpMigrate:  "MIGRATE",
+	BmOpMigrated: "MIGRATED",
+	BmOpMulti:    "MULTI",
+	BmOpFlush:    "FLUSH",
+	BmOpReplayed: "REPLAYED",
+	BmOpStage:    "STAGE",
+	BmOpCommit:   "COMMIT",
+	BmOpAbort:    "ABORT",
+}
+
+func (op OP) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("OP(%d)", byte(op))
+}
+
 // Bitmaps contains all bitmaps of namespace.
 type Bitmaps struct {
 	mu            sync.RWMutex
 	bitmaps       map[string]*Bitmap
-	writeCallback func(op OP, value string)
+	generation    uint64         // incremented when bitmaps are added or removed, guarded by mu
+	staged        *stagedRestore // bitmaps of a restore not committed yet, guarded by mu
+	writeCallback func(op OP, value string) error
+	writeTime     int64        // unix nano time of the replicated write being applied
+	notifier      atomic.Value // notifyFunc notified of applied writes
+
+	execMu    sync.Mutex // held to run a transaction
+	txMu      sync.Mutex
+	txWaiters map[uint64]chan txResult // EXEC waiting for its transaction to be applied, by transaction ID
+
+	frozenDir          string // directory of files mapped by frozen bitmaps
+	refuseFrozenWrites bool   // refuse writes to frozen bitmaps instead of thawing them
 }
 
 // NewBitmaps creates a Bitmaps.
@@ -39,101 +100,182 @@ func NewBitmaps() *Bitmaps {
 type Bitmap struct {
 	mu     sync.RWMutex
 	bitmap *roaring.Bitmap
+	meta   Metadata
+	frozen *frozenFile // set if bitmap is backed by a mapped file
+}
+
+func newBitmap(bm *roaring.Bitmap, now time.Time) *Bitmap {
+	if bm == nil {
+		bm = roaring.NewBitmap()
+	}
+	return &Bitmap{
+		bitmap: bm,
+		meta: Metadata{
+			Type:     BitmapTypeRoaring32,
+			Created:  now,
+			Modified: now,
+		},
+	}
 }
 
 // Add adds a value.
-func (bs *Bitmaps) Add(name string, v uint32, callback bool) {
-	if bs.writeCallback != nil && callback {
-		bs.writeCallback(BmOpAdd, fmt.Sprintf("%s,%d", name, v))
-		return
+func (bs *Bitmaps) Add(name string, v uint32, callback bool) error {
+	if callback {
+		if err := bs.checkWritable(name); err != nil {
+			return err
+		}
+		if bs.writeCallback != nil {
+			return bs.writeCallback(BmOpAdd, fmt.Sprintf("%s,%d", name, v))
+		}
 	}
 
+	now := bs.now()
 	bs.mu.Lock()
 	bm := bs.bitmaps[name]
 	if bm == nil {
-		bm = &Bitmap{
-			bitmap: roaring.NewBitmap(),
-		}
+		bm = newBitmap(nil, now)
 		bs.bitmaps[name] = bm
+		bs.generation++
 	}
 	bs.mu.Unlock()
 
 	bm.mu.Lock()
+	bm.thaw()
 	bm.bitmap.Add(v)
+	bm.meta.Modified = now
 	bm.mu.Unlock()
+	bs.notify(NotifyBitmap, "bmadd", name)
+	return nil
 }
 
 // AddMany adds multiple values.
-func (bs *Bitmaps) AddMany(name string, v []uint32, callback bool) {
-	if bs.writeCallback != nil && callback {
-		bs.writeCallback(BmOpAddMany, fmt.Sprintf("%s,%d", name, ints2str(v)))
-		return
+func (bs *Bitmaps) AddMany(name string, v []uint32, callback bool) error {
+	if callback {
+		if err := bs.checkWritable(name); err != nil {
+			return err
+		}
+		if bs.writeCallback != nil {
+			return bs.writeCallback(BmOpAddMany, fmt.Sprintf("%s,%s", name, strings.Trim(ints2str(v), "[]")))
+		}
 	}
 
+	now := bs.now()
 	bs.mu.Lock()
 	bm := bs.bitmaps[name]
 	if bm == nil {
-		bm = &Bitmap{
-			bitmap: roaring.NewBitmap(),
-		}
+		bm = newBitmap(nil, now)
 		bs.bitmaps[name] = bm
+		bs.generation++
 	}
 	bs.mu.Unlock()
 
 	bm.mu.Lock()
+	bm.thaw()
 	bm.bitmap.AddMany(v)
+	bm.meta.Modified = now
 	bm.mu.Unlock()
+	bs.notify(NotifyBitmap, "bmaddmany", name)
+	return nil
 }
 
 // Remove removes a value.
-func (bs *Bitmaps) Remove(name string, v uint32, callback bool) {
-	if bs.writeCallback != nil && callback {
-		bs.writeCallback(BmOpRemove, fmt.Sprintf("%s,%d", name, v))
-		return
+func (bs *Bitmaps) Remove(name string, v uint32, callback bool) error {
+	if callback {
+		if err := bs.checkWritable(name); err != nil {
+			return err
+		}
+		if bs.writeCallback != nil {
+			return bs.writeCallback(BmOpRemove, fmt.Sprintf("%s,%d", name, v))
+		}
 	}
 
+	now := bs.now()
 	bs.mu.Lock()
 	bm := bs.bitmaps[name]
 	if bm == nil {
-		bm = &Bitmap{
-			bitmap: roaring.NewBitmap(),
-		}
+		bm = newBitmap(nil, now)
 		bs.bitmaps[name] = bm
+		bs.generation++
 	}
 	bs.mu.Unlock()
 
 	bm.mu.Lock()
+	bm.thaw()
 	bm.bitmap.Remove(v)
+	bm.meta.Modified = now
 	bm.mu.Unlock()
+	bs.notify(NotifyBitmap, "bmdel", name)
+	return nil
 }
 
 // RemoveBitmap removes a bitmap.
-func (bs *Bitmaps) RemoveBitmap(name string, callback bool) {
+func (bs *Bitmaps) RemoveBitmap(name string, callback bool) error {
 	if bs.writeCallback != nil && callback {
-		bs.writeCallback(BmOpDrop, name)
-		return
+		return bs.writeCallback(BmOpDrop, name)
 	}
 
 	bs.mu.Lock()
+	bm := bs.bitmaps[name]
 	delete(bs.bitmaps, name)
+	bs.generation++
 	bs.mu.Unlock()
+
+	bm.release()
+	if bm != nil {
+		bs.notify(NotifyGeneric, "del", name)
+	}
+	return nil
 }
 
 // ClearBitmap clear a bitmap.
-func (bs *Bitmaps) ClearBitmap(name string, callback bool) {
-	if bs.writeCallback != nil && callback {
-		bs.writeCallback(BmOpClear, name)
-		return
+func (bs *Bitmaps) ClearBitmap(name string, callback bool) error {
+	if callback {
+		if err := bs.checkWritable(name); err != nil {
+			return err
+		}
+		if bs.writeCallback != nil {
+			return bs.writeCallback(BmOpClear, name)
+		}
 	}
 
 	bs.mu.RLock()
 	bm := bs.bitmaps[name]
 	if bm == nil {
 		bs.mu.RUnlock()
-		return
+		return nil
 	}
 	bs.mu.RUnlock()
+
+	bm.mu.Lock()
+	bm.thaw()
 	bm.bitmap.Clear()
+	bm.meta.Modified = bs.now()
+	bm.mu.Unlock()
+	bs.notify(NotifyBitmap, "bmclear", name)
+	return nil
+}
+
+// Flush removes all bitmaps but the ones being migrated, which are written by their migrations.
+func (bs *Bitmaps) Flush(callback bool) error {
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(BmOpFlush, "")
+	}
+
+	bs.flush()
+	return nil
+}
+
+// flush removes all bitmaps but the ones being migrated and returns names of the removed ones.
+func (bs *Bitmaps) flush() []string {
+	var removed []string
+	for _, name := range bs.Keys() {
+		if migrating, movedTo := bs.migration(name); migrating != 0 || movedTo != 0 {
+			continue
+		}
+		bs.RemoveBitmap(name, false)
+		removed = append(removed, name)
+	}
+	return removed
 }
 
 // Exists checks whether a value exists.
@@ -204,22 +346,118 @@ func (bs *Bitmaps) Stats(name string) Stats {
 	return Stats(stats)
 }
 
-func (bs *Bitmaps) intersection(names ...string) *roaring.Bitmap {
-	var bms []*roaring.Bitmap
+// SerializedSize returns the size in bytes of the named bitmap in portable serialization.
+func (bs *Bitmaps) SerializedSize(name string) uint64 {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	if bm == nil {
+		bs.mu.RUnlock()
+		return 0
+	}
+	bs.mu.RUnlock()
 
+	bm.mu.RLock()
+	size := bm.bitmap.GetSerializedSizeInBytes()
+	bm.mu.RUnlock()
+
+	return size
+}
+
+// Keys returns the sorted names of all bitmaps.
+func (bs *Bitmaps) Keys() []string {
 	bs.mu.RLock()
+	keys := make([]string, 0, len(bs.bitmaps))
+	for k := range bs.bitmaps {
+		keys = append(keys, k)
+	}
+	bs.mu.RUnlock()
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Clone returns a copy of the named bitmap, or nil if it does not exist.
+func (bs *Bitmaps) Clone(name string) *roaring.Bitmap {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return nil
+	}
+
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	return detach(bm.bitmap.Clone())
+}
+
+// rlock returns the named bitmaps, nil for missing ones, with their read locks held until unlock is called.
+// Locks are taken in order of names, so readers of multiple bitmaps can not deadlock with writers.
+func (bs *Bitmaps) rlock(names ...string) (rbms []*roaring.Bitmap, unlock func()) {
+	bs.mu.RLock()
+	bms := make(map[string]*Bitmap, len(names))
 	for _, name := range names {
-		bm := bs.bitmaps[name]
+		if bm := bs.bitmaps[name]; bm != nil {
+			bms[name] = bm
+		}
+	}
+	bs.mu.RUnlock()
+
+	locked := make([]string, 0, len(bms))
+	for name := range bms {
+		locked = append(locked, name)
+	}
+	sort.Strings(locked)
+	for _, name := range locked {
+		bms[name].mu.RLock()
+	}
+
+	rbms = make([]*roaring.Bitmap, len(names))
+	for i, name := range names {
+		if bm := bms[name]; bm != nil {
+			rbms[i] = bm.bitmap
+		}
+	}
+
+	return rbms, func() {
+		for _, name := range locked {
+			bms[name].mu.RUnlock()
+		}
+	}
+}
+
+// detach makes bm not share containers with mapped files of frozen bitmaps,
+// so it is still valid after they are unmapped.
+func detach(bm *roaring.Bitmap) *roaring.Bitmap {
+	if bm != nil {
+		bm.CloneCopyOnWriteContainers()
+	}
+	return bm
+}
+
+// store saves bm as the named bitmap.
+func (bs *Bitmaps) store(name string, bm *roaring.Bitmap) {
+	b := newBitmap(bm, bs.now())
+
+	bs.mu.Lock()
+	old := bs.bitmaps[name]
+	bs.bitmaps[name] = b
+	bs.generation++
+	bs.mu.Unlock()
+
+	old.release()
+}
+
+func (bs *Bitmaps) intersection(names ...string) *roaring.Bitmap {
+	bms, unlock := bs.rlock(names...)
+	defer unlock()
+
+	for _, bm := range bms {
 		if bm == nil {
-			bs.mu.RUnlock()
 			return nil
 		}
-		bms = append(bms, bm.bitmap)
-
 	}
-	bs.mu.RUnlock()
 
-	return roaring.ParAnd(0, bms...)
+	return detach(roaring.ParAnd(0, bms...))
 }
 
 // Inter computes the intersection (AND) of all provided bitmaps.
@@ -238,26 +476,24 @@ func (bs *Bitmaps) InterStore(destination string, names ...string) uint64 {
 		return 0
 	}
 
-	bs.mu.Lock()
-	bs.bitmaps[destination] = &Bitmap{bitmap: bm}
-	bs.mu.Unlock()
+	bs.store(destination, bm)
+	bs.notify(NotifyBitmap, "bminterstore", destination)
 
 	return bm.GetCardinality()
 }
 
 func (bs *Bitmaps) union(names ...string) *roaring.Bitmap {
-	var bms []*roaring.Bitmap
+	rbms, unlock := bs.rlock(names...)
+	defer unlock()
 
-	bs.mu.RLock()
-	for _, name := range names {
-		bm := bs.bitmaps[name]
+	var bms []*roaring.Bitmap
+	for _, bm := range rbms {
 		if bm != nil {
-			bms = append(bms, bm.bitmap)
+			bms = append(bms, bm)
 		}
 	}
-	bs.mu.RUnlock()
 
-	return roaring.ParHeapOr(0, bms...)
+	return detach(roaring.ParHeapOr(0, bms...))
 }
 
 // Union computes the union (OR) of all provided bitmaps.
@@ -270,32 +506,25 @@ func (bs *Bitmaps) Union(names ...string) []uint32 {
 func (bs *Bitmaps) UnionStore(destination string, names ...string) uint64 {
 	bm := bs.union(names...)
 
-	bs.mu.Lock()
-	bs.bitmaps[destination] = &Bitmap{bitmap: bm}
-	bs.mu.Unlock()
+	bs.store(destination, bm)
+	bs.notify(NotifyBitmap, "bmunionstore", destination)
 
 	return bm.GetCardinality()
 }
 
 func (bs *Bitmaps) xor(name1, name2 string) *roaring.Bitmap {
-	var rbm1, rbm2 *roaring.Bitmap
+	bms, unlock := bs.rlock(name1, name2)
+	defer unlock()
 
-	bs.mu.RLock()
-	bm1 := bs.bitmaps[name1]
-	if bm1 == nil {
+	rbm1, rbm2 := bms[0], bms[1]
+	if rbm1 == nil {
 		rbm1 = roaring.NewBitmap()
-	} else {
-		rbm1 = bm1.bitmap
 	}
-	bm2 := bs.bitmaps[name2]
-	if bm2 == nil {
+	if rbm2 == nil {
 		rbm2 = roaring.NewBitmap()
-	} else {
-		rbm2 = bm2.bitmap
 	}
-	bs.mu.RUnlock()
 
-	return roaring.Xor(rbm1, rbm2)
+	return detach(roaring.Xor(rbm1, rbm2))
 }
 
 // Xor computes the symmetric difference between two bitmaps and returns the result
@@ -308,32 +537,25 @@ func (bs *Bitmaps) Xor(name1, name2 string) []uint32 {
 func (bs *Bitmaps) XorStore(destination, name1, name2 string) uint64 {
 	bm := bs.xor(name1, name2)
 
-	bs.mu.Lock()
-	bs.bitmaps[destination] = &Bitmap{bitmap: bm}
-	bs.mu.Unlock()
+	bs.store(destination, bm)
+	bs.notify(NotifyBitmap, "bmxorstore", destination)
 
 	return bm.GetCardinality()
 }
 
 func (bs *Bitmaps) diff(name1, name2 string) *roaring.Bitmap {
-	var rbm1, rbm2 *roaring.Bitmap
+	bms, unlock := bs.rlock(name1, name2)
+	defer unlock()
 
-	bs.mu.RLock()
-	bm1 := bs.bitmaps[name1]
-	if bm1 == nil {
+	rbm1, rbm2 := bms[0], bms[1]
+	if rbm1 == nil {
 		rbm1 = roaring.NewBitmap()
-	} else {
-		rbm1 = bm1.bitmap
 	}
-	bm2 := bs.bitmaps[name2]
-	if bm2 == nil {
+	if rbm2 == nil {
 		rbm2 = roaring.NewBitmap()
-	} else {
-		rbm2 = bm2.bitmap
 	}
-	bs.mu.RUnlock()
 
-	return roaring.AndNot(rbm1, rbm2)
+	return detach(roaring.AndNot(rbm1, rbm2))
 }
 
 // Diff computes the difference between two bitmaps and returns the result.
@@ -346,28 +568,42 @@ func (bs *Bitmaps) Diff(name1, name2 string) []uint32 {
 func (bs *Bitmaps) DiffStore(destination, name1, name2 string) uint64 {
 	bm := bs.diff(name1, name2)
 
-	bs.mu.Lock()
-	bs.bitmaps[destination] = &Bitmap{bitmap: bm}
-	bs.mu.Unlock()
+	bs.store(destination, bm)
+	bs.notify(NotifyBitmap, "bmdiffstore", destination)
 
 	return bm.GetCardinality()
 }
 
+// bdbMagic starts files saved with metadata. Files saved by old versions start
+// with the length of the first name and are still readable.
+const bdbMagic uint32 = 0x02424442 // "BDB\x02"
+
+// bdbVersion is the version of the saved format.
+const bdbVersion uint32 = 2
+
+// bdbHeaderSize is the size of the header of saved files, the magic followed by the version.
+const bdbHeaderSize = 8
+
+// maxNameLen is the sanity limit of a name length in a saved record.
+const maxNameLen = 1 << 20
+
+// ErrCorruptedRecord is returned when a saved record is not valid.
+var ErrCorruptedRecord = errors.New("corrupted record")
+
 // Save saves bitmaps to the io.Writer.
+// Bitmaps are written in order of names, so the same bitmaps are always saved as the same bytes.
 func (bs *Bitmaps) Save(w io.Writer) error {
-	var keys []string
-	bs.mu.RLock()
-	for k := range bs.bitmaps {
-		keys = append(keys, k)
+	if err := binary.Write(w, binary.LittleEndian, [2]uint32{bdbMagic, bdbVersion}); err != nil {
+		log.Errorf("failed to write header: %v", err)
+		return err
 	}
-	bs.mu.RUnlock()
 
-	for _, k := range keys {
+	for _, k := range bs.Keys() {
 		bs.mu.RLock()
 		bm := bs.bitmaps[k]
 		bs.mu.RUnlock()
 		if bm != nil {
-			if err := bs.saveBitmap(w, k, bm.bitmap); err != nil {
+			if err := bs.saveBitmap(w, k, bm); err != nil {
 				return err
 			}
 		}
@@ -376,12 +612,33 @@ func (bs *Bitmaps) Save(w io.Writer) error {
 	return nil
 }
 
-func (bs *Bitmaps) saveBitmap(w io.Writer, name string, bm *roaring.Bitmap) error {
-	if bm == nil {
-		return nil
+func (bs *Bitmaps) saveBitmap(w io.Writer, name string, bm *Bitmap) error {
+	return bs.saveRecord(w, name, bm, "")
+}
+
+// saveRecord saves the bitmap as a record staged by the restore, or a bitmap if staged is empty.
+func (bs *Bitmaps) saveRecord(w io.Writer, name string, bm *Bitmap, staged string) error {
+	bm.mu.RLock()
+	m := bm.meta
+	m.Staged = staged
+	meta, err := json.Marshal(m)
+	// frozen bitmaps are immutable, so they are written from the mapped file
+	// under the read lock instead of being copied.
+	var pBitmap *roaring.Bitmap
+	var data []byte
+	if bm.frozen != nil {
+		data = bm.frozen.data
+		defer bm.mu.RUnlock()
+	} else {
+		pBitmap = bm.bitmap.Clone()
+		bm.mu.RUnlock()
+	}
+	if err != nil {
+		log.Errorf("failed to marshal metadata of %s: %v", name, err)
+		return err
 	}
 
-	err := binary.Write(w, binary.LittleEndian, uint32(len(name)))
+	err = binary.Write(w, binary.LittleEndian, uint32(len(name)))
 	if err != nil {
 		log.Errorf("failed to write len of name %s: %v", name, err)
 		return err
@@ -392,10 +649,22 @@ func (bs *Bitmaps) saveBitmap(w io.Writer, name string, bm *roaring.Bitmap) erro
 		return err
 	}
 
-	bs.mu.RLock()
-	pBitmap := bm.Clone()
-	bs.mu.RUnlock()
-	_, err = pBitmap.WriteTo(w)
+	err = binary.Write(w, binary.LittleEndian, uint32(len(meta)))
+	if err != nil {
+		log.Errorf("failed to write len of metadata %s: %v", name, err)
+		return err
+	}
+	_, err = w.Write(meta)
+	if err != nil {
+		log.Errorf("failed to write metadata %s: %v", name, err)
+		return err
+	}
+
+	if pBitmap != nil {
+		_, err = pBitmap.WriteTo(w)
+	} else {
+		_, err = w.Write(data)
+	}
 	if err != nil {
 		log.Errorf("failed to write bitmap %s: %v", name, err)
 		return err
@@ -406,8 +675,11 @@ func (bs *Bitmaps) saveBitmap(w io.Writer, name string, bm *roaring.Bitmap) erro
 
 // Read restores bitmaps from a io.Reader.
 func (bs *Bitmaps) Read(r io.Reader) error {
+	rr := NewRecordReader(r)
+	// frozen bitmaps are mapped from their serialized data instead of being decoded on heap
+	rr.frozenData = bs.frozenDir != ""
 	for {
-		name, bm, err := readBitmap(r)
+		rec, err := rr.Next()
 		if err == io.EOF {
 			return nil
 		}
@@ -416,41 +688,176 @@ func (bs *Bitmaps) Read(r io.Reader) error {
 		}
 
 		b := &Bitmap{
-			bitmap: bm,
+			bitmap: rec.Bitmap,
+			meta:   rec.Meta,
+		}
+		if rec.Data != nil {
+			if err := bs.mapFrozenData(rec.Name, b, rec.Data); err != nil {
+				return err
+			}
+		}
+		// bitmaps staged by a restore in progress when the snapshot is taken
+		if b.meta.Staged != "" {
+			bs.stage(b.meta.Staged).put(rec.Name, b)
+			continue
 		}
 
 		bs.mu.Lock()
-		bs.bitmaps[name] = b
+		old := bs.bitmaps[rec.Name]
+		bs.bitmaps[rec.Name] = b
+		bs.generation++
 		bs.mu.Unlock()
 
+		old.release()
+	}
+}
+
+// Restore replaces all bitmaps with the bitmaps saved in data.
+func (bs *Bitmaps) Restore(data []byte, callback bool) error {
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(BmOpRestore, string(data))
 	}
+
+	restored := NewBitmaps()
+	restored.frozenDir = bs.frozenDir
+	if err := restored.Read(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	bs.replace(restored.bitmaps)
+	return nil
+}
+
+// replace replaces all bitmaps with the restored ones.
+func (bs *Bitmaps) replace(restored map[string]*Bitmap) {
+	bs.mu.Lock()
+	old := bs.bitmaps
+	bs.bitmaps = restored
+	bs.generation++
+	bs.mu.Unlock()
+
+	for _, bm := range old {
+		bm.release()
+	}
+	for name := range old {
+		if restored[name] == nil {
+			bs.notify(NotifyGeneric, "del", name)
+		}
+	}
+	for name := range restored {
+		bs.notify(NotifyGeneric, "restore", name)
+	}
+}
+
+// Record is a bitmap saved by Save.
+type Record struct {
+	Name   string
+	Meta   Metadata
+	Bitmap *roaring.Bitmap
+	Data   []byte // the serialized bitmap of a frozen record, instead of Bitmap, if it is read by Bitmaps
+}
+
+// RecordReader reads records saved by Save.
+type RecordReader struct {
+	r          io.Reader
+	version    uint32 // 0 before the header is read
+	frozenData bool   // read serialized frozen bitmaps into Data instead of decoding them
 }
 
-func readBitmap(r io.Reader) (name string, bm *roaring.Bitmap, err error) {
+// NewRecordReader returns a RecordReader.
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{r: r}
+}
+
+// Version returns the version of the saved format, valid after the first Next.
+func (rr *RecordReader) Version() uint32 {
+	return rr.version
+}
+
+// HeaderSize returns the size of the header read before the first record, valid after the first Next.
+// It is 0 for files saved without header.
+func (rr *RecordReader) HeaderSize() int64 {
+	if rr.version > 1 {
+		return bdbHeaderSize
+	}
+	return 0
+}
+
+// Next reads the next record. It returns io.EOF if there is no more record.
+func (rr *RecordReader) Next() (*Record, error) {
 	var l uint32
-	err = binary.Read(r, binary.LittleEndian, &l)
+	err := binary.Read(rr.r, binary.LittleEndian, &l)
 	if err != nil {
 		if err == io.EOF {
-			return "", nil, err
+			return nil, err
 		}
 		log.Errorf("failed to read len of name: %v", err)
-		return "", nil, err
+		return nil, err
 	}
 
+	if rr.version == 0 {
+		if l != bdbMagic {
+			rr.version = 1 // saved without header and metadata
+		} else {
+			if err := binary.Read(rr.r, binary.LittleEndian, &rr.version); err != nil {
+				log.Errorf("failed to read version: %v", err)
+				return nil, err
+			}
+			if rr.version != bdbVersion {
+				return nil, fmt.Errorf("unsupported version %d", rr.version)
+			}
+			return rr.Next()
+		}
+	}
+
+	if l > maxNameLen {
+		return nil, ErrCorruptedRecord
+	}
 	var data = make([]byte, int(l))
-	_, err = io.ReadFull(r, data)
+	_, err = io.ReadFull(rr.r, data)
 	if err != nil {
 		log.Errorf("failed to read name: %v", err)
-		return "", nil, err
+		return nil, err
+	}
+	rec := &Record{Name: string(data)}
+
+	if rr.version > 1 {
+		err = binary.Read(rr.r, binary.LittleEndian, &l)
+		if err != nil {
+			log.Errorf("failed to read len of metadata %s: %v", rec.Name, err)
+			return nil, err
+		}
+		if l > maxNameLen {
+			return nil, ErrCorruptedRecord
+		}
+		data = make([]byte, int(l))
+		_, err = io.ReadFull(rr.r, data)
+		if err != nil {
+			log.Errorf("failed to read metadata %s: %v", rec.Name, err)
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &rec.Meta); err != nil {
+			log.Errorf("failed to unmarshal metadata %s: %v", rec.Name, err)
+			return nil, ErrCorruptedRecord
+		}
+	} else {
+		rec.Meta.Type = BitmapTypeRoaring32
+	}
+
+	if rr.frozenData && rec.Meta.Frozen {
+		rec.Data, err = readSerialized(rr.r)
+		if err != nil {
+			log.Errorf("failed to read bitmap %s: %v", rec.Name, err)
+			return nil, err
+		}
+		return rec, nil
 	}
-	name = string(data)
 
-	bm = roaring.NewBitmap()
-	_, err = bm.ReadFrom(r)
+	rec.Bitmap = roaring.NewBitmap()
+	_, err = rec.Bitmap.ReadFrom(rr.r)
 	if err != nil {
-		log.Errorf("failed to read name %s: %v", name, err)
-		return "", nil, err
+		log.Errorf("failed to read name %s: %v", rec.Name, err)
+		return nil, err
 	}
 
-	return name, bm, nil
+	return rec, nil
 }
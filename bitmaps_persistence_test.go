@@ -15,13 +15,13 @@ func TestBitmaps_Persistence(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		v := uint32(rand.Int31())
 		values1 = append(values1, v)
-		bms.Add("test1", v)
+		bms.Add("test1", v, false)
 	}
 	var values2 []uint32
 	for i := 0; i < 100; i++ {
 		v := uint32(rand.Int31())
 		values2 = append(values2, v)
-		bms.Add("test2", v)
+		bms.Add("test2", v, false)
 	}
 
 	err := bms.Save(buf)
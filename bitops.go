@@ -0,0 +1,582 @@
+package basalt
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Bit commands of Redis treat a bitmap as a string, bit offset N of the string is value N of the bitmap
+// and the string ends at the byte holding the maximum value. Like InterStore and the others, the write methods
+// here only write locally, they are replicated as transactions by Exec so their replies are computed when applied.
+
+// Errors of bit commands, the same as Redis.
+var (
+	errBitOffset        = errors.New("bit offset is not an integer or out of range")
+	errBitValue         = errors.New("bit is not an integer or out of range")
+	errNotInteger       = errors.New("value is not an integer or out of range")
+	errSyntax           = errors.New("syntax error")
+	errBitPosBit        = errors.New("The bit argument must be 1 or 0.")
+	errBitOpNot         = errors.New("BITOP NOT must be called with a single source key.")
+	errBitFieldType     = errors.New("Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	errBitFieldOverflow = errors.New("Invalid OVERFLOW type specified")
+)
+
+// BitRange is a range of BITCOUNT and BITPOS, negative positions count from the end of the string.
+type BitRange struct {
+	Start, End int64
+	HasEnd     bool // the end is given, otherwise the range ends at the end of the string
+	Bit        bool // positions are in bits instead of bytes
+}
+
+// bits returns the first and the last bit of the range in a string of length bytes, ok is false if it is empty.
+func (r *BitRange) bits(length int64) (from, to uint64, ok bool) {
+	if r == nil {
+		return 0, uint64(length)*8 - 1, length > 0
+	}
+	size := length
+	if r.Bit {
+		size = length * 8
+	}
+	start, end := r.Start, r.End
+	if !r.HasEnd {
+		end = size - 1
+	}
+	if start < 0 {
+		start += size
+	}
+	if end < 0 {
+		end += size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= size {
+		end = size - 1
+	}
+	if start > end {
+		return 0, 0, false
+	}
+	if r.Bit {
+		return uint64(start), uint64(end), true
+	}
+	return uint64(start) * 8, uint64(end)*8 + 7, true
+}
+
+// bitLength returns the length in bytes of the string of the bitmap.
+func bitLength(rb *roaring.Bitmap) int64 {
+	if rb == nil || rb.IsEmpty() {
+		return 0
+	}
+	return int64(rb.Maximum())/8 + 1
+}
+
+// GetBit returns the bit at offset of the named bitmap.
+func (bs *Bitmaps) GetBit(name string, offset uint32) int64 {
+	if bs.Exists(name, offset) {
+		return 1
+	}
+	return 0
+}
+
+// SetBit sets or clears the bit at offset of the named bitmap and returns the original bit.
+func (bs *Bitmaps) SetBit(name string, offset uint32, bit int) int64 {
+	now := bs.now()
+	bs.mu.Lock()
+	bm := bs.bitmaps[name]
+	if bm == nil {
+		bm = newBitmap(nil, now)
+		bs.bitmaps[name] = bm
+		bs.generation++
+	}
+	bs.mu.Unlock()
+
+	defer bs.notify(NotifyString, "setbit", name)
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.thaw()
+	bm.meta.Modified = now
+	if bit == 1 {
+		if bm.bitmap.CheckedAdd(offset) {
+			return 0
+		}
+		return 1
+	}
+	if bm.bitmap.CheckedRemove(offset) {
+		return 1
+	}
+	return 0
+}
+
+// BitCount counts set bits of the named bitmap in the range, or in the whole bitmap if r is nil.
+func (bs *Bitmaps) BitCount(name string, r *BitRange) int64 {
+	rbms, unlock := bs.rlock(name)
+	defer unlock()
+
+	rb := rbms[0]
+	from, to, ok := r.bits(bitLength(rb))
+	if !ok {
+		return 0
+	}
+	count := rb.Rank(uint32(to))
+	if from > 0 {
+		count -= rb.Rank(uint32(from - 1))
+	}
+	return int64(count)
+}
+
+// BitPos returns the position of the first bit set to bit in the range of the named bitmap, or -1 if it is not found.
+// If a clear bit is looked for without an end of the range, bits after the end of the string are clear.
+func (bs *Bitmaps) BitPos(name string, bit int, r *BitRange) int64 {
+	rbms, unlock := bs.rlock(name)
+	defer unlock()
+
+	rb := rbms[0]
+	length := bitLength(rb)
+	if length == 0 {
+		if bit == 1 {
+			return -1
+		}
+		return 0
+	}
+	from, to, ok := r.bits(length)
+	if !ok {
+		return -1
+	}
+
+	if bit == 1 {
+		var rank uint64
+		if from > 0 {
+			rank = rb.Rank(uint32(from - 1))
+		}
+		if rank >= rb.GetCardinality() {
+			return -1
+		}
+		v, err := rb.Select(uint32(rank))
+		if err != nil || uint64(v) > to {
+			return -1
+		}
+		return int64(v)
+	}
+
+	pos := from
+	it := rb.Iterator()
+	it.AdvanceIfNeeded(uint32(from))
+	for pos <= to && it.HasNext() && uint64(it.PeekNext()) == pos {
+		it.Next()
+		pos++
+	}
+	if pos <= to {
+		return int64(pos)
+	}
+	if r != nil && r.HasEnd {
+		return -1
+	}
+	return int64(to) + 1
+}
+
+// BitOp stores the bitwise and, or, xor or not of the named bitmaps to destination, and returns the length in bytes
+// of the longest source string. Missing bitmaps are empty, and destination is removed if all sources are empty.
+func (bs *Bitmaps) BitOp(op, destination string, names ...string) int64 {
+	rbms, unlock := bs.rlock(names...)
+	var length int64
+	var bms []*roaring.Bitmap
+	for _, rb := range rbms {
+		if l := bitLength(rb); l > length {
+			length = l
+		}
+		if rb != nil {
+			bms = append(bms, rb)
+		}
+	}
+
+	var result *roaring.Bitmap
+	switch {
+	case length == 0:
+	case op == "and":
+		if len(bms) == len(rbms) {
+			result = roaring.FastAnd(bms...)
+		}
+	case op == "or":
+		result = roaring.FastOr(bms...)
+	case op == "xor":
+		result = bms[0].Clone()
+		for _, rb := range bms[1:] {
+			result.Xor(rb)
+		}
+	case op == "not":
+		result = bms[0].Clone()
+		result.Flip(0, uint64(length)*8)
+	}
+	result = detach(result)
+	unlock()
+
+	if length == 0 {
+		bs.RemoveBitmap(destination, false)
+		return 0
+	}
+	bs.store(destination, result)
+	bs.notify(NotifyString, "set", destination)
+	return length
+}
+
+// BitFieldOp is a subcommand of BITFIELD on an integer field of a bitmap.
+type BitFieldOp struct {
+	Op       string // get, set or incrby
+	Signed   bool
+	Bits     uint   // width of the field, at most 64 for signed integers and 63 for unsigned ones
+	Offset   uint32 // offset of the most significant bit
+	Value    int64  // value of set or increment of incrby
+	Overflow string // wrap, sat or fail for set and incrby
+}
+
+// BitField runs the subcommands on the named bitmap and returns their replies, the value of get, the original value
+// of set and the new value of incrby, or nil if set or incrby overflows with the fail policy.
+func (bs *Bitmaps) BitField(name string, ops []BitFieldOp) []interface{} {
+	write := false
+	for _, op := range ops {
+		write = write || op.Op != "get"
+	}
+
+	now := bs.now()
+	bs.mu.Lock()
+	bm := bs.bitmaps[name]
+	if bm == nil && write {
+		bm = newBitmap(nil, now)
+		bs.bitmaps[name] = bm
+		bs.generation++
+	}
+	bs.mu.Unlock()
+
+	replies := make([]interface{}, 0, len(ops))
+	if bm == nil {
+		for range ops {
+			replies = append(replies, int64(0))
+		}
+		return replies
+	}
+	// notified after bm is unlocked
+	changed := false
+	defer func() {
+		if changed {
+			bs.notify(NotifyString, "setbit", name)
+		}
+	}()
+	if write {
+		bm.mu.Lock()
+		defer bm.mu.Unlock()
+		bm.thaw()
+	} else {
+		bm.mu.RLock()
+		defer bm.mu.RUnlock()
+	}
+
+	for _, op := range ops {
+		old := op.get(bm.bitmap)
+		if op.Op == "get" {
+			replies = append(replies, old)
+			continue
+		}
+		v, ok := op.apply(old)
+		if !ok {
+			replies = append(replies, nil)
+			continue
+		}
+		op.set(bm.bitmap, v)
+		bm.meta.Modified = now
+		changed = true
+		if op.Op == "set" {
+			replies = append(replies, old)
+		} else {
+			replies = append(replies, v)
+		}
+	}
+	return replies
+}
+
+// get reads the field, the most significant bit first.
+func (op BitFieldOp) get(rb *roaring.Bitmap) int64 {
+	var v uint64
+	for i := uint(0); i < op.Bits; i++ {
+		v <<= 1
+		if rb.Contains(op.Offset + uint32(i)) {
+			v |= 1
+		}
+	}
+	if op.Signed && op.Bits < 64 && v&(1<<(op.Bits-1)) != 0 {
+		v |= math.MaxUint64 << op.Bits
+	}
+	return int64(v)
+}
+
+// set writes the field, the most significant bit first.
+func (op BitFieldOp) set(rb *roaring.Bitmap, v int64) {
+	for i := uint(0); i < op.Bits; i++ {
+		if uint64(v)>>(op.Bits-1-i)&1 == 1 {
+			rb.Add(op.Offset + uint32(i))
+		} else {
+			rb.Remove(op.Offset + uint32(i))
+		}
+	}
+}
+
+// apply returns the new value of set or incrby on the old value, ok is false if it overflows with the fail policy.
+func (op BitFieldOp) apply(old int64) (v int64, ok bool) {
+	value, incr := old, op.Value
+	if op.Op == "set" {
+		value, incr = op.Value, 0
+	}
+	if op.Signed {
+		return addSigned(value, incr, op.Bits, op.Overflow)
+	}
+	u, ok := addUnsigned(uint64(value), incr, op.Bits, op.Overflow)
+	return int64(u), ok
+}
+
+// addSigned adds incr to a signed integer of bits like Redis, the sum wraps around or saturates when it overflows.
+func addSigned(value, incr int64, bits uint, overflow string) (int64, bool) {
+	max := int64(math.MaxInt64)
+	if bits < 64 {
+		max = 1<<(bits-1) - 1
+	}
+	min := -max - 1
+	// maxIncr and minIncr may overflow, but they are only used once value is in range
+	maxIncr, minIncr := max-value, min-value
+
+	var limit int64
+	switch {
+	case value > max || (bits != 64 && incr > maxIncr) || (value >= 0 && incr > 0 && incr > maxIncr):
+		limit = max
+	case value < min || (bits != 64 && incr < minIncr) || (value < 0 && incr < 0 && incr < minIncr):
+		limit = min
+	default:
+		return value + incr, true
+	}
+
+	switch overflow {
+	case "fail":
+		return 0, false
+	case "sat":
+		return limit, true
+	}
+	sum := uint64(value) + uint64(incr)
+	if bits < 64 {
+		mask := uint64(math.MaxUint64) << bits
+		if sum&(1<<(bits-1)) != 0 {
+			sum |= mask
+		} else {
+			sum &^= mask
+		}
+	}
+	return int64(sum), true
+}
+
+// addUnsigned adds incr to an unsigned integer of bits like Redis, the sum wraps around or saturates when it overflows.
+func addUnsigned(value uint64, incr int64, bits uint, overflow string) (uint64, bool) {
+	max := uint64(1)<<bits - 1
+	maxIncr, minIncr := int64(max-value), -int64(value)
+
+	var limit uint64
+	switch {
+	case value > max || (incr > 0 && incr > maxIncr):
+		limit = max
+	case incr < 0 && incr < minIncr:
+		limit = 0
+	default:
+		return value + uint64(incr), true
+	}
+
+	switch overflow {
+	case "fail":
+		return 0, false
+	case "sat":
+		return limit, true
+	}
+	return (value + uint64(incr)) &^ (math.MaxUint64 << bits), true
+}
+
+// parseBitOffset parses a bit offset, which must be a uint32 value.
+func parseBitOffset(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, errBitOffset
+	}
+	return uint32(v), nil
+}
+
+// bitArgs are parsed arguments of SETBIT and BITPOS.
+type bitArgs struct {
+	offset uint32
+	bit    int
+	r      *BitRange
+}
+
+func parseGetBit(args []string) (interface{}, error) {
+	return parseBitOffset(args[2])
+}
+
+func parseSetBit(args []string) (interface{}, error) {
+	offset, err := parseBitOffset(args[2])
+	if err != nil {
+		return nil, err
+	}
+	switch args[3] {
+	case "0":
+		return bitArgs{offset: offset, bit: 0}, nil
+	case "1":
+		return bitArgs{offset: offset, bit: 1}, nil
+	}
+	return nil, errBitValue
+}
+
+// parseBitRange parses `start [end [BYTE|BIT]]` of BITCOUNT and BITPOS.
+func parseBitRange(args []string) (*BitRange, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	if len(args) > 3 {
+		return nil, errSyntax
+	}
+	var r BitRange
+	var err error
+	if r.Start, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+		return nil, errNotInteger
+	}
+	if len(args) > 1 {
+		if r.End, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return nil, errNotInteger
+		}
+		r.HasEnd = true
+	}
+	if len(args) > 2 {
+		switch strings.ToLower(args[2]) {
+		case "byte":
+		case "bit":
+			r.Bit = true
+		default:
+			return nil, errSyntax
+		}
+	}
+	return &r, nil
+}
+
+func parseBitCount(args []string) (interface{}, error) {
+	// the end must be given with the start
+	if len(args) == 3 {
+		return nil, errSyntax
+	}
+	return parseBitRange(args[2:])
+}
+
+func parseBitPos(args []string) (interface{}, error) {
+	bit, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	if bit != 0 && bit != 1 {
+		return nil, errBitPosBit
+	}
+	r, err := parseBitRange(args[3:])
+	if err != nil {
+		return nil, err
+	}
+	return bitArgs{bit: int(bit), r: r}, nil
+}
+
+func parseBitOp(args []string) (interface{}, error) {
+	op := strings.ToLower(args[1])
+	switch op {
+	case "and", "or", "xor":
+	case "not":
+		if len(args) != 4 {
+			return nil, errBitOpNot
+		}
+	default:
+		return nil, errSyntax
+	}
+	return op, nil
+}
+
+func parseBitField(args []string) (interface{}, error) {
+	var ops []BitFieldOp
+	overflow := "wrap"
+	for i := 2; i < len(args); {
+		sub := strings.ToLower(args[i])
+		switch sub {
+		case "overflow":
+			if i+1 >= len(args) {
+				return nil, errSyntax
+			}
+			overflow = strings.ToLower(args[i+1])
+			if overflow != "wrap" && overflow != "sat" && overflow != "fail" {
+				return nil, errBitFieldOverflow
+			}
+			i += 2
+			continue
+		case "get", "set", "incrby":
+		default:
+			return nil, errSyntax
+		}
+
+		n := 3 // arguments of the subcommand
+		if sub == "get" {
+			n = 2
+		}
+		if i+n >= len(args) {
+			return nil, errSyntax
+		}
+		op := BitFieldOp{Op: sub, Overflow: overflow}
+		if err := op.parseField(args[i+1], args[i+2]); err != nil {
+			return nil, err
+		}
+		if n == 3 {
+			v, err := strconv.ParseInt(args[i+3], 10, 64)
+			if err != nil {
+				return nil, errNotInteger
+			}
+			op.Value = v
+		}
+		ops = append(ops, op)
+		i += n + 1
+	}
+	return ops, nil
+}
+
+// parseField parses the type like i8 or u16 and the offset of the field, an offset like #N is N times the width.
+func (op *BitFieldOp) parseField(typ, offset string) error {
+	if len(typ) < 2 {
+		return errBitFieldType
+	}
+	switch typ[0] {
+	case 'i', 'I':
+		op.Signed = true
+	case 'u', 'U':
+	default:
+		return errBitFieldType
+	}
+	bits, err := strconv.ParseUint(typ[1:], 10, 8)
+	if err != nil || bits == 0 || (op.Signed && bits > 64) || (!op.Signed && bits > 63) {
+		return errBitFieldType
+	}
+	op.Bits = uint(bits)
+
+	multiply := strings.HasPrefix(offset, "#")
+	v, err := strconv.ParseUint(strings.TrimPrefix(offset, "#"), 10, 32)
+	if err != nil {
+		return errBitOffset
+	}
+	if multiply {
+		v *= bits
+	}
+	if v+bits-1 > math.MaxUint32 {
+		return errBitOffset
+	}
+	op.Offset = uint32(v)
+	return nil
+}
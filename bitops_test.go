@@ -0,0 +1,280 @@
+package basalt
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// setString stores the bits of s to the named bitmap, like SET of a string in Redis.
+func setString(bs *Bitmaps, name, s string) {
+	bs.RemoveBitmap(name, false)
+	var values []uint32
+	for i := 0; i < len(s); i++ {
+		for j := 0; j < 8; j++ {
+			if s[i]&(0x80>>j) != 0 {
+				values = append(values, uint32(i*8+j))
+			}
+		}
+	}
+	bs.AddMany(name, values, false)
+}
+
+// getString returns the string of the named bitmap.
+func getString(bs *Bitmaps, name string) string {
+	rbms, unlock := bs.rlock(name)
+	defer unlock()
+	b := make([]byte, bitLength(rbms[0]))
+	for i := range b {
+		for j := 0; j < 8; j++ {
+			if rbms[0].Contains(uint32(i*8 + j)) {
+				b[i] |= 0x80 >> j
+			}
+		}
+	}
+	return string(b)
+}
+
+func TestBitmaps_BitOps(t *testing.T) {
+	bs := NewBitmaps()
+	if bs.SetBit("mykey", 7, 1) != 0 || bs.SetBit("mykey", 7, 0) != 1 || bs.SetBit("mykey", 7, 1) != 0 {
+		t.Errorf("expect the original bits returned by SetBit")
+	}
+	if bs.GetBit("mykey", 0) != 0 || bs.GetBit("mykey", 7) != 1 || bs.GetBit("mykey", 100) != 0 {
+		t.Errorf("unexpected GetBit")
+	}
+
+	setString(bs, "mykey", "foobar")
+	for _, c := range []struct {
+		r     *BitRange
+		count int64
+	}{
+		{nil, 26},
+		{&BitRange{Start: 0, End: 0, HasEnd: true}, 4},
+		{&BitRange{Start: 1, End: 1, HasEnd: true}, 6},
+		{&BitRange{Start: 5, End: 30, HasEnd: true, Bit: true}, 17},
+		{&BitRange{Start: -2, End: -1, HasEnd: true}, 7},
+		{&BitRange{Start: 3, End: 1, HasEnd: true}, 0},
+		{&BitRange{Start: -100, End: 100, HasEnd: true}, 26},
+	} {
+		if count := bs.BitCount("mykey", c.r); count != c.count {
+			t.Errorf("expect %d bits in %+v but got %d", c.count, c.r, count)
+		}
+	}
+	if bs.BitCount("missing", nil) != 0 {
+		t.Errorf("expect no bits of a missing bitmap")
+	}
+
+	for _, c := range []struct {
+		s   string
+		bit int
+		r   *BitRange
+		pos int64
+	}{
+		{"\xff\xf0\x00", 0, nil, 12},
+		{"\x00\xff\xf0", 1, &BitRange{Start: 0}, 8},
+		{"\x00\xff\xf0", 1, &BitRange{Start: 2}, 16},
+		{"\x00\xff\xf0", 1, &BitRange{Start: 2, End: -1, HasEnd: true}, 16},
+		{"\x00\xff\xf0", 1, &BitRange{Start: 7, End: 15, HasEnd: true, Bit: true}, 8},
+		{"\x00\xff\xf0", 1, &BitRange{Start: 17, End: -3, HasEnd: true, Bit: true}, 17},
+		{"\x00\x00\x00", 1, nil, -1},
+		{"\x00\x00\x00", 0, nil, 0},
+		{"\xff\xff", 0, nil, 16},
+		{"\xff\xff", 0, &BitRange{Start: 1}, 16},
+		{"\xff\xff", 0, &BitRange{Start: 0, End: 1, HasEnd: true}, -1},
+		{"\xff\xff", 1, &BitRange{Start: 2, End: 3, HasEnd: true}, -1},
+	} {
+		setString(bs, "mykey", c.s)
+		if pos := bs.BitPos("mykey", c.bit, c.r); pos != c.pos {
+			t.Errorf("expect position %d of %d in %q %+v but got %d", c.pos, c.bit, c.s, c.r, pos)
+		}
+	}
+
+	setString(bs, "key1", "foobar")
+	setString(bs, "key2", "abcdef")
+	if n := bs.BitOp("and", "dest", "key1", "key2"); n != 6 || getString(bs, "dest") != "`bc`ab" {
+		t.Errorf("unexpected AND %d %q", n, getString(bs, "dest"))
+	}
+	if n := bs.BitOp("or", "dest", "key1", "key2"); n != 6 || getString(bs, "dest") != "goofev" {
+		t.Errorf("unexpected OR %d %q", n, getString(bs, "dest"))
+	}
+	if n := bs.BitOp("xor", "dest", "key1", "key2", "key1"); n != 6 || getString(bs, "dest") != "abcdef" {
+		t.Errorf("unexpected XOR %d %q", n, getString(bs, "dest"))
+	}
+	setString(bs, "key3", "\xf0\x01")
+	if n := bs.BitOp("not", "dest", "key3"); n != 2 || getString(bs, "dest") != "\x0f\xfe" {
+		t.Errorf("unexpected NOT %d %q", n, getString(bs, "dest"))
+	}
+	if n := bs.BitOp("and", "dest", "key1", "missing"); n != 6 || bs.Card("dest") != 0 {
+		t.Errorf("expect AND with a missing bitmap empty but got %d", bs.Card("dest"))
+	}
+	if n := bs.BitOp("or", "dest", "missing"); n != 0 || bs.Clone("dest") != nil {
+		t.Errorf("expect the destination removed if sources are empty")
+	}
+}
+
+func TestBitmaps_BitField(t *testing.T) {
+	bs := NewBitmaps()
+	field := func(args ...string) []interface{} {
+		ops, err := parseBitField(append([]string{"bitfield", "mykey"}, args...))
+		if err != nil {
+			t.Fatalf("failed to parse %v: %v", args, err)
+		}
+		return bs.BitField("mykey", ops.([]BitFieldOp))
+	}
+
+	if rt := field("get", "u8", "0"); !reflect.DeepEqual(rt, []interface{}{int64(0)}) || bs.Clone("mykey") != nil {
+		t.Errorf("expect get not create the bitmap but got %v", rt)
+	}
+	if rt := field("incrby", "i5", "100", "1", "get", "u4", "0"); !reflect.DeepEqual(rt, []interface{}{int64(1), int64(0)}) {
+		t.Errorf("unexpected replies %v", rt)
+	}
+
+	var replies [][]interface{}
+	for i := 0; i < 4; i++ {
+		replies = append(replies, field("incrby", "u2", "200", "1", "overflow", "sat", "incrby", "u2", "202", "1"))
+	}
+	expected := [][]interface{}{{int64(1), int64(1)}, {int64(2), int64(2)}, {int64(3), int64(3)}, {int64(0), int64(3)}}
+	if !reflect.DeepEqual(replies, expected) {
+		t.Errorf("expect %v but got %v", expected, replies)
+	}
+	if rt := field("overflow", "fail", "incrby", "u2", "202", "1"); !reflect.DeepEqual(rt, []interface{}{nil}) {
+		t.Errorf("expect nil if it overflows but got %v", rt)
+	}
+
+	if rt := field("set", "i8", "#1", "127", "incrby", "i8", "8", "1", "get", "u8", "8"); !reflect.DeepEqual(rt, []interface{}{int64(0), int64(-128), int64(128)}) {
+		t.Errorf("expect wrapped around but got %v", rt)
+	}
+	if rt := field("overflow", "sat", "set", "i8", "8", "1000", "get", "i8", "8", "incrby", "i8", "8", "-1000"); !reflect.DeepEqual(rt, []interface{}{int64(-128), int64(127), int64(-128)}) {
+		t.Errorf("expect saturated but got %v", rt)
+	}
+	if rt := field("set", "u8", "16", "-1", "get", "u8", "16", "set", "i64", "32", "-1", "incrby", "i64", "32", "-9223372036854775807"); !reflect.DeepEqual(rt, []interface{}{int64(0), int64(255), int64(0), int64(-9223372036854775808)}) {
+		t.Errorf("unexpected replies %v", rt)
+	}
+
+	for _, args := range [][]string{
+		{"get", "u64", "0"},
+		{"get", "i65", "0"},
+		{"get", "x8", "0"},
+		{"get", "u8", "-1"},
+		{"get", "u8", "4294967290"},
+		{"set", "u8", "0"},
+		{"overflow", "none"},
+		{"incr", "u8", "0", "1"},
+		{"set", "u8", "0", "x"},
+	} {
+		if _, err := parseBitField(append([]string{"bitfield", "mykey"}, args...)); err == nil {
+			t.Errorf("expect an error for %v", args)
+		}
+	}
+}
+
+func TestServer_BitCommands(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	s := NewServer(addr, NewBitmaps(), nil, "")
+	s.ln = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.configListener(ctx, ln)
+	<-s.started
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	redis := redisCaller(t, conn)
+
+	for _, c := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"SETBIT", "k", "7", "1"}, ":0"},
+		{[]string{"setbit", "k", "7", "1"}, ":1"},
+		{[]string{"setbit", "k", "9", "1"}, ":0"},
+		{[]string{"getbit", "k", "7"}, ":1"},
+		{[]string{"bitcount", "k"}, ":2"},
+		{[]string{"bitcount", "k", "1", "-1"}, ":1"},
+		{[]string{"bitcount", "k", "0", "8", "BIT"}, ":1"},
+		{[]string{"bitpos", "k", "1", "1"}, ":9"},
+		{[]string{"bitpos", "k", "0"}, ":0"},
+		{[]string{"bitop", "not", "n", "k"}, ":2"},
+		{[]string{"bitcount", "n"}, ":14"},
+		{[]string{"bitfield", "f", "set", "u8", "0", "255", "overflow", "fail", "incrby", "u8", "0", "1", "get", "u4", "4"}, ":0 $-1 :15"},
+		{[]string{"setbit", "k", "4294967296", "1"}, "-ERR bit offset is not an integer or out of range"},
+		{[]string{"setbit", "k", "1", "2"}, "-ERR bit is not an integer or out of range"},
+		{[]string{"bitcount", "k", "1"}, "-ERR syntax error"},
+		{[]string{"bitpos", "k", "2"}, "-ERR The bit argument must be 1 or 0."},
+		{[]string{"bitop", "not", "n", "k", "f"}, "-ERR BITOP NOT must be called with a single source key."},
+		{[]string{"getbit", "k"}, "-ERR wrong number of arguments for 'getbit' command"},
+		{[]string{"multi"}, "+OK"},
+		{[]string{"setbit", "k", "8", "1"}, "+QUEUED"},
+		{[]string{"bitcount", "k"}, "+QUEUED"},
+		{[]string{"exec"}, ":0 :3"},
+	} {
+		if reply := redis(c.args...); reply != c.reply {
+			t.Errorf("expect %s for %v but got %s", c.reply, c.args, reply)
+		}
+	}
+}
+
+// redisCaller returns a function sending a command to conn and returning its reply,
+// with elements of an aggregate joined by spaces. Without arguments, it only reads the next reply.
+func redisCaller(t *testing.T, conn net.Conn) func(args ...string) string {
+	r := bufio.NewReader(conn)
+	var readReply func() string
+	readReply = func() string {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line[0] == '$' && line != "$-1":
+			n, _ := strconv.Atoi(line[1:])
+			b := make([]byte, n+2)
+			if _, err := io.ReadFull(r, b); err != nil {
+				t.Fatal(err)
+			}
+			return string(b[:n])
+		case strings.IndexByte("*%~>", line[0]) < 0 || line == "*-1":
+			return line
+		}
+		// maps, sets and pushes of RESP3 keep their type
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		var elems []string
+		for i := 0; i < n; i++ {
+			elems = append(elems, readReply())
+		}
+		if line[0] != '*' {
+			return line[:1] + strings.Join(elems, " ")
+		}
+		return strings.Join(elems, " ")
+	}
+	return func(args ...string) string {
+		if len(args) == 0 {
+			return readReply()
+		}
+		var sb strings.Builder
+		sb.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+		for _, arg := range args {
+			sb.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+		}
+		if _, err := conn.Write([]byte(sb.String())); err != nil {
+			t.Fatal(err)
+		}
+		return readReply()
+	}
+}
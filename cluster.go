@@ -0,0 +1,180 @@
+package basalt
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rpcxio/etcd/pkg/types"
+	"github.com/rpcxio/etcd/raft"
+)
+
+// Errors for cluster status.
+var (
+	ErrNotInCluster = errors.New("server is not in a raft cluster")
+	ErrRaftNotReady = errors.New("raft node is not started")
+	ErrRaftStopped  = errors.New("raft node is stopped")
+
+	ErrNodeNotFound       = errors.New("node not found")
+	ErrNotLearner         = errors.New("node is not a learner")
+	ErrLearnerNotCaughtUp = errors.New("learner has not caught up with the leader")
+	ErrNodeExists         = errors.New("node is already a member")
+	ErrNoVoters           = errors.New("no voters in the configuration")
+	ErrNoMemberURL        = errors.New("raft URL of new member is required")
+	ErrJointConfig        = errors.New("cluster is in a joint configuration")
+)
+
+const (
+	// maxPromoteLag is the max number of entries a learner can lag behind the leader to be promoted.
+	maxPromoteLag = 100
+	// transferTimeout is the timeout of leadership transfers requested by clients.
+	transferTimeout = 10 * time.Second
+)
+
+// Roles of a node in the cluster.
+const (
+	RoleLeader    = "leader"
+	RoleFollower  = "follower"
+	RoleCandidate = "candidate"
+	RoleLearner   = "learner"
+)
+
+// ClusterStatus is the raft status of a node and its view of the cluster.
+type ClusterStatus struct {
+	ID            uint64       `json:"id"`
+	Role          string       `json:"role"`
+	Leader        uint64       `json:"leader"` // 0 if the leader is unknown
+	Term          uint64       `json:"term"`
+	CommitIndex   uint64       `json:"commit_index"`
+	AppliedIndex  uint64       `json:"applied_index"`
+	SnapshotIndex uint64       `json:"snapshot_index"`
+	Lag           uint64       `json:"lag"` // committed entries not applied yet
+	Peers         []PeerStatus `json:"peers"`
+	Removed       []uint64     `json:"removed"` // IDs of members removed from the cluster
+}
+
+// PeerStatus is the status of a member of the cluster seen by a node.
+// Match, Next, State and Lag are only known by the leader.
+type PeerStatus struct {
+	ID          uint64    `json:"id"`
+	URL         string    `json:"url"`
+	Learner     bool      `json:"learner"`
+	Active      bool      `json:"active"` // connected with this node
+	ActiveSince time.Time `json:"active_since"`
+	Match       uint64    `json:"match,omitempty"`
+	Next        uint64    `json:"next,omitempty"`
+	State       string    `json:"state,omitempty"` // probe, replicate or snapshot
+	Lag         uint64    `json:"lag,omitempty"`   // entries not replicated to the peer yet
+
+	// health of the connection reported by the transport of this node
+	Unreachable     uint64    `json:"unreachable"` // times the peer is reported unreachable
+	LastUnreachable time.Time `json:"last_unreachable"`
+	SnapshotsSent   uint64    `json:"snapshots_sent"`
+	SnapshotsFailed uint64    `json:"snapshots_failed"`
+}
+
+// status returns the raft status of this node.
+func (rc *RaftNode) status() (*ClusterStatus, error) {
+	select {
+	case <-rc.startedc:
+	default:
+		return nil, ErrRaftNotReady
+	}
+
+	st := rc.node.Status()
+	_, learner := st.Config.Learners[st.ID]
+
+	cs := &ClusterStatus{
+		ID:           st.ID,
+		Role:         roleOf(st.RaftState, learner),
+		Leader:       st.Lead,
+		Term:         st.Term,
+		CommitIndex:  st.Commit,
+		AppliedIndex: st.Applied,
+	}
+	if st.Commit > st.Applied {
+		cs.Lag = st.Commit - st.Applied
+	}
+	if snap, err := rc.raftStorage.Snapshot(); err == nil {
+		cs.SnapshotIndex = snap.Metadata.Index
+	}
+	lastIndex, _ := rc.raftStorage.LastIndex()
+
+	ids := st.Config.Voters.IDs()
+	for id := range st.Config.Learners {
+		ids[id] = struct{}{}
+	}
+	for id := range ids {
+		_, learner := st.Config.Learners[id]
+		ps := PeerStatus{
+			ID:      id,
+			URL:     rc.peerURL(id),
+			Learner: learner,
+		}
+		if id == st.ID {
+			ps.Active = true
+		} else {
+			ps.ActiveSince = rc.transport.ActiveSince(types.ID(id))
+			ps.Active = !ps.ActiveSince.IsZero()
+			h := rc.peerHealth(id)
+			ps.Unreachable = h.unreachable
+			ps.LastUnreachable = h.lastUnreachable
+			ps.SnapshotsSent = h.snapshotsSent
+			ps.SnapshotsFailed = h.snapshotsFailed
+		}
+		if pr, ok := st.Progress[id]; ok {
+			ps.Match = pr.Match
+			ps.Next = pr.Next
+			ps.State = strings.ToLower(strings.TrimPrefix(pr.State.String(), "State"))
+			if lastIndex > pr.Match {
+				ps.Lag = lastIndex - pr.Match
+			}
+		}
+		cs.Peers = append(cs.Peers, ps)
+	}
+	sort.Slice(cs.Peers, func(i, j int) bool { return cs.Peers[i].ID < cs.Peers[j].ID })
+	cs.Removed = rc.removedIDs()
+
+	return cs, nil
+}
+
+func roleOf(state raft.StateType, learner bool) string {
+	switch {
+	case learner:
+		return RoleLearner
+	case state == raft.StateLeader:
+		return RoleLeader
+	case state == raft.StateCandidate || state == raft.StatePreCandidate:
+		return RoleCandidate
+	}
+	return RoleFollower
+}
+
+// ClusterStatus returns the raft status of this node and its view of the cluster.
+func (s *RaftServer) ClusterStatus() (*ClusterStatus, error) {
+	return s.node.status()
+}
+
+// ClusterStatus returns the raft status of this server, or ErrNotInCluster if it runs standalone.
+func (s *Server) ClusterStatus() (*ClusterStatus, error) {
+	if s.isSharded() {
+		return nil, ErrShardedServer
+	}
+	if s.raft == nil {
+		return nil, ErrNotInCluster
+	}
+	return s.raft.ClusterStatus()
+}
+
+// TransferLeadership transfers leadership to the target voter, or the most up-to-date voter if target is 0.
+func (s *Server) TransferLeadership(ctx context.Context, target uint64) error {
+	if s.isSharded() {
+		return ErrShardedServer
+	}
+	if s.raft == nil {
+		return ErrNotInCluster
+	}
+	return s.raft.TransferLeadership(ctx, target)
+}
@@ -0,0 +1,367 @@
+package basalt
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rpcxio/etcd/etcdserver/api/rafthttp"
+	"github.com/rpcxio/etcd/raft"
+	"github.com/rpcxio/etcd/raft/quorum"
+	"github.com/rpcxio/etcd/raft/raftpb"
+	"github.com/rpcxio/etcd/raft/tracker"
+)
+
+func TestRoleOf(t *testing.T) {
+	cases := []struct {
+		state   raft.StateType
+		learner bool
+		role    string
+	}{
+		{raft.StateLeader, false, RoleLeader},
+		{raft.StateFollower, false, RoleFollower},
+		{raft.StatePreCandidate, false, RoleCandidate},
+		{raft.StateFollower, true, RoleLearner},
+	}
+	for _, c := range cases {
+		if role := roleOf(c.state, c.learner); role != c.role {
+			t.Errorf("expect %s for %v but got %s", c.role, c.state, role)
+		}
+	}
+}
+
+func TestFormatClusterStatus(t *testing.T) {
+	status := &ClusterStatus{
+		ID:          1,
+		Role:        RoleLeader,
+		Leader:      1,
+		CommitIndex: 10,
+		Peers: []PeerStatus{
+			{ID: 1, URL: "http://127.0.0.1:12379", Active: true, State: "replicate", Match: 10, Next: 11},
+			{ID: 2, URL: "http://127.0.0.1:22379", Learner: true, Unreachable: 3, SnapshotsFailed: 1},
+		},
+		Removed: []uint64{3, 4},
+	}
+
+	info := formatClusterStatus(status)
+	for _, line := range []string{
+		"role:leader\r\n",
+		"commit_index:10\r\n",
+		"peers:2\r\n",
+		"learners:1\r\n",
+		"peer1:url=http://127.0.0.1:12379,learner=false,active=true,state=replicate,match=10,next=11,lag=0\r\n",
+		"removed:3,4\r\n",
+		"peer2:url=http://127.0.0.1:22379,learner=true,active=false,unreachable=3,snapshots_sent=0,snapshots_failed=1\r\n",
+	} {
+		if !strings.Contains(info, line) {
+			t.Errorf("expect %q in %q", line, info)
+		}
+	}
+}
+
+func TestRemovedIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basalt-removed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "removed")
+
+	removed, err := loadRemovedIDs(path)
+	if err != nil || len(removed) != 0 {
+		t.Fatalf("expect no removed IDs but got %v, %v", removed, err)
+	}
+
+	if err := saveRemovedIDs(path, []uint64{2, 5}); err != nil {
+		t.Fatalf("failed to save removed IDs: %v", err)
+	}
+	removed, err = loadRemovedIDs(path)
+	if err != nil {
+		t.Fatalf("failed to load removed IDs: %v", err)
+	}
+	if len(removed) != 2 {
+		t.Fatalf("expect 2 removed IDs but got %v", removed)
+	}
+	for _, id := range []uint64{2, 5} {
+		if _, ok := removed[id]; !ok {
+			t.Errorf("expect %d to be removed", id)
+		}
+	}
+}
+
+func TestMembers(t *testing.T) {
+	// replacing node 3 with node 4 in a joint configuration
+	cs := raftpb.ConfState{
+		Voters:         []uint64{1, 2, 4},
+		VotersOutgoing: []uint64{1, 2, 3},
+		Learners:       []uint64{5},
+	}
+	ids := members(cs)
+	if len(ids) != 5 {
+		t.Fatalf("expect 5 members but got %v", ids)
+	}
+	for id := uint64(1); id <= 5; id++ {
+		if _, ok := ids[id]; !ok {
+			t.Errorf("expect %d to be a member", id)
+		}
+	}
+}
+
+func TestMemberURLs(t *testing.T) {
+	data, err := encodeMemberURLs(nil)
+	if err != nil || data != nil {
+		t.Fatalf("expect empty context but got %q, %v", data, err)
+	}
+	urls, err := decodeMemberURLs(data)
+	if err != nil || len(urls) != 0 {
+		t.Fatalf("expect no urls but got %v, %v", urls, err)
+	}
+
+	data, err = encodeMemberURLs(map[uint64]string{4: "http://127.0.0.1:42379"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, err = decodeMemberURLs(data)
+	if err != nil {
+		t.Fatalf("failed to decode urls: %v", err)
+	}
+	if len(urls) != 1 || urls[4] != "http://127.0.0.1:42379" {
+		t.Fatalf("expect the url of node 4 but got %v", urls)
+	}
+}
+
+// statusNode is a raft node that only reports the given status.
+type statusNode struct {
+	raft.Node
+	st raft.Status
+}
+
+func (n *statusNode) Status() raft.Status { return n.st }
+
+// newStatusRaftNode returns a started raft node reporting the given status, whose log ends at lastIndex.
+func newStatusRaftNode(t *testing.T, st raft.Status, lastIndex uint64) *RaftNode {
+	storage := raft.NewMemoryStorage()
+	var ents []raftpb.Entry
+	for i := uint64(1); i <= lastIndex; i++ {
+		ents = append(ents, raftpb.Entry{Index: i, Term: 1})
+	}
+	if err := storage.Append(ents); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &RaftNode{
+		node:        &statusNode{st: st},
+		raftStorage: storage,
+		transport:   &rafthttp.Transport{},
+		startedc:    make(chan struct{}),
+		peerURLs: map[uint64]string{
+			1: "http://127.0.0.1:12379",
+			2: "http://127.0.0.1:22379",
+			3: "http://127.0.0.1:32379",
+		},
+		removed: make(map[uint64]struct{}),
+		health:  make(map[uint64]*peerHealth),
+	}
+	close(rc.startedc)
+	return rc
+}
+
+// clusterRaftStatus returns the status of node 1 in a cluster of voters 1 and 2 and learner 3.
+func clusterRaftStatus(state raft.StateType, lead uint64, learner tracker.Progress) raft.Status {
+	st := raft.Status{
+		BasicStatus: raft.BasicStatus{
+			ID:        1,
+			HardState: raftpb.HardState{Term: 2, Commit: 200},
+			SoftState: raft.SoftState{Lead: lead, RaftState: state},
+			Applied:   200,
+		},
+		Config: tracker.Config{
+			Voters:   quorum.JointConfig{quorum.MajorityConfig{1: {}, 2: {}}},
+			Learners: map[uint64]struct{}{3: {}},
+		},
+	}
+	if state == raft.StateLeader {
+		st.Progress = map[uint64]tracker.Progress{
+			1: {Match: 200, Next: 201, State: tracker.StateReplicate},
+			2: {Match: 200, Next: 201, State: tracker.StateReplicate},
+			3: learner,
+		}
+	}
+	return st
+}
+
+func TestPromoteLearner(t *testing.T) {
+	caughtUp := tracker.Progress{Match: 150, Next: 151, State: tracker.StateReplicate}
+	cases := []struct {
+		name    string
+		state   raft.StateType
+		lead    uint64
+		learner tracker.Progress
+		id      uint64
+		err     error
+	}{
+		{"promoted", raft.StateLeader, 1, caughtUp, 3, nil},
+		{"not leader", raft.StateFollower, 2, caughtUp, 3, &NotLeaderError{Leader: 2, Addr: "127.0.0.1:28972"}},
+		{"no leader", raft.StateFollower, 0, caughtUp, 3, ErrNoLeader},
+		{"not a learner", raft.StateLeader, 1, caughtUp, 2, ErrNotLearner},
+		{"probing learner", raft.StateLeader, 1, tracker.Progress{Match: 150, Next: 151, State: tracker.StateProbe}, 3, ErrLearnerNotCaughtUp},
+		{"lagging learner", raft.StateLeader, 1, tracker.Progress{Match: 99, Next: 100, State: tracker.StateReplicate}, 3, ErrLearnerNotCaughtUp},
+		{"unknown node", raft.StateLeader, 1, caughtUp, 9, ErrNodeNotFound},
+	}
+	for _, c := range cases {
+		rs := &RaftServer{
+			node:        newStatusRaftNode(t, clusterRaftStatus(c.state, c.lead, c.learner), 200),
+			confChangeC: make(chan raftpb.ConfChangeI, 1),
+			peerAddrs:   map[uint64]string{2: "127.0.0.1:28972"},
+		}
+
+		err := rs.PromoteLearner(c.id)
+		var notLeader *NotLeaderError
+		if want, ok := c.err.(*NotLeaderError); ok {
+			if !errors.As(err, &notLeader) || *notLeader != *want {
+				t.Errorf("%s: expect %v but got %v", c.name, want, err)
+			}
+			continue
+		}
+		if err != c.err {
+			t.Errorf("%s: expect %v but got %v", c.name, c.err, err)
+			continue
+		}
+		if err != nil {
+			if len(rs.confChangeC) != 0 {
+				t.Errorf("%s: expect no conf change to be proposed", c.name)
+			}
+			continue
+		}
+
+		cc := (<-rs.confChangeC).(raftpb.ConfChange)
+		if cc.Type != raftpb.ConfChangeAddNode || cc.NodeID != 3 || string(cc.Context) != "http://127.0.0.1:32379" {
+			t.Errorf("%s: expect node 3 to be added as a voter but got %v", c.name, cc)
+		}
+	}
+}
+
+func TestClusterStatusLearner(t *testing.T) {
+	learner := tracker.Progress{Match: 150, Next: 151, State: tracker.StateReplicate}
+	rs := &RaftServer{node: newStatusRaftNode(t, clusterRaftStatus(raft.StateLeader, 1, learner), 200)}
+
+	status, err := rs.ClusterStatus()
+	if err != nil {
+		t.Fatalf("failed to get cluster status: %v", err)
+	}
+	if status.Role != RoleLeader || len(status.Peers) != 3 {
+		t.Fatalf("expect a leader with 3 peers but got %+v", status)
+	}
+	for _, p := range status.Peers {
+		if p.Learner != (p.ID == 3) {
+			t.Errorf("expect only node 3 to be a learner but got %+v", p)
+		}
+	}
+	p := status.Peers[2]
+	if p.URL != "http://127.0.0.1:32379" || p.State != "replicate" || p.Match != 150 || p.Lag != 50 {
+		t.Errorf("expect progress of the learner but got %+v", p)
+	}
+	if info := formatClusterStatus(status); !strings.Contains(info, "learners:1\r\n") {
+		t.Errorf("expect 1 learner in %q", info)
+	}
+
+	// the learner reports its own role
+	st := clusterRaftStatus(raft.StateFollower, 1, learner)
+	st.ID = 3
+	rs = &RaftServer{node: newStatusRaftNode(t, st, 200)}
+	if status, err = rs.ClusterStatus(); err != nil || status.Role != RoleLearner {
+		t.Errorf("expect role %s but got %+v, %v", RoleLearner, status, err)
+	}
+}
+
+// testMemberConfig is the configuration of voters 1, 2 and 3 and learner 4.
+func testMemberConfig() *memberConfig {
+	return &memberConfig{
+		voters:  map[uint64]struct{}{1: {}, 2: {}, 3: {}},
+		members: map[uint64]struct{}{1: {}, 2: {}, 3: {}, 4: {}},
+	}
+}
+
+// removedOnly reports node 9 as removed.
+func removedOnly(id uint64) bool { return id == 9 }
+
+func formatChanges(changes []raftpb.ConfChangeSingle) string {
+	var parts []string
+	for _, c := range changes {
+		op := "add"
+		if c.Type == raftpb.ConfChangeRemoveNode {
+			op = "remove"
+		}
+		parts = append(parts, fmt.Sprintf("%s%d", op, c.NodeID))
+	}
+	return strings.Join(parts, ",")
+}
+
+func TestMemberConfigReconfigure(t *testing.T) {
+	cases := []struct {
+		name    string
+		voters  map[uint64]string
+		changes string
+		urls    map[uint64]string
+		err     error
+	}{
+		{"unchanged", map[uint64]string{1: "", 2: "", 3: ""}, "", nil, nil},
+		{"add a voter", map[uint64]string{1: "", 2: "", 3: "", 5: "http://127.0.0.1:52379"}, "add5", map[uint64]string{5: "http://127.0.0.1:52379"}, nil},
+		{"remove a voter", map[uint64]string{1: "", 2: ""}, "remove3", nil, nil},
+		{"promote a learner", map[uint64]string{1: "", 2: "", 3: "", 4: ""}, "add4", nil, nil},
+		{"replace voters", map[uint64]string{1: "", 4: "", 5: "http://127.0.0.1:52379"}, "add4,add5,remove2,remove3", map[uint64]string{5: "http://127.0.0.1:52379"}, nil},
+		{"no url of new member", map[uint64]string{1: "", 2: "", 5: ""}, "", nil, ErrNoMemberURL},
+		{"removed member", map[uint64]string{1: "", 2: "", 9: "http://127.0.0.1:92379"}, "", nil, ErrMemberRemoved},
+	}
+	for _, c := range cases {
+		changes, urls, err := testMemberConfig().reconfigure(c.voters, removedOnly)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: expect %v but got %v", c.name, c.err, err)
+			continue
+		}
+		if got := formatChanges(changes); got != c.changes {
+			t.Errorf("%s: expect changes %q but got %q", c.name, c.changes, got)
+		}
+		if len(urls) != len(c.urls) {
+			t.Errorf("%s: expect urls %v but got %v", c.name, c.urls, urls)
+		}
+		for id, url := range c.urls {
+			if urls[id] != url {
+				t.Errorf("%s: expect url %s of %d but got %s", c.name, url, id, urls[id])
+			}
+		}
+	}
+}
+
+func TestMemberConfigReplace(t *testing.T) {
+	cases := []struct {
+		name         string
+		oldID, newID uint64
+		changes      string
+		err          error
+	}{
+		{"replace a voter", 3, 5, "add5,remove3", nil},
+		{"replace a learner", 4, 5, "add5,remove4", nil},
+		{"same node", 3, 3, "", ErrNodeExists},
+		{"new node is a member", 3, 4, "", ErrNodeExists},
+		{"unknown node", 6, 5, "", ErrNodeNotFound},
+		{"removed member", 3, 9, "", ErrMemberRemoved},
+	}
+	for _, c := range cases {
+		changes, urls, err := testMemberConfig().replace(c.oldID, c.newID, "http://127.0.0.1:52379", removedOnly)
+		if err != c.err {
+			t.Errorf("%s: expect %v but got %v", c.name, c.err, err)
+			continue
+		}
+		if got := formatChanges(changes); got != c.changes {
+			t.Errorf("%s: expect changes %q but got %q", c.name, c.changes, got)
+		}
+		if err == nil && (len(urls) != 1 || urls[c.newID] != "http://127.0.0.1:52379") {
+			t.Errorf("%s: expect the url of %d but got %v", c.name, c.newID, urls)
+		}
+	}
+}
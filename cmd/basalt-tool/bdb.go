@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rpcxio/basalt"
+	"github.com/rpcxio/etcd/etcdserver/api/snap"
+	"go.uber.org/zap"
+)
+
+// record is a bitmap record in a .bdb file.
+type record struct {
+	name   string
+	offset int64 // offset of the record in the file
+	size   int64 // size of the record in bytes
+	card   uint64
+	bytes  uint64 // portable serialized size of the bitmap
+}
+
+// countingReader counts bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// scanRecords reads all records of a .bdb file with the given size. It stops at the first
+// broken record and returns the records read so far, with the offset where the good data ends.
+// A record cut off by the end of file is reported as io.ErrUnexpectedEOF.
+func scanRecords(r io.Reader, size int64) (records []record, end int64, err error) {
+	cr := &countingReader{r: bufio.NewReader(r)}
+	rr := basalt.NewRecordReader(cr)
+	for {
+		offset := cr.n
+		rec, err := rr.Next()
+		if offset == 0 {
+			offset = rr.HeaderSize() // skip the header, a file with only the header has no records
+		}
+		if err == io.EOF && cr.n == offset {
+			return records, offset, nil
+		}
+		if err != nil {
+			if cr.n >= size || err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, offset, io.ErrUnexpectedEOF
+			}
+			return records, offset, fmt.Errorf("record at offset %d: %v", offset, err)
+		}
+
+		records = append(records, record{
+			name:   rec.Name,
+			offset: offset,
+			size:   cr.n - offset,
+			card:   rec.Bitmap.GetCardinality(),
+			bytes:  rec.Bitmap.GetSerializedSizeInBytes(),
+		})
+	}
+}
+
+// loadBitmapsFile reads bitmaps from a .bdb file or a raft .snap file.
+func loadBitmapsFile(file string) (*basalt.Bitmaps, error) {
+	if !isSnapFile(file) {
+		return loadBitmaps(file)
+	}
+
+	snapshot, err := snap.Read(zap.NewNop(), file)
+	if err != nil {
+		return nil, err
+	}
+	bitmaps := basalt.NewBitmaps()
+	if err := bitmaps.Read(bytes.NewReader(snapshot.Data)); err != nil {
+		return nil, err
+	}
+	return bitmaps, nil
+}
+
+func isSnapFile(file string) bool {
+	return filepath.Ext(file) == ".snap"
+}
+
+// runInfo lists keys, cardinalities and sizes of bitmaps.
+func runInfo(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	dataFile := fs.String("data", "bitmaps.bdb", "the persisted file or a raft .snap file")
+	fs.Parse(args)
+
+	bitmaps, err := loadBitmapsFile(*dataFile)
+	if err != nil {
+		return err
+	}
+
+	var totalCard, totalBytes uint64
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tCARDINALITY\tBYTES\tCONTAINERS\tOWNER\tMODIFIED")
+	for _, name := range bitmaps.Keys() {
+		stats := bitmaps.Stats(name)
+		size := bitmaps.SerializedSize(name)
+		meta, _ := bitmaps.Metadata(name)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n", name, meta.Type, stats.Cardinality, size, stats.Containers,
+			meta.Owner, meta.Modified.Format(time.RFC3339))
+		totalCard += stats.Cardinality
+		totalBytes += size
+	}
+	tw.Flush()
+
+	fmt.Printf("\n%d bitmaps, %d values, %d bytes\n", len(bitmaps.Keys()), totalCard, totalBytes)
+	return nil
+}
+
+// runVerify checks every record of a .bdb file.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dataFile := fs.String("data", "bitmaps.bdb", "the persisted file")
+	verbose := fs.Bool("v", false, "print every record")
+	fs.Parse(args)
+
+	f, err := os.Open(*dataFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	records, end, err := scanRecords(f, fi.Size())
+	seen := make(map[string]int64)
+	var dups []string
+	for _, rec := range records {
+		if *verbose {
+			fmt.Printf("%d\t%d\t%s\t%d values\t%d bytes\n", rec.offset, rec.size, rec.name, rec.card, rec.bytes)
+		}
+		if _, ok := seen[rec.name]; ok {
+			dups = append(dups, rec.name)
+		}
+		seen[rec.name] = rec.offset
+	}
+	sort.Strings(dups)
+
+	fmt.Printf("%s: %d records, %d of %d bytes valid\n", *dataFile, len(records), end, fi.Size())
+	for _, name := range dups {
+		fmt.Printf("duplicate key %s, the last record wins\n", name)
+	}
+
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("torn record at offset %d, run 'basalt-tool repair' to truncate it", end)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+// runRepair truncates a torn tail record of a .bdb file.
+func runRepair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	dataFile := fs.String("data", "bitmaps.bdb", "the persisted file")
+	backup := fs.Bool("backup", true, "copy the file to <data>.bak before truncating")
+	fs.Parse(args)
+
+	f, err := os.Open(*dataFile)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	records, end, err := scanRecords(f, fi.Size())
+	f.Close()
+	if err == nil {
+		fmt.Printf("%s: %d records, nothing to repair\n", *dataFile, len(records))
+		return nil
+	}
+	if err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("only a torn tail can be repaired: %v", err)
+	}
+
+	if *backup {
+		if err := copyFile(*dataFile, *dataFile+".bak"); err != nil {
+			return err
+		}
+	}
+	if err := os.Truncate(*dataFile, end); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: truncated to %d bytes, %d records kept\n", *dataFile, end, len(records))
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, err := os.Stat(dst); err == nil {
+		return errors.New(dst + " already exists")
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
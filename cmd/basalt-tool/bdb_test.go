@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/rpcxio/basalt"
+)
+
+// testBDB returns a .bdb file of two bitmaps, and the offset of the second record.
+func testBDB(t *testing.T) ([]byte, int64) {
+	bitmaps := basalt.NewBitmaps()
+	bitmaps.AddMany("a", []uint32{1, 2, 3}, false)
+	var buf bytes.Buffer
+	if err := bitmaps.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	second := int64(buf.Len())
+
+	bitmaps.AddMany("b", []uint32{4, 5}, false)
+	buf.Reset()
+	if err := bitmaps.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), second
+}
+
+// testV1BDB returns a .bdb file of one bitmap saved without header and metadata by old versions.
+func testV1BDB(t *testing.T) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(1))
+	buf.WriteString("a")
+	if _, err := roaring.BitmapOf(1, 2, 3).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withBadNameLength replaces the record at offset with one of a name length beyond the limit.
+func withBadNameLength(data []byte, offset int64) []byte {
+	bad := append([]byte(nil), data[:offset]...)
+	bad = append(bad, make([]byte, 8)...)
+	binary.LittleEndian.PutUint32(bad[offset:], 1<<30)
+	return bad
+}
+
+func TestScanRecords(t *testing.T) {
+	data, second := testBDB(t)
+	badName := withBadNameLength(data, second)
+	v1 := testV1BDB(t)
+
+	cases := []struct {
+		name    string
+		data    []byte
+		records int
+		first   int64 // offset of the first record, after the header
+		end     int64
+		err     string // expected error, io.ErrUnexpectedEOF for a torn tail
+	}{
+		{"clean", data, 2, 8, int64(len(data)), ""},
+		{"header only", data[:8], 0, 8, 8, ""},
+		{"torn after header", data[:10], 0, 8, 8, io.ErrUnexpectedEOF.Error()},
+		{"torn tail", data[:len(data)-3], 1, 8, second, io.ErrUnexpectedEOF.Error()},
+		{"bad name length", badName, 1, 8, second, "corrupted record"},
+		{"without header", v1, 1, 0, int64(len(v1)), ""},
+	}
+	for _, c := range cases {
+		records, end, err := scanRecords(bytes.NewReader(c.data), int64(len(c.data)))
+		if len(records) != c.records || end != c.end {
+			t.Errorf("%s: expect %d records ending at %d but got %d ending at %d", c.name, c.records, c.end, len(records), end)
+		}
+		if len(records) > 0 && records[0].offset != c.first {
+			t.Errorf("%s: expect the first record at %d but got %d", c.name, c.first, records[0].offset)
+		}
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: expect error %q but got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestRunRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basalt-tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, second := testBDB(t)
+	badName := withBadNameLength(data, second)
+
+	cases := []struct {
+		name string
+		data []byte
+		size int64 // size after repair
+		err  string
+	}{
+		{"clean", data, int64(len(data)), ""},
+		{"header only", data[:8], 8, ""},
+		{"torn tail", data[:len(data)-3], second, ""},
+		{"bad name length", badName, int64(len(badName)), "only a torn tail can be repaired"},
+	}
+	for i, c := range cases {
+		file := filepath.Join(dir, strings.Replace(c.name, " ", "-", -1)+".bdb")
+		if err := ioutil.WriteFile(file, c.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := runRepair([]string{"-data", file})
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: expect error %q but got %v", c.name, c.err, err)
+		}
+		if fi, err := os.Stat(file); err != nil || fi.Size() != c.size {
+			t.Errorf("%s: expect %d bytes after repair but got %v", c.name, c.size, fi)
+		}
+		if _, err := os.Stat(file + ".bak"); (err == nil) != (i == 2) {
+			t.Errorf("%s: expect a backup only for a repaired file but got %v", c.name, err)
+		}
+	}
+
+	// the repaired file is read as the records before the torn one
+	bitmaps, err := loadBitmaps(filepath.Join(dir, "torn-tail.bdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := bitmaps.Keys(); len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("expect only a kept but got %v", keys)
+	}
+}
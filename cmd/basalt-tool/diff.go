@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+
+	"github.com/rpcxio/basalt"
+)
+
+// runDiff compares bitmaps of two .bdb or raft .snap files.
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: basalt-tool diff <file1> <file2>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("two files are required")
+	}
+
+	a, err := loadBitmapsFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+	b, err := loadBitmapsFile(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(1), err)
+	}
+
+	diffs := diffBitmaps(a, b)
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("%d bitmaps differ", len(diffs))
+	}
+	fmt.Println("no difference")
+	return nil
+}
+
+// diffBitmaps describes bitmaps which are not the same in a and b.
+func diffBitmaps(a, b *basalt.Bitmaps) []string {
+	var diffs []string
+
+	names := make(map[string]bool)
+	for _, name := range a.Keys() {
+		names[name] = true
+	}
+	for _, name := range b.Keys() {
+		names[name] = true
+	}
+
+	for _, name := range sortedKeys(names) {
+		bmA, bmB := a.Clone(name), b.Clone(name)
+		switch {
+		case bmB == nil:
+			diffs = append(diffs, fmt.Sprintf("- %s: %d values", name, bmA.GetCardinality()))
+		case bmA == nil:
+			diffs = append(diffs, fmt.Sprintf("+ %s: %d values", name, bmB.GetCardinality()))
+		default:
+			onlyA := roaring.AndNot(bmA, bmB).GetCardinality()
+			onlyB := roaring.AndNot(bmB, bmA).GetCardinality()
+			if onlyA > 0 || onlyB > 0 {
+				diffs = append(diffs, fmt.Sprintf("~ %s: %d values only in first, %d values only in second", name, onlyA, onlyB))
+			}
+		}
+	}
+	return diffs
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
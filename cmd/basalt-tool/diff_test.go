@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rpcxio/basalt"
+)
+
+func TestDiffBitmaps(t *testing.T) {
+	a := basalt.NewBitmaps()
+	a.AddMany("same", []uint32{1, 2}, false)
+	a.AddMany("changed", []uint32{1, 2, 3}, false)
+	a.AddMany("removed", []uint32{1, 2}, false)
+
+	b := basalt.NewBitmaps()
+	b.AddMany("same", []uint32{1, 2}, false)
+	b.AddMany("changed", []uint32{3, 4}, false)
+	b.AddMany("added", []uint32{5}, false)
+
+	cases := []struct {
+		name  string
+		a, b  *basalt.Bitmaps
+		diffs []string
+	}{
+		{"identical", a, a, nil},
+		{"both empty", basalt.NewBitmaps(), basalt.NewBitmaps(), nil},
+		{"changed", a, b, []string{
+			"+ added: 1 values",
+			"~ changed: 2 values only in first, 1 values only in second",
+			"- removed: 2 values",
+		}},
+		{"reversed", b, a, []string{
+			"- added: 1 values",
+			"~ changed: 1 values only in first, 2 values only in second",
+			"+ removed: 2 values",
+		}},
+	}
+	for _, c := range cases {
+		if diffs := diffBitmaps(c.a, c.b); !reflect.DeepEqual(diffs, c.diffs) {
+			t.Errorf("%s: expect %q but got %q", c.name, c.diffs, diffs)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rpcxio/basalt"
+)
+
+// runExport exports bitmaps of a .bdb file.
+// Formats holding one bitmap write one file per key into the output directory.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dataFile := fs.String("data", "bitmaps.bdb", "the persisted file")
+	format := fs.String("format", "csv", "export format: roaring, ints, csv or json")
+	names := fs.String("names", "", "comma separated bitmap names, all bitmaps if empty")
+	out := fs.String("out", "", "output file, or output directory for roaring and ints formats. stdout if empty")
+	fs.Parse(args)
+
+	f, err := basalt.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	bitmaps, err := loadBitmaps(*dataFile)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	if *names != "" {
+		keys = strings.Split(*names, ",")
+	} else {
+		keys = bitmaps.Keys()
+	}
+
+	if !f.SingleBitmap() {
+		return exportTo(*out, func(w io.Writer) error {
+			return bitmaps.Export(w, f, keys...)
+		})
+	}
+
+	if *out == "" {
+		if len(keys) != 1 {
+			return errors.New("-out directory is required to export multiple bitmaps in " + *format)
+		}
+		return bitmaps.Export(os.Stdout, f, keys[0])
+	}
+
+	if err := os.MkdirAll(*out, 0750); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		file := filepath.Join(*out, url.PathEscape(key)+"."+string(f))
+		err := exportTo(file, func(w io.Writer) error {
+			return bitmaps.Export(w, f, key)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// runImport imports bitmaps into a .bdb file, the file is created if it does not exist.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dataFile := fs.String("data", "bitmaps.bdb", "the persisted file")
+	format := fs.String("format", "csv", "import format: roaring, ints, csv or json")
+	name := fs.String("name", "", "bitmap name for roaring and ints formats, defaults to the input file name without extension")
+	fs.Parse(args)
+
+	f, err := basalt.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	bitmaps := basalt.NewBitmaps()
+	if _, err := os.Stat(*dataFile); err == nil {
+		if bitmaps, err = loadBitmaps(*dataFile); err != nil {
+			return err
+		}
+	}
+
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	if *name != "" && len(inputs) > 1 {
+		return errors.New("-name can only be used with one input file")
+	}
+
+	for _, in := range inputs {
+		key := *name
+		if key == "" && f.SingleBitmap() && in != "-" {
+			key = strings.TrimSuffix(filepath.Base(in), filepath.Ext(in))
+			if unescaped, err := url.PathUnescape(key); err == nil {
+				key = unescaped
+			}
+		}
+
+		n, err := importFrom(in, func(r io.Reader) (uint64, error) {
+			return bitmaps.Import(r, f, key, false)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %v", in, err)
+		}
+		fmt.Fprintf(os.Stderr, "imported %d values from %s\n", n, in)
+	}
+
+	return saveBitmaps(*dataFile, bitmaps)
+}
+
+func exportTo(file string, fn func(w io.Writer) error) error {
+	if file == "" || file == "-" {
+		return fn(os.Stdout)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func importFrom(file string, fn func(r io.Reader) (uint64, error)) (uint64, error) {
+	if file == "-" {
+		return fn(os.Stdin)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return fn(f)
+}
@@ -0,0 +1,103 @@
+// basalt-tool is an offline tool to work with basalt data files.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rpcxio/basalt"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"info":     {"list keys, cardinalities and sizes of a .bdb or .snap file", runInfo},
+	"verify":   {"check all records of a .bdb file", runVerify},
+	"repair":   {"truncate a torn tail record of a .bdb file", runRepair},
+	"dump-wal": {"decode entries of a raft WAL directory", runDumpWAL},
+	"diff":     {"compare bitmaps of two .bdb or .snap files", runDiff},
+	"export":   {"export bitmaps of a .bdb file in a portable format", runExport},
+	"import":   {"import bitmaps in a portable format into a .bdb file", runImport},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: basalt-tool <command> [flags]\n\ncommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun 'basalt-tool <command> -h' for flags of a command.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "basalt-tool %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// loadBitmaps reads all bitmaps from a .bdb file.
+func loadBitmaps(file string) (*basalt.Bitmaps, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bitmaps := basalt.NewBitmaps()
+	if err := bitmaps.Read(bufio.NewReader(f)); err != nil {
+		return nil, err
+	}
+	return bitmaps, nil
+}
+
+// saveBitmaps writes bitmaps to a .bdb file. It writes a temporary file
+// and renames it, so the original file is left intact on failure.
+func saveBitmaps(file string, bitmaps *basalt.Bitmaps) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if err := bitmaps.Save(w); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/rpcxio/basalt"
+	"github.com/rpcxio/etcd/raft/raftpb"
+	"github.com/rpcxio/etcd/wal"
+	"github.com/rpcxio/etcd/wal/walpb"
+	"go.uber.org/zap"
+)
+
+// runDumpWAL decodes entries of a raft WAL directory into human-readable operations.
+func runDumpWAL(args []string) error {
+	fs := flag.NewFlagSet("dump-wal", flag.ExitOnError)
+	walDir := fs.String("wal", "raftexample-1", "the WAL directory of a raft node")
+	index := fs.Uint64("index", 0, "dump entries after the snapshot at this index")
+	fs.Parse(args)
+
+	start := walpb.Snapshot{Index: *index}
+	if *index > 0 {
+		snaps, err := wal.ValidSnapshotEntries(zap.NewNop(), *walDir)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, s := range snaps {
+			if s.Index == *index {
+				start, found = s, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no snapshot at index %d in %s", *index, *walDir)
+		}
+	}
+
+	w, err := wal.OpenForRead(zap.NewNop(), *walDir, start)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	_, st, ents, err := w.ReadAll()
+	// entries read before a torn tail are still returned, print them anyway.
+	fmt.Printf("hardstate: term=%d vote=%d commit=%d\n", st.Term, st.Vote, st.Commit)
+	for _, e := range ents {
+		fmt.Printf("%d\t%d\t%s\n", e.Term, e.Index, describeEntry(e))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read WAL after %d entries: %v", len(ents), err)
+	}
+	fmt.Printf("%d entries\n", len(ents))
+	return nil
+}
+
+func describeEntry(e raftpb.Entry) string {
+	switch e.Type {
+	case raftpb.EntryNormal:
+		if len(e.Data) == 0 {
+			return "EMPTY"
+		}
+		ops, vals, err := basalt.DecodeOperations(e.Data)
+		if err != nil {
+			return fmt.Sprintf("UNKNOWN %d bytes: %v", len(e.Data), err)
+		}
+		if len(ops) == 1 {
+			return ops[0].String() + " " + truncate(vals[0], 80)
+		}
+		descs := make([]string, len(ops))
+		for i := range ops {
+			descs[i] = ops[i].String() + " " + vals[i]
+		}
+		return fmt.Sprintf("%s %d: %s", basalt.OP(basalt.BmOpBatch), len(ops), truncate(strings.Join(descs, "; "), 80))
+	case raftpb.EntryConfChange:
+		var cc raftpb.ConfChange
+		if err := cc.Unmarshal(e.Data); err != nil {
+			return fmt.Sprintf("CONFCHANGE %d bytes: %v", len(e.Data), err)
+		}
+		return fmt.Sprintf("CONFCHANGE %s %d %s", cc.Type, cc.NodeID, cc.Context)
+	case raftpb.EntryConfChangeV2:
+		var cc raftpb.ConfChangeV2
+		if err := cc.Unmarshal(e.Data); err != nil {
+			return fmt.Sprintf("CONFCHANGEV2 %d bytes: %v", len(e.Data), err)
+		}
+		return fmt.Sprintf("CONFCHANGEV2 %s %v", cc.Transition, cc.Changes)
+	}
+	return fmt.Sprintf("%s %d bytes", e.Type, len(e.Data))
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return fmt.Sprintf("%s...(%d bytes)", s[:n], len(s))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+	"testing"
+
+	"github.com/rpcxio/basalt"
+	"github.com/rpcxio/etcd/raft/raftpb"
+)
+
+// entryOp has the fields of an operation proposed to raft, so it decodes as one.
+type entryOp struct {
+	OP    basalt.OP
+	Val   string
+	Batch []entryOp
+}
+
+func encodeEntryOp(t *testing.T, op entryOp) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(op); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDescribeEntry(t *testing.T) {
+	cc, err := (&raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 4, Context: []byte("http://127.0.0.1:4")}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		entry raftpb.Entry
+		desc  string
+	}{
+		{"empty", raftpb.Entry{Type: raftpb.EntryNormal}, "EMPTY"},
+		{"single", raftpb.Entry{Data: encodeEntryOp(t, entryOp{OP: basalt.BmOpAdd, Val: "a,1"})}, "ADD a,1"},
+		{"long value", raftpb.Entry{Data: encodeEntryOp(t, entryOp{OP: basalt.BmOpAddMany, Val: "a," + strings.Repeat("1", 100)})},
+			"ADDMANY a," + strings.Repeat("1", 78) + "...(102 bytes)"},
+		{"batch", raftpb.Entry{Data: encodeEntryOp(t, entryOp{OP: basalt.BmOpBatch, Batch: []entryOp{
+			{OP: basalt.BmOpAdd, Val: "a,1"},
+			{OP: basalt.BmOpRemove, Val: "b,2"},
+		}})}, "BATCH 2: ADD a,1; REMOVE b,2"},
+		{"unknown", raftpb.Entry{Data: []byte("not an operation")}, "UNKNOWN 16 bytes: "},
+		{"conf change", raftpb.Entry{Type: raftpb.EntryConfChange, Data: cc}, "CONFCHANGE ConfChangeAddNode 4 http://127.0.0.1:4"},
+	}
+	for _, c := range cases {
+		if desc := describeEntry(c.entry); !strings.HasPrefix(desc, c.desc) {
+			t.Errorf("%s: expect %q but got %q", c.name, c.desc, desc)
+		}
+	}
+}
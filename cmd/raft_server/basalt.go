@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/rpcxio/basalt"
 	"github.com/rpcxio/etcd/raft/raftpb"
@@ -14,43 +21,208 @@ var (
 	addr     = flag.String("addr", ":18972", "the listened address")
 	dataFile = flag.String("data", "bitmaps.bdb", "the persisted file")
 
+	frozenDir          = flag.String("frozen-dir", "", "the directory of memory-mapped frozen bitmaps, <data>.frozen if not set")
+	refuseFrozenWrites = flag.Bool("refuse-frozen-writes", false, "refuse writes to frozen bitmaps instead of thawing them")
+
 	peers = flag.String("peers", "http://127.0.0.1:12379", "comma separated peers in a cluster")
 	id    = flag.Int("id", 1, "node ID")
 	join  = flag.Bool("join", false, "join an existing cluster")
+
+	leaderMode = flag.String("leader-mode", "local", "how writes to a follower are handled: local, forward or redirect")
+	peerAddrs  = flag.String("peer-addrs", "", "comma separated service addresses of peers, in the same order as peers")
+
+	batchBytes = flag.Int("batch-bytes", basalt.DefaultBatchBytes, "max size of writes coalesced into a raft entry")
+	batchDelay = flag.Duration("batch-delay", 0, "how long a write waits for more writes to fill its raft entry")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for pending proposals when shutting down")
+	snapshotOnStop  = flag.Bool("snapshot-on-stop", false, "take a snapshot when shutting down")
+
+	routing = flag.String("routing", "", "the routing table in JSON which partitions bitmaps into shards of raft groups")
+	groups  = flag.String("groups", "", "comma separated IDs of raft groups hosted by this process, all groups in the routing table if not set")
+
+	tlsCert       = flag.String("tls-cert", "", "the certificate file to serve clients over TLS")
+	tlsKey        = flag.String("tls-key", "", "the key file of -tls-cert")
+	tlsCA         = flag.String("tls-ca", "", "the CA file to verify client certificates, and services of the leader when writes are forwarded")
+	tlsClientAuth = flag.Bool("tls-client-auth", false, "require client certificates")
+
+	peerTLSCert = flag.String("peer-tls-cert", "", "the certificate file for mutual TLS between raft peers, peers must use https URLs")
+	peerTLSKey  = flag.String("peer-tls-key", "", "the key file of -peer-tls-cert")
+	peerTLSCA   = flag.String("peer-tls-ca", "", "the CA file to verify certificates of raft peers")
+
+	aclFile      = flag.String("acl", "", "the users and their permissions in JSON, clients are not authenticated if not set")
+	forwardToken = flag.String("forward-token", "", "the token of a user with the cluster category to forward writes to the leader")
+
+	slowlogThreshold = flag.Duration("slowlog-threshold", basalt.DefaultSlowLogThreshold, "commands slower than it are logged in the slow log, 0 logs all commands and a negative one disables the slow log")
+	slowlogMaxLen    = flag.Int("slowlog-max-len", basalt.DefaultSlowLogMaxLen, "max number of commands kept in the slow log")
+
+	notifyKeyspaceEvents = flag.String("notify-keyspace-events", "", "classes of keyspace notifications published to redis subscribers, like KEA, disabled if empty")
+)
+
+var (
+	peerTLS    basalt.TLSOptions
+	forwardTLS *tls.Config // to forward writes to services of the leader
 )
 
 func main() {
 	flag.Parse()
 
-	if _, err := os.Stat(*dataFile); os.IsNotExist(err) {
-		f, err := os.Create(*dataFile)
+	mode, err := basalt.ParseLeaderMode(*leaderMode)
+	if err != nil {
+		log.Fatalf("wrong leader mode %s: %v", *leaderMode, err)
+	}
+
+	clientTLS := basalt.TLSOptions{CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA, ClientCertAuth: *tlsClientAuth}
+	peerTLS = basalt.TLSOptions{CertFile: *peerTLSCert, KeyFile: *peerTLSKey, CAFile: *peerTLSCA}
+	var serverTLS *tls.Config
+	if !clientTLS.Empty() {
+		if serverTLS, err = clientTLS.ServerConfig(); err != nil {
+			log.Fatalf("failed to load TLS certificate: %v", err)
+		}
+		if forwardTLS, err = clientTLS.ClientConfig(); err != nil {
+			log.Fatalf("failed to load TLS certificate: %v", err)
+		}
+	}
+
+	var raftServers []*basalt.RaftServer
+	var srv *basalt.Server
+	if *routing == "" {
+		var raftServer *basalt.RaftServer
+		srv, raftServer = startGroup(0, *addr, *dataFile, *frozenDir, strings.Split(*peers, ","), *peerAddrs, mode)
+		// set confchange handler
+		srv.SetConfChangeCallback(raftServer)
+		raftServers = append(raftServers, raftServer)
+	} else {
+		rt, err := basalt.LoadRoutingTable(*routing)
+		if err != nil {
+			log.Fatalf("failed to load routing table %s: %v", *routing, err)
+		}
+		srv = basalt.NewServer(*addr, basalt.NewBitmaps(), nil, *dataFile)
+		srv.SetRoutingTable(rt)
+		for _, id := range hostedGroups(rt) {
+			route := rt.Group(id)
+			if route == nil {
+				log.Fatalf("raft group %d is not in the routing table", id)
+			}
+			suffix := fmt.Sprintf(".g%d", id)
+			var frozen string
+			if *frozenDir != "" {
+				frozen = *frozenDir + suffix
+			}
+			g, raftServer := startGroup(id, "", *dataFile+suffix, frozen, route.Peers, strings.Join(route.Addrs, ","), mode)
+			g.SetConfChangeCallback(raftServer)
+			srv.AddGroup(id, g)
+			raftServers = append(raftServers, raftServer)
+		}
+	}
+
+	if serverTLS != nil {
+		srv.SetTLSConfig(serverTLS)
+	}
+	if *aclFile != "" {
+		acl, err := basalt.LoadACL(*aclFile)
+		if err != nil {
+			log.Fatalf("failed to load ACL %s: %v", *aclFile, err)
+		}
+		srv.SetACL(acl)
+	}
+	srv.SetSlowLog(*slowlogThreshold, *slowlogMaxLen)
+	if err := srv.SetNotifyKeyspaceEvents(*notifyKeyspaceEvents); err != nil {
+		log.Fatalf("wrong keyspace events %s: %v", *notifyKeyspaceEvents, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigc
+		log.Printf("received %v, shutting down", sig)
+		cancel()
+	}()
+
+	if err := srv.Serve(ctx); err != nil {
+		log.Printf("basalt services stopped: %v", err)
+	}
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer stopCancel()
+	for _, raftServer := range raftServers {
+		if err := raftServer.Stop(stopCtx, *snapshotOnStop); err != nil {
+			log.Printf("failed to stop raft node gracefully: %v", err)
+		}
+	}
+	log.Printf("basalt is stopped")
+}
+
+// startGroup starts the raft node of a raft group, or of the whole cluster if group is 0,
+// and returns the server holding its bitmaps.
+func startGroup(group uint64, addr, dataFile, frozenDir string, peers []string, peerAddrs string, mode basalt.LeaderMode) (*basalt.Server, *basalt.RaftServer) {
+	if _, err := os.Stat(dataFile); os.IsNotExist(err) {
+		f, err := os.Create(dataFile)
 		if err != nil {
-			log.Fatalf("failed to create file %s: %v", *dataFile, err)
+			log.Fatalf("failed to create file %s: %v", dataFile, err)
 		}
 		f.Close()
 	}
 
 	// bitmap
 	bitmaps := basalt.NewBitmaps()
-	srv := basalt.NewServer(*addr, bitmaps, nil, *dataFile)
+	if frozenDir == "" {
+		frozenDir = dataFile + ".frozen"
+	}
+	if err := bitmaps.SetFrozenDir(frozenDir); err != nil {
+		log.Fatalf("failed to set frozen dir %s: %v", frozenDir, err)
+	}
+	bitmaps.SetRefuseFrozenWrites(*refuseFrozenWrites)
+	srv := basalt.NewServer(addr, bitmaps, nil, dataFile)
 
 	// raft
+	// proposeC and confChangeC are closed by raftServer.Stop
 	proposeC := make(chan string)
-	defer close(proposeC)
-	confChangeC := make(chan raftpb.ConfChange)
-	defer close(confChangeC)
+	confChangeC := make(chan raftpb.ConfChangeI)
 
 	var raftServer *basalt.RaftServer
 	getSnapshot := func() ([]byte, error) { return raftServer.GetSnapshot() }
-	commitC, errorC, snapshotterReady := basalt.NewRaftNode(*id, strings.Split(*peers, ","), *join, getSnapshot, proposeC, confChangeC)
+	var opts []basalt.RaftNodeOption
+	if !peerTLS.Empty() {
+		for _, peer := range peers {
+			if !strings.HasPrefix(peer, "https://") {
+				log.Fatalf("peer %s must use https with -peer-tls-cert", peer)
+			}
+		}
+		opts = append(opts, basalt.WithPeerTLS(peerTLS))
+	}
+	raftNode, commitC, errorC, snapshotterReady := basalt.NewRaftGroupNode(group, *id, peers, *join, getSnapshot, proposeC, confChangeC, opts...)
 
-	raftServer = basalt.NewRaftServer(srv, <-snapshotterReady, confChangeC, proposeC, commitC, errorC)
+	raftServer = basalt.NewRaftServer(srv, raftNode, <-snapshotterReady, confChangeC, proposeC, commitC, errorC)
 
-	// set confchange handler
-	srv.SetConfChangeCallback(raftServer)
+	raftServer.SetLeaderMode(mode)
+	raftServer.SetBatchOptions(basalt.BatchOptions{MaxBytes: *batchBytes, MaxDelay: *batchDelay})
+	if forwardTLS != nil {
+		raftServer.SetForwardTLSConfig(forwardTLS)
+	}
+	raftServer.SetForwardToken(*forwardToken)
+	if peerAddrs != "" {
+		raftServer.SetPeerAddrs(strings.Split(peerAddrs, ","))
+	}
+	return srv, raftServer
+}
 
-	if err := srv.Serve(); err != nil {
-		log.Fatalf("failed to start basalt services:%v", err)
+// hostedGroups returns IDs of raft groups hosted by this process, all groups in the routing table if -groups is not set.
+func hostedGroups(rt *basalt.RoutingTable) []uint64 {
+	var ids []uint64
+	if *groups == "" {
+		for _, g := range rt.Groups {
+			ids = append(ids, g.ID)
+		}
+		return ids
+	}
+	for _, s := range strings.Split(*groups, ",") {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			log.Fatalf("wrong raft group %s: %v", s, err)
+		}
+		ids = append(ids, id)
 	}
-	srv.Close()
+	return ids
 }
@@ -22,20 +22,20 @@ func main() {
 
 	var ok bool
 
-	xclient.Call(context.Background(), "Add", &basalt.BitmapValueRequest{"test1", 1}, &ok)
-	xclient.Call(context.Background(), "AddMany", &basalt.BitmapValuesRequest{"test1", []uint32{2, 3, 10, 11}}, &ok)
+	xclient.Call(context.Background(), "Add", &basalt.BitmapValueRequest{Name: "test1", Value: 1}, &ok)
+	xclient.Call(context.Background(), "AddMany", &basalt.BitmapValuesRequest{Name: "test1", Values: []uint32{2, 3, 10, 11}}, &ok)
 
-	xclient.Call(context.Background(), "Add", &basalt.BitmapValueRequest{"test2", 1}, &ok)
-	xclient.Call(context.Background(), "AddMany", &basalt.BitmapValuesRequest{"test2", []uint32{2, 3, 20, 21}}, &ok)
+	xclient.Call(context.Background(), "Add", &basalt.BitmapValueRequest{Name: "test2", Value: 1}, &ok)
+	xclient.Call(context.Background(), "AddMany", &basalt.BitmapValuesRequest{Name: "test2", Values: []uint32{2, 3, 20, 21}}, &ok)
 
 	var exist bool
-	xclient.Call(context.Background(), "Exists", &basalt.BitmapValueRequest{"test1", 10}, &exist)
+	xclient.Call(context.Background(), "Exists", &basalt.BitmapValueRequest{Name: "test1", Value: 10}, &exist)
 	if !exist {
 		log.Fatalf("10 not found")
 	}
 
-	xclient.Call(context.Background(), "DiffStore", &basalt.BitmapDstAndPairRequest{"test3", "test1", "test2"}, &ok)
-	xclient.Call(context.Background(), "Exists", &basalt.BitmapValueRequest{"test3", 10}, &exist)
+	xclient.Call(context.Background(), "DiffStore", &basalt.BitmapDstAndPairRequest{Destination: "test3", Name1: "test1", Name2: "test2"}, &ok)
+	xclient.Call(context.Background(), "Exists", &basalt.BitmapValueRequest{Name: "test3", Value: 10}, &exist)
 	if !exist {
 		log.Fatalf("10 not found")
 	}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/rpcxio/basalt"
 )
@@ -11,6 +14,18 @@ import (
 var (
 	addr     = flag.String("addr", ":8972", "the listened address")
 	dataFile = flag.String("data", "bitmaps.bdb", "the persisted file")
+
+	frozenDir          = flag.String("frozen-dir", "", "the directory of memory-mapped frozen bitmaps, <data>.frozen if not set")
+	refuseFrozenWrites = flag.Bool("refuse-frozen-writes", false, "refuse writes to frozen bitmaps instead of thawing them")
+
+	tlsCert       = flag.String("tls-cert", "", "the certificate file to serve clients over TLS")
+	tlsKey        = flag.String("tls-key", "", "the key file of -tls-cert")
+	tlsCA         = flag.String("tls-ca", "", "the CA file to verify client certificates")
+	tlsClientAuth = flag.Bool("tls-client-auth", false, "require client certificates")
+
+	aclFile = flag.String("acl", "", "the users and their permissions in JSON, clients are not authenticated if not set")
+
+	notifyKeyspaceEvents = flag.String("notify-keyspace-events", "", "classes of keyspace notifications published to redis subscribers, like KEA, disabled if empty")
 )
 
 func main() {
@@ -25,8 +40,32 @@ func main() {
 	}
 
 	bitmaps := basalt.NewBitmaps()
+	if *frozenDir == "" {
+		*frozenDir = *dataFile + ".frozen"
+	}
+	if err := bitmaps.SetFrozenDir(*frozenDir); err != nil {
+		log.Fatalf("failed to set frozen dir %s: %v", *frozenDir, err)
+	}
+	bitmaps.SetRefuseFrozenWrites(*refuseFrozenWrites)
 
 	srv := basalt.NewServer(*addr, bitmaps, nil, *dataFile)
+	if tlsOpts := (basalt.TLSOptions{CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA, ClientCertAuth: *tlsClientAuth}); !tlsOpts.Empty() {
+		cfg, err := tlsOpts.ServerConfig()
+		if err != nil {
+			log.Fatalf("failed to load TLS certificate: %v", err)
+		}
+		srv.SetTLSConfig(cfg)
+	}
+	if *aclFile != "" {
+		acl, err := basalt.LoadACL(*aclFile)
+		if err != nil {
+			log.Fatalf("failed to load ACL %s: %v", *aclFile, err)
+		}
+		srv.SetACL(acl)
+	}
+	if err := srv.SetNotifyKeyspaceEvents(*notifyKeyspaceEvents); err != nil {
+		log.Fatalf("wrong keyspace events %s: %v", *notifyKeyspaceEvents, err)
+	}
 	err := srv.Restore()
 	if err != nil {
 		log.Fatalf("failed to start basalt services:%v", err)
@@ -34,8 +73,22 @@ func main() {
 		log.Printf("succeeded to restore bitmaps from %s", *dataFile)
 	}
 
-	if err := srv.Serve(); err != nil {
-		log.Fatalf("failed to start basalt services:%v", err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigc
+		log.Printf("received %v, shutting down", sig)
+		cancel()
+	}()
+
+	if err := srv.Serve(ctx); err != nil {
+		log.Printf("basalt services stopped: %v", err)
+	}
+
+	if err := srv.Save(); err != nil {
+		log.Fatalf("failed to save bitmaps to %s: %v", *dataFile, err)
 	}
-	srv.Close()
+	log.Printf("succeeded to save bitmaps to %s", *dataFile)
 }
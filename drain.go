@@ -0,0 +1,199 @@
+package basalt
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// drainTimeout is the timeout of drains requested by clients and of shutdowns after the serving context is done.
+	drainTimeout = 30 * time.Second
+	// drainPollInterval is the interval to check whether in-flight redis commands are finished.
+	drainPollInterval = 10 * time.Millisecond
+)
+
+// Drain shuts down the server gracefully. It transfers leadership away if this node is the leader,
+// stops accepting new connections, waits for in-flight requests until ctx is done and then makes Serve return.
+func (s *Server) Drain(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return ErrDraining
+	}
+	defer s.closeDrained()
+
+	for _, r := range s.rafts() {
+		if !r.isLeader() {
+			continue
+		}
+		if err := r.TransferLeadership(ctx, 0); err != nil {
+			log.Printf("failed to transfer leadership of raft group %d before draining: %v", r.node.group, err)
+		}
+	}
+
+	return s.shutdown(ctx)
+}
+
+// rafts returns the raft servers of this server, or of hosted raft groups if it is sharded.
+func (s *Server) rafts() []*RaftServer {
+	var rafts []*RaftServer
+	if s.raft != nil {
+		rafts = append(rafts, s.raft)
+	}
+	for _, id := range s.Groups() {
+		if r := s.groups[id].raft; r != nil {
+			rafts = append(rafts, r)
+		}
+	}
+	return rafts
+}
+
+// Shutdown stops accepting new connections, waits for in-flight requests until ctx is done
+// and then makes Serve return. Unlike Drain, it does not transfer leadership.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return ErrDraining
+	}
+	defer s.closeDrained()
+
+	return s.shutdown(ctx)
+}
+
+// Close closes the listener and all connections immediately, in-flight requests are interrupted.
+func (s *Server) Close() error {
+	atomic.StoreInt32(&s.draining, 1)
+	defer s.closeDrained()
+
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	if !s.waitStarted() {
+		return nil
+	}
+
+	s.rpcxServer.Close()
+	s.httpService.Close()
+	s.redisServer.Close()
+	s.pubsub.close()
+	return nil
+}
+
+// shutdown closes the listener and shuts down services in parallel.
+func (s *Server) shutdown(ctx context.Context) error {
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	if !s.waitStarted() {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		errs[0] = s.rpcxServer.Shutdown(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = s.httpService.Shutdown(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[2] = s.waitRedisCommands(ctx)
+		s.redisServer.Close()
+		s.pubsub.close()
+	}()
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitStarted waits until all services are accepting connections, so they can be shut down safely.
+// It returns false if the server is not serving.
+func (s *Server) waitStarted() bool {
+	if atomic.LoadInt32(&s.serving) == 0 {
+		return false
+	}
+	<-s.started
+	return true
+}
+
+func (s *Server) closeDrained() {
+	s.drainedOnce.Do(func() { close(s.drained) })
+}
+
+// startDrain drains the server in background, it is used by drains requested by clients.
+func (s *Server) startDrain() error {
+	if s.isDraining() {
+		return ErrDraining
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := s.Drain(ctx); err != nil {
+			log.Printf("failed to drain: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// waitRedisCommands waits until in-flight redis commands are finished or ctx is done.
+func (s *Server) waitRedisCommands(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&s.redisInflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// drainListener blocks Accept after the underlying listener fails until it is closed,
+// so the redis server does not spin on accept errors while in-flight commands are finishing.
+type drainListener struct {
+	net.Listener
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *drainListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.closed
+	}
+	return conn, err
+}
+
+func (l *drainListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// startedListener marks a service as started when it accepts connections for the first time.
+type startedListener struct {
+	net.Listener
+	once    sync.Once
+	started *sync.WaitGroup
+}
+
+func (l *startedListener) Accept() (net.Conn, error) {
+	l.once.Do(l.started.Done)
+	return l.Listener.Accept()
+}
@@ -0,0 +1,119 @@
+package basalt
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServer_Drain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	s := NewServer(addr, NewBitmaps(), nil, "")
+	s.ln = ln
+	errc := make(chan error, 1)
+	go func() { errc <- s.configListener(context.Background(), ln) }()
+
+	resp, err := http.Post("http://"+addr+"/add/test/1", "", nil)
+	if err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	resp.Body.Close()
+
+	// a redis connection is open and idle while draining.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "+PONG\r\n" {
+		t.Fatalf("failed to ping: %q, %v", buf[:n], err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Drain(ctx); err != nil {
+		t.Fatalf("failed to drain: %v", err)
+	}
+	if err := s.Drain(ctx); err != ErrDraining {
+		t.Fatalf("expect ErrDraining but got %v", err)
+	}
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("expect Serve to return nil but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve does not return after draining")
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("expect new connections to be refused")
+	}
+	if s.bitmaps.Card("test") != 1 {
+		t.Fatal("expect the write before draining to be applied")
+	}
+}
+
+func TestServer_ServeContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	s := NewServer(addr, NewBitmaps(), nil, "")
+	s.ln = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- s.configListener(ctx, ln) }()
+
+	resp, err := http.Post("http://"+addr+"/add/test/1", "", nil)
+	if err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	resp.Body.Close()
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("expect Serve to return nil but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve does not return after the context is done")
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("expect new connections to be refused")
+	}
+	if err := s.Shutdown(context.Background()); err != ErrDraining {
+		t.Fatalf("expect ErrDraining but got %v", err)
+	}
+}
+
+func TestRaftServer_ExpireProposals(t *testing.T) {
+	s := &RaftServer{bmServer: NewServer("", NewBitmaps(), nil, ""), pending: map[uint64]uint64{1: 1, 2: 2, 3: 3}}
+	commitC := make(chan *Commit, 2)
+	errorC := make(chan error)
+	// the empty entry of the leader of term 3 expires proposals dropped by the leaders of terms 1 and 2
+	commitC <- &Commit{Index: 10, Term: 3}
+	close(commitC)
+	close(errorC)
+	s.readCommits(commitC, errorC, false)
+
+	if n := s.pendingProposals(); n != 1 || s.pending[3] != 3 {
+		t.Errorf("expect only the proposal of term 3 pending but got %v", s.pending)
+	}
+}
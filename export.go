@@ -0,0 +1,375 @@
+package basalt
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Format is the portable format used to export and import bitmaps.
+type Format string
+
+// Supported portable formats.
+const (
+	// FormatRoaring is the standard portable roaring serialization, one bitmap per file.
+	FormatRoaring Format = "roaring"
+	// FormatInts is newline-delimited integers, one bitmap per file.
+	FormatInts Format = "ints"
+	// FormatCSV is `name,value` lines.
+	FormatCSV Format = "csv"
+	// FormatJSON is an object of `"name": [values...]`.
+	FormatJSON Format = "json"
+)
+
+// Errors for export and import.
+var (
+	ErrUnknownFormat      = errors.New("unknown format")
+	ErrSingleBitmap       = errors.New("format supports exactly one bitmap")
+	ErrBitmapNotFound     = errors.New("bitmap not found")
+	ErrBitmapNameRequired = errors.New("bitmap name is required")
+	ErrBitmapNameNotUsed  = errors.New("format names its bitmaps, a bitmap name can not be given")
+)
+
+// importBatchSize is the number of values proposed in one AddMany while importing.
+const importBatchSize = 4096
+
+// ParseFormat parses the name of a format.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatRoaring, FormatInts, FormatCSV, FormatJSON:
+		return f, nil
+	case "txt":
+		return FormatInts, nil
+	}
+	return "", ErrUnknownFormat
+}
+
+// SingleBitmap returns whether the format holds only one bitmap.
+func (f Format) SingleBitmap() bool {
+	return f == FormatRoaring || f == FormatInts
+}
+
+// Export writes the named bitmaps to w in the given format.
+// All bitmaps are exported if names is empty.
+func (bs *Bitmaps) Export(w io.Writer, format Format, names ...string) error {
+	if len(names) == 0 {
+		for _, name := range bs.Keys() {
+			// migrated bitmaps are exported by their new raft groups
+			if _, movedTo := bs.migration(name); movedTo == 0 {
+				names = append(names, name)
+			}
+		}
+	}
+	if format.SingleBitmap() && len(names) != 1 {
+		return ErrSingleBitmap
+	}
+
+	bw := bufio.NewWriter(w)
+	var err error
+	switch format {
+	case FormatRoaring:
+		err = bs.exportRoaring(bw, names[0])
+	case FormatInts:
+		err = bs.exportInts(bw, names[0])
+	case FormatCSV:
+		err = bs.exportCSV(bw, names)
+	case FormatJSON:
+		err = bs.exportJSON(bw, names)
+	default:
+		err = ErrUnknownFormat
+	}
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func (bs *Bitmaps) exportRoaring(w io.Writer, name string) error {
+	bm := bs.Clone(name)
+	if bm == nil {
+		return ErrBitmapNotFound
+	}
+
+	_, err := bm.WriteTo(w)
+	return err
+}
+
+func (bs *Bitmaps) exportInts(w *bufio.Writer, name string) error {
+	bm := bs.Clone(name)
+	if bm == nil {
+		return ErrBitmapNotFound
+	}
+
+	var buf []byte
+	it := bm.Iterator()
+	for it.HasNext() {
+		buf = strconv.AppendUint(buf[:0], uint64(it.Next()), 10)
+		buf = append(buf, '\n')
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs *Bitmaps) exportCSV(w io.Writer, names []string) error {
+	cw := csv.NewWriter(w)
+	for _, name := range names {
+		bm := bs.Clone(name)
+		if bm == nil {
+			continue
+		}
+
+		it := bm.Iterator()
+		for it.HasNext() {
+			if err := cw.Write([]string{name, strconv.FormatUint(uint64(it.Next()), 10)}); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportJSON streams `{"name":[v1,v2,...],...}` without building the whole document in memory.
+func (bs *Bitmaps) exportJSON(w *bufio.Writer, names []string) error {
+	w.WriteByte('{')
+	first := true
+	for _, name := range names {
+		bm := bs.Clone(name)
+		if bm == nil {
+			continue
+		}
+
+		if !first {
+			w.WriteByte(',')
+		}
+		first = false
+
+		key, err := json.Marshal(name)
+		if err != nil {
+			return err
+		}
+		w.Write(key)
+		w.WriteString(":[")
+
+		var buf []byte
+		it := bm.Iterator()
+		for i := 0; it.HasNext(); i++ {
+			buf = buf[:0]
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = strconv.AppendUint(buf, uint64(it.Next()), 10)
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+		}
+		w.WriteByte(']')
+	}
+	_, err := w.WriteString("}\n")
+	return err
+}
+
+// Import reads bitmaps in the given format from r and adds their values.
+// name is required by single bitmap formats and ignored by others.
+// If callback is true values are proposed through the write callback,
+// so imports on a cluster node are replicated.
+func (bs *Bitmaps) Import(r io.Reader, format Format, name string, callback bool) (uint64, error) {
+	if format.SingleBitmap() && name == "" {
+		return 0, ErrBitmapNameRequired
+	}
+	// names in the input would be written instead of name, bypassing checks of name by callers
+	if !format.SingleBitmap() && name != "" {
+		return 0, ErrBitmapNameNotUsed
+	}
+
+	switch format {
+	case FormatRoaring:
+		return bs.importRoaring(r, name, callback)
+	case FormatInts:
+		return bs.importInts(r, name, callback)
+	case FormatCSV:
+		return bs.importCSV(r, callback)
+	case FormatJSON:
+		return bs.importJSON(r, callback)
+	}
+	return 0, ErrUnknownFormat
+}
+
+func (bs *Bitmaps) importRoaring(r io.Reader, name string, callback bool) (uint64, error) {
+	bm := roaring.NewBitmap()
+	if _, err := bm.ReadFrom(r); err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	buf := make([]uint32, importBatchSize)
+	it := bm.ManyIterator()
+	for {
+		c := it.NextMany(buf)
+		if c == 0 {
+			break
+		}
+		if err := bs.AddMany(name, append([]uint32(nil), buf[:c]...), callback); err != nil {
+			return n, err
+		}
+		n += uint64(c)
+	}
+
+	return n, nil
+}
+
+func (bs *Bitmaps) importInts(r io.Reader, name string, callback bool) (uint64, error) {
+	var n uint64
+	var batch []uint32
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		v, err := str2uint32(text)
+		if err != nil {
+			return n, fmt.Errorf("line %d: %v", line, err)
+		}
+		batch = append(batch, v)
+		if len(batch) == importBatchSize {
+			if err := bs.AddMany(name, batch, callback); err != nil {
+				return n, err
+			}
+			n += uint64(len(batch))
+			batch = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return n, err
+	}
+
+	if len(batch) > 0 {
+		if err := bs.AddMany(name, batch, callback); err != nil {
+			return n, err
+		}
+		n += uint64(len(batch))
+	}
+	return n, nil
+}
+
+func (bs *Bitmaps) importCSV(r io.Reader, callback bool) (uint64, error) {
+	var n uint64
+	batches := make(map[string][]uint32)
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.ReuseRecord = true
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		v, err := str2uint32(strings.TrimSpace(record[1]))
+		if err != nil {
+			return n, fmt.Errorf("record %d: %v", line, err)
+		}
+
+		name := record[0]
+		batches[name] = append(batches[name], v)
+		if len(batches[name]) == importBatchSize {
+			if err := bs.AddMany(name, batches[name], callback); err != nil {
+				return n, err
+			}
+			n += importBatchSize
+			delete(batches, name)
+		}
+	}
+
+	for name, batch := range batches {
+		if err := bs.AddMany(name, batch, callback); err != nil {
+			return n, err
+		}
+		n += uint64(len(batch))
+	}
+	return n, nil
+}
+
+// importJSON streams `{"name":[v1,v2,...],...}` bitmap by bitmap, without decoding the whole document in memory.
+func (bs *Bitmaps) importJSON(r io.Reader, callback bool) (uint64, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return n, err
+		}
+		name, ok := t.(string)
+		if !ok {
+			return n, fmt.Errorf("expect a bitmap name but got %v", t)
+		}
+
+		t, err = dec.Token()
+		if err != nil {
+			return n, err
+		}
+		if t == nil { // null is a bitmap without values
+			continue
+		}
+		if d, ok := t.(json.Delim); !ok || d != '[' {
+			return n, fmt.Errorf("expect values of %s but got %v", name, t)
+		}
+
+		var batch []uint32
+		for dec.More() {
+			var v uint32
+			if err := dec.Decode(&v); err != nil {
+				return n, fmt.Errorf("values of %s: %v", name, err)
+			}
+			batch = append(batch, v)
+			if len(batch) == importBatchSize {
+				if err := bs.AddMany(name, batch, callback); err != nil {
+					return n, err
+				}
+				n += uint64(len(batch))
+				batch = nil
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return n, err
+		}
+		if len(batch) > 0 {
+			if err := bs.AddMany(name, batch, callback); err != nil {
+				return n, err
+			}
+			n += uint64(len(batch))
+		}
+	}
+	return n, expectDelim(dec, '}')
+}
+
+// expectDelim reads the next token, which must be the delimiter.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expect %v but got %v", delim, t)
+	}
+	return nil
+}
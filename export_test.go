@@ -0,0 +1,117 @@
+package basalt
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBitmaps_ExportImport(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11}, false)
+	bms.AddMany("test2", []uint32{1, 2, 3, 20, 21, 1 << 31}, false)
+
+	for _, format := range []Format{FormatCSV, FormatJSON} {
+		var buf bytes.Buffer
+		if err := bms.Export(&buf, format); err != nil {
+			t.Fatalf("failed to export %s: %v", format, err)
+		}
+
+		restored := NewBitmaps()
+		n, err := restored.Import(&buf, format, "", false)
+		if err != nil {
+			t.Fatalf("failed to import %s: %v", format, err)
+		}
+		if n != 11 {
+			t.Errorf("%s: expect 11 values imported but got %d", format, n)
+		}
+
+		for _, name := range []string{"test1", "test2"} {
+			if restored.Card(name) != bms.Card(name) {
+				t.Errorf("%s: expect %d values in %s but got %d", format, bms.Card(name), name, restored.Card(name))
+			}
+		}
+		if !restored.Exists("test2", 1<<31) {
+			t.Errorf("%s: not found %d in imported bitmap test2", format, 1<<31)
+		}
+	}
+
+	for _, format := range []Format{FormatRoaring, FormatInts} {
+		var buf bytes.Buffer
+		if err := bms.Export(&buf, format); err != ErrSingleBitmap {
+			t.Errorf("%s: expect ErrSingleBitmap but got %v", format, err)
+		}
+		if err := bms.Export(&buf, format, "test2"); err != nil {
+			t.Fatalf("failed to export %s: %v", format, err)
+		}
+
+		restored := NewBitmaps()
+		if _, err := restored.Import(bytes.NewReader(buf.Bytes()), format, "", false); err != ErrBitmapNameRequired {
+			t.Errorf("%s: expect ErrBitmapNameRequired but got %v", format, err)
+		}
+		if _, err := restored.Import(&buf, format, "copy", false); err != nil {
+			t.Fatalf("failed to import %s: %v", format, err)
+		}
+
+		result := restored.Diff("copy", "none")
+		if len(result) != 6 || result[0] != 1 || result[3] != 20 || result[5] != 1<<31 {
+			t.Fatalf("%s: expect 1,2,3,20,21,%d but got %v", format, uint32(1<<31), result)
+		}
+	}
+}
+
+func TestBitmaps_ImportReplicated(t *testing.T) {
+	leader := NewBitmaps()
+	var ops []operaton
+	leader.writeCallback = func(op OP, value string) error {
+		ops = append(ops, operaton{OP: op, Val: value})
+		return nil
+	}
+	if _, err := leader.Import(strings.NewReader(`{"test":[1,2,1000000]}`), FormatJSON, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].OP != BmOpAddMany {
+		t.Fatalf("expect an AddMany proposed but got %+v", ops)
+	}
+
+	// replicas apply the proposed AddMany
+	replica := NewServer("", NewBitmaps(), nil, "")
+	rs := &RaftServer{bmServer: replica, migrations: make(map[string]*migration)}
+	rs.processOP(ops[0])
+	if result := replica.bitmaps.Union("test"); len(result) != 3 || result[2] != 1000000 {
+		t.Errorf("expect 1,2,1000000 applied but got %v", result)
+	}
+}
+
+func TestBitmaps_ImportJSON(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString(`{"big":[`)
+	for i := 0; i < importBatchSize+10; i++ {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.Itoa(i))
+	}
+	sb.WriteString(`], "empty": [], "null": null, "small": [7]}`)
+
+	for _, c := range []struct {
+		input string
+		n     uint64
+		err   bool
+	}{
+		{sb.String(), importBatchSize + 11, false},
+		{`{}`, 0, false},
+		{`[1,2]`, 0, true},
+		{`{"a":1}`, 0, true},
+		{`{"a":[1,-2]}`, 0, true},
+		{`{"a":[1,2],"b":[4294967296]}`, 2, true},
+		{`{"a":[1,2]`, 2, true},
+	} {
+		bms := NewBitmaps()
+		n, err := bms.Import(strings.NewReader(c.input), FormatJSON, "", false)
+		if n != c.n || (err != nil) != c.err {
+			t.Errorf("%.20s: expect %d values imported and error %v but got %d and %v", c.input, c.n, c.err, n, err)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package basalt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/smallnest/log"
+)
+
+// ErrBitmapFrozen is returned when writing a frozen bitmap while frozen writes are refused.
+var ErrBitmapFrozen = errors.New("bitmap is frozen")
+
+// frozenFile is a file of a bitmap in portable serialization, mapped into memory. The file is removed
+// once it is mapped.
+type frozenFile struct {
+	path string
+	data []byte
+}
+
+// SetFrozenDir sets the directory of files mapped by frozen bitmaps. A file is removed once it is mapped,
+// the mapping keeps its data until the bitmap is thawed or removed, so files are not left in the directory
+// and other files in it are not touched. Frozen bitmaps are mapped again when they are read.
+// It must be invoked before bitmaps are read. Frozen bitmaps are kept on heap if it is not set.
+func (bs *Bitmaps) SetFrozenDir(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	bs.frozenDir = dir
+	return nil
+}
+
+// SetRefuseFrozenWrites sets whether writes to frozen bitmaps are refused with ErrBitmapFrozen.
+// Otherwise a write thaws the bitmap first.
+func (bs *Bitmaps) SetRefuseFrozenWrites(refuse bool) {
+	bs.refuseFrozenWrites = refuse
+}
+
+// checkWritable checks whether the named bitmap accepts writes from clients.
+func (bs *Bitmaps) checkWritable(name string) error {
+	if !bs.refuseFrozenWrites {
+		return nil
+	}
+
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return nil
+	}
+
+	bm.mu.RLock()
+	frozen := bm.meta.Frozen
+	bm.mu.RUnlock()
+	if frozen {
+		return ErrBitmapFrozen
+	}
+	return nil
+}
+
+// Freeze makes the named bitmap read-only and backed by a memory-mapped file,
+// so it does not occupy heap and is not copied when bitmaps are saved.
+// Reads and set operations work on the mapped data directly.
+func (bs *Bitmaps) Freeze(name string, callback bool) error {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return ErrBitmapNotFound
+	}
+
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(BmOpFreeze, name)
+	}
+
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if bm.meta.Frozen {
+		return nil
+	}
+	bm.meta.Frozen = true
+	bs.mapFrozen(name, bm)
+	return nil
+}
+
+// Thaw makes the named bitmap writable and moves it back to heap.
+func (bs *Bitmaps) Thaw(name string, callback bool) error {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return ErrBitmapNotFound
+	}
+
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(BmOpThaw, name)
+	}
+
+	bm.mu.Lock()
+	bm.thaw()
+	bm.mu.Unlock()
+	return nil
+}
+
+// mapFrozen writes a frozen bitmap to a file in frozenDir and replaces it with the mapped file.
+// The bitmap stays on heap if it fails, it is still frozen but not mapped.
+// The caller must hold the lock of bm or be the only one accessing it.
+func (bs *Bitmaps) mapFrozen(name string, bm *Bitmap) {
+	if bs.frozenDir == "" || bm.frozen != nil {
+		return
+	}
+	bs.mapFrozenFrom(name, bm, bm.bitmap)
+}
+
+// mapFrozenData maps the serialized frozen bitmap read by a RecordReader without decoding it on heap.
+// The bitmap is decoded on heap if it fails.
+func (bs *Bitmaps) mapFrozenData(name string, bm *Bitmap, data []byte) error {
+	if bs.frozenDir != "" && bs.mapFrozenFrom(name, bm, bytes.NewReader(data)) {
+		return nil
+	}
+	bm.bitmap = roaring.NewBitmap()
+	_, err := bm.bitmap.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+// mapFrozenFrom writes the serialized bitmap from src to a file in frozenDir and maps it as bm.
+func (bs *Bitmaps) mapFrozenFrom(name string, bm *Bitmap, src io.WriterTo) bool {
+	f, err := writeFrozenFile(bs.frozenDir, name, src)
+	if err != nil {
+		log.Errorf("failed to map frozen bitmap %s: %v", name, err)
+		return false
+	}
+
+	rb := roaring.NewBitmap()
+	if _, err := rb.FromBuffer(f.data); err != nil {
+		log.Errorf("failed to map frozen bitmap %s: %v", name, err)
+		f.close()
+		return false
+	}
+
+	bm.bitmap = rb
+	bm.frozen = f
+	return true
+}
+
+func writeFrozenFile(dir, name string, src io.WriterTo) (*frozenFile, error) {
+	file, err := ioutil.TempFile(dir, url.PathEscape(name)+"-*.roaring")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = src.WriteTo(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	data, err := mmapFile(file)
+	file.Close()
+	os.Remove(file.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	return &frozenFile{path: file.Name(), data: data}, nil
+}
+
+// readSerialized reads a bitmap in the portable format of roaring without decoding it, only its headers are
+// parsed to know its size.
+func readSerialized(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	read := func(n int) ([]byte, error) {
+		start := buf.Len()
+		if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return buf.Bytes()[start:], nil
+	}
+
+	b, err := read(4)
+	if err != nil {
+		return nil, err
+	}
+	cookie := binary.LittleEndian.Uint32(b)
+	var size int
+	var isRun []byte
+	switch {
+	case cookie&0xFFFF == serialCookie:
+		size = int(cookie>>16) + 1
+		if isRun, err = read((size + 7) / 8); err != nil {
+			return nil, err
+		}
+		isRun = append([]byte(nil), isRun...)
+	case cookie == serialCookieNoRunContainer:
+		if b, err = read(4); err != nil {
+			return nil, err
+		}
+		size = int(binary.LittleEndian.Uint32(b))
+		if size > 1<<16 {
+			return nil, ErrCorruptedRecord
+		}
+	default:
+		return nil, ErrCorruptedRecord
+	}
+
+	header, err := read(4 * size)
+	if err != nil {
+		return nil, err
+	}
+	cards := make([]int, size)
+	for i := range cards {
+		cards[i] = int(binary.LittleEndian.Uint16(header[4*i+2:])) + 1
+	}
+	if isRun == nil || size >= noOffsetThreshold {
+		if _, err := read(4 * size); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, card := range cards {
+		var n int
+		switch {
+		case isRun != nil && isRun[i/8]&(1<<(i%8)) != 0:
+			if b, err = read(2); err != nil {
+				return nil, err
+			}
+			n = 4 * int(binary.LittleEndian.Uint16(b))
+		case card > arrayMaxSize:
+			n = 8192
+		default:
+			n = 2 * card
+		}
+		if _, err := read(n); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// constants of the portable format of roaring
+const (
+	serialCookieNoRunContainer = 12346 // only arrays and bitmaps
+	serialCookie               = 12347 // runs, arrays, and bitmaps
+	noOffsetThreshold          = 4     // offsets of containers are omitted in bitmaps with runs and fewer containers
+	arrayMaxSize               = 4096  // containers with more values are bitmaps
+)
+
+// close unmaps the file.
+func (f *frozenFile) close() {
+	if err := munmap(f.data); err != nil {
+		log.Errorf("failed to unmap %s: %v", f.path, err)
+	}
+}
+
+// thaw moves a frozen bitmap back to heap. The caller must hold the write lock of bm.
+func (bm *Bitmap) thaw() {
+	if !bm.meta.Frozen {
+		return
+	}
+
+	if bm.frozen != nil {
+		bm.bitmap = detach(bm.bitmap.Clone())
+		bm.frozen.close()
+		bm.frozen = nil
+	}
+	bm.meta.Frozen = false
+}
+
+// release releases the mapped file of a bitmap removed from Bitmaps.
+func (bm *Bitmap) release() {
+	if bm == nil {
+		return
+	}
+
+	bm.mu.Lock()
+	if bm.frozen != nil {
+		bm.bitmap = roaring.NewBitmap()
+		bm.frozen.close()
+		bm.frozen = nil
+	}
+	bm.mu.Unlock()
+}
@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package basalt
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// mmapFile reads the file into memory on platforms without mmap support.
+func mmapFile(f *os.File) ([]byte, error) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,148 @@
+package basalt
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+func TestBitmaps_Freeze(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basalt-frozen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bms := NewBitmaps()
+	if err := bms.SetFrozenDir(dir); err != nil {
+		t.Fatalf("failed to set frozen dir: %v", err)
+	}
+	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11}, false)
+	bms.AddMany("test2", []uint32{1, 2, 3, 20, 21}, false)
+
+	if err := bms.Freeze("test1", false); err != nil {
+		t.Fatalf("failed to freeze test1: %v", err)
+	}
+	if err := bms.Freeze("test3", false); err != ErrBitmapNotFound {
+		t.Fatalf("expect ErrBitmapNotFound but got %v", err)
+	}
+	// mapped files are removed once they are mapped, other files are kept
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.roaring")); len(files) != 0 {
+		t.Fatalf("expect no mapped files left but got %d", len(files))
+	}
+	other := filepath.Join(dir, "other.roaring")
+	if err := ioutil.WriteFile(other, []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewBitmaps().SetFrozenDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("expect files of others kept but got %v", err)
+	}
+	os.Remove(other)
+
+	if !bms.Exists("test1", 10) || bms.Card("test1") != 5 {
+		t.Fatalf("failed to read frozen bitmap")
+	}
+	bms.InterStore("test3", "test1", "test2")
+	if rt := bms.Union("test1", "test3"); !reflect.DeepEqual(rt, []uint32{1, 2, 3, 10, 11}) {
+		t.Fatalf("expect [1 2 3 10 11] but got %v", rt)
+	}
+
+	// saved frozen bitmaps are mapped again when they are read.
+	var buf bytes.Buffer
+	if err := bms.Save(&buf); err != nil {
+		t.Fatalf("failed to save Bitmaps: %v", err)
+	}
+	restored := NewBitmaps()
+	if err := restored.SetFrozenDir(dir); err != nil {
+		t.Fatalf("failed to set frozen dir: %v", err)
+	}
+	if err := restored.Read(&buf); err != nil {
+		t.Fatalf("failed to read Bitmaps: %v", err)
+	}
+	if meta, _ := restored.Metadata("test1"); !meta.Frozen || restored.bitmaps["test1"].frozen == nil {
+		t.Fatalf("expect test1 to be frozen and mapped")
+	}
+	if rt := restored.Inter("test1", "test2"); !reflect.DeepEqual(rt, []uint32{1, 2, 3}) {
+		t.Fatalf("expect [1 2 3] but got %v", rt)
+	}
+
+	// writes are refused by policy, or thaw the bitmap.
+	bms.SetRefuseFrozenWrites(true)
+	if err := bms.Add("test1", 100, true); err != ErrBitmapFrozen {
+		t.Fatalf("expect ErrBitmapFrozen but got %v", err)
+	}
+	bms.SetRefuseFrozenWrites(false)
+	if err := bms.Add("test1", 100, true); err != nil {
+		t.Fatalf("failed to add to frozen bitmap: %v", err)
+	}
+	if meta, _ := bms.Metadata("test1"); meta.Frozen {
+		t.Fatalf("expect test1 to be thawed")
+	}
+	if !bms.Exists("test1", 100) || bms.Card("test1") != 6 {
+		t.Fatalf("failed to write thawed bitmap")
+	}
+
+	bms.Freeze("test2", false)
+	bms.RemoveBitmap("test2", false)
+	restored.RemoveBitmap("test1", false)
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.roaring")); len(files) != 0 {
+		t.Fatalf("expect no mapped files left but got %v", files)
+	}
+}
+
+func TestReadSerialized(t *testing.T) {
+	many := roaring.New()
+	many.AddRange(0, 10000) // a bitmap container
+	for i := uint32(1); i < 10; i++ {
+		many.Add(i << 16) // containers with offsets
+	}
+	runs := roaring.New()
+	runs.AddRange(100, 200)
+	runs.AddRange(1<<16, 1<<16+3000)
+	runs.RunOptimize()
+	many2 := many.Clone()
+	many2.RunOptimize()
+
+	for _, c := range []struct {
+		name string
+		bm   *roaring.Bitmap
+	}{
+		{"empty", roaring.New()},
+		{"array", roaring.BitmapOf(1, 2, 3, 1<<20)},
+		{"containers", many},
+		{"runs", runs},
+		{"runs with offsets", many2},
+	} {
+		var buf bytes.Buffer
+		c.bm.WriteTo(&buf)
+		want := buf.Len()
+		buf.WriteString("next record")
+
+		data, err := readSerialized(&buf)
+		if err != nil || len(data) != want {
+			t.Errorf("%s: expect %d bytes read but got %d, %v", c.name, want, len(data), err)
+			continue
+		}
+		if buf.String() != "next record" {
+			t.Errorf("%s: expect the rest left but got %q", c.name, buf.String())
+		}
+		rb := roaring.New()
+		if _, err := rb.FromBuffer(data); err != nil || !rb.Equals(c.bm) {
+			t.Errorf("%s: expect the bitmap read but got %v", c.name, err)
+		}
+
+		// a torn bitmap
+		if _, err := readSerialized(bytes.NewReader(data[:len(data)-1])); len(data) > 8 && err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: expect io.ErrUnexpectedEOF but got %v", c.name, err)
+		}
+	}
+}
@@ -6,6 +6,8 @@ require (
 	github.com/RoaringBitmap/roaring v0.4.21
 	github.com/go-redis/redis v6.15.7+incompatible
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/prometheus/client_golang v1.1.0
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
 	github.com/rpcxio/etcd v0.0.0-20200729120139-f9cde972fd94
 	github.com/smallnest/log v0.0.0-20190128090703-5dc5752d8772
 	github.com/smallnest/rpcx v0.0.0-20200213044823-78d7a4d32e2a
@@ -0,0 +1,332 @@
+package basalt
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// redisVersion is the Redis version reported by INFO, client libraries check it to pick commands they use.
+const redisVersion = "6.0.0"
+
+// infoSections are sections of INFO in order.
+var infoSections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "commandstats", "keyspace"}
+
+// Info returns information and statistics of the server in the format of Redis INFO, sections are separated
+// by blank lines and each field is a `key:value` line. Without sections or with "default", all sections
+// but commandstats are returned, "all" and "everything" return all sections. Unknown sections are ignored.
+func (s *Server) Info(sections ...string) string {
+	selected := make(map[string]bool)
+	for _, section := range sections {
+		section = strings.ToLower(section)
+		switch section {
+		case "all", "everything":
+			for _, name := range infoSections {
+				selected[name] = true
+			}
+		case "default":
+			for _, name := range infoSections {
+				selected[name] = name != "commandstats" || selected[name]
+			}
+		default:
+			selected[section] = true
+		}
+	}
+	if len(sections) == 0 {
+		for _, name := range infoSections {
+			selected[name] = name != "commandstats"
+		}
+	}
+
+	var w infoWriter
+	for _, name := range infoSections {
+		if !selected[name] {
+			continue
+		}
+		w.section(name)
+		switch name {
+		case "server":
+			s.infoServer(&w)
+		case "clients":
+			w.field("connected_clients", atomic.LoadInt64(&s.redisClients))
+		case "memory":
+			s.infoMemory(&w)
+		case "persistence":
+			s.infoPersistence(&w)
+		case "stats":
+			s.infoStats(&w)
+		case "replication":
+			s.infoReplication(&w)
+		case "commandstats":
+			s.infoCommandStats(&w)
+		case "keyspace":
+			s.infoKeyspace(&w)
+		}
+	}
+	return w.String()
+}
+
+// infoWriter writes sections and fields of INFO.
+type infoWriter struct {
+	strings.Builder
+}
+
+func (w *infoWriter) section(name string) {
+	if w.Len() > 0 {
+		w.WriteString("\r\n")
+	}
+	w.WriteString("# " + strings.ToUpper(name[:1]) + name[1:] + "\r\n")
+}
+
+func (w *infoWriter) field(key string, value interface{}) {
+	fmt.Fprintf(w, "%s:%v\r\n", key, value)
+}
+
+func (s *Server) infoServer(w *infoWriter) {
+	mode := "standalone"
+	switch {
+	case s.isSharded():
+		mode = "sharded"
+	case s.raft != nil:
+		mode = "cluster"
+	}
+	port := ""
+	addr := s.addr
+	if s.ln != nil {
+		addr = s.ln.Addr().String()
+	}
+	if _, p, err := net.SplitHostPort(addr); err == nil {
+		port = p
+	}
+	uptime := time.Since(s.startTime)
+
+	w.field("redis_version", redisVersion)
+	w.field("basalt_mode", mode)
+	w.field("os", runtime.GOOS+" "+runtime.GOARCH)
+	w.field("arch_bits", strconv.IntSize)
+	w.field("go_version", runtime.Version())
+	w.field("process_id", os.Getpid())
+	w.field("tcp_port", port)
+	w.field("uptime_in_seconds", int64(uptime/time.Second))
+	w.field("uptime_in_days", int64(uptime/(24*time.Hour)))
+}
+
+func (s *Server) infoMemory(w *infoWriter) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	var u bitmapsUsage
+	var stats Stats
+	for _, bs := range s.allBitmaps() {
+		gu := bs.usage()
+		u.heapBytes += gu.heapBytes
+		u.mappedBytes += gu.mappedBytes
+		stats.add(bs.totalStats())
+	}
+
+	w.field("used_memory", ms.HeapAlloc)
+	w.field("used_memory_human", humanBytes(ms.HeapAlloc))
+	w.field("used_memory_sys", ms.Sys)
+	w.field("used_memory_sys_human", humanBytes(ms.Sys))
+	w.field("used_memory_bitmaps", u.heapBytes)
+	w.field("used_memory_bitmaps_human", humanBytes(u.heapBytes))
+	w.field("used_memory_mapped", u.mappedBytes)
+	w.field("used_memory_mapped_human", humanBytes(u.mappedBytes))
+	w.field("bitmap_values", stats.Cardinality)
+	w.field("containers", stats.Containers)
+	w.field("array_containers", stats.ArrayContainers)
+	w.field("array_container_bytes", stats.ArrayContainerBytes)
+	w.field("bitmap_containers", stats.BitmapContainers)
+	w.field("bitmap_container_bytes", stats.BitmapContainerBytes)
+	w.field("run_containers", stats.RunContainers)
+	w.field("run_container_bytes", stats.RunContainerBytes)
+}
+
+func (s *Server) infoPersistence(w *infoWriter) {
+	s.saveMu.Lock()
+	st := s.lastSave
+	s.saveMu.Unlock()
+
+	// like Redis, the last save is the start time if bitmaps are not saved yet
+	last := st.time
+	if last.IsZero() {
+		last = s.startTime
+	}
+	status, saveTime := "ok", int64(-1)
+	if st.err != nil {
+		status = "err"
+	}
+	if st.saves > 0 {
+		saveTime = int64(st.duration / time.Second)
+	}
+
+	w.field("loading", 0)
+	w.field("rdb_saves", st.saves)
+	w.field("rdb_last_save_time", last.Unix())
+	w.field("rdb_last_bgsave_status", status)
+	w.field("rdb_last_bgsave_time_sec", saveTime)
+}
+
+func (s *Server) infoStats(w *infoWriter) {
+	var calls uint64
+	for _, st := range s.metrics.commandStats(protocolRedis) {
+		calls += st.calls
+	}
+	w.field("total_connections_received", atomic.LoadInt64(&s.redisConns))
+	w.field("total_commands_processed", calls)
+	w.field("pubsub_dropped_events", atomic.LoadUint64(&s.pubsub.dropped))
+}
+
+func (s *Server) infoReplication(w *infoWriter) {
+	if s.isSharded() {
+		ids := s.Groups()
+		w.field("role", "master")
+		w.field("raft_groups", len(ids))
+		for _, id := range ids {
+			g := s.groups[id]
+			if g.raft == nil {
+				continue
+			}
+			cs, err := g.raft.ClusterStatus()
+			if err != nil {
+				continue
+			}
+			w.field("group"+strconv.FormatUint(id, 10), fmt.Sprintf("role=%s,id=%d,leader=%d,term=%d,commit_index=%d,applied_index=%d,lag=%d",
+				cs.Role, cs.ID, cs.Leader, cs.Term, cs.CommitIndex, cs.AppliedIndex, cs.Lag))
+		}
+		return
+	}
+	if s.raft == nil {
+		w.field("role", "master")
+		return
+	}
+
+	cs, err := s.raft.ClusterStatus()
+	if err != nil {
+		w.field("role", "slave")
+		return
+	}
+	role := "slave"
+	if cs.Role == RoleLeader {
+		role = "master"
+	}
+	w.field("role", role)
+	w.field("raft_role", cs.Role)
+	w.field("raft_id", cs.ID)
+	w.field("raft_leader", cs.Leader)
+	w.field("raft_term", cs.Term)
+	w.field("raft_commit_index", cs.CommitIndex)
+	w.field("raft_applied_index", cs.AppliedIndex)
+	w.field("raft_snapshot_index", cs.SnapshotIndex)
+	w.field("raft_apply_lag", cs.Lag)
+	w.field("raft_proposals_pending", s.raft.pendingProposals())
+	var i int
+	for _, p := range cs.Peers {
+		if p.ID == cs.ID {
+			continue
+		}
+		state := "offline"
+		if p.Active {
+			state = "online"
+		}
+		w.field("peer"+strconv.Itoa(i), fmt.Sprintf("id=%d,url=%s,learner=%d,state=%s,match=%d,lag=%d",
+			p.ID, p.URL, boolInt(p.Learner), state, p.Match, p.Lag))
+		i++
+	}
+}
+
+func (s *Server) infoCommandStats(w *infoWriter) {
+	stats := s.metrics.commandStats(protocolRedis)
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		st := stats[name]
+		usec := st.duration.Microseconds()
+		var perCall float64
+		if st.calls > 0 {
+			perCall = float64(usec) / float64(st.calls)
+		}
+		w.field("cmdstat_"+name, fmt.Sprintf("calls=%d,usec=%d,usec_per_call=%.2f,failed_calls=%d", st.calls, usec, perCall, st.failed))
+	}
+}
+
+// infoKeyspace reports no expiring bitmaps in the Redis format, since TTLs of bitmaps are advisory.
+func (s *Server) infoKeyspace(w *infoWriter) {
+	var keys int
+	for _, bs := range s.allBitmaps() {
+		keys += len(bs.all())
+	}
+	if keys == 0 {
+		return
+	}
+	w.field("db0", fmt.Sprintf("keys=%d,expires=0,avg_ttl=0", keys))
+}
+
+// allBitmaps returns bitmaps of all raft groups hosted by a sharded server, or the bitmaps of the server.
+func (s *Server) allBitmaps() []*Bitmaps {
+	if !s.isSharded() {
+		return []*Bitmaps{s.bitmaps}
+	}
+	var all []*Bitmaps
+	for _, id := range s.Groups() {
+		all = append(all, s.groups[id].bitmaps)
+	}
+	return all
+}
+
+// totalStats returns the sum of stats of all bitmaps.
+func (bs *Bitmaps) totalStats() Stats {
+	var total Stats
+	for _, bm := range bs.all() {
+		bm.mu.RLock()
+		stats := bm.bitmap.Stats()
+		bm.mu.RUnlock()
+		total.add(Stats(stats))
+	}
+	return total
+}
+
+func (st *Stats) add(o Stats) {
+	st.Cardinality += o.Cardinality
+	st.Containers += o.Containers
+	st.ArrayContainers += o.ArrayContainers
+	st.ArrayContainerBytes += o.ArrayContainerBytes
+	st.ArrayContainerValues += o.ArrayContainerValues
+	st.BitmapContainers += o.BitmapContainers
+	st.BitmapContainerBytes += o.BitmapContainerBytes
+	st.BitmapContainerValues += o.BitmapContainerValues
+	st.RunContainers += o.RunContainers
+	st.RunContainerBytes += o.RunContainerBytes
+	st.RunContainerValues += o.RunContainerValues
+}
+
+// humanBytes formats bytes like Redis, such as 1.50M.
+func humanBytes(n uint64) string {
+	const units = "KMGTP"
+	if n < 1024 {
+		return strconv.FormatUint(n, 10) + "B"
+	}
+	v := float64(n) / 1024
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.2f%c", v, units[i])
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+package basalt
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Info(t *testing.T) {
+	s := NewServer("127.0.0.1:18972", NewBitmaps(), nil, "")
+	s.bitmaps.AddMany("a", []uint32{1, 2, 3}, false)
+	s.bitmaps.AddMany("b", []uint32{1}, false)
+	ttl := int64(100)
+	s.bitmaps.SetMetadata("a", MetadataUpdate{TTL: &ttl}, false)
+	s.metrics.observeCommand(protocolRedis, "bmadd", time.Now(), false)
+	s.metrics.observeCommand(protocolRedis, "bmadd", time.Now(), true)
+	s.metrics.observeCommand(protocolHTTP, "add", time.Now(), false)
+
+	info := s.Info()
+	for _, line := range []string{
+		"# Server\r\nredis_version:" + redisVersion + "\r\nbasalt_mode:standalone\r\n",
+		"tcp_port:18972\r\n",
+		"\r\n\r\n# Clients\r\nconnected_clients:0\r\n",
+		"bitmap_values:4\r\n",
+		"rdb_last_bgsave_status:ok\r\nrdb_last_bgsave_time_sec:-1\r\n",
+		"total_commands_processed:2\r\n",
+		"# Replication\r\nrole:master\r\n",
+		"# Keyspace\r\ndb0:keys=2,expires=0,avg_ttl=0\r\n",
+	} {
+		if !strings.Contains(info, line) {
+			t.Errorf("expect %q in info:\n%s", line, info)
+		}
+	}
+	if strings.Contains(info, "# Commandstats") {
+		t.Errorf("expect no commandstats by default")
+	}
+
+	info = s.Info("COMMANDSTATS", "persistence", "unknown")
+	if !strings.HasPrefix(info, "# Persistence\r\n") || !strings.Contains(info, "\r\n\r\n# Commandstats\r\n") {
+		t.Errorf("expect persistence and commandstats in order:\n%s", info)
+	}
+	if !strings.Contains(info, "cmdstat_bmadd:calls=2,usec=") || !strings.Contains(info, ",failed_calls=1\r\n") {
+		t.Errorf("unexpected commandstats:\n%s", info)
+	}
+	if strings.Contains(info, "cmdstat_add") {
+		t.Errorf("expect only redis commands in commandstats")
+	}
+	if info := s.Info("all"); !strings.Contains(info, "# Commandstats") || !strings.Contains(info, "# Server") {
+		t.Errorf("expect all sections:\n%s", info)
+	}
+
+	if err := s.Save(); err != ErrPersistFileNotFound {
+		t.Fatalf("expect ErrPersistFileNotFound but got %v", err)
+	}
+	if info := s.Info("persistence"); !strings.Contains(info, "rdb_saves:1\r\n") || !strings.Contains(info, "rdb_last_bgsave_status:err\r\n") {
+		t.Errorf("expect the failed save:\n%s", info)
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	cases := map[uint64]string{
+		0:               "0B",
+		1023:            "1023B",
+		1536:            "1.50K",
+		3 * 1024 * 1024: "3.00M",
+		5 << 30:         "5.00G",
+	}
+	for n, s := range cases {
+		if got := humanBytes(n); got != s {
+			t.Errorf("expect %s for %d but got %s", s, n, got)
+		}
+	}
+}
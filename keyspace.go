@@ -0,0 +1,169 @@
+package basalt
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// DefaultScanCount is the number of bitmaps examined by a SCAN step without COUNT, the same as Redis.
+const DefaultScanCount = 10
+
+// has returns whether the named bitmap exists, bitmaps moved to other raft groups do not exist.
+func (bs *Bitmaps) has(name string) bool {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return false
+	}
+
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	return bm.meta.MovedTo == 0
+}
+
+// Has returns whether the named bitmaps exist, a name is counted as many times as it is given.
+func (bs *Bitmaps) Has(names ...string) int64 {
+	var n int64
+	for _, name := range names {
+		if bs.has(name) {
+			n++
+		}
+	}
+	return n
+}
+
+// Del removes the named bitmaps and returns the number of removed ones. Like InterStore, it only writes locally,
+// it is replicated as a transaction by Exec.
+func (bs *Bitmaps) Del(names ...string) int64 {
+	var n int64
+	for _, name := range names {
+		if bs.has(name) {
+			bs.RemoveBitmap(name, false)
+			n++
+		}
+	}
+	return n
+}
+
+// DBSize returns the number of bitmaps of all raft groups hosted by the server.
+func (s *Server) DBSize() int64 {
+	var n int64
+	for _, bs := range s.allBitmaps() {
+		n += bs.Has(bs.Keys()...)
+	}
+	return n
+}
+
+// Scan iterates names of bitmaps of all raft groups hosted by the server like SCAN of Redis. Bitmaps are iterated
+// in order of the hashes of their names, starting from the cursor. It examines about count bitmaps and returns
+// the ones matching the pattern, if it is not empty, and the cursor to continue with, which is 0 at the end.
+// Bitmaps existing during the whole iteration are returned at least once.
+func (s *Server) Scan(cursor uint64, count int, pattern string) (next uint64, names []string) {
+	index := s.scanKeys()
+	if count < 1 {
+		count = 1
+	}
+
+	// bitmaps of the same hash are returned in one step, so the next step can start from the next hash
+	i := sort.Search(len(index), func(i int) bool { return index[i].hash >= cursor })
+	n := 0
+	var last uint64
+	for ; i < len(index) && (n < count || index[i].hash == last); i++ {
+		k := index[i]
+		if !k.bitmaps.has(k.name) {
+			continue
+		}
+		n++
+		last = k.hash
+		if pattern == "" || matchGlob(pattern, k.name) {
+			names = append(names, k.name)
+		}
+	}
+	if i < len(index) {
+		next = last + 1
+	}
+	return next, names
+}
+
+// scanKey is a bitmap in the index of Scan.
+type scanKey struct {
+	hash    uint64
+	name    string
+	bitmaps *Bitmaps
+}
+
+// scanIndex is bitmaps of all raft groups sorted by scanHash, and generations of the groups it is built from.
+type scanIndex struct {
+	keys        []scanKey
+	groups      []*Bitmaps
+	generations []uint64
+}
+
+// stale returns whether bitmaps are added to or removed from the groups since the index is built.
+func (idx *scanIndex) stale(groups []*Bitmaps) bool {
+	if idx == nil || len(idx.groups) != len(groups) {
+		return true
+	}
+	for i, bs := range groups {
+		if idx.groups[i] != bs || idx.generations[i] != bs.keysGeneration() {
+			return true
+		}
+	}
+	return false
+}
+
+// scanKeys returns the index of Scan, it is rebuilt only if it is stale.
+func (s *Server) scanKeys() []scanKey {
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+	groups := s.allBitmaps()
+	if !s.scanIndex.stale(groups) {
+		return s.scanIndex.keys
+	}
+
+	idx := &scanIndex{groups: groups, generations: make([]uint64, len(groups))}
+	for i, bs := range groups {
+		// bitmaps added after the generation is read make the index stale again
+		idx.generations[i] = bs.keysGeneration()
+		for _, name := range bs.Keys() {
+			idx.keys = append(idx.keys, scanKey{scanHash(name), name, bs})
+		}
+	}
+	sort.Slice(idx.keys, func(i, j int) bool {
+		if idx.keys[i].hash != idx.keys[j].hash {
+			return idx.keys[i].hash < idx.keys[j].hash
+		}
+		return idx.keys[i].name < idx.keys[j].name
+	})
+	s.scanIndex = idx
+	return idx.keys
+}
+
+// keysGeneration returns the generation of names of bitmaps, it changes when bitmaps are added or removed.
+func (bs *Bitmaps) keysGeneration() uint64 {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	return bs.generation
+}
+
+// scanHash returns the position of the named bitmap in iterations of Scan.
+func scanHash(name string) uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return uint64(h.Sum32())
+}
+
+// applyFlush removes all bitmaps but the ones being migrated, removed bitmaps captured by migrations are captured
+// as drops. The caller must hold s.mu.
+func (s *RaftServer) applyFlush(op operaton) {
+	removed := s.bmServer.bitmaps.flush()
+
+	s.migrationsMu.Lock()
+	defer s.migrationsMu.Unlock()
+	for _, name := range removed {
+		if m := s.migrations[name]; m != nil {
+			m.ops = append(m.ops, operaton{OP: BmOpDrop, Val: name, Time: op.Time})
+		}
+	}
+}
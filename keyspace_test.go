@@ -0,0 +1,179 @@
+package basalt
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestServer_Scan(t *testing.T) {
+	s := NewServer("", NewBitmaps(), nil, "")
+	for i := 0; i < 100; i++ {
+		s.bitmaps.Add("key:"+strconv.Itoa(i), 1, false)
+	}
+	if n := s.DBSize(); n != 100 {
+		t.Fatalf("expect 100 bitmaps but got %d", n)
+	}
+
+	seen := make(map[string]int)
+	var cursor uint64
+	steps := 0
+	for {
+		next, names := s.Scan(cursor, 7, "")
+		for _, name := range names {
+			seen[name]++
+		}
+		steps++
+		// bitmaps removed and added during the iteration may or may not be returned
+		if steps == 3 {
+			s.bitmaps.RemoveBitmap("key:99", false)
+			s.bitmaps.Add("new", 1, false)
+		}
+		if next == 0 {
+			break
+		}
+		if next <= cursor {
+			t.Fatalf("expect the cursor increasing but got %d after %d", next, cursor)
+		}
+		cursor = next
+	}
+	for i := 0; i < 99; i++ {
+		if seen["key:"+strconv.Itoa(i)] == 0 {
+			t.Errorf("expect key:%d returned", i)
+		}
+	}
+	if steps < 100/7 {
+		t.Errorf("expect about 7 bitmaps in a step but got %d steps", steps)
+	}
+
+	_, names := s.Scan(0, 1000, "key:1?")
+	sort.Strings(names)
+	if len(names) != 10 || names[0] != "key:10" || names[9] != "key:19" {
+		t.Errorf("unexpected matched bitmaps %v", names)
+	}
+	// a new iteration returns bitmaps added during the last one, and not the removed ones
+	// the index is rebuilt only when bitmaps are added or removed
+	idx := s.scanIndex
+	s.bitmaps.Add("key:1", 2, false)
+	if s.Scan(0, 1, ""); s.scanIndex != idx {
+		t.Errorf("expect the index kept without bitmaps added or removed")
+	}
+	s.bitmaps.Add("new", 2, false)
+	s.bitmaps.Add("new2", 1, false)
+	s.bitmaps.RemoveBitmap("new2", false)
+	if s.Scan(0, 1, ""); s.scanIndex == idx {
+		t.Errorf("expect the index rebuilt after bitmaps added or removed")
+	}
+	_, all := s.Scan(0, 1000, "")
+	sort.Strings(all)
+	if len(all) != 100 || all[99] != "new" || all[98] != "key:98" {
+		t.Errorf("expect key:0 to key:98 and new in a new iteration but got %v", all)
+	}
+
+	s.bitmaps.fence("key:1", 2)
+	if err := s.bitmaps.Flush(false); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.DBSize(); n != 1 {
+		t.Errorf("expect the bitmap being migrated kept but got %d bitmaps", n)
+	}
+}
+
+func TestServer_KeyspaceCommands(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	s := NewServer(addr, NewBitmaps(), nil, "")
+	s.ln = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.configListener(ctx, ln)
+	<-s.started
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	redis := redisCaller(t, conn)
+
+	s.bitmaps.Add("a", 1, false)
+	s.bitmaps.Add("b", 2, false)
+	s.bitmaps.Add("c", 3, false)
+	for _, c := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"exists", "a", "b", "a", "x"}, ":3"},
+		{[]string{"type", "a"}, "+string"},
+		{[]string{"type", "x"}, "+none"},
+		{[]string{"dbsize"}, ":3"},
+		{[]string{"del", "a", "x", "a"}, ":1"},
+		{[]string{"scan", "0", "match", "[bx]", "type", "string"}, "0 b"},
+		{[]string{"scan", "0", "type", "list"}, "0 "},
+		{[]string{"scan", "x"}, "-ERR invalid cursor"},
+		{[]string{"scan", "0", "count", "0"}, "-ERR syntax error"},
+		{[]string{"multi"}, "+OK"},
+		{[]string{"exists", "b"}, "+QUEUED"},
+		{[]string{"del", "b"}, "+QUEUED"},
+		{[]string{"exec"}, ":1 :1"},
+		{[]string{"flushdb", "async"}, "+OK"},
+		{[]string{"dbsize"}, ":0"},
+		{[]string{"echo", "hello"}, "hello"},
+		{[]string{"select", "0"}, "+OK"},
+		{[]string{"select", "1"}, "-ERR DB index is out of range"},
+		{[]string{"client", "getname"}, "$-1"},
+		{[]string{"client", "setname", "my conn"}, "-ERR Client names cannot contain spaces, newlines or special characters."},
+		{[]string{"client", "setname", "worker"}, "+OK"},
+		{[]string{"client", "getname"}, "worker"},
+		{[]string{"client", "kill"}, "-ERR unknown subcommand 'kill'. Try CLIENT HELP."},
+		{[]string{"command", "info", "del", "setbit", "nope"}, "del :-2 +write :1 :-1 :1 +@write setbit :4 +write :1 :1 :1 +@write $-1"},
+		{[]string{"command", "count"}, ":" + strconv.Itoa(len(redisCommands))},
+	} {
+		if reply := redis(c.args...); reply != c.reply {
+			t.Errorf("expect %s for %v but got %s", c.reply, c.args, reply)
+		}
+	}
+
+	list := redis("client", "list")
+	if !strings.Contains(list, "addr="+conn.LocalAddr().String()+" name=worker ") || !strings.Contains(list, "cmd=client") {
+		t.Errorf("unexpected client list %q", list)
+	}
+	if all := redis("command"); !strings.HasPrefix(all, "addlearner :3 +admin") {
+		t.Errorf("unexpected commands %.100s", all)
+	}
+}
+
+func TestRaftServer_ApplyFlush(t *testing.T) {
+	s := NewServer("", NewBitmaps(), nil, "")
+	rs := &RaftServer{bmServer: s, migrations: make(map[string]*migration)}
+	bs := s.bitmaps
+	var proposed []OP
+	bs.writeCallback = func(op OP, value string) error {
+		proposed = append(proposed, op)
+		return nil
+	}
+	bs.Add("a", 1, false)
+	bs.Add("b", 2, false)
+	bs.Add("c", 3, false)
+	if err := bs.Flush(true); err != nil || len(proposed) != 1 || proposed[0] != BmOpFlush || s.DBSize() != 3 {
+		t.Fatalf("expect the flush proposed but got %v", proposed)
+	}
+
+	// a is being captured by a migration and c is fenced
+	m := &migration{name: "a"}
+	rs.migrations["a"] = m
+	bs.fence("c", 2)
+	rs.processOP(operaton{OP: BmOpFlush, Time: 1})
+	if keys := bs.Keys(); len(keys) != 1 || keys[0] != "c" {
+		t.Errorf("expect only the fenced bitmap kept but got %v", keys)
+	}
+	if ops := rs.takeMigrationOps(m); len(ops) != 1 || ops[0].OP != BmOpDrop || ops[0].Val != "a" {
+		t.Errorf("expect a drop captured but got %+v", ops)
+	}
+}
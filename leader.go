@@ -0,0 +1,314 @@
+package basalt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smallnest/rpcx/codec"
+	"github.com/smallnest/rpcx/protocol"
+	"github.com/smallnest/rpcx/share"
+)
+
+// LeaderMode is how a node handles writes when it is not the leader.
+type LeaderMode string
+
+// Supported leader modes.
+const (
+	// LeaderModeLocal proposes writes on the node that receives them.
+	LeaderModeLocal LeaderMode = "local"
+	// LeaderModeForward forwards writes to the leader over rpcx and relays the result.
+	LeaderModeForward LeaderMode = "forward"
+	// LeaderModeRedirect refuses writes with a NotLeaderError naming the leader.
+	LeaderModeRedirect LeaderMode = "redirect"
+)
+
+// Errors for leader handling.
+var (
+	ErrUnknownLeaderMode = errors.New("unknown leader mode")
+	ErrNoLeader          = errors.New("no leader in the cluster")
+	ErrNoTransferee      = errors.New("no voter to transfer leadership to")
+	ErrNotVoter          = errors.New("node is not a voter")
+	ErrNotForwardable    = errors.New("operation can not be forwarded to the leader")
+)
+
+const (
+	// forwardTimeout is the timeout of a write forwarded to the leader.
+	forwardTimeout = 5 * time.Second
+	// transferPollInterval is the interval to check whether leadership is transferred.
+	transferPollInterval = 50 * time.Millisecond
+)
+
+// ParseLeaderMode parses the name of a leader mode.
+func ParseLeaderMode(s string) (LeaderMode, error) {
+	switch m := LeaderMode(s); m {
+	case LeaderModeLocal, LeaderModeForward, LeaderModeRedirect:
+		return m, nil
+	}
+	return "", ErrUnknownLeaderMode
+}
+
+// NotLeaderError is returned for writes to a follower in LeaderModeRedirect.
+type NotLeaderError struct {
+	Leader uint64 // ID of the leader
+	Addr   string // service address of the leader, empty if it is unknown
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Addr == "" {
+		return fmt.Sprintf("not leader, leader is node %d", e.Leader)
+	}
+	return fmt.Sprintf("not leader, leader is node %d at %s", e.Leader, e.Addr)
+}
+
+// isLeaderError returns whether err is caused by the leader handling of writes.
+func isLeaderError(err error) bool {
+	if _, ok := err.(*NotLeaderError); ok {
+		return true
+	}
+	return err == ErrNoLeader
+}
+
+// TransferLeadership transfers leadership of the cluster to the target voter and waits until it is done.
+// The most up-to-date voter is chosen if target is 0. It must be invoked on the leader.
+func (s *RaftServer) TransferLeadership(ctx context.Context, target uint64) error {
+	status, err := s.node.status()
+	if err != nil {
+		return err
+	}
+	if status.Role != RoleLeader {
+		if status.Leader == 0 {
+			return ErrNoLeader
+		}
+		return &NotLeaderError{Leader: status.Leader, Addr: s.peerAddrs[status.Leader]}
+	}
+
+	if target == 0 {
+		var match uint64
+		for _, p := range status.Peers {
+			if p.ID != status.ID && !p.Learner && p.Active && p.Match >= match {
+				target, match = p.ID, p.Match
+			}
+		}
+		if target == 0 {
+			return ErrNoTransferee
+		}
+	} else if target == status.ID {
+		return nil
+	} else {
+		var found bool
+		for _, p := range status.Peers {
+			if p.ID == target {
+				if p.Learner {
+					return ErrNotVoter
+				}
+				found = true
+			}
+		}
+		if !found {
+			return ErrNodeNotFound
+		}
+	}
+
+	s.node.node.TransferLeadership(ctx, status.ID, target)
+
+	ticker := time.NewTicker(transferPollInterval)
+	defer ticker.Stop()
+	for s.node.leader() != target {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// isLeader returns whether this node is the leader.
+func (s *RaftServer) isLeader() bool {
+	return s.node.leader() == uint64(s.node.id)
+}
+
+// ForwardRequest is a write forwarded from a follower to the leader.
+type ForwardRequest struct {
+	OP    OP
+	Value string
+}
+
+// forwardable returns whether the write can be forwarded to the leader: writes of a single bitmap, including
+// bitmaps put by migrations, and transactions. Others, like restores and flushes, replace many bitmaps or
+// change migrations, so they are proposed by the leader itself.
+func forwardable(op OP, value string) bool {
+	_, ok := forwardedKeys(op, value)
+	return ok
+}
+
+// forwardedKeys returns names of bitmaps written by a forwarded write, which are checked by ACLs like the
+// write itself, and false if the write can not be forwarded.
+func forwardedKeys(op OP, value string) ([]string, bool) {
+	switch op {
+	case BmOpAdd, BmOpAddMany, BmOpRemove, BmOpDrop, BmOpClear, BmOpSetMeta, BmOpFreeze, BmOpThaw:
+		return []string{opBitmap(operaton{OP: op, Val: value})}, true
+	case BmOpMulti:
+		var tx Transaction
+		if err := json.Unmarshal([]byte(value), &tx); err != nil {
+			return nil, false
+		}
+		for _, args := range tx.Commands {
+			if len(args) == 0 {
+				return nil, false
+			}
+			if _, _, err := parseTxCommand(args); err != nil {
+				return nil, false
+			}
+		}
+		return tx.Keys(), true
+	case BmOpPut:
+		rr := NewRecordReader(strings.NewReader(value))
+		rec, err := rr.Next()
+		if err != nil {
+			return nil, false
+		}
+		if _, err := rr.Next(); err != io.EOF {
+			return nil, false
+		}
+		return []string{rec.Name}, true
+	}
+	return nil, false
+}
+
+// forwarder forwards writes to the leader over rpcx.
+// It speaks the rpcx protocol directly, since the rpcx client brings in
+// dependencies which conflict with the raft implementation.
+type forwarder struct {
+	mu        sync.Mutex
+	conns     map[string]*forwardConn // by service address
+	tlsConfig *tls.Config             // set if services are served over TLS
+	token     string                  // set if services check ACLs
+}
+
+// forwardConn is a connection to the leader, calls on it are serialized.
+type forwardConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	seq  uint64
+}
+
+func (f *forwarder) forward(addr, servicePath string, op OP, value string) error {
+	c, err := f.conn(addr)
+	if err != nil {
+		return err
+	}
+
+	err = c.call(servicePath, "Forward", f.token, &ForwardRequest{OP: op, Value: value})
+	if _, ok := err.(remoteServiceError); ok {
+		return remoteError(err)
+	}
+	if err != nil {
+		f.drop(addr, c)
+	}
+	return err
+}
+
+func (f *forwarder) conn(addr string) (*forwardConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if c := f.conns[addr]; c != nil {
+		return c, nil
+	}
+
+	var conn net.Conn
+	var err error
+	if f.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: forwardTimeout}, "tcp", addr, f.tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, forwardTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &forwardConn{conn: conn, r: bufio.NewReader(conn)}
+	if f.conns == nil {
+		f.conns = make(map[string]*forwardConn)
+	}
+	f.conns[addr] = c
+	return c, nil
+}
+
+func (f *forwarder) drop(addr string, c *forwardConn) {
+	f.mu.Lock()
+	if f.conns[addr] == c {
+		delete(f.conns, addr)
+	}
+	f.mu.Unlock()
+	c.conn.Close()
+}
+
+// remoteServiceError is an error returned by the rpcx service of the leader.
+type remoteServiceError string
+
+func (e remoteServiceError) Error() string {
+	return string(e)
+}
+
+// call invokes a rpcx method whose reply is a bool.
+func (c *forwardConn) call(servicePath, serviceMethod, token string, args interface{}) error {
+	var cc codec.MsgpackCodec
+	payload, err := cc.Encode(args)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	req := protocol.NewMessage()
+	req.SetMessageType(protocol.Request)
+	req.SetSerializeType(protocol.MsgPack)
+	req.SetSeq(c.seq)
+	req.ServicePath = servicePath
+	req.ServiceMethod = serviceMethod
+	req.Payload = payload
+	if token != "" {
+		req.Metadata = map[string]string{share.AuthKey: token}
+	}
+
+	c.conn.SetDeadline(time.Now().Add(forwardTimeout))
+	if err := req.WriteTo(c.conn); err != nil {
+		return err
+	}
+	res, err := protocol.Read(c.r)
+	if err != nil {
+		return err
+	}
+	if res.Seq() != c.seq {
+		return fmt.Errorf("unexpected seq %d of reply, expect %d", res.Seq(), c.seq)
+	}
+	if res.MessageStatusType() == protocol.Error {
+		return remoteServiceError(res.Metadata[protocol.ServiceError])
+	}
+
+	var reply bool
+	return cc.Decode(res.Payload, &reply)
+}
+
+// remoteError maps an error returned by the leader back to the sentinel error of this package.
+func remoteError(err error) error {
+	for _, e := range []error{ErrBitmapFrozen, ErrBitmapNotFound, ErrNoLeader, ErrNotInCluster, ErrRaftStopped, ErrMemberRemoved, ErrMigrating, ErrNotForwardable} {
+		if err.Error() == e.Error() {
+			return e
+		}
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package basalt
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+)
+
+func TestParseLeaderMode(t *testing.T) {
+	for _, m := range []LeaderMode{LeaderModeLocal, LeaderModeForward, LeaderModeRedirect} {
+		if mode, err := ParseLeaderMode(string(m)); err != nil || mode != m {
+			t.Errorf("failed to parse %s: %v", m, err)
+		}
+	}
+	if _, err := ParseLeaderMode("proxy"); err != ErrUnknownLeaderMode {
+		t.Errorf("expect ErrUnknownLeaderMode but got %v", err)
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(ln.Addr().String(), NewBitmaps(), nil, "")
+	s.ln = ln
+	go s.configListener(context.Background(), ln)
+	defer s.Drain(context.Background())
+
+	// the server runs standalone, so the forwarded write is refused by it.
+	var f forwarder
+	for i := 0; i < 2; i++ {
+		if err := f.forward(ln.Addr().String(), "Bitmap", BmOpAdd, "test,1"); err != ErrNotInCluster {
+			t.Fatalf("expect ErrNotInCluster but got %v", err)
+		}
+	}
+}
+
+func TestForwardable(t *testing.T) {
+	bs := NewBitmaps()
+	bs.Add("a", 1, false)
+	bs.Add("b", 2, false)
+	var one, two bytes.Buffer
+	if err := bs.saveBitmaps(&one, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.saveBitmaps(&two, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		op          OP
+		value       string
+		forwardable bool
+	}{
+		{BmOpAdd, "a,1", true},
+		{BmOpSetMeta, `a,{"owner":"ads"}`, true},
+		{BmOpMulti, `{"commands":[["bmadd","a","1"]]}`, true},
+		{BmOpPut, one.String(), true},
+		{BmOpPut, two.String(), false},
+		{BmOpPut, "", false},
+		{BmOpRestore, one.String(), false},
+		{BmOpFlush, "", false},
+		{BmOpMigrate, "a,2", false},
+		{BmOpMigrated, "a,2", false},
+		{BmOpReplayed, "a,1", false},
+		{BmOpBatch, "", false},
+		{OP(100), "", false},
+	} {
+		if got := forwardable(c.op, c.value); got != c.forwardable {
+			t.Errorf("expect %v for %s but got %v", c.forwardable, c.op, got)
+		}
+	}
+
+	// the leader refuses writes which can not be forwarded
+	svc := &RpcxBitmapService{s: &Server{bitmaps: NewBitmaps(), raft: &RaftServer{}}}
+	var reply bool
+	if err := svc.Forward(context.Background(), &ForwardRequest{OP: BmOpFlush}, &reply); err != ErrNotForwardable {
+		t.Errorf("expect ErrNotForwardable but got %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package basalt
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rpcxio/etcd/pkg/types"
+	"github.com/rpcxio/etcd/raft"
+	"github.com/rpcxio/etcd/raft/raftpb"
+)
+
+// ErrMemberRemoved is returned for messages from or changes to a member removed from the cluster.
+var ErrMemberRemoved = errors.New("member has been removed from the cluster")
+
+// peerHealth is the health of the connection to a peer, reported by the transport.
+type peerHealth struct {
+	unreachable     uint64
+	lastUnreachable time.Time
+	snapshotsSent   uint64
+	snapshotsFailed uint64
+}
+
+// IsIDRemoved reports whether the member is removed from the cluster.
+// The transport rejects messages from removed members, so they stop talking to the cluster.
+func (rc *RaftNode) IsIDRemoved(id uint64) bool {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	_, ok := rc.removed[id]
+	return ok
+}
+
+// ReportUnreachable reports that the peer cannot be reached, raft probes it instead of sending more entries.
+func (rc *RaftNode) ReportUnreachable(id uint64) {
+	rc.mu.Lock()
+	h := rc.healthOf(id)
+	h.unreachable++
+	h.lastUnreachable = time.Now()
+	rc.mu.Unlock()
+
+	rc.node.ReportUnreachable(id)
+}
+
+// ReportSnapshot reports whether a snapshot is sent to the peer, so raft can resume replicating to it.
+func (rc *RaftNode) ReportSnapshot(id uint64, status raft.SnapshotStatus) {
+	rc.mu.Lock()
+	h := rc.healthOf(id)
+	if status == raft.SnapshotFinish {
+		h.snapshotsSent++
+	} else {
+		h.snapshotsFailed++
+	}
+	rc.mu.Unlock()
+
+	rc.node.ReportSnapshot(id, status)
+}
+
+// Process steps a message from a peer into raft, messages from removed members are rejected.
+func (rc *RaftNode) Process(ctx context.Context, m raftpb.Message) error {
+	if rc.IsIDRemoved(m.From) {
+		return ErrMemberRemoved
+	}
+	return rc.node.Step(ctx, m)
+}
+
+// healthOf returns the health of the peer, the caller must hold rc.mu.
+func (rc *RaftNode) healthOf(id uint64) *peerHealth {
+	h := rc.health[id]
+	if h == nil {
+		h = &peerHealth{}
+		rc.health[id] = h
+	}
+	return h
+}
+
+// peerHealth returns a copy of the health of the peer.
+func (rc *RaftNode) peerHealth(id uint64) peerHealth {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	if h := rc.health[id]; h != nil {
+		return *h
+	}
+	return peerHealth{}
+}
+
+// removedIDs returns the sorted IDs of removed members.
+func (rc *RaftNode) removedIDs() []uint64 {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	ids := make([]uint64, 0, len(rc.removed))
+	for id := range rc.removed {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// markRemoved records a removed member and persists the removed IDs,
+// because they can not be recovered once the conf change is compacted into a snapshot.
+func (rc *RaftNode) markRemoved(id uint64) error {
+	rc.mu.Lock()
+	rc.removed[id] = struct{}{}
+	delete(rc.peerURLs, id)
+	delete(rc.health, id)
+	rc.mu.Unlock()
+
+	return saveRemovedIDs(rc.removedPath, rc.removedIDs())
+}
+
+// applyConfChange applies a conf change and updates the transport for members added or removed by it,
+// urls are raft URLs of added members. It returns false if this node is removed from the cluster.
+// Members removed in a joint configuration are kept until the cluster leaves the joint configuration.
+func (rc *RaftNode) applyConfChange(cc raftpb.ConfChangeI, urls map[uint64]string) bool {
+	old := members(rc.confState)
+	rc.confState = *rc.node.ApplyConfChange(cc)
+	cur := members(rc.confState)
+
+	for id, url := range urls {
+		if _, ok := cur[id]; !ok || url == "" {
+			continue
+		}
+		if id != uint64(rc.id) {
+			rc.transport.AddPeer(types.ID(id), []string{url})
+		}
+		rc.setPeerURL(id, url)
+	}
+
+	for id := range old {
+		if _, ok := cur[id]; ok {
+			continue
+		}
+		if id == uint64(rc.id) {
+			log.Println("I've been removed from the cluster! Shutting down.")
+			return false
+		}
+		rc.transport.RemovePeer(types.ID(id))
+		if err := rc.markRemoved(id); err != nil {
+			log.Printf("failed to persist removed member %d: %v", id, err)
+		}
+	}
+	return true
+}
+
+// memberConfig is the current configuration of the cluster.
+type memberConfig struct {
+	voters  map[uint64]struct{}
+	members map[uint64]struct{} // voters and learners
+}
+
+func (c *memberConfig) voterIDs() []uint64 {
+	ids := make([]uint64, 0, len(c.voters))
+	for id := range c.voters {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// replace returns the changes to replace the member oldID with the new voter newID, whose raft URL is addr.
+func (c *memberConfig) replace(oldID, newID uint64, addr string, removed func(uint64) bool) ([]raftpb.ConfChangeSingle, map[uint64]string, error) {
+	if oldID == newID {
+		return nil, nil, ErrNodeExists
+	}
+	if removed(newID) {
+		return nil, nil, ErrMemberRemoved
+	}
+	if _, ok := c.members[oldID]; !ok {
+		return nil, nil, ErrNodeNotFound
+	}
+	if _, ok := c.members[newID]; ok {
+		return nil, nil, ErrNodeExists
+	}
+
+	changes := []raftpb.ConfChangeSingle{
+		{Type: raftpb.ConfChangeAddNode, NodeID: newID},
+		{Type: raftpb.ConfChangeRemoveNode, NodeID: oldID},
+	}
+	return changes, map[uint64]string{newID: addr}, nil
+}
+
+// reconfigure returns the changes to make voters the voters of the cluster, and the raft URLs of new members.
+// There are no changes if voters are the current voters.
+func (c *memberConfig) reconfigure(voters map[uint64]string, removed func(uint64) bool) ([]raftpb.ConfChangeSingle, map[uint64]string, error) {
+	var changes []raftpb.ConfChangeSingle
+	urls := make(map[uint64]string)
+	ids := make([]uint64, 0, len(voters))
+	for id := range voters {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if removed(id) {
+			return nil, nil, ErrMemberRemoved
+		}
+		if _, ok := c.voters[id]; ok {
+			continue
+		}
+		if _, ok := c.members[id]; !ok {
+			if voters[id] == "" {
+				return nil, nil, fmt.Errorf("%w: %d", ErrNoMemberURL, id)
+			}
+			urls[id] = voters[id]
+		}
+		changes = append(changes, raftpb.ConfChangeSingle{Type: raftpb.ConfChangeAddNode, NodeID: id})
+	}
+	for _, id := range c.voterIDs() {
+		if _, ok := voters[id]; !ok {
+			changes = append(changes, raftpb.ConfChangeSingle{Type: raftpb.ConfChangeRemoveNode, NodeID: id})
+		}
+	}
+	return changes, urls, nil
+}
+
+// config returns the current configuration, it fails if the cluster is in a joint configuration
+// because raft does not accept another change before leaving it.
+func (rc *RaftNode) config() (*memberConfig, error) {
+	select {
+	case <-rc.startedc:
+	default:
+		return nil, ErrRaftNotReady
+	}
+
+	st := rc.node.Status()
+	if len(st.Config.Voters[1]) > 0 || len(st.Config.LearnersNext) > 0 {
+		return nil, ErrJointConfig
+	}
+	cfg := &memberConfig{
+		voters:  make(map[uint64]struct{}),
+		members: make(map[uint64]struct{}),
+	}
+	for id := range st.Config.Voters[0] {
+		cfg.voters[id] = struct{}{}
+		cfg.members[id] = struct{}{}
+	}
+	for id := range st.Config.Learners {
+		cfg.members[id] = struct{}{}
+	}
+	return cfg, nil
+}
+
+// members returns IDs of voters and learners in the configuration, including outgoing voters and
+// learners to be added in a joint configuration.
+func members(cs raftpb.ConfState) map[uint64]struct{} {
+	ids := make(map[uint64]struct{})
+	for _, group := range [][]uint64{cs.Voters, cs.Learners, cs.VotersOutgoing, cs.LearnersNext} {
+		for _, id := range group {
+			ids[id] = struct{}{}
+		}
+	}
+	return ids
+}
+
+// encodeMemberURLs encodes raft URLs of added members as the context of a ConfChangeV2.
+func encodeMemberURLs(urls map[uint64]string) ([]byte, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(urls)
+}
+
+func decodeMemberURLs(data []byte) (map[uint64]string, error) {
+	urls := make(map[uint64]string)
+	if len(data) == 0 {
+		return urls, nil
+	}
+	err := json.Unmarshal(data, &urls)
+	return urls, err
+}
+
+// loadRemovedIDs reads removed IDs from the file, one ID per line.
+func loadRemovedIDs(path string) (map[uint64]struct{}, error) {
+	removed := make(map[uint64]struct{})
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return removed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("wrong removed ID %q in %s: %w", line, path, err)
+		}
+		removed[id] = struct{}{}
+	}
+	return removed, scanner.Err()
+}
+
+// saveRemovedIDs writes removed IDs to a temporary file and renames it to path.
+func saveRemovedIDs(path string, ids []uint64) error {
+	var sb strings.Builder
+	for _, id := range ids {
+		sb.WriteString(strconv.FormatUint(id, 10))
+		sb.WriteString("\n")
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(sb.String()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
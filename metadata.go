@@ -0,0 +1,224 @@
+package basalt
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Types of bitmaps.
+const (
+	// BitmapTypeRoaring32 is a roaring bitmap of uint32 values.
+	BitmapTypeRoaring32 = "roaring32"
+)
+
+// ErrInvalidMetadataField is returned for an unknown metadata field.
+var ErrInvalidMetadataField = errors.New("invalid metadata field")
+
+// Metadata is the metadata persisted and replicated with each bitmap.
+type Metadata struct {
+	Type        string            `json:"type"`
+	Owner       string            `json:"owner,omitempty"` // owner namespace
+	Created     time.Time         `json:"created"`
+	Modified    time.Time         `json:"modified"`
+	TTL         int64             `json:"ttl,omitempty"`     // seconds, advisory, 0 means the bitmap never expires
+	TTLSet      time.Time         `json:"ttl_set,omitempty"` // when the TTL is set, it is measured from then
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Frozen      bool              `json:"frozen,omitempty"` // read-only, backed by a mapped file
+
+	// set by migrations between raft groups
+	Migrating uint64 `json:"migrating,omitempty"` // raft group the bitmap is being migrated to, writes are refused
+	MovedTo   uint64 `json:"moved_to,omitempty"`  // raft group the bitmap has been moved to, the bitmap is empty
+	// writes refused by the fence or applied after the move, not replayed to the target group yet
+	Kept     []KeptWrite `json:"kept,omitempty"`
+	Replayed uint64      `json:"replayed,omitempty"` // number of kept writes replayed and removed
+
+	// set in snapshots taken during a restore, the bitmap is staged by the restore instead of being put
+	Staged string `json:"staged,omitempty"`
+}
+
+// ExpireAt returns when the bitmap expires, or zero time if it has no TTL. TTLs are advisory, bitmaps are never
+// removed by basalt when they expire, it is up to their owners. A TTL set by old versions without TTLSet is
+// measured from the creation of the bitmap.
+func (m Metadata) ExpireAt() time.Time {
+	if m.TTL <= 0 {
+		return time.Time{}
+	}
+	from := m.TTLSet
+	if from.IsZero() {
+		from = m.Created
+	}
+	return from.Add(time.Duration(m.TTL) * time.Second)
+}
+
+func (m Metadata) clone() Metadata {
+	if m.Tags != nil {
+		tags := make(map[string]string, len(m.Tags))
+		for k, v := range m.Tags {
+			tags[k] = v
+		}
+		m.Tags = tags
+	}
+	if m.Kept != nil {
+		m.Kept = append([]KeptWrite(nil), m.Kept...)
+	}
+	return m
+}
+
+// MetadataUpdate changes user defined metadata of a bitmap. Nil fields are left unchanged.
+type MetadataUpdate struct {
+	Owner       *string           `json:"owner,omitempty"`
+	TTL         *int64            `json:"ttl,omitempty"`
+	Description *string           `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"` // a tag with empty value is removed
+}
+
+func (u MetadataUpdate) apply(m *Metadata, now time.Time) {
+	if u.Owner != nil {
+		m.Owner = *u.Owner
+	}
+	if u.TTL != nil {
+		m.TTL, m.TTLSet = *u.TTL, now
+	}
+	if u.Description != nil {
+		m.Description = *u.Description
+	}
+	for k, v := range u.Tags {
+		if v == "" {
+			delete(m.Tags, k)
+			continue
+		}
+		if m.Tags == nil {
+			m.Tags = make(map[string]string)
+		}
+		m.Tags[k] = v
+	}
+}
+
+// ParseMetadataUpdate parses `field value` pairs into an update.
+// Fields are owner, ttl, description and tag:<key>.
+func ParseMetadataUpdate(pairs []string) (MetadataUpdate, error) {
+	var u MetadataUpdate
+	if len(pairs)%2 != 0 {
+		return u, ErrInvalidMetadataField
+	}
+
+	for i := 0; i < len(pairs); i += 2 {
+		field, value := strings.ToLower(pairs[i]), pairs[i+1]
+		switch {
+		case field == "owner":
+			u.Owner = &value
+		case field == "description" || field == "desc":
+			u.Description = &value
+		case field == "ttl":
+			ttl, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return u, err
+			}
+			u.TTL = &ttl
+		case strings.HasPrefix(field, "tag:") && len(field) > 4:
+			if u.Tags == nil {
+				u.Tags = make(map[string]string)
+			}
+			u.Tags[pairs[i][4:]] = value
+		default:
+			return u, ErrInvalidMetadataField
+		}
+	}
+	return u, nil
+}
+
+// Pairs returns the metadata as `field value` pairs, in the format accepted by ParseMetadataUpdate.
+func (m Metadata) Pairs() []string {
+	pairs := []string{
+		"type", m.Type,
+		"owner", m.Owner,
+		"created", m.Created.Format(time.RFC3339Nano),
+		"modified", m.Modified.Format(time.RFC3339Nano),
+		"ttl", strconv.FormatInt(m.TTL, 10),
+		"description", m.Description,
+		"frozen", strconv.FormatBool(m.Frozen),
+	}
+	if !m.TTLSet.IsZero() {
+		pairs = append(pairs, "ttl_set", m.TTLSet.Format(time.RFC3339Nano))
+	}
+	if m.Migrating != 0 {
+		pairs = append(pairs, "migrating", strconv.FormatUint(m.Migrating, 10))
+	}
+	if m.MovedTo != 0 {
+		pairs = append(pairs, "moved_to", strconv.FormatUint(m.MovedTo, 10))
+	}
+
+	var keys []string
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		pairs = append(pairs, "tag:"+k, m.Tags[k])
+	}
+	return pairs
+}
+
+// Metadata returns the metadata of the named bitmap.
+func (bs *Bitmaps) Metadata(name string) (Metadata, bool) {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return Metadata{}, false
+	}
+
+	bm.mu.RLock()
+	meta := bm.meta.clone()
+	bm.mu.RUnlock()
+
+	return meta, true
+}
+
+// SetMetadata updates user defined metadata of the named bitmap.
+// An empty bitmap is created if it does not exist.
+func (bs *Bitmaps) SetMetadata(name string, update MetadataUpdate, callback bool) error {
+	if bs.writeCallback != nil && callback {
+		data, err := json.Marshal(update)
+		if err != nil {
+			return err
+		}
+		return bs.writeCallback(BmOpSetMeta, name+","+string(data))
+	}
+
+	now := bs.now()
+	bs.mu.Lock()
+	bm := bs.bitmaps[name]
+	if bm == nil {
+		bm = newBitmap(nil, now)
+		bs.bitmaps[name] = bm
+		bs.generation++
+	}
+	bs.mu.Unlock()
+
+	bm.mu.Lock()
+	update.apply(&bm.meta, now)
+	bm.meta.Modified = now
+	bm.mu.Unlock()
+	return nil
+}
+
+// now returns the time of the current write. Replicated writes are applied
+// with the time they are proposed, so every node has the same metadata.
+func (bs *Bitmaps) now() time.Time {
+	if t := atomic.LoadInt64(&bs.writeTime); t > 0 {
+		return time.Unix(0, t).UTC()
+	}
+	return time.Now().UTC()
+}
+
+// setWriteTime sets the time used by writes being applied, zero for the wall clock.
+func (bs *Bitmaps) setWriteTime(t int64) {
+	atomic.StoreInt64(&bs.writeTime, t)
+}
@@ -0,0 +1,85 @@
+package basalt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+func TestBitmaps_Metadata(t *testing.T) {
+	bms := NewBitmaps()
+
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	bms.setWriteTime(created.UnixNano())
+	bms.AddMany("test1", []uint32{1, 2, 3}, false)
+
+	modified := created.Add(time.Hour)
+	bms.setWriteTime(modified.UnixNano())
+	update, err := ParseMetadataUpdate([]string{"owner", "ads", "ttl", "3600", "tag:source", "spark", "desc", "segment"})
+	if err != nil {
+		t.Fatalf("failed to parse metadata update: %v", err)
+	}
+	bms.SetMetadata("test1", update, false)
+	// writes after the TTL is set do not reset it
+	bms.setWriteTime(modified.Add(time.Minute).UnixNano())
+	bms.Add("test1", 4, false)
+	bms.setWriteTime(0)
+
+	var buf bytes.Buffer
+	if err := bms.Save(&buf); err != nil {
+		t.Fatalf("failed to save Bitmaps: %v", err)
+	}
+	bms = NewBitmaps()
+	if err := bms.Read(&buf); err != nil {
+		t.Fatalf("failed to restore Bitmaps: %v", err)
+	}
+
+	meta, ok := bms.Metadata("test1")
+	if !ok {
+		t.Fatalf("not found metadata of test1")
+	}
+	if meta.Type != BitmapTypeRoaring32 || meta.Owner != "ads" || meta.Description != "segment" ||
+		meta.TTL != 3600 || meta.Tags["source"] != "spark" {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+	if !meta.Created.Equal(created) || !meta.Modified.Equal(modified.Add(time.Minute)) || !meta.TTLSet.Equal(modified) {
+		t.Errorf("expect created %v, modified %v and ttl set %v but got %+v", created, modified.Add(time.Minute), modified, meta)
+	}
+	if !meta.ExpireAt().Equal(modified.Add(time.Hour)) {
+		t.Errorf("expect expire at %v but got %v", modified.Add(time.Hour), meta.ExpireAt())
+	}
+
+	update, _ = ParseMetadataUpdate([]string{"tag:source", ""})
+	bms.SetMetadata("test1", update, false)
+	meta, _ = bms.Metadata("test1")
+	if _, ok := meta.Tags["source"]; ok || meta.Owner != "ads" {
+		t.Errorf("expect tag source removed and owner kept but got %+v", meta)
+	}
+
+	if _, err := ParseMetadataUpdate([]string{"color", "red"}); err != ErrInvalidMetadataField {
+		t.Errorf("expect ErrInvalidMetadataField but got %v", err)
+	}
+}
+
+func TestBitmaps_ReadWithoutMetadata(t *testing.T) {
+	// the format saved by old versions: name length, name and bitmap.
+	var buf bytes.Buffer
+	bm := roaring.BitmapOf(1, 2, 3)
+	binary.Write(&buf, binary.LittleEndian, uint32(len("test1")))
+	buf.WriteString("test1")
+	bm.WriteTo(&buf)
+
+	bms := NewBitmaps()
+	if err := bms.Read(&buf); err != nil {
+		t.Fatalf("failed to restore Bitmaps: %v", err)
+	}
+	if bms.Card("test1") != 3 {
+		t.Errorf("expect 3 elements but got %d", bms.Card("test1"))
+	}
+	if meta, _ := bms.Metadata("test1"); meta.Type != BitmapTypeRoaring32 {
+		t.Errorf("expect type %s but got %s", BitmapTypeRoaring32, meta.Type)
+	}
+}
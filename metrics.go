@@ -0,0 +1,278 @@
+package basalt
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Protocols of commands in metrics.
+const (
+	protocolRedis = "redis"
+	protocolHTTP  = "http"
+	protocolRpcx  = "rpcx"
+)
+
+// Persistence operations in metrics.
+const (
+	persistSave    = "save"    // save bitmaps into the persist file
+	persistLoad    = "load"    // load bitmaps from the persist file
+	persistBackup  = "backup"  // write a backup
+	persistRestore = "restore" // restore a backup
+)
+
+var (
+	commandBuckets = prometheus.ExponentialBuckets(0.0001, 4, 10) // 100µs to 26s
+	persistBuckets = prometheus.ExponentialBuckets(0.001, 4, 10)  // 1ms to 262s
+)
+
+// serverMetrics are metrics of a server and the raft groups it hosts, exported by /metrics of the HTTP service.
+type serverMetrics struct {
+	registry    *prometheus.Registry
+	handler     http.Handler
+	commands    *prometheus.CounterVec
+	durations   *prometheus.HistogramVec
+	persistence *prometheus.HistogramVec
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "basalt_commands_total",
+			Help: "Commands handled, by protocol, command and status (ok or error).",
+		}, []string{"protocol", "command", "status"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "basalt_command_duration_seconds",
+			Help:    "Latencies of commands, by protocol and command.",
+			Buckets: commandBuckets,
+		}, []string{"protocol", "command"}),
+		persistence: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "basalt_persistence_duration_seconds",
+			Help:    "Durations of saving, loading, backing up and restoring bitmaps.",
+			Buckets: persistBuckets,
+		}, []string{"operation"}),
+	}
+	m.registry.MustRegister(m.commands, m.durations, m.persistence, &serverCollector{s: s})
+	// the default registry has metrics of the Go runtime, the process and the raft transport
+	m.handler = promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, m.registry},
+		promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError})
+	return m
+}
+
+// observeCommand records a command started at start.
+func (m *serverMetrics) observeCommand(protocol, command string, start time.Time, failed bool) {
+	status := "ok"
+	if failed {
+		status = "error"
+	}
+	m.commands.WithLabelValues(protocol, command, status).Inc()
+	m.durations.WithLabelValues(protocol, command).Observe(time.Since(start).Seconds())
+}
+
+// observePersistence records a persistence operation started at start, use it with defer.
+func (m *serverMetrics) observePersistence(operation string, start time.Time) {
+	m.persistence.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// commandStat is the number of calls of a command, how many of them failed, and the time spent on them.
+type commandStat struct {
+	calls    uint64
+	failed   uint64
+	duration time.Duration
+}
+
+// commandStats returns statistics of commands of the protocol, by command.
+func (m *serverMetrics) commandStats(protocol string) map[string]*commandStat {
+	ch := make(chan prometheus.Metric, 64)
+	go func() {
+		m.commands.Collect(ch)
+		m.durations.Collect(ch)
+		close(ch)
+	}()
+
+	stats := make(map[string]*commandStat)
+	for metric := range ch {
+		var pb dto.Metric
+		if err := metric.Write(&pb); err != nil {
+			continue
+		}
+		labels := make(map[string]string, len(pb.GetLabel()))
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if labels["protocol"] != protocol {
+			continue
+		}
+		st := stats[labels["command"]]
+		if st == nil {
+			st = &commandStat{}
+			stats[labels["command"]] = st
+		}
+		switch {
+		case pb.Counter != nil:
+			n := uint64(pb.GetCounter().GetValue())
+			st.calls += n
+			if labels["status"] == "error" {
+				st.failed += n
+			}
+		case pb.Histogram != nil:
+			st.duration = time.Duration(pb.GetHistogram().GetSampleSum() * float64(time.Second))
+		}
+	}
+	return stats
+}
+
+// newSnapshotHistogram returns the histogram of durations of snapshots taken by the raft node of the group.
+func newSnapshotHistogram(group uint64) prometheus.Histogram {
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:        "basalt_raft_snapshot_duration_seconds",
+		Help:        "Durations of raft snapshots taken by this node, the count is the number of snapshots.",
+		Buckets:     persistBuckets,
+		ConstLabels: prometheus.Labels{"group": strconv.FormatUint(group, 10)},
+	})
+}
+
+var (
+	bitmapsDesc = prometheus.NewDesc("basalt_bitmaps",
+		"Number of bitmaps.", []string{"group"}, nil)
+	frozenBitmapsDesc = prometheus.NewDesc("basalt_frozen_bitmaps",
+		"Number of frozen bitmaps.", []string{"group"}, nil)
+	bitmapBytesDesc = prometheus.NewDesc("basalt_bitmap_bytes",
+		"Bytes used by bitmaps, in heap or in files mapped by frozen bitmaps.", []string{"group", "storage"}, nil)
+
+	raftTermDesc = prometheus.NewDesc("basalt_raft_term",
+		"Raft term of this node.", []string{"group"}, nil)
+	raftLeaderDesc = prometheus.NewDesc("basalt_raft_leader",
+		"ID of the leader known by this node, 0 if it is unknown.", []string{"group"}, nil)
+	raftIsLeaderDesc = prometheus.NewDesc("basalt_raft_is_leader",
+		"1 if this node is the leader.", []string{"group"}, nil)
+	raftCommitIndexDesc = prometheus.NewDesc("basalt_raft_commit_index",
+		"Raft commit index of this node.", []string{"group"}, nil)
+	raftAppliedIndexDesc = prometheus.NewDesc("basalt_raft_applied_index",
+		"Raft applied index of this node.", []string{"group"}, nil)
+	raftSnapshotIndexDesc = prometheus.NewDesc("basalt_raft_snapshot_index",
+		"Raft index of the last snapshot of this node.", []string{"group"}, nil)
+	raftLagDesc = prometheus.NewDesc("basalt_raft_apply_lag",
+		"Committed raft entries not applied yet.", []string{"group"}, nil)
+	raftPendingDesc = prometheus.NewDesc("basalt_raft_proposals_pending",
+		"Proposals of this node not applied yet.", []string{"group"}, nil)
+
+	peerActiveDesc = prometheus.NewDesc("basalt_raft_peer_active",
+		"1 if the peer is connected with this node.", []string{"group", "peer"}, nil)
+	peerLagDesc = prometheus.NewDesc("basalt_raft_peer_lag",
+		"Raft entries not replicated to the peer yet, only known by the leader.", []string{"group", "peer"}, nil)
+	peerUnreachableDesc = prometheus.NewDesc("basalt_raft_peer_unreachable_total",
+		"Times the peer is reported unreachable by the transport.", []string{"group", "peer"}, nil)
+	peerSnapshotsSentDesc = prometheus.NewDesc("basalt_raft_peer_snapshots_sent_total",
+		"Snapshots sent to the peer.", []string{"group", "peer"}, nil)
+	peerSnapshotsFailedDesc = prometheus.NewDesc("basalt_raft_peer_snapshots_failed_total",
+		"Snapshots failed to be sent to the peer.", []string{"group", "peer"}, nil)
+)
+
+// serverCollector collects metrics of bitmaps and raft when they are scraped. It is an unchecked collector,
+// because the raft groups and their peers are not known when it is registered.
+type serverCollector struct {
+	s *Server
+}
+
+func (c *serverCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *serverCollector) Collect(ch chan<- prometheus.Metric) {
+	if !c.s.isSharded() {
+		collectGroup(ch, "0", c.s)
+		return
+	}
+	for _, id := range c.s.Groups() {
+		collectGroup(ch, strconv.FormatUint(id, 10), c.s.groups[id])
+	}
+}
+
+func collectGroup(ch chan<- prometheus.Metric, group string, s *Server) {
+	u := s.bitmaps.usage()
+	ch <- prometheus.MustNewConstMetric(bitmapsDesc, prometheus.GaugeValue, float64(u.count), group)
+	ch <- prometheus.MustNewConstMetric(frozenBitmapsDesc, prometheus.GaugeValue, float64(u.frozen), group)
+	ch <- prometheus.MustNewConstMetric(bitmapBytesDesc, prometheus.GaugeValue, float64(u.heapBytes), group, "heap")
+	ch <- prometheus.MustNewConstMetric(bitmapBytesDesc, prometheus.GaugeValue, float64(u.mappedBytes), group, "mapped")
+
+	if s.raft == nil {
+		return
+	}
+	s.raft.node.snapshotDuration.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(raftPendingDesc, prometheus.GaugeValue, float64(s.raft.pendingProposals()), group)
+
+	cs, err := s.raft.ClusterStatus()
+	if err != nil {
+		return
+	}
+	isLeader := 0.0
+	if cs.Role == RoleLeader {
+		isLeader = 1
+	}
+	ch <- prometheus.MustNewConstMetric(raftTermDesc, prometheus.GaugeValue, float64(cs.Term), group)
+	ch <- prometheus.MustNewConstMetric(raftLeaderDesc, prometheus.GaugeValue, float64(cs.Leader), group)
+	ch <- prometheus.MustNewConstMetric(raftIsLeaderDesc, prometheus.GaugeValue, isLeader, group)
+	ch <- prometheus.MustNewConstMetric(raftCommitIndexDesc, prometheus.GaugeValue, float64(cs.CommitIndex), group)
+	ch <- prometheus.MustNewConstMetric(raftAppliedIndexDesc, prometheus.GaugeValue, float64(cs.AppliedIndex), group)
+	ch <- prometheus.MustNewConstMetric(raftSnapshotIndexDesc, prometheus.GaugeValue, float64(cs.SnapshotIndex), group)
+	ch <- prometheus.MustNewConstMetric(raftLagDesc, prometheus.GaugeValue, float64(cs.Lag), group)
+
+	for _, p := range cs.Peers {
+		if p.ID == cs.ID {
+			continue
+		}
+		peer := strconv.FormatUint(p.ID, 10)
+		active := 0.0
+		if p.Active {
+			active = 1
+		}
+		ch <- prometheus.MustNewConstMetric(peerActiveDesc, prometheus.GaugeValue, active, group, peer)
+		if cs.Role == RoleLeader {
+			ch <- prometheus.MustNewConstMetric(peerLagDesc, prometheus.GaugeValue, float64(p.Lag), group, peer)
+		}
+		ch <- prometheus.MustNewConstMetric(peerUnreachableDesc, prometheus.CounterValue, float64(p.Unreachable), group, peer)
+		ch <- prometheus.MustNewConstMetric(peerSnapshotsSentDesc, prometheus.CounterValue, float64(p.SnapshotsSent), group, peer)
+		ch <- prometheus.MustNewConstMetric(peerSnapshotsFailedDesc, prometheus.CounterValue, float64(p.SnapshotsFailed), group, peer)
+	}
+}
+
+// bitmapsUsage is the number of bitmaps and the memory they use.
+type bitmapsUsage struct {
+	count       int
+	frozen      int
+	heapBytes   uint64
+	mappedBytes uint64 // bytes of files mapped by frozen bitmaps
+}
+
+func (bs *Bitmaps) usage() bitmapsUsage {
+	bms := bs.all()
+	u := bitmapsUsage{count: len(bms)}
+	for _, bm := range bms {
+		bm.mu.RLock()
+		if bm.meta.Frozen {
+			u.frozen++
+		}
+		if bm.frozen != nil {
+			u.mappedBytes += uint64(len(bm.frozen.data))
+		} else {
+			u.heapBytes += bm.bitmap.GetSizeInBytes()
+		}
+		bm.mu.RUnlock()
+	}
+	return u
+}
+
+// all returns all bitmaps, so they can be locked one by one without holding the lock of bs.
+func (bs *Bitmaps) all() []*Bitmap {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	bms := make([]*Bitmap, 0, len(bs.bitmaps))
+	for _, bm := range bs.bitmaps {
+		bms = append(bms, bm)
+	}
+	return bms
+}
@@ -0,0 +1,140 @@
+package basalt
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServer_Metrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basalt-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	s := NewServer(addr, NewBitmaps(), nil, filepath.Join(dir, "bitmaps.bdb"))
+	s.ln = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.configListener(ctx, ln)
+	<-s.started
+
+	// redis
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("*3\r\n$5\r\nbmadd\r\n$1\r\na\r\n$1\r\n1\r\n*1\r\n$3\r\nfoo\r\n*1\r\n$4\r\nPING\r\n"))
+	buf := make([]byte, 64)
+	var replies string
+	for !strings.HasSuffix(replies, "+PONG\r\n") {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies += string(buf[:n])
+	}
+
+	// http
+	for _, path := range []string{"/add/a/2", "/add/a/x", "/save"} {
+		resp, err := http.Post("http://"+addr+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// rpcx
+	var f forwarder
+	c, err := f.conn(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.call("Bitmap", "Add", "", &BitmapValueRequest{Name: "b", Value: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.call("Bitmap", "Forward", "", &ForwardRequest{OP: BmOpAdd, Value: "b,4"}); err == nil {
+		t.Fatal("expect forwarded writes refused out of a cluster")
+	}
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	metrics := string(data)
+	for _, line := range []string{
+		`basalt_commands_total{command="bmadd",protocol="redis",status="ok"} 1`,
+		`basalt_commands_total{command="unknown",protocol="redis",status="error"} 1`,
+		`basalt_commands_total{command="ping",protocol="redis",status="ok"} 1`,
+		`basalt_commands_total{command="add",protocol="http",status="ok"} 1`,
+		`basalt_commands_total{command="add",protocol="http",status="error"} 1`,
+		`basalt_commands_total{command="Add",protocol="rpcx",status="ok"} 1`,
+		`basalt_commands_total{command="Forward",protocol="rpcx",status="error"} 1`,
+		`basalt_command_duration_seconds_count{command="bmadd",protocol="redis"} 1`,
+		`basalt_persistence_duration_seconds_count{operation="save"} 1`,
+		`basalt_bitmaps{group="0"} 2`,
+		`basalt_frozen_bitmaps{group="0"} 0`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("expect %s in metrics", line)
+		}
+	}
+	if strings.Contains(metrics, "basalt_raft_term") {
+		t.Errorf("expect no raft metrics out of a cluster")
+	}
+}
+
+func TestServer_MetricsOfGroups(t *testing.T) {
+	rt, err := ParseRoutingTable([]byte(`{"mode":"range","splits":["m"],"groups":[{"id":1,"shards":[0]},{"id":2,"shards":[1]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("", NewBitmaps(), nil, "")
+	s.SetRoutingTable(rt)
+	g1 := NewServer("", NewBitmaps(), nil, "")
+	g2 := NewServer("", NewBitmaps(), nil, "")
+	s.AddGroup(1, g1)
+	s.AddGroup(2, g2)
+	g1.bitmaps.AddMany("apple", []uint32{1, 2, 3}, false)
+	g2.bitmaps.AddMany("pear", []uint32{1}, false)
+	g2.bitmaps.AddMany("plum", []uint32{1}, false)
+
+	if g1.metrics != s.metrics {
+		t.Fatal("expect groups share metrics of the server")
+	}
+	mfs, err := s.metrics.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmaps := make(map[string]float64)
+	for _, mf := range mfs {
+		if mf.GetName() != "basalt_bitmaps" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			bitmaps[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	if bitmaps["1"] != 1 || bitmaps["2"] != 2 || len(bitmaps) != 2 {
+		t.Errorf("unexpected bitmaps of groups: %v", bitmaps)
+	}
+
+	if u := g1.bitmaps.usage(); u.count != 1 || u.heapBytes == 0 || u.mappedBytes != 0 {
+		t.Errorf("unexpected usage %+v", u)
+	}
+}
@@ -0,0 +1,576 @@
+package basalt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// migrateTimeout is the timeout of migrations requested by clients.
+	migrateTimeout = 30 * time.Second
+	// migrateGrace is how long a migration waits for writes applied to a moved bitmap, it covers writes
+	// checked against the fence before it is applied but proposed after the switch.
+	migrateGrace = proposeTimeout
+)
+
+// Errors for migrations between raft groups.
+var (
+	ErrMigrating          = errors.New("bitmap is being migrated, try again later")
+	ErrMigrationInProcess = errors.New("bitmap is already being migrated by this node")
+	ErrSameGroup          = errors.New("bitmap is already in the raft group")
+	ErrNotSharded         = errors.New("server is not sharded")
+)
+
+// KeptWrite is a write to a bitmap refused by the fence of a migration or applied after the bitmap is moved.
+// It is kept in the metadata of the bitmap, so it is replicated and survives failures of the node driving
+// the migration, until it is replayed to the target group or applied when the fence is lifted.
+type KeptWrite struct {
+	OP    OP     `json:"op"`
+	Value string `json:"value"`
+}
+
+// migration is a migration of a bitmap driven by this node. Writes to the bitmap applied after it is copied
+// are captured, so they are replayed to the target group.
+type migration struct {
+	name     string
+	target   uint64
+	ops      []operaton    // captured writes not replayed yet
+	replayed uint64        // sequence of the last kept write replayed
+	resumed  bool          // the fence was applied by an interrupted migration
+	fenced   chan struct{} // closed when the fence is applied
+	moved    chan struct{} // closed when the bitmap is moved
+}
+
+// Migrate moves the named bitmap from the raft group holding it to the target group without downtime.
+// It copies the bitmap to the target group, fences writes to it, replays writes applied after the copy,
+// switches routing to the target group and deletes the source copy. Writes during the fence are refused
+// with ErrMigrating. The source group must be hosted by this process.
+//
+// Writes reaching the source group after the fence are kept by the bitmap and replayed, at least once, to
+// the target group. A migration interrupted by a failure of its node is resumed by migrating the bitmap to
+// the same group again, or aborted by migrating it to the group holding it, which lifts the fence and applies
+// the kept writes. Migrate also replays writes kept by the bitmap after an interrupted switch.
+func (s *Server) Migrate(ctx context.Context, name string, target uint64) error {
+	if !s.isSharded() {
+		return ErrNotSharded
+	}
+	if s.routing.Group(target) == nil {
+		return ErrGroupNotFound
+	}
+	replayed, err := s.replayMoved(name)
+	if err != nil {
+		return err
+	}
+	g, err := s.route(name)
+	if err != nil {
+		return err
+	}
+	src := g.raft
+	if src == nil {
+		return ErrNotInCluster
+	}
+	if src.node.group == target {
+		if migrating, _ := g.bitmaps.migration(name); migrating != 0 {
+			return src.liftFence(name)
+		}
+		if replayed {
+			return nil
+		}
+		return ErrSameGroup
+	}
+
+	m, data, err := src.startMigration(name, target)
+	if err != nil {
+		return err
+	}
+	defer src.endMigration(m)
+	propose := s.groupProposer(target, src)
+
+	// copy
+	if err := propose(BmOpPut, string(data)); err != nil {
+		return fmt.Errorf("copy %s to raft group %d: %w", name, target, err)
+	}
+
+	// fence
+	if !m.resumed {
+		if err := src.Propose(BmOpMigrate, name+","+strconv.FormatUint(target, 10)); err != nil {
+			return err
+		}
+	}
+	if err := waitMigration(ctx, m.fenced); err != nil {
+		src.abortMigration(m)
+		return err
+	}
+
+	// replay writes applied since the copy and the ones refused by the fence, then switch routing and
+	// delete the source copy
+	if err := src.replayMigration(m, propose); err != nil {
+		src.abortMigration(m)
+		return err
+	}
+	if _, err := src.replayKept(m, propose); err != nil {
+		src.abortMigration(m)
+		return err
+	}
+	if err := src.Propose(BmOpMigrated, name+","+strconv.FormatUint(target, 10)); err != nil {
+		src.abortMigration(m)
+		return err
+	}
+	if err := waitMigration(ctx, m.moved); err != nil {
+		src.abortMigration(m)
+		return err
+	}
+
+	// writes forwarded by members not aware of the fence yet may be applied after the switch, they are
+	// kept by the moved bitmap and replayed until none arrives within migrateGrace
+	return src.confirmMigration(ctx, m, propose)
+}
+
+func waitMigration(ctx context.Context, c chan struct{}) error {
+	select {
+	case <-c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// groupProposer returns a function to propose writes to the raft group, through the group
+// if it is hosted by this process or by forwarding them to a member of the group.
+func (s *Server) groupProposer(id uint64, src *RaftServer) func(op OP, value string) error {
+	if g := s.groups[id]; g != nil && g.raft != nil {
+		return g.raft.Propose
+	}
+	addrs := s.routing.Group(id).Addrs
+	return func(op OP, value string) error {
+		if len(addrs) == 0 {
+			return &MovedError{Group: id}
+		}
+		var err error
+		for _, addr := range addrs {
+			if err = src.fwd.forward(addr, groupServicePath(id), op, value); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+}
+
+// replayMoved replays writes kept by tombstones of the named bitmap in raft groups hosted by this process,
+// they are left by migrations interrupted after the switch. It returns true if any write is replayed.
+func (s *Server) replayMoved(name string) (bool, error) {
+	var replayed bool
+	id, _ := s.routing.GroupOf(name)
+	for i := 0; i < len(s.routing.Groups); i++ {
+		g := s.groups[id]
+		if g == nil || g.raft == nil {
+			break
+		}
+		_, movedTo := g.bitmaps.migration(name)
+		if movedTo == 0 {
+			break
+		}
+		n, err := g.raft.drainKept(&migration{name: name, target: movedTo}, s.groupProposer(movedTo, g.raft))
+		if err != nil {
+			return replayed, err
+		}
+		replayed = replayed || n > 0
+		id = movedTo
+	}
+	return replayed, nil
+}
+
+// startMigration copies the named bitmap and starts capturing writes to it applied after the copy.
+// A bitmap fenced for the target group by an interrupted migration is copied with the fence kept.
+func (s *RaftServer) startMigration(name string, target uint64) (*migration, []byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	meta, ok := s.bmServer.bitmaps.Metadata(name)
+	if !ok || meta.MovedTo != 0 {
+		return nil, nil, ErrBitmapNotFound
+	}
+	if meta.Migrating != 0 && meta.Migrating != target {
+		return nil, nil, ErrMigrating
+	}
+	var buf bytes.Buffer
+	if err := s.bmServer.bitmaps.saveBitmaps(&buf, name); err != nil {
+		return nil, nil, err
+	}
+
+	s.migrationsMu.Lock()
+	defer s.migrationsMu.Unlock()
+	if s.migrations[name] != nil {
+		return nil, nil, ErrMigrationInProcess
+	}
+	m := &migration{name: name, target: target, fenced: make(chan struct{}), moved: make(chan struct{})}
+	if meta.Migrating != 0 {
+		m.resumed = true
+		close(m.fenced)
+	}
+	s.migrations[name] = m
+	return m, buf.Bytes(), nil
+}
+
+func (s *RaftServer) endMigration(m *migration) {
+	s.migrationsMu.Lock()
+	if s.migrations[m.name] == m {
+		delete(s.migrations, m.name)
+	}
+	s.migrationsMu.Unlock()
+}
+
+// takeMigrationOps returns the captured writes of the migration and clears them.
+func (s *RaftServer) takeMigrationOps(m *migration) []operaton {
+	s.migrationsMu.Lock()
+	defer s.migrationsMu.Unlock()
+	ops := m.ops
+	m.ops = nil
+	return ops
+}
+
+// replayMigration proposes the captured writes to the target group in order.
+func (s *RaftServer) replayMigration(m *migration, propose func(op OP, value string) error) error {
+	for _, op := range s.takeMigrationOps(m) {
+		if err := propose(op.OP, op.Val); err != nil {
+			return fmt.Errorf("replay %s to raft group %d: %w", op.OP, m.target, err)
+		}
+	}
+	return nil
+}
+
+// replayKept proposes the writes kept by the bitmap which are not replayed by the migration yet to the target
+// group in order, and returns the number of them.
+func (s *RaftServer) replayKept(m *migration, propose func(op OP, value string) error) (int, error) {
+	kept, replayed := s.bmServer.bitmaps.keptWrites(m.name)
+	if m.replayed < replayed {
+		m.replayed = replayed
+	}
+	var n int
+	for i, w := range kept {
+		seq := replayed + uint64(i) + 1
+		if seq <= m.replayed {
+			continue
+		}
+		if err := propose(w.OP, w.Value); err != nil {
+			return n, fmt.Errorf("replay %s to raft group %d: %w", w.OP, m.target, err)
+		}
+		m.replayed = seq
+		n++
+	}
+	return n, nil
+}
+
+// drainKept replays the writes kept by the moved bitmap, and removes them from the bitmap.
+func (s *RaftServer) drainKept(m *migration, propose func(op OP, value string) error) (int, error) {
+	n, err := s.replayKept(m, propose)
+	if err != nil || m.replayed == 0 {
+		return n, err
+	}
+	if _, replayed := s.bmServer.bitmaps.keptWrites(m.name); replayed >= m.replayed {
+		return n, nil
+	}
+	return n, s.Propose(BmOpReplayed, m.name+","+strconv.FormatUint(m.replayed, 10))
+}
+
+// confirmMigration replays writes kept by the moved bitmap until none arrives within migrateGrace, or ctx
+// is done. Writes arriving later are kept by the bitmap until it is migrated again.
+func (s *RaftServer) confirmMigration(ctx context.Context, m *migration, propose func(op OP, value string) error) error {
+	if _, err := s.drainKept(m, propose); err != nil {
+		return err
+	}
+	timer := time.NewTimer(migrateGrace)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		n, err := s.drainKept(m, propose)
+		if err != nil || n == 0 {
+			return err
+		}
+		timer.Reset(migrateGrace)
+	}
+}
+
+// abortMigration lifts the fence, the writes kept by the bitmap are applied to the source when it is lifted.
+func (s *RaftServer) abortMigration(m *migration) {
+	if err := s.Propose(BmOpMigrate, m.name+",0"); err != nil {
+		log.Printf("failed to lift the fence of %s: %v", m.name, err)
+	}
+}
+
+// liftFence aborts a migration of the named bitmap interrupted by a failure of the node driving it.
+func (s *RaftServer) liftFence(name string) error {
+	s.migrationsMu.Lock()
+	m := s.migrations[name]
+	s.migrationsMu.Unlock()
+	if m != nil {
+		return ErrMigrationInProcess
+	}
+	return s.Propose(BmOpMigrate, name+",0")
+}
+
+// captureMigrating captures the write to a bitmap being migrated by this node and returns true if it must not
+// be applied, because the bitmap is fenced or moved. Such writes are kept by the bitmap. The caller must hold s.mu.
+func (s *RaftServer) captureMigrating(op operaton) bool {
+	name := opBitmap(op)
+	if name == "" {
+		return false
+	}
+	bs := s.bmServer.bitmaps
+	if migrating, movedTo := bs.migration(name); migrating != 0 || movedTo != 0 {
+		bs.keep(name, KeptWrite{OP: op.OP, Value: op.Val})
+		return true
+	}
+
+	s.migrationsMu.Lock()
+	if m := s.migrations[name]; m != nil {
+		m.ops = append(m.ops, op)
+	}
+	s.migrationsMu.Unlock()
+	return false
+}
+
+// applyMigration applies a fence or a switch of a migration. Writes kept by the bitmap are applied when
+// its fence is lifted. The caller must hold s.mu.
+func (s *RaftServer) applyMigration(op operaton) {
+	items := strings.SplitN(op.Val, ",", 2)
+	if len(items) != 2 {
+		log.Printf("wrong request: %+v", op)
+		return
+	}
+	name := items[0]
+	group, err := strconv.ParseUint(items[1], 10, 64)
+	if err != nil {
+		log.Printf("wrong request: %+v", op)
+		return
+	}
+
+	bs := s.bmServer.bitmaps
+	if op.OP == BmOpMigrate {
+		bs.fence(name, group)
+		if _, movedTo := bs.migration(name); group == 0 && movedTo == 0 {
+			for _, w := range bs.takeKept(name) {
+				s.processOP(operaton{OP: w.OP, Val: w.Value, Time: op.Time})
+			}
+		}
+	} else {
+		bs.markMoved(name, group)
+	}
+
+	s.migrationsMu.Lock()
+	defer s.migrationsMu.Unlock()
+	m := s.migrations[name]
+	if m == nil || group != m.target {
+		return
+	}
+	c := m.moved
+	if op.OP == BmOpMigrate {
+		c = m.fenced
+	}
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
+}
+
+// applyReplayed removes writes kept by a moved bitmap which are replayed to its new raft group.
+// The caller must hold s.mu.
+func (s *RaftServer) applyReplayed(op operaton) {
+	items := strings.SplitN(op.Val, ",", 2)
+	if len(items) != 2 {
+		log.Printf("wrong request: %+v", op)
+		return
+	}
+	seq, err := strconv.ParseUint(items[1], 10, 64)
+	if err != nil {
+		log.Printf("wrong request: %+v", op)
+		return
+	}
+	s.bmServer.bitmaps.trimKept(items[0], seq)
+}
+
+// opBitmap returns the name of the bitmap written by op, or an empty string if it does not write a single bitmap.
+func opBitmap(op operaton) string {
+	switch op.OP {
+	case BmOpAdd, BmOpAddMany, BmOpRemove, BmOpSetMeta:
+		return strings.SplitN(op.Val, ",", 2)[0]
+	case BmOpDrop, BmOpClear, BmOpFreeze, BmOpThaw:
+		return op.Val
+	}
+	return ""
+}
+
+// saveBitmaps saves the named bitmaps in the format of Save.
+func (bs *Bitmaps) saveBitmaps(w *bytes.Buffer, names ...string) error {
+	if err := binary.Write(w, binary.LittleEndian, [2]uint32{bdbMagic, bdbVersion}); err != nil {
+		return err
+	}
+	for _, name := range names {
+		bs.mu.RLock()
+		bm := bs.bitmaps[name]
+		bs.mu.RUnlock()
+		if bm == nil {
+			return ErrBitmapNotFound
+		}
+		if err := bs.saveBitmap(w, name, bm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put replaces bitmaps with the ones saved in data, other bitmaps are not changed. Fences and kept writes
+// of bitmaps copied by resumed migrations are not put. Bitmaps put are notified as restored.
+func (bs *Bitmaps) put(data []byte) error {
+	copied := NewBitmaps()
+	copied.frozenDir = bs.frozenDir
+	if err := copied.Read(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	for name, b := range copied.bitmaps {
+		b.meta.Migrating, b.meta.Kept, b.meta.Replayed = 0, nil, 0
+
+		bs.mu.Lock()
+		old := bs.bitmaps[name]
+		bs.bitmaps[name] = b
+		bs.generation++
+		bs.mu.Unlock()
+
+		old.release()
+		bs.notify(NotifyGeneric, "restore", name)
+	}
+	return nil
+}
+
+// fence refuses writes to the named bitmap being migrated to the group, or lifts the fence if group is 0.
+func (bs *Bitmaps) fence(name string, group uint64) {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return
+	}
+
+	bm.mu.Lock()
+	if bm.meta.MovedTo == 0 {
+		bm.meta.Migrating = group
+	}
+	bm.mu.Unlock()
+}
+
+// markMoved deletes the named bitmap moved to the group and keeps its metadata, so it is routed to the group.
+func (bs *Bitmaps) markMoved(name string, group uint64) {
+	b := newBitmap(nil, bs.now())
+
+	bs.mu.Lock()
+	old := bs.bitmaps[name]
+	if old != nil {
+		old.mu.RLock()
+		b.meta = old.meta.clone()
+		old.mu.RUnlock()
+		b.meta.Frozen = false
+	}
+	b.meta.Migrating = 0
+	b.meta.MovedTo = group
+	bs.bitmaps[name] = b
+	bs.generation++
+	bs.mu.Unlock()
+
+	old.release()
+}
+
+// migration returns the raft group the named bitmap is being migrated to and the one it has been moved to,
+// they are 0 if it is not fenced or moved.
+func (bs *Bitmaps) migration(name string) (migrating, movedTo uint64) {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return 0, 0
+	}
+
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	return bm.meta.Migrating, bm.meta.MovedTo
+}
+
+// keep keeps the write refused by the fence of the named bitmap or applied after it is moved.
+func (bs *Bitmaps) keep(name string, w KeptWrite) {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return
+	}
+
+	bm.mu.Lock()
+	bm.meta.Kept = append(bm.meta.Kept, w)
+	bm.mu.Unlock()
+}
+
+// keptWrites returns the writes kept by the named bitmap and the number of kept writes removed before them.
+func (bs *Bitmaps) keptWrites(name string) ([]KeptWrite, uint64) {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return nil, 0
+	}
+
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	return append([]KeptWrite(nil), bm.meta.Kept...), bm.meta.Replayed
+}
+
+// trimKept removes the writes kept by the named bitmap up to the sequence seq, counted from the first kept write.
+func (bs *Bitmaps) trimKept(name string, seq uint64) {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return
+	}
+
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if seq <= bm.meta.Replayed {
+		return
+	}
+	n := seq - bm.meta.Replayed
+	if n > uint64(len(bm.meta.Kept)) {
+		n = uint64(len(bm.meta.Kept))
+	}
+	bm.meta.Kept = append([]KeptWrite(nil), bm.meta.Kept[n:]...)
+	if len(bm.meta.Kept) == 0 {
+		bm.meta.Kept = nil
+	}
+	bm.meta.Replayed = seq
+}
+
+// takeKept removes and returns the writes kept by the named bitmap.
+func (bs *Bitmaps) takeKept(name string) []KeptWrite {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return nil
+	}
+
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	kept := bm.meta.Kept
+	bm.meta.Kept, bm.meta.Replayed = nil, 0
+	return kept
+}
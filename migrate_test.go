@@ -0,0 +1,213 @@
+package basalt
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestOpBitmap(t *testing.T) {
+	cases := []struct {
+		op   operaton
+		name string
+	}{
+		{operaton{OP: BmOpAdd, Val: "a,1"}, "a"},
+		{operaton{OP: BmOpAddMany, Val: "a,1,2,3"}, "a"},
+		{operaton{OP: BmOpSetMeta, Val: "a,owner,ads"}, "a"},
+		{operaton{OP: BmOpDrop, Val: "a"}, "a"},
+		{operaton{OP: BmOpFreeze, Val: "a"}, "a"},
+		{operaton{OP: BmOpRestore, Val: "data"}, ""},
+		{operaton{OP: BmOpPut, Val: "data"}, ""},
+	}
+	for _, c := range cases {
+		if got := opBitmap(c.op); got != c.name {
+			t.Errorf("expect bitmap %q of %s but got %q", c.name, c.op.OP, got)
+		}
+	}
+}
+
+func TestBitmaps_Migration(t *testing.T) {
+	src := NewBitmaps()
+	src.AddMany("a", []uint32{1, 2, 3}, false)
+	src.AddMany("b", []uint32{4, 5}, false)
+
+	var buf bytes.Buffer
+	if err := src.saveBitmaps(&buf, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.saveBitmaps(&bytes.Buffer{}, "missing"); err != ErrBitmapNotFound {
+		t.Errorf("expect ErrBitmapNotFound but got %v", err)
+	}
+
+	dst := NewBitmaps()
+	dst.AddMany("c", []uint32{6}, false)
+	if err := dst.put(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if rt := dst.Union("a"); !reflect.DeepEqual(rt, []uint32{1, 2, 3}) {
+		t.Errorf("expect [1 2 3] copied but got %v", rt)
+	}
+	if dst.Card("c") != 1 || dst.Card("b") != 0 {
+		t.Errorf("expect only a copied")
+	}
+
+	src.fence("a", 2)
+	if migrating, movedTo := src.migration("a"); migrating != 2 || movedTo != 0 {
+		t.Errorf("expect a fenced for group 2 but got %d and %d", migrating, movedTo)
+	}
+	src.fence("a", 0)
+	if migrating, _ := src.migration("a"); migrating != 0 {
+		t.Errorf("expect the fence lifted but got %d", migrating)
+	}
+
+	src.fence("a", 2)
+	src.markMoved("a", 2)
+	if migrating, movedTo := src.migration("a"); migrating != 0 || movedTo != 2 {
+		t.Errorf("expect a moved to group 2 but got %d and %d", migrating, movedTo)
+	}
+	if src.Card("a") != 0 {
+		t.Errorf("expect the source copy deleted")
+	}
+
+	// tombstones are persisted
+	buf.Reset()
+	if err := src.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	src = NewBitmaps()
+	if err := src.Read(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, movedTo := src.migration("a"); movedTo != 2 {
+		t.Errorf("expect the tombstone of a restored but got %d", movedTo)
+	}
+}
+
+func TestServer_RouteMigrated(t *testing.T) {
+	rt, err := ParseRoutingTable([]byte(`{"mode":"range","splits":["h","p"],"groups":[
+		{"id":1,"shards":[0]},{"id":2,"shards":[1]},{"id":3,"shards":[2],"addrs":["127.0.0.1:38972"],"peers":["http://127.0.0.1:32379"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("", NewBitmaps(), nil, "")
+	s.SetRoutingTable(rt)
+	g1 := NewServer("", NewBitmaps(), nil, "")
+	g2 := NewServer("", NewBitmaps(), nil, "")
+	s.AddGroup(1, g1)
+	s.AddGroup(2, g2)
+
+	g1.bitmaps.AddMany("apple", []uint32{1, 2, 3}, false)
+	g1.bitmaps.AddMany("banana", []uint32{2, 3, 4}, false)
+
+	g1.bitmaps.fence("apple", 2)
+	if _, err := s.routeWrite("apple"); err != ErrMigrating {
+		t.Errorf("expect ErrMigrating but got %v", err)
+	}
+	if g, err := s.route("apple"); err != nil || g != g1 {
+		t.Errorf("expect reads of group 1 during the fence but got %v", err)
+	}
+	if g, err := s.routeWrite("banana"); err != nil || g != g1 {
+		t.Errorf("expect writes to other bitmaps of group 1 but got %v", err)
+	}
+
+	g1.bitmaps.markMoved("apple", 2)
+	if g, err := s.routeWrite("apple"); err != nil || g != g2 {
+		t.Errorf("expect group 2 for apple moved but got %v", err)
+	}
+	if _, err := s.routeAll("apple", "banana"); err != ErrCrossShard {
+		t.Errorf("expect ErrCrossShard but got %v", err)
+	}
+
+	g2.bitmaps.markMoved("apple", 3)
+	_, err = s.route("apple")
+	if e, ok := err.(*MovedError); !ok || e.Group != 3 || e.Addr != "127.0.0.1:38972" {
+		t.Errorf("expect MovedError to group 3 but got %v", err)
+	}
+
+	if err := g1.Migrate(context.Background(), "banana", 2); err != ErrNotSharded {
+		t.Errorf("expect ErrNotSharded but got %v", err)
+	}
+	if err := s.Migrate(context.Background(), "banana", 4); err != ErrGroupNotFound {
+		t.Errorf("expect ErrGroupNotFound but got %v", err)
+	}
+}
+
+func TestRaftServer_KeptWrites(t *testing.T) {
+	s := NewServer("", NewBitmaps(), nil, "")
+	rs := &RaftServer{bmServer: s, migrations: make(map[string]*migration)}
+	bs := s.bitmaps
+	bs.AddMany("a", []uint32{1}, false)
+	apply := func(op OP, value string) {
+		if o := (operaton{OP: op, Val: value, Time: 1}); !rs.captureMigrating(o) {
+			rs.processOP(o)
+		}
+	}
+
+	// writes refused by the fence are applied when it is lifted
+	apply(BmOpMigrate, "a,2")
+	apply(BmOpAdd, "a,2")
+	if kept, _ := bs.keptWrites("a"); len(kept) != 1 || bs.Exists("a", 2) {
+		t.Fatalf("expect the write kept but got %v", kept)
+	}
+	apply(BmOpMigrate, "a,0")
+	if kept, _ := bs.keptWrites("a"); len(kept) != 0 || !bs.Exists("a", 2) {
+		t.Errorf("expect the kept write applied but got %v", kept)
+	}
+
+	// an interrupted migration is resumed with the fence kept
+	apply(BmOpMigrate, "a,2")
+	apply(BmOpAdd, "a,3")
+	if _, _, err := rs.startMigration("a", 3); err != ErrMigrating {
+		t.Errorf("expect ErrMigrating but got %v", err)
+	}
+	m, data, err := rs.startMigration("a", 2)
+	if err != nil || !m.resumed {
+		t.Fatalf("expect the migration resumed but got %v", err)
+	}
+	dst := NewBitmaps()
+	if err := dst.put(data); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := dst.Metadata("a"); meta.Migrating != 0 || meta.Kept != nil {
+		t.Errorf("expect no fence or kept writes put but got %+v", meta)
+	}
+
+	// writes applied after the switch are kept by the tombstone, and persisted
+	apply(BmOpMigrated, "a,2")
+	apply(BmOpRemove, "a,1")
+	var buf bytes.Buffer
+	if err := bs.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewBitmaps()
+	if err := restored.Read(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if kept, _ := restored.keptWrites("a"); len(kept) != 2 {
+		t.Errorf("expect 2 kept writes restored but got %v", kept)
+	}
+
+	var replayed []string
+	propose := func(op OP, value string) error {
+		replayed = append(replayed, op.String()+" "+value)
+		return nil
+	}
+	if n, err := rs.replayKept(m, propose); err != nil || n != 2 {
+		t.Fatalf("expect 2 writes replayed but got %d, %v", n, err)
+	}
+	apply(BmOpReplayed, "a,1")
+	apply(BmOpAdd, "a,4")
+	if n, err := rs.replayKept(m, propose); err != nil || n != 1 {
+		t.Fatalf("expect 1 write replayed but got %d, %v", n, err)
+	}
+	expected := []string{"ADD a,3", "REMOVE a,1", "ADD a,4"}
+	if !reflect.DeepEqual(replayed, expected) {
+		t.Errorf("expect %v replayed but got %v", expected, replayed)
+	}
+	apply(BmOpReplayed, "a,3")
+	if kept, n := bs.keptWrites("a"); len(kept) != 0 || n != 3 {
+		t.Errorf("expect kept writes removed but got %v and %d", kept, n)
+	}
+	rs.endMigration(m)
+}
@@ -0,0 +1,106 @@
+package basalt
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// KeyspaceEvents are classes of keyspace notifications, configured by letters like notify-keyspace-events of Redis.
+type KeyspaceEvents uint32
+
+// Classes of keyspace notifications. Notifications are published only if K or E is set along with the class
+// of the event.
+const (
+	NotifyKeyspace KeyspaceEvents = 1 << iota // K: the event is published to __keyspace@0__:<bitmap>
+	NotifyKeyevent                            // E: the bitmap is published to __keyevent@0__:<event>
+	NotifyGeneric                             // g: del and restore
+	NotifyString                              // $: setbit and set of bit commands
+	NotifyBitmap                              // b: writes of bitmap commands, like bmadd and bmclear
+
+	NotifyAll = NotifyGeneric | NotifyString | NotifyBitmap // A
+)
+
+// Prefixes of channels of keyspace notifications, bitmaps are in the database 0.
+const (
+	keyspaceChannelPrefix = "__keyspace@0__:"
+	keyeventChannelPrefix = "__keyevent@0__:"
+)
+
+var keyspaceEventLetters = []struct {
+	letter byte
+	events KeyspaceEvents
+}{
+	{'K', NotifyKeyspace},
+	{'E', NotifyKeyevent},
+	{'A', NotifyAll},
+	{'g', NotifyGeneric},
+	{'$', NotifyString},
+	{'b', NotifyBitmap},
+}
+
+// ParseKeyspaceEvents parses classes of keyspace notifications, like "KEA" or "Kb". Notifications are disabled
+// by an empty string.
+func ParseKeyspaceEvents(s string) (KeyspaceEvents, error) {
+	var events KeyspaceEvents
+	for i := 0; i < len(s); i++ {
+		found := false
+		for _, l := range keyspaceEventLetters {
+			if s[i] == l.letter {
+				events |= l.events
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown class of keyspace events %q", s[i])
+		}
+	}
+	return events, nil
+}
+
+// SetNotifyKeyspaceEvents sets classes of keyspace notifications published to subscribers of the redis service,
+// for bitmaps of all raft groups hosted by the server. Notifications are disabled by default.
+func (s *Server) SetNotifyKeyspaceEvents(events string) error {
+	e, err := ParseKeyspaceEvents(events)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&s.pubsub.events, uint32(e))
+	return nil
+}
+
+// notifyFunc is notified of writes to bitmaps.
+type notifyFunc func(class KeyspaceEvents, event, name string)
+
+// setNotify sets the function notified of writes to bitmaps.
+func (bs *Bitmaps) setNotify(notify notifyFunc) {
+	bs.notifier.Store(notify)
+}
+
+// notify notifies the event of the named bitmap. Events are notified where writes are applied, so every replica
+// of a raft group notifies them. It must be invoked without locks of bitmaps held.
+func (bs *Bitmaps) notify(class KeyspaceEvents, event, name string) {
+	if notify, ok := bs.notifier.Load().(notifyFunc); ok {
+		notify(class, event, name)
+	}
+}
+
+// notifyKeyspaceEvent queues the event of the named bitmap to be published if its class is configured. It is
+// notified while writes are applied, so channels are matched by publishEvent off the apply loop.
+func (ps *pubSub) notifyKeyspaceEvent(class KeyspaceEvents, e, name string) {
+	if KeyspaceEvents(atomic.LoadUint32(&ps.events))&class == 0 {
+		return
+	}
+	ps.enqueue(event{e, name})
+}
+
+// publishEvent publishes the event to the channels of configured notifications.
+func (ps *pubSub) publishEvent(e event) {
+	events := KeyspaceEvents(atomic.LoadUint32(&ps.events))
+	if events&NotifyKeyspace != 0 {
+		ps.publish(keyspaceChannelPrefix+e.name, e.event, e.name)
+	}
+	if events&NotifyKeyevent != 0 {
+		ps.publish(keyeventChannelPrefix+e.event, e.name, e.name)
+	}
+}
@@ -0,0 +1,154 @@
+package basalt
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseKeyspaceEvents(t *testing.T) {
+	for _, c := range []struct {
+		s      string
+		events KeyspaceEvents
+	}{
+		{"", 0},
+		{"KEA", NotifyKeyspace | NotifyKeyevent | NotifyAll},
+		{"Kb", NotifyKeyspace | NotifyBitmap},
+		{"Eg$", NotifyKeyevent | NotifyGeneric | NotifyString},
+	} {
+		if events, err := ParseKeyspaceEvents(c.s); err != nil || events != c.events {
+			t.Errorf("expect %b for %q but got %b, %v", c.events, c.s, events, err)
+		}
+	}
+	if _, err := ParseKeyspaceEvents("Kx"); err == nil {
+		t.Error("expect an error of an unknown class")
+	}
+}
+
+func TestBitmaps_Notify(t *testing.T) {
+	bs := NewBitmaps()
+	var events []string
+	bs.setNotify(func(class KeyspaceEvents, event, name string) {
+		events = append(events, event+" "+name)
+	})
+
+	bs.Add("a", 1, false)
+	bs.AddMany("a", []uint32{2, 3}, false)
+	bs.Remove("a", 3, false)
+	bs.UnionStore("b", "a")
+	bs.ClearBitmap("b", false)
+	bs.SetBit("c", 7, 1)
+	bs.BitField("c", []BitFieldOp{{Op: "get", Bits: 8}})
+	bs.BitField("c", []BitFieldOp{{Op: "incrby", Bits: 8, Value: 1}})
+	bs.BitOp("or", "d", "x")
+	bs.BitOp("or", "d", "c")
+	bs.RemoveBitmap("x", false)
+	bs.Del("b", "x")
+	if _, err := bs.Exec(&Transaction{Commands: [][]string{{"bmadd", "e", "1"}, {"bmcard", "e"}}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// writes are notified where they are applied
+	rs := &RaftServer{bmServer: &Server{bitmaps: bs}, migrations: make(map[string]*migration)}
+	rs.processOP(operaton{OP: BmOpDrop, Val: "e", Time: 1})
+
+	expected := []string{"bmadd a", "bmaddmany a", "bmdel a", "bmunionstore b", "bmclear b", "setbit c", "setbit c",
+		"set d", "del b", "bmadd e", "del e"}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Errorf("expect events %v but got %v", expected, events)
+	}
+}
+
+func TestPubSub_EnqueueDropsWhenFull(t *testing.T) {
+	ps := &pubSub{events: uint32(NotifyKeyspace | NotifyAll), queue: make(chan event, 1)}
+	ps.notifyKeyspaceEvent(NotifyBitmap, "bmadd", "a")
+	ps.notifyKeyspaceEvent(NotifyBitmap, "bmadd", "b")
+	if n := len(ps.queue); n != 1 || ps.dropped != 1 {
+		t.Errorf("expect 1 event queued and 1 dropped but got %d and %d", n, ps.dropped)
+	}
+	if e := <-ps.queue; e.name != "a" {
+		t.Errorf("expect the event of a queued but got %v", e)
+	}
+}
+
+func TestServer_KeyspaceNotifications(t *testing.T) {
+	acl, err := ParseACL([]byte(testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	s := NewServer(addr, NewBitmaps(), nil, "")
+	s.SetACL(acl)
+	if err := s.SetNotifyKeyspaceEvents("KEbg"); err != nil {
+		t.Fatal(err)
+	}
+	s.ln = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.configListener(ctx, ln)
+	<-s.started
+
+	dial := func() func(args ...string) string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return redisCaller(t, conn)
+	}
+	writer, sub, sub3, public := dial(), dial(), dial(), dial()
+	for _, redis := range []func(args ...string) string{writer, sub, sub3} {
+		if reply := redis("auth", "admin", "password"); reply != "+OK" {
+			t.Fatalf("failed to authenticate: %s", reply)
+		}
+	}
+
+	for _, c := range []struct {
+		redis func(args ...string) string
+		args  []string
+		reply string
+	}{
+		{sub, []string{"unsubscribe"}, "unsubscribe $-1 :0"},
+		{sub, []string{"subscribe", "__keyspace@0__:a"}, "subscribe __keyspace@0__:a :1"},
+		{sub, []string{"psubscribe", "__keyevent@0__:bm*"}, "psubscribe __keyevent@0__:bm* :2"},
+		{sub, []string{"bmcard", "a"}, "-ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context"},
+		{sub, []string{"ping"}, "pong "},
+		{sub3, []string{"hello", "3"}, "%server redis version 6.0.0 proto :3 id :3 mode standalone role master modules "},
+		{sub3, []string{"subscribe", "__keyevent@0__:del"}, ">subscribe __keyevent@0__:del :1"},
+		{sub3, []string{"bmcard", "a"}, ":0"},
+		{public, []string{"psubscribe", "__keyevent@0__:*"}, "psubscribe __keyevent@0__:* :1"},
+
+		// setbit is not published without $
+		{writer, []string{"setbit", "a", "2", "1"}, ":0"},
+		{writer, []string{"bmadd", "a", "1"}, ":1"},
+		{sub, nil, "message __keyspace@0__:a bmadd"},
+		{sub, nil, "pmessage __keyevent@0__:bm* __keyevent@0__:bmadd a"},
+		{writer, []string{"bmadd", "public:1", "1"}, ":1"},
+		{sub, nil, "pmessage __keyevent@0__:bm* __keyevent@0__:bmadd public:1"},
+		{writer, []string{"del", "a", "public:1"}, ":2"},
+		{sub, nil, "message __keyspace@0__:a del"},
+		{sub3, nil, ">message __keyevent@0__:del a"},
+		{sub3, nil, ">message __keyevent@0__:del public:1"},
+		// the default user can only read public:*
+		{public, nil, "pmessage __keyevent@0__:* __keyevent@0__:bmadd public:1"},
+		{public, nil, "pmessage __keyevent@0__:* __keyevent@0__:del public:1"},
+
+		{sub, []string{"unsubscribe"}, "unsubscribe __keyspace@0__:a :1"},
+		{sub, []string{"punsubscribe", "__keyevent@0__:bm*", "x"}, "punsubscribe __keyevent@0__:bm* :0"},
+		{sub, nil, "punsubscribe x :0"},
+		{sub, []string{"bmcard", "a"}, ":0"},
+	} {
+		if reply := c.redis(c.args...); reply != c.reply {
+			t.Errorf("expect %s for %v but got %s", c.reply, c.args, reply)
+		}
+	}
+
+	if list := writer("client", "list"); !strings.Contains(list, " sub=1 psub=0 cmd=bmcard resp=3") {
+		t.Errorf("unexpected client list %q", list)
+	}
+}
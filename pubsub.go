@@ -0,0 +1,351 @@
+package basalt
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tidwall/redcon"
+)
+
+// subscriberQueueLen is the number of messages queued for a subscriber. Like client-output-buffer-limit of Redis,
+// a subscriber too slow to receive them is disconnected, so publishers are never blocked.
+const subscriberQueueLen = 4096
+
+// publishQueueLen is the number of keyspace events queued to be published. Events are notified where writes are
+// applied, they are dropped if the queue is full, so the apply loop is never blocked by matching patterns.
+const publishQueueLen = 65536
+
+// pubSub publishes messages to redis connections subscribing channels, or patterns matching channels.
+// It is shared by all raft groups hosted by the server.
+type pubSub struct {
+	events  uint32 // KeyspaceEvents published, accessed atomically
+	dropped uint64 // events dropped because the queue is full, accessed atomically
+
+	queue chan event // events to be published
+	done  chan struct{}
+
+	mu          sync.RWMutex
+	channels    map[string]map[*subscriber]bool
+	patterns    map[string]map[*subscriber]bool
+	subscribers map[*subscriber]bool
+	closed      bool
+}
+
+func newPubSub() *pubSub {
+	ps := &pubSub{
+		queue:       make(chan event, publishQueueLen),
+		done:        make(chan struct{}),
+		channels:    make(map[string]map[*subscriber]bool),
+		patterns:    make(map[string]map[*subscriber]bool),
+		subscribers: make(map[*subscriber]bool),
+	}
+	go ps.publishEvents()
+	return ps
+}
+
+// event is a keyspace event to be published.
+type event struct {
+	event string
+	name  string
+}
+
+// enqueue queues the event to be published without blocking, it is dropped if the queue is full.
+func (ps *pubSub) enqueue(e event) {
+	select {
+	case ps.queue <- e:
+	default:
+		atomic.AddUint64(&ps.dropped, 1)
+	}
+}
+
+// publishEvents publishes queued events until the pubSub is closed.
+func (ps *pubSub) publishEvents() {
+	for {
+		select {
+		case e := <-ps.queue:
+			ps.publishEvent(e)
+		case <-ps.done:
+			return
+		}
+	}
+}
+
+// message is a message published to a channel, it is about the key and delivered only to subscribers allowed
+// to read the key.
+type message struct {
+	pattern string // the matched pattern, empty if the channel is subscribed
+	channel string
+	payload string
+	key     string
+}
+
+// publish queues the message to subscribers of the channel and subscribers of patterns matching the channel.
+func (ps *pubSub) publish(channel, payload, key string) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for sub := range ps.channels[channel] {
+		sub.send(message{channel: channel, payload: payload, key: key})
+	}
+	for pattern, subs := range ps.patterns {
+		if !matchGlob(pattern, channel) {
+			continue
+		}
+		for sub := range subs {
+			sub.send(message{pattern: pattern, channel: channel, payload: payload, key: key})
+		}
+	}
+}
+
+// add adds the subscriber, it returns false if the pubSub is closed.
+func (ps *pubSub) add(sub *subscriber) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return false
+	}
+	ps.subscribers[sub] = true
+	return true
+}
+
+// remove removes the subscriber and its subscriptions.
+func (ps *pubSub) remove(sub *subscriber) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.subscribers, sub)
+	for ch := range sub.channels {
+		ps.unsubscribeLocked(ps.channels, ch, sub)
+	}
+	for pattern := range sub.patterns {
+		ps.unsubscribeLocked(ps.patterns, pattern, sub)
+	}
+}
+
+func (ps *pubSub) subscribe(subs map[string]map[*subscriber]bool, name string, sub *subscriber) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if subs[name] == nil {
+		subs[name] = make(map[*subscriber]bool)
+	}
+	subs[name][sub] = true
+}
+
+func (ps *pubSub) unsubscribe(subs map[string]map[*subscriber]bool, name string, sub *subscriber) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.unsubscribeLocked(subs, name, sub)
+}
+
+func (ps *pubSub) unsubscribeLocked(subs map[string]map[*subscriber]bool, name string, sub *subscriber) {
+	delete(subs[name], sub)
+	if len(subs[name]) == 0 {
+		delete(subs, name)
+	}
+}
+
+// close disconnects all subscribers, no subscriber can be added after it is closed.
+func (ps *pubSub) close() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if !ps.closed {
+		close(ps.done)
+	}
+	ps.closed = true
+	for sub := range ps.subscribers {
+		sub.close()
+	}
+}
+
+// subscriber is a redis connection detached from the server loop when it subscribes first, so messages can be
+// written to it while it waits for commands. Its commands are run by serveSubscriber.
+type subscriber struct {
+	conn      redcon.DetachedConn
+	client    *redisClient
+	mu        sync.Mutex // held to write to conn
+	messages  chan message
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// subscriptions, they are written with client.mu held by the goroutine running commands of the connection
+	channels map[string]bool
+	patterns map[string]bool
+}
+
+func newSubscriber(conn redcon.DetachedConn, c *redisClient) *subscriber {
+	return &subscriber{
+		conn:     conn,
+		client:   c,
+		messages: make(chan message, subscriberQueueLen),
+		done:     make(chan struct{}),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+}
+
+// send queues the message, the subscriber is disconnected if its queue is full.
+func (sub *subscriber) send(m message) {
+	select {
+	case sub.messages <- m:
+	default:
+		sub.close()
+	}
+}
+
+// close closes the connection without waiting for writes in progress.
+func (sub *subscriber) close() {
+	sub.closeOnce.Do(func() {
+		close(sub.done)
+		sub.conn.NetConn().Close()
+	})
+}
+
+// count returns the number of subscribed channels and patterns.
+func (sub *subscriber) count() int {
+	return len(sub.channels) + len(sub.patterns)
+}
+
+// writeMessages writes queued messages until the subscriber is closed.
+func (sub *subscriber) writeMessages() {
+	for {
+		select {
+		case m := <-sub.messages:
+			sub.mu.Lock()
+			sub.writeMessage(m)
+			for n := len(sub.messages); n > 0; n-- {
+				sub.writeMessage(<-sub.messages)
+			}
+			err := sub.conn.Flush()
+			sub.mu.Unlock()
+			if err != nil {
+				sub.close()
+				return
+			}
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// writeMessage writes the message if the user of the connection can read its key.
+func (sub *subscriber) writeMessage(m message) {
+	sub.client.mu.Lock()
+	user := sub.client.user
+	sub.client.mu.Unlock()
+	if user != nil && user.Allowed(CategoryRead, m.key) != nil {
+		return
+	}
+
+	if m.pattern != "" {
+		writePush(sub.conn, 4)
+		sub.conn.WriteBulkString("pmessage")
+		sub.conn.WriteBulkString(m.pattern)
+	} else {
+		writePush(sub.conn, 3)
+		sub.conn.WriteBulkString("message")
+	}
+	sub.conn.WriteBulkString(m.channel)
+	sub.conn.WriteBulkString(m.payload)
+}
+
+// subscribe runs subscribe, psubscribe, unsubscribe and punsubscribe. The connection is detached from the server
+// loop when it subscribes first, and its commands are run by serveSubscriber until it is closed.
+func (rs *RedisService) subscribe(conn redcon.Conn, c *redisClient, name string, args [][]byte) {
+	sub := c.subscriber
+	if sub == nil {
+		if name == "unsubscribe" || name == "punsubscribe" {
+			writePush(conn, 3)
+			conn.WriteBulkString(name)
+			writeNull(conn)
+			conn.WriteInt(0)
+			return
+		}
+
+		sub = newSubscriber(conn.Detach(), c)
+		if !rs.s.pubsub.add(sub) {
+			sub.conn.Close()
+			return
+		}
+		c.mu.Lock()
+		c.subscriber = sub
+		c.mu.Unlock()
+		// serveSubscriber writes after the replies below
+		sub.mu.Lock()
+		defer sub.mu.Unlock()
+		go rs.serveSubscriber(sub)
+	}
+
+	ps := rs.s.pubsub
+	subscribed, subs := sub.channels, ps.channels
+	if name == "psubscribe" || name == "punsubscribe" {
+		subscribed, subs = sub.patterns, ps.patterns
+	}
+	var names []string
+	for _, arg := range args[1:] {
+		names = append(names, string(arg))
+	}
+	switch name {
+	case "subscribe", "psubscribe":
+		for _, n := range names {
+			if !subscribed[n] {
+				ps.subscribe(subs, n, sub)
+				c.mu.Lock()
+				subscribed[n] = true
+				c.mu.Unlock()
+			}
+			writePush(conn, 3)
+			conn.WriteBulkString(name)
+			conn.WriteBulkString(n)
+			conn.WriteInt(sub.count())
+		}
+	default:
+		if len(names) == 0 {
+			for n := range subscribed {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+		}
+		if len(names) == 0 {
+			writePush(conn, 3)
+			conn.WriteBulkString(name)
+			writeNull(conn)
+			conn.WriteInt(sub.count())
+		}
+		for _, n := range names {
+			if subscribed[n] {
+				ps.unsubscribe(subs, n, sub)
+				c.mu.Lock()
+				delete(subscribed, n)
+				c.mu.Unlock()
+			}
+			writePush(conn, 3)
+			conn.WriteBulkString(name)
+			conn.WriteBulkString(n)
+			conn.WriteInt(sub.count())
+		}
+	}
+}
+
+// serveSubscriber runs commands of the subscribing connection until it is closed. The connection stays detached
+// after all subscriptions are removed.
+func (rs *RedisService) serveSubscriber(sub *subscriber) {
+	go sub.writeMessages()
+	defer func() {
+		rs.s.pubsub.remove(sub)
+		sub.close()
+		rs.removeClient(sub.client)
+	}()
+
+	sub.mu.Lock()
+	err := sub.conn.Flush()
+	sub.mu.Unlock()
+	for err == nil {
+		var cmd redcon.Command
+		if cmd, err = sub.conn.ReadCommand(); err != nil {
+			return
+		}
+		sub.mu.Lock()
+		rs.handler(sub.conn, cmd)
+		err = sub.conn.Flush()
+		sub.mu.Unlock()
+	}
+}
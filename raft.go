@@ -18,16 +18,21 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rpcxio/etcd/etcdserver/api/rafthttp"
 	"github.com/rpcxio/etcd/etcdserver/api/snap"
 	stats "github.com/rpcxio/etcd/etcdserver/api/v2stats"
 	"github.com/rpcxio/etcd/pkg/fileutil"
+	"github.com/rpcxio/etcd/pkg/transport"
 	"github.com/rpcxio/etcd/pkg/types"
 	"github.com/rpcxio/etcd/raft"
 	"github.com/rpcxio/etcd/raft/raftpb"
@@ -37,18 +42,27 @@ import (
 	"go.uber.org/zap"
 )
 
-// A key-value stream backed by raft
-type raftNode struct {
-	proposeC    <-chan string            // proposed messages (k,v)
-	confChangeC <-chan raftpb.ConfChange // proposed cluster config changes
-	commitC     chan<- *string           // entries committed to log (k,v)
-	errorC      chan<- error             // errors from raft session
+// Commit is a log entry committed by raft.
+type Commit struct {
+	Data  string // proposed message, empty for the empty entry of a new leader
+	Index uint64 // raft index of the entry
+	Term  uint64 // raft term of the entry
+}
+
+// RaftNode is a key-value stream backed by raft.
+type RaftNode struct {
+	proposeC    <-chan string             // proposed messages (k,v)
+	confChangeC <-chan raftpb.ConfChangeI // proposed cluster config changes, ConfChange or ConfChangeV2
+	commitC     chan<- *Commit            // entries committed to log (k,v)
+	errorC      chan<- error              // errors from raft session
 
+	group       uint64   // ID of the raft group, 0 if bitmaps are not sharded
 	id          int      // client ID for raft session
 	peers       []string // raft peer URLs
 	join        bool     // node is joining an existing cluster
 	waldir      string   // path to WAL directory
 	snapdir     string   // path to snapshot directory
+	removedPath string   // path to the file of removed member IDs
 	getSnapshot func() ([]byte, error)
 	lastIndex   uint64 // index of log at start
 
@@ -69,45 +83,95 @@ type raftNode struct {
 	stopc     chan struct{} // signals proposal channel closed
 	httpstopc chan struct{} // signals http server to shutdown
 	httpdonec chan struct{} // signals http server shutdown complete
+	startedc  chan struct{} // closed when node and transport are started
+	donec     chan struct{} // closed when the node is stopped and its WAL is closed
+
+	snapshotOnStop int32 // set to take a snapshot when the proposal channel is closed
+
+	peerTLS transport.TLSInfo // set to secure raft traffic between peers with mutual TLS
+
+	snapshotDuration prometheus.Histogram // durations of snapshots taken by this node
+
+	lead uint64 // ID of the leader known by this node, 0 if it is unknown
+	term uint64 // current term known by this node
+
+	mu       sync.RWMutex
+	peerURLs map[uint64]string      // raft URLs of members, by node ID
+	removed  map[uint64]struct{}    // IDs of members removed from the cluster
+	health   map[uint64]*peerHealth // health of peers reported by the transport, by node ID
 }
 
 var defaultSnapshotCount uint64 = 10000
 
-// newRaftNode initiates a raft instance and returns a committed log entry
+// RaftNodeOption configures a raft node before it starts.
+type RaftNodeOption func(*RaftNode)
+
+// WithPeerTLS secures raft traffic between peers with mutual TLS, so URLs of peers must be https.
+// Peers present their certificates to each other, and they are verified by the CA of the options.
+func WithPeerTLS(opts TLSOptions) RaftNodeOption {
+	return func(rc *RaftNode) {
+		rc.peerTLS = opts.info()
+		rc.peerTLS.ClientCertAuth = true
+	}
+}
+
+// NewRaftNode initiates a raft instance and returns it with a committed log entry
 // channel and error channel. Proposals for log updates are sent over the
 // provided the proposal channel. All log entries are replayed over the
 // commit channel, followed by a nil message (to indicate the channel is
 // current), then new log entries. To shutdown, close proposeC and read errorC.
 func NewRaftNode(id int, peers []string, join bool, getSnapshot func() ([]byte, error), proposeC <-chan string,
-	confChangeC <-chan raftpb.ConfChange) (<-chan *string, <-chan error, <-chan *snap.Snapshotter) {
+	confChangeC <-chan raftpb.ConfChangeI, opts ...RaftNodeOption) (*RaftNode, <-chan *Commit, <-chan error, <-chan *snap.Snapshotter) {
+	return NewRaftGroupNode(0, id, peers, join, getSnapshot, proposeC, confChangeC, opts...)
+}
 
-	commitC := make(chan *string)
+// NewRaftGroupNode initiates a raft instance of a raft group like NewRaftNode, so a process can run
+// a raft node for each group it hosts. Nodes of different groups have their own WAL, snapshots and peers.
+func NewRaftGroupNode(group uint64, id int, peers []string, join bool, getSnapshot func() ([]byte, error), proposeC <-chan string,
+	confChangeC <-chan raftpb.ConfChangeI, opts ...RaftNodeOption) (*RaftNode, <-chan *Commit, <-chan error, <-chan *snap.Snapshotter) {
+
+	commitC := make(chan *Commit)
 	errorC := make(chan error)
 
-	rc := &raftNode{
+	prefix := fmt.Sprintf("raftexample-%d", id)
+	if group != 0 {
+		prefix = fmt.Sprintf("raftexample-g%d-%d", group, id)
+	}
+
+	rc := &RaftNode{
 		proposeC:    proposeC,
 		confChangeC: confChangeC,
 		commitC:     commitC,
 		errorC:      errorC,
+		group:       group,
 		id:          id,
 		peers:       peers,
 		join:        join,
-		waldir:      fmt.Sprintf("raftexample-%d", id),
-		snapdir:     fmt.Sprintf("raftexample-%d-snap", id),
+		waldir:      prefix,
+		snapdir:     prefix + "-snap",
+		removedPath: prefix + "-removed",
 		getSnapshot: getSnapshot,
 		snapCount:   defaultSnapshotCount,
 		stopc:       make(chan struct{}),
 		httpstopc:   make(chan struct{}),
 		httpdonec:   make(chan struct{}),
+		startedc:    make(chan struct{}),
+		donec:       make(chan struct{}),
+		peerURLs:    make(map[uint64]string),
+		health:      make(map[uint64]*peerHealth),
 
+		snapshotDuration: newSnapshotHistogram(group),
 		snapshotterReady: make(chan *snap.Snapshotter, 1),
 		// rest of structure populated after WAL replay
 	}
+	for _, opt := range opts {
+		opt(rc)
+	}
 	go rc.startRaft()
-	return commitC, errorC, rc.snapshotterReady
+	return rc, commitC, errorC, rc.snapshotterReady
 }
 
-func (rc *raftNode) saveSnap(snap raftpb.Snapshot) error {
+func (rc *RaftNode) saveSnap(snap raftpb.Snapshot) error {
 	// must save the snapshot index to the WAL before saving the
 	// snapshot to maintain the invariant that we only Open the
 	// wal at previously-saved snapshot indexes.
@@ -124,7 +188,7 @@ func (rc *raftNode) saveSnap(snap raftpb.Snapshot) error {
 	return rc.wal.ReleaseLockTo(snap.Metadata.Index)
 }
 
-func (rc *raftNode) entriesToApply(ents []raftpb.Entry) (nents []raftpb.Entry) {
+func (rc *RaftNode) entriesToApply(ents []raftpb.Entry) (nents []raftpb.Entry) {
 	if len(ents) == 0 {
 		return ents
 	}
@@ -140,17 +204,15 @@ func (rc *raftNode) entriesToApply(ents []raftpb.Entry) (nents []raftpb.Entry) {
 
 // publishEntries writes committed log entries to commit channel and returns
 // whether all entries could be published.
-func (rc *raftNode) publishEntries(ents []raftpb.Entry) bool {
+func (rc *RaftNode) publishEntries(ents []raftpb.Entry) bool {
 	for i := range ents {
 		switch ents[i].Type {
 		case raftpb.EntryNormal:
-			if len(ents[i].Data) == 0 {
-				// ignore empty messages
-				break
-			}
-			s := string(ents[i].Data)
+			// empty entries appended by new leaders are published, so proposals dropped in previous terms
+			// can be expired
+			c := &Commit{Data: string(ents[i].Data), Index: ents[i].Index, Term: ents[i].Term}
 			select {
-			case rc.commitC <- &s:
+			case rc.commitC <- c:
 			case <-rc.stopc:
 				return false
 			}
@@ -158,18 +220,23 @@ func (rc *raftNode) publishEntries(ents []raftpb.Entry) bool {
 		case raftpb.EntryConfChange:
 			var cc raftpb.ConfChange
 			cc.Unmarshal(ents[i].Data)
-			rc.confState = *rc.node.ApplyConfChange(cc)
-			switch cc.Type {
-			case raftpb.ConfChangeAddNode:
-				if len(cc.Context) > 0 {
-					rc.transport.AddPeer(types.ID(cc.NodeID), []string{string(cc.Context)})
-				}
-			case raftpb.ConfChangeRemoveNode:
-				if cc.NodeID == uint64(rc.id) {
-					log.Println("I've been removed from the cluster! Shutting down.")
-					return false
-				}
-				rc.transport.RemovePeer(types.ID(cc.NodeID))
+			urls := make(map[uint64]string)
+			if (cc.Type == raftpb.ConfChangeAddNode || cc.Type == raftpb.ConfChangeAddLearnerNode) && len(cc.Context) > 0 {
+				urls[cc.NodeID] = string(cc.Context)
+			}
+			if !rc.applyConfChange(cc, urls) {
+				return false
+			}
+
+		case raftpb.EntryConfChangeV2:
+			var cc raftpb.ConfChangeV2
+			cc.Unmarshal(ents[i].Data)
+			urls, err := decodeMemberURLs(cc.Context)
+			if err != nil {
+				log.Printf("wrong context of conf change at index %d: %v", ents[i].Index, err)
+			}
+			if !rc.applyConfChange(cc, urls) {
+				return false
 			}
 		}
 
@@ -188,7 +255,7 @@ func (rc *raftNode) publishEntries(ents []raftpb.Entry) bool {
 	return true
 }
 
-func (rc *raftNode) loadSnapshot() *raftpb.Snapshot {
+func (rc *RaftNode) loadSnapshot() *raftpb.Snapshot {
 	snapshot, err := rc.snapshotter.Load()
 	if err != nil && err != snap.ErrNoSnapshot {
 		log.Fatalf("raftexample: error loading snapshot (%v)", err)
@@ -197,7 +264,7 @@ func (rc *raftNode) loadSnapshot() *raftpb.Snapshot {
 }
 
 // openWAL returns a WAL ready for reading.
-func (rc *raftNode) openWAL(snapshot *raftpb.Snapshot) *wal.WAL {
+func (rc *RaftNode) openWAL(snapshot *raftpb.Snapshot) *wal.WAL {
 	if !wal.Exist(rc.waldir) {
 		if err := os.Mkdir(rc.waldir, 0750); err != nil {
 			log.Fatalf("raftexample: cannot create dir for wal (%v)", err)
@@ -224,7 +291,7 @@ func (rc *raftNode) openWAL(snapshot *raftpb.Snapshot) *wal.WAL {
 }
 
 // replayWAL replays WAL entries into the raft instance.
-func (rc *raftNode) replayWAL() *wal.WAL {
+func (rc *RaftNode) replayWAL() *wal.WAL {
 	log.Printf("replaying WAL of member %d", rc.id)
 	snapshot := rc.loadSnapshot()
 	w := rc.openWAL(snapshot)
@@ -249,7 +316,7 @@ func (rc *raftNode) replayWAL() *wal.WAL {
 	return w
 }
 
-func (rc *raftNode) writeError(err error) {
+func (rc *RaftNode) writeError(err error) {
 	rc.stopHTTP()
 	close(rc.commitC)
 	rc.errorC <- err
@@ -257,7 +324,7 @@ func (rc *raftNode) writeError(err error) {
 	rc.node.Stop()
 }
 
-func (rc *raftNode) startRaft() {
+func (rc *RaftNode) startRaft() {
 	if !fileutil.Exist(rc.snapdir) {
 		if err := os.Mkdir(rc.snapdir, 0750); err != nil {
 			log.Fatalf("raftexample: cannot create dir for snapshot (%v)", err)
@@ -266,6 +333,14 @@ func (rc *raftNode) startRaft() {
 	rc.snapshotter = snap.New(zap.NewExample(), rc.snapdir)
 	rc.snapshotterReady <- rc.snapshotter
 
+	removed, err := loadRemovedIDs(rc.removedPath)
+	if err != nil {
+		log.Fatalf("raftexample: failed to load removed members (%v)", err)
+	}
+	rc.mu.Lock()
+	rc.removed = removed
+	rc.mu.Unlock()
+
 	oldwal := wal.Exist(rc.waldir)
 	rc.wal = rc.replayWAL()
 
@@ -283,52 +358,57 @@ func (rc *raftNode) startRaft() {
 		MaxUncommittedEntriesSize: 1 << 30,
 	}
 
-	if oldwal {
+	// a joining node starts without peers, it learns the configuration from the leader.
+	if oldwal || rc.join {
 		rc.node = raft.RestartNode(c)
 	} else {
-		startPeers := rpeers
-		if rc.join {
-			startPeers = nil
-		}
-		rc.node = raft.StartNode(c, startPeers)
+		rc.node = raft.StartNode(c, rpeers)
 	}
 
 	rc.transport = &rafthttp.Transport{
 		Logger:      zap.NewExample(),
 		ID:          types.ID(rc.id),
-		ClusterID:   0x1000,
+		ClusterID:   types.ID(0x1000 + rc.group),
 		Raft:        rc,
 		ServerStats: stats.NewServerStats("", ""),
 		LeaderStats: stats.NewLeaderStats(zap.NewExample(), strconv.Itoa(rc.id)),
 		ErrorC:      make(chan error),
+		TLSInfo:     rc.peerTLS,
 	}
 
-	rc.transport.Start()
+	if err := rc.transport.Start(); err != nil {
+		log.Fatalf("raftexample: Failed to start rafthttp (%v)", err)
+	}
 	for i := range rc.peers {
+		if rc.IsIDRemoved(uint64(i + 1)) {
+			continue
+		}
 		if i+1 != rc.id {
 			rc.transport.AddPeer(types.ID(i+1), []string{rc.peers[i]})
 		}
+		rc.setPeerURL(uint64(i+1), rc.peers[i])
 	}
+	close(rc.startedc)
 
 	go rc.serveRaft()
 	go rc.serveChannels()
 }
 
 // stop closes http, closes all channels, and stops raft.
-func (rc *raftNode) stop() {
+func (rc *RaftNode) stop() {
 	rc.stopHTTP()
 	close(rc.commitC)
 	close(rc.errorC)
 	rc.node.Stop()
 }
 
-func (rc *raftNode) stopHTTP() {
+func (rc *RaftNode) stopHTTP() {
 	rc.transport.Stop()
 	close(rc.httpstopc)
 	<-rc.httpdonec
 }
 
-func (rc *raftNode) publishSnapshot(snapshotToSave raftpb.Snapshot) {
+func (rc *RaftNode) publishSnapshot(snapshotToSave raftpb.Snapshot) {
 	if raft.IsEmptySnap(snapshotToSave) {
 		return
 	}
@@ -348,22 +428,48 @@ func (rc *raftNode) publishSnapshot(snapshotToSave raftpb.Snapshot) {
 
 var snapshotCatchUpEntriesN uint64 = 10000
 
-func (rc *raftNode) maybeTriggerSnapshot() {
+func (rc *RaftNode) maybeTriggerSnapshot() {
 	if rc.appliedIndex-rc.snapshotIndex <= rc.snapCount {
 		return
 	}
 
+	if err := rc.triggerSnapshot(); err != nil {
+		log.Panic(err)
+	}
+}
+
+// stopWithSnapshot sets whether to take a snapshot when the node is stopped by closing the proposal channel.
+func (rc *RaftNode) stopWithSnapshot(snapshot bool) {
+	if snapshot {
+		atomic.StoreInt32(&rc.snapshotOnStop, 1)
+	} else {
+		atomic.StoreInt32(&rc.snapshotOnStop, 0)
+	}
+}
+
+// finalSnapshot takes a snapshot before the node is stopped, so it restarts without replaying the WAL.
+func (rc *RaftNode) finalSnapshot() {
+	if atomic.LoadInt32(&rc.snapshotOnStop) == 0 || rc.appliedIndex <= rc.snapshotIndex {
+		return
+	}
+	if err := rc.triggerSnapshot(); err != nil {
+		log.Printf("failed to take the final snapshot: %v", err)
+	}
+}
+
+func (rc *RaftNode) triggerSnapshot() error {
 	log.Printf("start snapshot [applied index: %d | last snapshot index: %d]", rc.appliedIndex, rc.snapshotIndex)
+	start := time.Now()
 	data, err := rc.getSnapshot()
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 	snap, err := rc.raftStorage.CreateSnapshot(rc.appliedIndex, &rc.confState, data)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	if err := rc.saveSnap(snap); err != nil {
-		panic(err)
+		return err
 	}
 
 	compactIndex := uint64(1)
@@ -371,14 +477,16 @@ func (rc *raftNode) maybeTriggerSnapshot() {
 		compactIndex = rc.appliedIndex - snapshotCatchUpEntriesN
 	}
 	if err := rc.raftStorage.Compact(compactIndex); err != nil {
-		panic(err)
+		return err
 	}
 
 	log.Printf("compacted log at index %d", compactIndex)
 	rc.snapshotIndex = rc.appliedIndex
+	rc.snapshotDuration.Observe(time.Since(start).Seconds())
+	return nil
 }
 
-func (rc *raftNode) serveChannels() {
+func (rc *RaftNode) serveChannels() {
 	snap, err := rc.raftStorage.Snapshot()
 	if err != nil {
 		panic(err)
@@ -387,6 +495,7 @@ func (rc *raftNode) serveChannels() {
 	rc.snapshotIndex = snap.Metadata.Index
 	rc.appliedIndex = snap.Metadata.Index
 
+	defer close(rc.donec)
 	defer rc.wal.Close()
 
 	ticker := time.NewTicker(100 * time.Millisecond)
@@ -411,7 +520,10 @@ func (rc *raftNode) serveChannels() {
 					rc.confChangeC = nil
 				} else {
 					confChangeCount++
-					cc.ID = confChangeCount
+					if v1, ok := cc.(raftpb.ConfChange); ok {
+						v1.ID = confChangeCount
+						cc = v1
+					}
 					rc.node.ProposeConfChange(context.TODO(), cc)
 				}
 			}
@@ -428,6 +540,12 @@ func (rc *raftNode) serveChannels() {
 
 		// store raft entries to wal, then publish over commit channel
 		case rd := <-rc.node.Ready():
+			if rd.SoftState != nil {
+				atomic.StoreUint64(&rc.lead, rd.SoftState.Lead)
+			}
+			if !raft.IsEmptyHardState(rd.HardState) {
+				atomic.StoreUint64(&rc.term, rd.HardState.Term)
+			}
 			rc.wal.Save(rd.HardState, rd.Entries)
 			if !raft.IsEmptySnap(rd.Snapshot) {
 				rc.saveSnap(rd.Snapshot)
@@ -448,22 +566,30 @@ func (rc *raftNode) serveChannels() {
 			return
 
 		case <-rc.stopc:
+			rc.finalSnapshot()
 			rc.stop()
 			return
 		}
 	}
 }
 
-func (rc *raftNode) serveRaft() {
+func (rc *RaftNode) serveRaft() {
 	url, err := url.Parse(rc.peers[rc.id-1])
 	if err != nil {
 		log.Fatalf("raftexample: Failed parsing URL (%v)", err)
 	}
 
-	ln, err := newStoppableListener(url.Host, rc.httpstopc)
+	var ln net.Listener
+	ln, err = newStoppableListener(url.Host, rc.httpstopc)
 	if err != nil {
 		log.Fatalf("raftexample: Failed to listen rafthttp (%v)", err)
 	}
+	if !rc.peerTLS.Empty() {
+		ln, err = transport.NewTLSListener(ln, &rc.peerTLS)
+		if err != nil {
+			log.Fatalf("raftexample: Failed to listen rafthttp over TLS (%v)", err)
+		}
+	}
 
 	err = (&http.Server{Handler: rc.transport.Handler()}).Serve(ln)
 	select {
@@ -474,9 +600,40 @@ func (rc *raftNode) serveRaft() {
 	close(rc.httpdonec)
 }
 
-func (rc *raftNode) Process(ctx context.Context, m raftpb.Message) error {
-	return rc.node.Step(ctx, m)
+// Propose proposes data to raft, it returns once raft accepts the proposal or ctx is done.
+func (rc *RaftNode) Propose(ctx context.Context, data []byte) error {
+	select {
+	case <-rc.startedc:
+	default:
+		return ErrRaftNotReady
+	}
+	return rc.node.Propose(ctx, data)
+}
+
+// setPeerURL records the raft URL of a member, or removes it if url is empty.
+func (rc *RaftNode) setPeerURL(id uint64, url string) {
+	rc.mu.Lock()
+	if url == "" {
+		delete(rc.peerURLs, id)
+	} else {
+		rc.peerURLs[id] = url
+	}
+	rc.mu.Unlock()
+}
+
+// leader returns the ID of the leader, or 0 if it is unknown.
+func (rc *RaftNode) leader() uint64 {
+	return atomic.LoadUint64(&rc.lead)
+}
+
+// currentTerm returns the current term known by this node.
+func (rc *RaftNode) currentTerm() uint64 {
+	return atomic.LoadUint64(&rc.term)
+}
+
+// peerURL returns the raft URL of a member.
+func (rc *RaftNode) peerURL(id uint64) string {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	return rc.peerURLs[id]
 }
-func (rc *raftNode) IsIDRemoved(id uint64) bool                           { return false }
-func (rc *raftNode) ReportUnreachable(id uint64)                          {}
-func (rc *raftNode) ReportSnapshot(id uint64, status raft.SnapshotStatus) {}
@@ -2,9 +2,15 @@ package basalt
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/gob"
+	"encoding/json"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rpcxio/etcd/etcdserver/api/snap"
 	"github.com/rpcxio/etcd/raft/raftpb"
@@ -13,66 +19,332 @@ import (
 type ConfChange interface {
 	AddNode(id uint64, addr []byte) error
 	RemoveNode(id uint64) error
+	AddLearner(id uint64, addr []byte) error
+	PromoteLearner(id uint64) error
+	ReplaceNode(oldID, newID uint64, addr []byte) error
+	Reconfigure(voters map[uint64]string) error
 }
 type RaftServer struct {
 	proposeC    chan<- string
-	confChangeC chan raftpb.ConfChange
+	confChangeC chan raftpb.ConfChangeI
 	bmServer    *Server
+	node        *RaftNode
 	snapshotter *snap.Snapshotter
+
+	// mu is held to apply committed entries, so the bitmaps and
+	// appliedIndex are consistent with each other while it is held for reading.
+	mu           sync.RWMutex
+	appliedIndex uint64
+
+	leaderMode LeaderMode
+	peerAddrs  map[uint64]string // service addresses of members, by node ID
+	fwd        forwarder
+
+	// proposeMu is held for reading to send to proposeC and confChangeC, Stop holds it to close them.
+	proposeMu sync.RWMutex
+	stopped   bool
+
+	pendingMu   sync.Mutex
+	pending     map[uint64]uint64 // terms of proposals of this node that are not applied yet, by sequence
+	proposalSeq uint64
+	appliedTerm uint64 // term of the last applied entry
+
+	batchOpts BatchOptions
+	batchOnce sync.Once
+	batcher   *batcher // started by the first proposal
+
+	migrationsMu sync.Mutex
+	migrations   map[string]*migration // migrations driven by this node, by bitmap name
 }
 
 type operaton struct {
-	OP  OP
-	Val string
+	OP   OP
+	Val  string
+	Time int64  // unix nano time when the operation is proposed
+	Node uint64 // ID of the node that proposes the operation
+	Seq  uint64 // sequence of the proposal on the node
+
+	Batch []operaton // operations of a BmOpBatch entry
 }
 
-func NewRaftServer(bmServer *Server, snapshotter *snap.Snapshotter, confChangeC chan raftpb.ConfChange, proposeC chan<- string, commitC <-chan *string, errorC <-chan error) *RaftServer {
-	s := &RaftServer{proposeC: proposeC, confChangeC: confChangeC, bmServer: bmServer, snapshotter: snapshotter}
+func NewRaftServer(bmServer *Server, node *RaftNode, snapshotter *snap.Snapshotter, confChangeC chan raftpb.ConfChangeI, proposeC chan<- string, commitC <-chan *Commit, errorC <-chan error) *RaftServer {
+	s := &RaftServer{proposeC: proposeC, confChangeC: confChangeC, bmServer: bmServer, node: node, snapshotter: snapshotter,
+		pending:    make(map[uint64]uint64),
+		migrations: make(map[string]*migration),
+		// sequences start from the current time, so proposals of a previous run are not taken as pending ones.
+		proposalSeq: uint64(time.Now().UnixNano()),
+	}
 	bmServer.bitmaps.writeCallback = s.Propose
-	s.readCommits(commitC, errorC)
-	go s.readCommits(commitC, errorC)
+	bmServer.raft = s
+	if err := s.loadSnapshot(); err != nil {
+		log.Panic(err)
+	}
+	s.readCommits(commitC, errorC, true)
+	go s.readCommits(commitC, errorC, false)
 
 	return s
 }
 
-func (s *RaftServer) Propose(op OP, value string) {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(operaton{op, value}); err != nil {
-		log.Fatal(err)
+// SetLeaderMode sets how writes to a follower are handled. It must be invoked before Serve.
+func (s *RaftServer) SetLeaderMode(mode LeaderMode) {
+	s.leaderMode = mode
+}
+
+// SetBatchOptions sets how concurrent proposals are coalesced into raft entries. It must be invoked before Serve.
+func (s *RaftServer) SetBatchOptions(opts BatchOptions) {
+	s.batchOpts = opts
+}
+
+// SetForwardTLSConfig forwards writes to services of the leader over TLS. It must be invoked before Serve.
+func (s *RaftServer) SetForwardTLSConfig(cfg *tls.Config) {
+	s.fwd.tlsConfig = cfg
+}
+
+// SetForwardToken sets the token of a user with the cluster category to forward writes to services
+// of the leader which check ACLs. It must be invoked before Serve.
+func (s *RaftServer) SetForwardToken(token string) {
+	s.fwd.token = token
+}
+
+// SetPeerAddrs sets service addresses of members, the address of node i+1 is addrs[i].
+// It must be invoked before Serve.
+func (s *RaftServer) SetPeerAddrs(addrs []string) {
+	s.peerAddrs = make(map[uint64]string, len(addrs))
+	for i, addr := range addrs {
+		if addr != "" {
+			s.peerAddrs[uint64(i+1)] = addr
+		}
+	}
+}
+
+// Propose proposes a write through raft. Writes to a follower are proposed locally,
+// forwarded to the leader or refused with a NotLeaderError according to the leader mode.
+// Writes which can not be forwarded are refused with a NotLeaderError in LeaderModeForward.
+func (s *RaftServer) Propose(op OP, value string) error {
+	if s.leaderMode == LeaderModeForward || s.leaderMode == LeaderModeRedirect {
+		leader := s.node.leader()
+		if leader == 0 {
+			return ErrNoLeader
+		}
+		if leader != uint64(s.node.id) {
+			addr := s.peerAddrs[leader]
+			if s.leaderMode == LeaderModeRedirect || addr == "" || !forwardable(op, value) {
+				return &NotLeaderError{Leader: leader, Addr: addr}
+			}
+			return s.fwd.forward(addr, groupServicePath(s.node.group), op, value)
+		}
+	}
+
+	return s.propose(op, value)
+}
+
+// propose proposes a write through raft on this node. Concurrent writes are coalesced into batched entries,
+// it returns once raft accepts the batch of the write.
+func (s *RaftServer) propose(op OP, value string) error {
+	s.proposeMu.RLock()
+	if s.stopped {
+		s.proposeMu.RUnlock()
+		return ErrRaftStopped
 	}
+	s.batchOnce.Do(func() {
+		s.batcher = newBatcher(s.batchOpts, s.node.Propose)
+	})
+
+	seq := atomic.AddUint64(&s.proposalSeq, 1)
+	p := &proposal{
+		op:   operaton{op, value, time.Now().UnixNano(), uint64(s.node.id), seq, nil},
+		done: make(chan error, 1),
+	}
+
+	s.pendingMu.Lock()
+	s.pending[seq] = s.node.currentTerm()
+	s.pendingMu.Unlock()
 
-	s.proposeC <- buf.String()
+	s.batcher.proposalC <- p
+	s.proposeMu.RUnlock()
+
+	err := <-p.done
+	if err != nil {
+		s.applied(p.op)
+		return err
+	}
+	// raft may drop the accepted proposal if leadership changes, it is expired once an entry of a later term
+	// is applied
+	s.pendingMu.Lock()
+	if _, ok := s.pending[seq]; ok {
+		s.pending[seq] = s.node.currentTerm()
+	}
+	s.pendingMu.Unlock()
+	return nil
 }
 
-func (s *RaftServer) readCommits(commitC <-chan *string, errorC <-chan error) {
+// proposeConfChange proposes a configuration change through raft on this node.
+func (s *RaftServer) proposeConfChange(cc raftpb.ConfChangeI) error {
+	s.proposeMu.RLock()
+	defer s.proposeMu.RUnlock()
+	if s.stopped {
+		return ErrRaftStopped
+	}
+
+	s.confChangeC <- cc
+	return nil
+}
+
+// applied marks the proposal of this node as applied, or failed to be proposed.
+func (s *RaftServer) applied(op operaton) {
+	if op.Node != uint64(s.node.id) {
+		return
+	}
+	s.pendingMu.Lock()
+	delete(s.pending, op.Seq)
+	s.pendingMu.Unlock()
+}
+
+// expireProposals removes proposals of this node accepted in terms before term, an entry of term is applied
+// so the ones committed are applied before it, and the others are dropped by raft.
+func (s *RaftServer) expireProposals(term uint64) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	for seq, t := range s.pending {
+		if t < term {
+			delete(s.pending, seq)
+		}
+	}
+}
+
+func (s *RaftServer) pendingProposals() int {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	return len(s.pending)
+}
+
+// Stop stops the raft node gracefully. It refuses new proposals, waits until proposals of this node
+// are applied or ctx is done, and then stops the raft node, which takes a final snapshot if snapshot is true
+// and closes its WAL. It returns ctx.Err() if some proposals are not applied, but the node is stopped anyway.
+func (s *RaftServer) Stop(ctx context.Context, snapshot bool) error {
+	s.proposeMu.Lock()
+	if s.stopped {
+		s.proposeMu.Unlock()
+		return ErrRaftStopped
+	}
+	s.stopped = true
+	s.proposeMu.Unlock()
+
+	if s.batcher != nil {
+		s.batcher.close()
+	}
+
+	err := s.waitPendingProposals(ctx)
+	if err != nil {
+		log.Printf("%d proposals are not applied before stopping: %v", s.pendingProposals(), err)
+	}
+
+	s.node.stopWithSnapshot(snapshot)
+	close(s.proposeC)
+	close(s.confChangeC)
+	<-s.node.donec
+	return err
+}
+
+// waitPendingProposals waits until proposals of this node are applied or ctx is done.
+func (s *RaftServer) waitPendingProposals(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for s.pendingProposals() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.node.donec:
+			return ErrRaftStopped
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func decodeOperation(data []byte) (operaton, error) {
+	var op operaton
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&op)
+	return op, err
+}
+
+// DecodeOperation decodes an operation proposed to raft.
+func DecodeOperation(data []byte) (OP, string, error) {
+	op, err := decodeOperation(data)
+	return op.OP, op.Val, err
+}
+
+// readCommits applies committed entries. If replay is true, it returns once the entries in the WAL are replayed.
+func (s *RaftServer) readCommits(commitC <-chan *Commit, errorC <-chan error, replay bool) {
 	for data := range commitC {
 		if data == nil {
-			snapshot, err := s.snapshotter.Load()
-			if err == snap.ErrNoSnapshot {
-				return
-			}
-			if err != nil {
+			// replay is finished or a snapshot is received from the leader
+			if err := s.loadSnapshot(); err != nil {
 				log.Panic(err)
 			}
-			log.Printf("loading snapshot at term %d and index %d", snapshot.Metadata.Term, snapshot.Metadata.Index)
-			if err := s.recoverFromSnapshot(snapshot.Data); err != nil {
-				log.Panic(err)
+			if replay {
+				return
 			}
 			continue
 		}
 
-		var op operaton
-		dec := gob.NewDecoder(bytes.NewBufferString(*data))
-		if err := dec.Decode(&op); err != nil {
+		if data.Term > s.appliedTerm {
+			s.appliedTerm = data.Term
+			s.expireProposals(data.Term)
+		}
+		if data.Data == "" {
+			continue
+		}
+
+		op, err := decodeOperation([]byte(data.Data))
+		if err != nil {
 			log.Fatalf("raftexample: could not decode message (%v)", err)
 		}
-		s.processOP(op)
+		ops := op.ops()
+		s.mu.Lock()
+		for _, op := range ops {
+			s.bmServer.bitmaps.setWriteTime(op.Time)
+			if s.captureMigrating(op) {
+				continue
+			}
+			s.processOP(op)
+		}
+		s.bmServer.bitmaps.setWriteTime(0)
+		s.appliedIndex = data.Index
+		s.mu.Unlock()
+		for _, op := range ops {
+			s.applied(op)
+		}
 	}
 	if err, ok := <-errorC; ok {
 		log.Fatal(err)
 	}
 }
 
+// loadSnapshot recovers the bitmaps from the latest snapshot if it is newer than them.
+func (s *RaftServer) loadSnapshot() error {
+	snapshot, err := s.snapshotter.Load()
+	if err == snap.ErrNoSnapshot {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if snapshot.Metadata.Index <= s.appliedIndex {
+		return nil
+	}
+	log.Printf("loading snapshot at term %d and index %d", snapshot.Metadata.Term, snapshot.Metadata.Index)
+	if err := s.recoverFromSnapshot(snapshot.Data); err != nil {
+		return err
+	}
+	s.appliedIndex = snapshot.Metadata.Index
+	return nil
+}
+
 func (s *RaftServer) processOP(op operaton) {
 	switch op.OP {
 	case BmOpAdd:
@@ -100,28 +372,87 @@ func (s *RaftServer) processOP(op operaton) {
 		s.bmServer.drop(op.Val, false)
 	case BmOpClear:
 		s.bmServer.clear(op.Val, false)
+	case BmOpSetMeta:
+		items := strings.SplitN(op.Val, ",", 2)
+		if len(items) != 2 {
+			log.Printf("wrong request: %+v", op)
+			return
+		}
+		var update MetadataUpdate
+		if err := json.Unmarshal([]byte(items[1]), &update); err != nil {
+			log.Printf("wrong request: %+v", op)
+			return
+		}
+		s.bmServer.bitmaps.SetMetadata(items[0], update, false)
+	case BmOpRestore:
+		if err := s.bmServer.bitmaps.Restore([]byte(op.Val), false); err != nil {
+			log.Printf("failed to restore bitmaps: %v", err)
+		}
+	case BmOpFreeze:
+		s.bmServer.bitmaps.Freeze(op.Val, false)
+	case BmOpThaw:
+		s.bmServer.bitmaps.Thaw(op.Val, false)
+	case BmOpPut:
+		if err := s.bmServer.bitmaps.put([]byte(op.Val)); err != nil {
+			log.Printf("failed to put bitmaps: %v", err)
+		}
+	case BmOpMigrate, BmOpMigrated:
+		s.applyMigration(op)
+	case BmOpReplayed:
+		s.applyReplayed(op)
+	case BmOpMulti:
+		s.applyTransaction(op)
+	case BmOpFlush:
+		s.applyFlush(op)
+	case BmOpStage:
+		if err := s.bmServer.bitmaps.applyStage(op.Val); err != nil {
+			log.Printf("failed to stage bitmaps: %v", err)
+		}
+	case BmOpCommit:
+		if err := s.bmServer.bitmaps.applyCommit(op.Val); err != nil {
+			log.Printf("failed to commit the restore: %v", err)
+		}
+	case BmOpAbort:
+		s.bmServer.bitmaps.applyAbort(op.Val)
 	}
 }
 
+// GetSnapshot saves the bitmaps, and the bitmaps staged by a restore in progress.
 func (s *RaftServer) GetSnapshot() ([]byte, error) {
 	var buf bytes.Buffer
-	err := s.bmServer.bitmaps.Save(&buf)
+	if err := s.bmServer.bitmaps.Save(&buf); err != nil {
+		return nil, err
+	}
+	err := s.bmServer.bitmaps.saveStaged(&buf)
 	return buf.Bytes(), err
 }
 
+// consistentSnapshot returns the bitmaps and the raft index they correspond to.
+func (s *RaftServer) consistentSnapshot() ([]byte, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// bitmaps staged by a restore are not part of the state yet
+	var buf bytes.Buffer
+	err := s.bmServer.bitmaps.Save(&buf)
+	return buf.Bytes(), s.appliedIndex, err
+}
+
 func (s *RaftServer) recoverFromSnapshot(snapshot []byte) error {
 	var buf = bytes.NewBuffer(snapshot)
 	return s.bmServer.bitmaps.Read(buf)
 }
 
 func (s *RaftServer) AddNode(id uint64, addr []byte) error {
+	if s.node.IsIDRemoved(id) {
+		return ErrMemberRemoved
+	}
 	cc := raftpb.ConfChange{
 		Type:    raftpb.ConfChangeAddNode,
 		NodeID:  id,
 		Context: addr,
 	}
-	s.confChangeC <- cc
-	return nil
+	return s.proposeConfChange(cc)
 }
 
 func (s *RaftServer) RemoveNode(id uint64) error {
@@ -129,6 +460,99 @@ func (s *RaftServer) RemoveNode(id uint64) error {
 		Type:   raftpb.ConfChangeRemoveNode,
 		NodeID: id,
 	}
-	s.confChangeC <- cc
-	return nil
+	return s.proposeConfChange(cc)
+}
+
+// AddLearner adds a learner, which receives the log but does not vote.
+func (s *RaftServer) AddLearner(id uint64, addr []byte) error {
+	if s.node.IsIDRemoved(id) {
+		return ErrMemberRemoved
+	}
+	cc := raftpb.ConfChange{
+		Type:    raftpb.ConfChangeAddLearnerNode,
+		NodeID:  id,
+		Context: addr,
+	}
+	return s.proposeConfChange(cc)
+}
+
+// PromoteLearner promotes a caught-up learner to voter.
+// It must be invoked on the leader, which knows the progress of learners.
+func (s *RaftServer) PromoteLearner(id uint64) error {
+	status, err := s.node.status()
+	if err != nil {
+		return err
+	}
+	if status.Role != RoleLeader {
+		if status.Leader == 0 {
+			return ErrNoLeader
+		}
+		return &NotLeaderError{Leader: status.Leader, Addr: s.peerAddrs[status.Leader]}
+	}
+
+	for _, p := range status.Peers {
+		if p.ID != id {
+			continue
+		}
+		if !p.Learner {
+			return ErrNotLearner
+		}
+		if p.State != "replicate" || p.Lag > maxPromoteLag {
+			return ErrLearnerNotCaughtUp
+		}
+
+		cc := raftpb.ConfChange{
+			Type:    raftpb.ConfChangeAddNode,
+			NodeID:  id,
+			Context: []byte(p.URL),
+		}
+		return s.proposeConfChange(cc)
+	}
+	return ErrNodeNotFound
+}
+
+// ReplaceNode replaces a member with a new voter in one step using joint consensus,
+// so the cluster is never left with both or neither of them. addr is the raft URL of the new node.
+func (s *RaftServer) ReplaceNode(oldID, newID uint64, addr []byte) error {
+	cfg, err := s.node.config()
+	if err != nil {
+		return err
+	}
+	changes, urls, err := cfg.replace(oldID, newID, string(addr), s.node.IsIDRemoved)
+	if err != nil {
+		return err
+	}
+	return s.proposeConfChangeV2(changes, urls)
+}
+
+// Reconfigure changes the voters of the cluster to the given members in one step using joint consensus.
+// voters maps node IDs to raft URLs, which are only needed by new members. Learners in voters are promoted,
+// voters not in voters are removed and other learners are kept.
+func (s *RaftServer) Reconfigure(voters map[uint64]string) error {
+	if len(voters) == 0 {
+		return ErrNoVoters
+	}
+	cfg, err := s.node.config()
+	if err != nil {
+		return err
+	}
+	changes, urls, err := cfg.reconfigure(voters, s.node.IsIDRemoved)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	return s.proposeConfChangeV2(changes, urls)
+}
+
+// proposeConfChangeV2 proposes changes of members, raft enters a joint configuration if there are
+// more than one changes and leaves it automatically once the joint configuration is committed.
+func (s *RaftServer) proposeConfChangeV2(changes []raftpb.ConfChangeSingle, urls map[uint64]string) error {
+	data, err := encodeMemberURLs(urls)
+	if err != nil {
+		return err
+	}
+	return s.proposeConfChange(raftpb.ConfChangeV2{
+		Transition: raftpb.ConfChangeTransitionAuto,
+		Changes:    changes,
+		Context:    data,
+	})
 }
@@ -0,0 +1,170 @@
+package basalt
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// redcon only writes RESP2, replies of RESP3 are written raw for connections switched to it by HELLO 3.
+// RESP2 replies of the same commands are kept for existing clients.
+
+// resp3 returns whether the connection uses RESP3.
+func resp3(conn redcon.Conn) bool {
+	c, ok := conn.Context().(*redisClient)
+	return ok && c.resp == 3
+}
+
+// writeMap writes the header of a map of n pairs, which is an array of 2n elements in RESP2.
+func writeMap(conn redcon.Conn, n int) {
+	if resp3(conn) {
+		conn.WriteRaw([]byte("%" + strconv.Itoa(n) + "\r\n"))
+		return
+	}
+	conn.WriteArray(2 * n)
+}
+
+// writeSet writes the header of a set of n elements, which is an array in RESP2.
+func writeSet(conn redcon.Conn, n int) {
+	if resp3(conn) {
+		conn.WriteRaw([]byte("~" + strconv.Itoa(n) + "\r\n"))
+		return
+	}
+	conn.WriteArray(n)
+}
+
+// writePush writes the header of a push of n elements, which is an array in RESP2.
+func writePush(conn redcon.Conn, n int) {
+	if resp3(conn) {
+		conn.WriteRaw([]byte(">" + strconv.Itoa(n) + "\r\n"))
+		return
+	}
+	conn.WriteArray(n)
+}
+
+// writeBool writes a boolean, which is the integer 1 or 0 in RESP2.
+func writeBool(conn redcon.Conn, b bool) {
+	switch {
+	case resp3(conn) && b:
+		conn.WriteRaw([]byte("#t\r\n"))
+	case resp3(conn):
+		conn.WriteRaw([]byte("#f\r\n"))
+	case b:
+		conn.WriteInt(1)
+	default:
+		conn.WriteInt(0)
+	}
+}
+
+// writeNull writes a null, which is a null bulk string in RESP2.
+func writeNull(conn redcon.Conn) {
+	if resp3(conn) {
+		conn.WriteRaw([]byte("_\r\n"))
+		return
+	}
+	conn.WriteNull()
+}
+
+// writeNullArray writes a null, which is a null array in RESP2.
+func writeNullArray(conn redcon.Conn) {
+	if resp3(conn) {
+		conn.WriteRaw([]byte("_\r\n"))
+		return
+	}
+	conn.WriteRaw([]byte("*-1\r\n"))
+}
+
+// writeUint32Set writes values as a set.
+func writeUint32Set(conn redcon.Conn, values []uint32) {
+	writeSet(conn, len(values))
+	for _, v := range values {
+		conn.WriteInt64(int64(v))
+	}
+}
+
+// hello switches the protocol of the connection and replies information of the server as a map:
+// hello [protover [AUTH username password] [SETNAME clientname]]
+func (rs *RedisService) hello(conn redcon.Conn, cmd redcon.Command) {
+	c := rs.client(conn)
+	resp := c.resp
+	if len(cmd.Args) > 1 {
+		v, err := strconv.Atoi(string(cmd.Args[1]))
+		if err != nil {
+			conn.WriteError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v != 2 && v != 3 {
+			conn.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		resp = v
+	}
+
+	var user *User
+	name, setName := "", false
+	for i := 2; i < len(cmd.Args); i++ {
+		switch opt := strings.ToLower(string(cmd.Args[i])); {
+		case opt == "auth" && i+2 < len(cmd.Args):
+			if rs.s.acl == nil {
+				conn.WriteError("ERR AUTH called without any ACL configured")
+				return
+			}
+			u, err := rs.s.acl.Authenticate(string(cmd.Args[i+1]), string(cmd.Args[i+2]))
+			if err != nil {
+				conn.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+				return
+			}
+			user = u
+			i += 2
+		case opt == "setname" && i+1 < len(cmd.Args):
+			name, setName = string(cmd.Args[i+1]), true
+			if !validClientName(name) {
+				conn.WriteError("ERR Client names cannot contain spaces, newlines or special characters.")
+				return
+			}
+			i++
+		default:
+			conn.WriteError("ERR Syntax error in HELLO option '" + string(cmd.Args[i]) + "'")
+			return
+		}
+	}
+	if user == nil && rs.s.acl != nil && c.user == nil {
+		conn.WriteError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return
+	}
+
+	c.mu.Lock()
+	c.resp = resp
+	if user != nil {
+		c.user = user
+	}
+	if setName {
+		c.name = name
+	}
+	c.mu.Unlock()
+
+	mode, role := "standalone", "master"
+	if rs.s.isSharded() {
+		mode = "cluster"
+	} else if rs.s.raft != nil {
+		if cs, err := rs.s.raft.ClusterStatus(); err != nil || cs.Role != RoleLeader {
+			role = "replica"
+		}
+	}
+	writeMap(conn, 7)
+	conn.WriteBulkString("server")
+	conn.WriteBulkString("redis")
+	conn.WriteBulkString("version")
+	conn.WriteBulkString(redisVersion)
+	conn.WriteBulkString("proto")
+	conn.WriteInt(resp)
+	conn.WriteBulkString("id")
+	conn.WriteInt64(int64(c.id))
+	conn.WriteBulkString("mode")
+	conn.WriteBulkString(mode)
+	conn.WriteBulkString("role")
+	conn.WriteBulkString(role)
+	conn.WriteBulkString("modules")
+	conn.WriteArray(0)
+}
@@ -0,0 +1,73 @@
+package basalt
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestServer_RESP3(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	s := NewServer(addr, NewBitmaps(), nil, "")
+	s.ln = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.configListener(ctx, ln)
+	<-s.started
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	redis := redisCaller(t, conn)
+
+	s.bitmaps.AddMany("a", []uint32{1, 2, 3}, false)
+	s.bitmaps.AddMany("b", []uint32{2, 3, 4}, false)
+	for _, c := range []struct {
+		args  []string
+		reply string
+	}{
+		// RESP2 until HELLO 3
+		{[]string{"bmexists", "a", "1"}, ":1"},
+		{[]string{"bminter", "a", "b"}, ":2 :3"},
+		{[]string{"bitfield", "a", "overflow", "fail", "incrby", "u2", "0", "4"}, "$-1"},
+		{[]string{"hello", "4"}, "-NOPROTO unsupported protocol version"},
+		{[]string{"hello", "x"}, "-ERR Protocol version is not an integer or out of range"},
+		{[]string{"hello", "3", "setname"}, "-ERR Syntax error in HELLO option 'setname'"},
+		{[]string{"hello", "3", "auth", "u", "p"}, "-ERR AUTH called without any ACL configured"},
+		{[]string{"hello", "3", "setname", "cache"}, "%server redis version 6.0.0 proto :3 id :1 mode standalone role master modules "},
+		{[]string{"client", "getname"}, "cache"},
+		{[]string{"bmexists", "a", "1"}, "#t"},
+		{[]string{"bmexists", "a", "4"}, "#f"},
+		{[]string{"bminter", "a", "b"}, "~:2 :3"},
+		{[]string{"bmunion", "a", "x"}, "~:1 :2 :3"},
+		{[]string{"bitfield", "a", "overflow", "fail", "incrby", "u2", "0", "4"}, "_"},
+		{[]string{"multi"}, "+OK"},
+		{[]string{"bmexists", "b", "4"}, "+QUEUED"},
+		{[]string{"bmdiff", "b", "a"}, "+QUEUED"},
+		{[]string{"exec"}, "#t ~:4"},
+		{[]string{"hello", "2"}, "server redis version 6.0.0 proto :2 id :1 mode standalone role master modules "},
+		{[]string{"bmexists", "a", "1"}, ":1"},
+	} {
+		if reply := redis(c.args...); reply != c.reply {
+			t.Errorf("expect %s for %v but got %s", c.reply, c.args, reply)
+		}
+	}
+
+	if stats := redis("bmstats", "a"); !strings.Contains(stats, "cardinality:3\r\n") {
+		t.Errorf("expect stats as a bulk string but got %q", stats)
+	}
+	redis("hello", "3")
+	if stats := redis("bmstats", "a"); !strings.HasPrefix(stats, "%") || !strings.Contains(stats, "cardinality :3") {
+		t.Errorf("expect stats as a map but got %q", stats)
+	}
+	if info := redis("bminfo", "a"); !strings.HasPrefix(info, "%") {
+		t.Errorf("expect info as a map but got %q", info)
+	}
+}
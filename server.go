@@ -2,11 +2,16 @@ package basalt
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/smallnest/rpcx/protocol"
 	"github.com/smallnest/rpcx/server"
@@ -17,6 +22,7 @@ import (
 // Errors for bitmaps
 var (
 	ErrPersistFileNotFound = errors.New("persist file not found")
+	ErrDraining            = errors.New("server is draining")
 )
 
 // Server is the bitmap server that supports multiple services.
@@ -24,21 +30,63 @@ type Server struct {
 	addr               string
 	bitmaps            *Bitmaps
 	ln                 net.Listener
+	tlsConfig          *tls.Config // set to serve all services over TLS
+	acl                *ACL        // set to authenticate clients and check their permissions
+	metrics            *serverMetrics
+	slowlog            *SlowLog
+	pubsub             *pubSub // keyspace notifications of the server and its raft groups
 	confChangeCallback ConfChange
+	raft               *RaftServer // set if the server runs in a raft cluster
+
+	routing *RoutingTable      // set if bitmaps are partitioned into shards of raft groups
+	groups  map[uint64]*Server // raft groups hosted by this process, by ID
 
 	rpcxOptions []ConfigRpcxOption
 
 	persistFile string
+
+	// services, they are created before serving
+	rpcxServer    *server.Server
+	httpService   *HTTPService
+	redisServer   *redcon.Server
+	redisInflight int64 // redis commands being handled
+	redisClients  int64 // redis connections open
+	redisConns    int64 // redis connections accepted
+	lastClientID  uint64
+	clientsMu     sync.Mutex
+	clients       map[uint64]*redisClient // redis connections open, by client ID
+
+	scanMu    sync.Mutex
+	scanIndex *scanIndex // rebuilt by Scan when bitmaps are added or removed
+
+	startTime time.Time
+	saveMu    sync.Mutex
+	lastSave  saveStatus
+
+	serving     int32         // set when services are being created
+	started     chan struct{} // closed when all services are accepting connections
+	draining    int32         // set when the server starts draining or shutting down
+	drained     chan struct{} // closed when the server is drained
+	drainedOnce sync.Once
 }
 
 // NewServer returns a server.
 func NewServer(addr string, bitmaps *Bitmaps, rpcxOptions []ConfigRpcxOption, persistFile string) *Server {
-	return &Server{
+	s := &Server{
 		addr:        addr,
 		bitmaps:     bitmaps,
 		rpcxOptions: rpcxOptions,
 		persistFile: persistFile,
+		started:     make(chan struct{}),
+		drained:     make(chan struct{}),
+		startTime:   time.Now(),
+		slowlog:     NewSlowLog(),
+		pubsub:      newPubSub(),
+		clients:     make(map[uint64]*redisClient),
 	}
+	s.metrics = newServerMetrics(s)
+	bitmaps.setNotify(s.pubsub.notifyKeyspaceEvent)
+	return s
 }
 
 // SetConfChangeCallback must invoke before Serve.
@@ -46,26 +94,22 @@ func (s *Server) SetConfChangeCallback(confChangeCallback ConfChange) {
 	s.confChangeCallback = confChangeCallback
 }
 
-// Serve serves basalt services.
-func (s *Server) Serve() error {
+// Serve serves basalt services until ctx is done, then shuts them down gracefully.
+// It returns nil if the server is shut down or drained, or the error of the failed service,
+// in which case the other services are closed.
+func (s *Server) Serve(ctx context.Context) error {
 	ln, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return err
 	}
+	s.ln = ln
 
-	return s.configListener(ln)
+	return s.configListener(ctx, s.tlsListener(ln))
 }
 
-// Close closes this server.
-func (s *Server) Close() error {
-	if s.ln == nil {
-		return nil
-	}
-
-	return s.ln.Close()
-}
+func (s *Server) configListener(ctx context.Context, ln net.Listener) error {
+	atomic.StoreInt32(&s.serving, 1)
 
-func (s *Server) configListener(ln net.Listener) error {
 	m := cmux.New(ln)
 
 	// rpcx
@@ -77,46 +121,110 @@ func (s *Server) configListener(ln net.Listener) error {
 	// redis
 	redisLn := m.Match(cmux.Any())
 
-	go s.startRpcxService(rpcxLn)
-	go s.startHTTPService(httpLn)
-	go s.startRedisService(redisLn)
-
-	return m.Serve()
+	s.rpcxServer = server.NewServer()
+	s.httpService = &HTTPService{
+		s:                  s,
+		confChangeCallback: s.confChangeCallback,
+	}
+	s.httpService.config()
+	for _, g := range s.groups {
+		g.httpService = &HTTPService{
+			s:                  g,
+			confChangeCallback: g.confChangeCallback,
+		}
+		g.httpService.config()
+	}
+	redisService := &RedisService{
+		s:                  s,
+		confChangeCallback: s.confChangeCallback,
+	}
+	redisService.handler = s.countRedisCommand(redisService.meter(redisService.redisHandler))
+	s.redisServer = redcon.NewServer(s.addr, redisService.handler, redisService.redisAccept, redisService.redisClose)
+
+	var started sync.WaitGroup
+	started.Add(3)
+	go func() {
+		started.Wait()
+		close(s.started)
+	}()
+
+	errc := make(chan error, 4)
+	go func() {
+		errc <- s.startRpcxService(&startedListener{Listener: rpcxLn, started: &started})
+	}()
+	go func() {
+		errc <- s.startHTTPService(&startedListener{Listener: httpLn, started: &started})
+	}()
+	go func() {
+		redisLn := &drainListener{Listener: redisLn, closed: make(chan struct{})}
+		errc <- s.startRedisService(&startedListener{Listener: redisLn, started: &started})
+	}()
+	go func() {
+		errc <- m.Serve()
+	}()
+
+	select {
+	case <-ctx.Done():
+		sctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := s.Shutdown(sctx); err != ErrDraining {
+			return err
+		}
+		<-s.drained
+		return nil
+	case err := <-errc:
+		if s.isDraining() {
+			<-s.drained
+			return nil
+		}
+		s.Close()
+		return err
+	}
 }
 
-func (s *Server) startRpcxService(ln net.Listener) {
-	srv := server.NewServer()
+func (s *Server) startRpcxService(ln net.Listener) error {
+	srv := s.rpcxServer
 
 	for _, opt := range s.rpcxOptions {
 		opt(s, srv)
 	}
+	if s.acl != nil {
+		srv.AuthFunc = s.rpcxAuth
+	}
+	srv.Plugins.Add(&rpcxMetricsPlugin{m: s.metrics, slowlog: s.slowlog})
 
 	srv.RegisterName("Bitmap", &RpcxBitmapService{s: s, confChangeCallback: s.confChangeCallback}, "")
+	for id, g := range s.groups {
+		srv.RegisterName(groupServicePath(id), &RpcxBitmapService{s: g, confChangeCallback: g.confChangeCallback}, "")
+	}
 	if err := srv.ServeListener("tcp", ln); err != nil {
-		log.Fatalf("failed to start rpcx services: %v", err)
+		return fmt.Errorf("rpcx service: %w", err)
 	}
+	return nil
 }
 
 // if not config adminAddr, we don't start admin service.
 // It is useful for security purpose.
-func (s *Server) startHTTPService(ln net.Listener) {
-	hs := &HTTPService{
-		s:                  s,
-		confChangeCallback: s.confChangeCallback,
+func (s *Server) startHTTPService(ln net.Listener) error {
+	if err := s.httpService.Serve(ln); err != nil {
+		return fmt.Errorf("http service: %w", err)
 	}
+	return nil
+}
 
-	if err := hs.Serve(ln); err != nil {
-		log.Fatalf("failed to start http service: %v", err)
+func (s *Server) startRedisService(ln net.Listener) error {
+	if err := s.redisServer.Serve(ln); err != nil {
+		return fmt.Errorf("redis service: %w", err)
 	}
+	return nil
 }
 
-func (s *Server) startRedisService(ln net.Listener) {
-	redisService := &RedisService{
-		s:                  s,
-		confChangeCallback: s.confChangeCallback,
-	}
-	if err := redcon.Serve(ln, redisService.redisHandler, redisService.redisAccept, redisService.redisClose); err != nil {
-		log.Fatalf("failed to start redis services: %v", err)
+// countRedisCommand counts redis commands being handled, so draining can wait for them.
+func (s *Server) countRedisCommand(handler func(conn redcon.Conn, cmd redcon.Command)) func(conn redcon.Conn, cmd redcon.Command) {
+	return func(conn redcon.Conn, cmd redcon.Command) {
+		atomic.AddInt64(&s.redisInflight, 1)
+		defer atomic.AddInt64(&s.redisInflight, -1)
+		handler(conn, cmd)
 	}
 }
 
@@ -129,11 +237,44 @@ func rpcxPrefixByteMatcher() cmux.Matcher {
 	}
 }
 
-// Save saves the data into file.
+// saveStatus is the status of saves into the persist file.
+type saveStatus struct {
+	saves    int64
+	time     time.Time     // start of the last successful save
+	duration time.Duration // duration of the last save
+	err      error         // error of the last save
+}
+
+// Save saves the data into file. A sharded server saves bitmaps of every hosted raft group into its file.
 func (s *Server) Save() error {
+	start := time.Now()
+	err := s.save()
+
+	s.saveMu.Lock()
+	s.lastSave.saves++
+	s.lastSave.duration = time.Since(start)
+	s.lastSave.err = err
+	if err == nil {
+		s.lastSave.time = start
+	}
+	s.saveMu.Unlock()
+	return err
+}
+
+func (s *Server) save() error {
+	if s.isSharded() {
+		for _, id := range s.Groups() {
+			if err := s.groups[id].Save(); err != nil {
+				return fmt.Errorf("raft group %d: %w", id, err)
+			}
+		}
+		return nil
+	}
 	if s.persistFile == "" {
 		return ErrPersistFileNotFound
 	}
+	defer s.metrics.observePersistence(persistSave, time.Now())
+
 	file, err := os.Create(s.persistFile)
 	if err != nil {
 		return err
@@ -158,6 +299,7 @@ func (s *Server) Restore() error {
 	if s.persistFile == "" {
 		return ErrPersistFileNotFound
 	}
+	defer s.metrics.observePersistence(persistLoad, time.Now())
 
 	file, err := os.Open(s.persistFile)
 	if err != nil {
@@ -179,8 +321,7 @@ func (s *Server) add(name, value string, callback bool) error {
 		return err
 	}
 
-	s.bitmaps.Add(name, v, callback)
-	return nil
+	return s.bitmaps.Add(name, v, callback)
 }
 
 func (s *Server) addMany(name, values string, callback bool) error {
@@ -189,8 +330,7 @@ func (s *Server) addMany(name, values string, callback bool) error {
 		return err
 	}
 
-	s.bitmaps.AddMany(name, vs, callback)
-	return nil
+	return s.bitmaps.AddMany(name, vs, callback)
 }
 
 func (s *Server) remove(name, value string, callback bool) error {
@@ -199,14 +339,13 @@ func (s *Server) remove(name, value string, callback bool) error {
 		return err
 	}
 
-	s.bitmaps.Remove(name, v, callback)
-	return err
+	return s.bitmaps.Remove(name, v, callback)
 }
 
-func (s *Server) drop(name string, callback bool) {
-	s.bitmaps.RemoveBitmap(name, callback)
+func (s *Server) drop(name string, callback bool) error {
+	return s.bitmaps.RemoveBitmap(name, callback)
 }
 
-func (s *Server) clear(name string, callback bool) {
-	s.bitmaps.ClearBitmap(name, callback)
+func (s *Server) clear(name string, callback bool) error {
+	return s.bitmaps.ClearBitmap(name, callback)
 }
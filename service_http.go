@@ -1,13 +1,17 @@
 package basalt
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -15,54 +19,103 @@ import (
 // HTTPService is a http service.
 type HTTPService struct {
 	router             *httprouter.Router
+	server             *http.Server
 	s                  *Server
 	confChangeCallback ConfChange
 }
 
 // Serve serves http service.
 func (s *HTTPService) Serve(ln net.Listener) error {
-	s.config()
+	if s.router == nil {
+		s.config()
+	}
+
+	return s.server.Serve(ln)
+}
 
-	return http.Serve(ln, s.router)
+// Shutdown stops the http service after active requests are finished.
+func (s *HTTPService) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// Close closes the http service and all its connections immediately.
+func (s *HTTPService) Close() error {
+	return s.server.Close()
 }
 
 func (s *HTTPService) config() {
 	router := httprouter.New()
 	s.router = router
-
-	router.POST("/add/:name/:value", s.add)
-	router.POST("/addmany/:name/:values", s.addMany)
-	router.POST("/remove/:name/:value", s.remove)
-	router.POST("/drop/:name", s.drop)
-	router.POST("/clear/:name", s.clear)
-	router.GET("/exists/:name/:value", s.exists)
-	router.GET("/card/:name", s.card)
-
-	router.GET("/inter/:names", s.inter)
-	router.GET("/interstore/:dst/:names", s.interStore)
-
-	router.GET("/union/:names", s.union)
-	router.GET("/unionstore/:dst/:names", s.unionStore)
-
-	router.GET("/xor/:name1/:name2", s.xor)
-	router.GET("/xorstore/:dst/:name1/:name2", s.xorStore)
-
-	router.GET("/diff/:name1/:name2", s.diff)
-	router.GET("/diffstore/:dst/:name1/:name2", s.diffStore)
-
-	router.GET("/stats/:name", s.stats)
-	router.POST("/save", s.save)
-
-	router.POST("/peers/:nodeID", s.addNode)
-	router.DELETE("/peers/:nodeID", s.removeNode)
+	s.server = &http.Server{Handler: withScheme(router, s.s != nil && s.s.tlsConfig != nil)}
+
+	router.POST("/add/:name/:value", s.handle("add", CategoryWrite, s.add))
+	router.POST("/addmany/:name/:values", s.handle("addmany", CategoryWrite, s.addMany))
+	router.POST("/remove/:name/:value", s.handle("remove", CategoryWrite, s.remove))
+	router.POST("/drop/:name", s.handle("drop", CategoryWrite, s.drop))
+	router.POST("/clear/:name", s.handle("clear", CategoryWrite, s.clear))
+	router.POST("/freeze/:name", s.handle("freeze", CategoryWrite, s.freeze))
+	router.POST("/thaw/:name", s.handle("thaw", CategoryWrite, s.thaw))
+	router.GET("/exists/:name/:value", s.handle("exists", CategoryRead, s.exists))
+	router.GET("/card/:name", s.handle("card", CategoryRead, s.card))
+
+	router.GET("/inter/:names", s.handle("inter", CategoryRead, s.inter))
+	router.GET("/interstore/:dst/:names", s.handle("interstore", CategoryWrite, s.interStore))
+
+	router.GET("/union/:names", s.handle("union", CategoryRead, s.union))
+	router.GET("/unionstore/:dst/:names", s.handle("unionstore", CategoryWrite, s.unionStore))
+
+	router.GET("/xor/:name1/:name2", s.handle("xor", CategoryRead, s.xor))
+	router.GET("/xorstore/:dst/:name1/:name2", s.handle("xorstore", CategoryWrite, s.xorStore))
+
+	router.GET("/diff/:name1/:name2", s.handle("diff", CategoryRead, s.diff))
+	router.GET("/diffstore/:dst/:name1/:name2", s.handle("diffstore", CategoryWrite, s.diffStore))
+
+	router.GET("/stats/:name", s.handle("stats", CategoryRead, s.stats))
+	router.GET("/info/:name", s.handle("info", CategoryRead, s.info))
+	router.POST("/info/:name", s.handle("setinfo", CategoryWrite, s.setInfo))
+	router.POST("/save", s.handle("save", CategoryAdmin, s.save))
+
+	router.GET("/backup", s.handle("backup", CategoryAdmin, s.backup))
+	router.POST("/restore", s.handle("restore", CategoryAdmin, s.restore))
+	router.GET("/checksum", s.handle("checksum", CategoryAdmin, s.checksum))
+
+	router.GET("/export/:format", s.handle("export", CategoryAdmin, s.export))
+	router.GET("/export/:format/:names", s.handle("export", CategoryRead, s.export))
+	router.POST("/import/:format", s.handle("import", CategoryAdmin, s.importBitmaps))
+	router.POST("/import/:format/:name", s.handle("import", CategoryWrite, s.importBitmaps))
+
+	router.GET("/cluster/status", s.handle("clusterstatus", CategoryCluster, s.clusterStatus))
+	router.POST("/cluster/transfer", s.handle("transferleadership", CategoryCluster, s.transferLeadership))
+	router.POST("/cluster/transfer/:nodeID", s.handle("transferleadership", CategoryCluster, s.transferLeadership))
+	router.POST("/drain", s.handle("drain", CategoryAdmin, s.drain))
+	router.POST("/migrate/:name/:group", s.handle("migrate", CategoryAdmin, s.migrate))
+	router.POST("/peers/:nodeID", s.handle("addnode", CategoryCluster, s.addNode))
+	router.DELETE("/peers/:nodeID", s.handle("removenode", CategoryCluster, s.removeNode))
+	router.POST("/peers/:nodeID/replace/:newID", s.handle("replacenode", CategoryCluster, s.replaceNode))
+	router.PUT("/peers", s.handle("reconfigure", CategoryCluster, s.reconfigure))
+	router.POST("/learners/:nodeID", s.handle("addlearner", CategoryCluster, s.addLearner))
+	router.POST("/learners/:nodeID/promote", s.handle("promotelearner", CategoryCluster, s.promoteLearner))
+	router.GET("/metrics", s.auth(CategoryCluster, s.metrics))
+	router.GET("/slowlog", s.handle("slowlog", CategoryAdmin, s.slowlog))
+	router.GET("/slowlog/:count", s.handle("slowlog", CategoryAdmin, s.slowlog))
+	router.DELETE("/slowlog", s.handle("slowlogreset", CategoryAdmin, s.resetSlowLog))
+
+	router.Handle(http.MethodGet, "/groups/:group/*path", s.group)
+	router.Handle(http.MethodPost, "/groups/:group/*path", s.group)
+	router.Handle(http.MethodPut, "/groups/:group/*path", s.group)
+	router.Handle(http.MethodDelete, "/groups/:group/*path", s.group)
 }
 
 func (s *HTTPService) add(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	name := ps.ByName("name")
 	value := ps.ByName("value")
-	err := s.s.add(name, value, true)
+	g := s.route(w, r, name)
+	if g == nil {
+		return
+	}
+	err := g.add(name, value, true)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 }
@@ -70,9 +123,13 @@ func (s *HTTPService) add(w http.ResponseWriter, r *http.Request, ps httprouter.
 func (s *HTTPService) addMany(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	name := ps.ByName("name")
 	values := ps.ByName("values")
-	err := s.s.addMany(name, values, true)
+	g := s.route(w, r, name)
+	if g == nil {
+		return
+	}
+	err := g.addMany(name, values, true)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 }
@@ -80,26 +137,248 @@ func (s *HTTPService) addMany(w http.ResponseWriter, r *http.Request, ps httprou
 func (s *HTTPService) remove(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	name := ps.ByName("name")
 	value := ps.ByName("value")
-	err := s.s.remove(name, value, true)
+	g := s.route(w, r, name)
+	if g == nil {
+		return
+	}
+	err := g.remove(name, value, true)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 }
 
 func (s *HTTPService) drop(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	name := ps.ByName("name")
-	s.s.drop(name, true)
+	g := s.route(w, r, name)
+	if g == nil {
+		return
+	}
+	if err := g.drop(name, true); err != nil {
+		writeError(w, r, err)
+	}
 }
 
 func (s *HTTPService) clear(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	name := ps.ByName("name")
-	s.s.clear(name, true)
+	g := s.route(w, r, name)
+	if g == nil {
+		return
+	}
+	if err := g.clear(name, true); err != nil {
+		writeError(w, r, err)
+	}
+}
+
+// freeze makes the bitmap read-only and backed by a memory-mapped file.
+func (s *HTTPService) freeze(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("name")
+	g := s.route(w, r, name)
+	if g == nil {
+		return
+	}
+	if err := g.bitmaps.Freeze(name, true); err != nil {
+		writeError(w, r, err)
+	}
+}
+
+// thaw makes the frozen bitmap writable.
+func (s *HTTPService) thaw(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("name")
+	g := s.route(w, r, name)
+	if g == nil {
+		return
+	}
+	if err := g.bitmaps.Thaw(name, true); err != nil {
+		writeError(w, r, err)
+	}
+}
+
+// writeError writes err with the status code of its kind.
+// Writes to a follower in the redirect leader mode are redirected to the leader.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch e := err.(type) {
+	case *strconv.NumError:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case *NotLeaderError:
+		if e.Addr == "" {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Basalt-Leader", strconv.FormatUint(e.Leader, 10))
+		http.Redirect(w, r, redirectURL(r, e.Addr), http.StatusTemporaryRedirect)
+		return
+	case *MovedError:
+		if e.Addr == "" {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Basalt-Shard", strconv.Itoa(e.Shard))
+		w.Header().Set("X-Basalt-Group", strconv.FormatUint(e.Group, 10))
+		http.Redirect(w, r, redirectURL(r, e.Addr), http.StatusTemporaryRedirect)
+		return
+	}
+
+	switch err {
+	case ErrNoLeader:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case ErrAuthRequired, ErrAuthFailed:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="basalt"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case ErrNoPermission:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case ErrMigrating:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case ErrCrossShard, ErrShardedServer, ErrNotSharded, ErrSameGroup:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case ErrMigrationInProcess:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case ErrGroupNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrBitmapFrozen:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case ErrBitmapNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		if errors.Is(err, errWrongArity) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handle serves the command by h after checking permissions of the user by auth, and records its metrics.
+func (s *HTTPService) handle(command string, c Category, h httprouter.Handle) httprouter.Handle {
+	h = s.auth(c, h)
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r, ps)
+		s.s.metrics.observeCommand(protocolHTTP, command, start, sw.status >= http.StatusBadRequest)
+		if d := time.Since(start); s.s.slowlog.slow(d) {
+			args := make([]string, 0, len(ps))
+			for _, p := range ps {
+				args = append(args, p.Value)
+			}
+			s.s.slowlog.add(SlowLogEntry{Time: start, Duration: d, Protocol: protocolHTTP,
+				Command: command, Args: args, Client: r.RemoteAddr})
+		}
+	}
+}
+
+// statusWriter records the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// auth authenticates the request by its bearer token and checks that the user can run commands of the category
+// on bitmaps named in the path, if the server has an ACL.
+func (s *HTTPService) auth(c Category, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if acl := s.s.acl; acl != nil {
+			u, err := acl.AuthenticateToken(bearerToken(r))
+			if err == nil {
+				err = u.Allowed(c, pathKeys(ps)...)
+			}
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		h(w, r, ps)
+	}
+}
+
+// bearerToken returns the token in the Authorization header, or an empty string.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return auth[len("Bearer "):]
+	}
+	return ""
+}
+
+// pathKeys returns names of bitmaps in the path.
+func pathKeys(ps httprouter.Params) []string {
+	var keys []string
+	for _, p := range ps {
+		switch p.Key {
+		case "name", "dst", "name1", "name2":
+			keys = append(keys, p.Value)
+		case "names":
+			keys = append(keys, strings.Split(p.Value, ",")...)
+		}
+	}
+	return keys
+}
+
+// route returns the server holding the named bitmaps for writes, they must be in the same raft group.
+// It writes the error and returns nil if they can not be written by this process.
+func (s *HTTPService) route(w http.ResponseWriter, r *http.Request, names ...string) *Server {
+	g, err := s.s.routeWrite(names...)
+	if err != nil {
+		writeError(w, r, err)
+		return nil
+	}
+	return g
+}
+
+// readBitmaps returns the bitmaps holding the named bitmaps for reads, which may run across shards.
+// It writes the error and returns nil if they can not be read by this process.
+func (s *HTTPService) readBitmaps(w http.ResponseWriter, r *http.Request, names ...string) *Bitmaps {
+	bs, err := s.s.bitmapsOf(names...)
+	if err != nil {
+		writeError(w, r, err)
+		return nil
+	}
+	return bs
+}
+
+// group serves a request of a raft group hosted by this process, /groups/:group/<path> is served as /<path> by the group.
+func (s *HTTPService) group(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, err := strconv.ParseUint(ps.ByName("group"), 0, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g, err := s.s.group(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	gs := g.httpService
+	if gs == nil {
+		http.Error(w, ErrGroupNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = ps.ByName("path")
+	r2.URL.RawPath = ""
+	gs.router.ServeHTTP(w, r2)
+}
+
+// metrics exports metrics of the server and the raft groups it hosts in the Prometheus text format.
+func (s *HTTPService) metrics(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.s.metrics.handler.ServeHTTP(w, r)
 }
 
 func (s *HTTPService) card(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	name := ps.ByName("name")
-	count := s.s.bitmaps.Card(name)
+	bs := s.readBitmaps(w, r, name)
+	if bs == nil {
+		return
+	}
+	count := bs.Card(name)
 	w.Write([]byte(strconv.FormatUint(count, 10)))
 }
 
@@ -111,46 +390,78 @@ func (s *HTTPService) exists(w http.ResponseWriter, r *http.Request, ps httprout
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
 
-	existed := s.s.bitmaps.Exists(name, v)
+	bs := s.readBitmaps(w, r, name)
+	if bs == nil {
+		return
+	}
+	existed := bs.Exists(name, v)
 	if !existed {
 		http.Error(w, "not found", http.StatusNotFound)
 	}
 }
 
 func (s *HTTPService) inter(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	names := strings.Split(ps.ByName("name"), ",")
-	rt := s.s.bitmaps.Inter(names...)
+	names := strings.Split(ps.ByName("names"), ",")
+	bs := s.readBitmaps(w, r, names...)
+	if bs == nil {
+		return
+	}
+	rt := bs.Inter(names...)
 
 	w.Write([]byte(ints2str(rt)))
 }
 
 func (s *HTTPService) interStore(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	dst := ps.ByName("dst")
-	names := strings.Split(ps.ByName("name"), ",")
-	count := s.s.bitmaps.InterStore(dst, names...)
+	names := strings.Split(ps.ByName("names"), ",")
+	g := s.route(w, r, append([]string{dst}, names...)...)
+	if g == nil {
+		return
+	}
+	count, err := g.bitmaps.execCommand(append([]string{"bminterstore", dst}, names...)...)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	w.Write([]byte(strconv.FormatUint(count, 10)))
+	w.Write([]byte(strconv.FormatInt(count.(int64), 10)))
 }
 
 func (s *HTTPService) union(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	names := strings.Split(ps.ByName("name"), ",")
-	rt := s.s.bitmaps.Union(names...)
+	names := strings.Split(ps.ByName("names"), ",")
+	bs := s.readBitmaps(w, r, names...)
+	if bs == nil {
+		return
+	}
+	rt := bs.Union(names...)
 
 	w.Write([]byte(ints2str(rt)))
 }
 
 func (s *HTTPService) unionStore(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	dst := ps.ByName("dst")
-	names := strings.Split(ps.ByName("name"), ",")
-	count := s.s.bitmaps.UnionStore(dst, names...)
+	names := strings.Split(ps.ByName("names"), ",")
+	g := s.route(w, r, append([]string{dst}, names...)...)
+	if g == nil {
+		return
+	}
+	count, err := g.bitmaps.execCommand(append([]string{"bmunionstore", dst}, names...)...)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	w.Write([]byte(strconv.FormatUint(count, 10)))
+	w.Write([]byte(strconv.FormatInt(count.(int64), 10)))
 }
 
 func (s *HTTPService) xor(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	name1 := ps.ByName("name1")
 	name2 := ps.ByName("name2")
-	rt := s.s.bitmaps.Xor(name1, name2)
+	bs := s.readBitmaps(w, r, name1, name2)
+	if bs == nil {
+		return
+	}
+	rt := bs.Xor(name1, name2)
 
 	w.Write([]byte(ints2str(rt)))
 }
@@ -159,15 +470,27 @@ func (s *HTTPService) xorStore(w http.ResponseWriter, r *http.Request, ps httpro
 	dst := ps.ByName("dst")
 	name1 := ps.ByName("name1")
 	name2 := ps.ByName("name2")
-	count := s.s.bitmaps.XorStore(dst, name1, name2)
+	g := s.route(w, r, dst, name1, name2)
+	if g == nil {
+		return
+	}
+	count, err := g.bitmaps.execCommand("bmxorstore", dst, name1, name2)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	w.Write([]byte(strconv.FormatUint(count, 10)))
+	w.Write([]byte(strconv.FormatInt(count.(int64), 10)))
 }
 
 func (s *HTTPService) diff(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	name1 := ps.ByName("name1")
 	name2 := ps.ByName("name2")
-	rt := s.s.bitmaps.Diff(name1, name2)
+	bs := s.readBitmaps(w, r, name1, name2)
+	if bs == nil {
+		return
+	}
+	rt := bs.Diff(name1, name2)
 
 	w.Write([]byte(ints2str(rt)))
 }
@@ -176,14 +499,26 @@ func (s *HTTPService) diffStore(w http.ResponseWriter, r *http.Request, ps httpr
 	dst := ps.ByName("dst")
 	name1 := ps.ByName("name1")
 	name2 := ps.ByName("name2")
-	count := s.s.bitmaps.DiffStore(dst, name1, name2)
+	g := s.route(w, r, dst, name1, name2)
+	if g == nil {
+		return
+	}
+	count, err := g.bitmaps.execCommand("bmdiffstore", dst, name1, name2)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	w.Write([]byte(strconv.FormatUint(count, 10)))
+	w.Write([]byte(strconv.FormatInt(count.(int64), 10)))
 }
 
 func (s *HTTPService) stats(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	name := ps.ByName("name")
-	stats := s.s.bitmaps.Stats(name)
+	bs := s.readBitmaps(w, r, name)
+	if bs == nil {
+		return
+	}
+	stats := bs.Stats(name)
 	w.Header().Set("Content-Type", "application/json")
 	data, err := json.Marshal(stats)
 	if err != nil {
@@ -192,6 +527,44 @@ func (s *HTTPService) stats(w http.ResponseWriter, r *http.Request, ps httproute
 	w.Write(data)
 }
 
+func (s *HTTPService) info(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("name")
+	bs := s.readBitmaps(w, r, name)
+	if bs == nil {
+		return
+	}
+	meta, ok := bs.Metadata(name)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(meta)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// setInfo updates metadata of the bitmap with a json MetadataUpdate in the request body.
+func (s *HTTPService) setInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("name")
+	var update MetadataUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	g := s.route(w, r, name)
+	if g == nil {
+		return
+	}
+	if err := g.bitmaps.SetMetadata(name, update, true); err != nil {
+		writeError(w, r, err)
+	}
+}
+
 func (s *HTTPService) save(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	err := s.s.Save()
 	if err != nil {
@@ -199,6 +572,217 @@ func (s *HTTPService) save(w http.ResponseWriter, r *http.Request, ps httprouter
 	}
 }
 
+// backup streams a point-in-time backup of all bitmaps.
+func (s *HTTPService) backup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	h, data, err := s.s.prepareBackup()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(backupSize(h), 10))
+	w.Header().Set("X-Basalt-Index", strconv.FormatUint(h.Index, 10))
+	w.Header().Set("X-Basalt-Checksum", strconv.FormatUint(uint64(h.Checksum), 10))
+	writeBackup(w, h, data)
+}
+
+// restore reseeds the bitmaps of the cluster from a backup in the request body.
+func (s *HTTPService) restore(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+	h, index, err := s.s.RestoreBackup(r.Body, 30*time.Second)
+	switch err {
+	case nil:
+	case ErrInvalidBackup, ErrBackupChecksum:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case ErrRestoreUnverified:
+		http.Error(w, err.Error(), http.StatusAccepted)
+		return
+	default:
+		writeError(w, r, err)
+		return
+	}
+
+	// members have the restored state if their checksums at the index are the same
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Basalt-Index", strconv.FormatUint(index, 10))
+	json.NewEncoder(w).Encode(h)
+}
+
+// checksum returns the checksum of bitmaps on this node, to verify a restore.
+func (s *HTTPService) checksum(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	checksum, index, err := s.s.Checksum()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]uint64{
+		"index":    index,
+		"checksum": uint64(checksum),
+	})
+}
+
+// export streams bitmaps in a portable format. All bitmaps are exported if names is not set.
+func (s *HTTPService) export(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	format, err := ParseFormat(ps.ByName("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var names []string
+	if ps.ByName("names") != "" {
+		names = strings.Split(ps.ByName("names"), ",")
+	}
+	if format.SingleBitmap() && len(names) != 1 {
+		http.Error(w, ErrSingleBitmap.Error(), http.StatusBadRequest)
+		return
+	}
+	bs := s.s.bitmaps
+	if len(names) > 0 {
+		if bs = s.readBitmaps(w, r, names...); bs == nil {
+			return
+		}
+	} else if s.s.isSharded() {
+		writeError(w, r, ErrShardedServer)
+		return
+	}
+	if format.SingleBitmap() && !bs.has(names[0]) {
+		http.Error(w, ErrBitmapNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", formatContentType(format))
+	err = bs.Export(w, format, names...)
+	if err != nil {
+		// headers have been sent, so we can only log it.
+		log.Printf("failed to export bitmaps: %v", err)
+	}
+}
+
+// importBitmaps reads bitmaps in a portable format from the request body.
+func (s *HTTPService) importBitmaps(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	format, err := ParseFormat(ps.ByName("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	g := s.s
+	if name := ps.ByName("name"); name != "" {
+		if g = s.route(w, r, name); g == nil {
+			return
+		}
+	} else if s.s.isSharded() {
+		writeError(w, r, ErrShardedServer)
+		return
+	}
+	n, err := g.bitmaps.Import(r.Body, format, ps.ByName("name"), true)
+	if isLeaderError(err) {
+		writeError(w, r, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte(strconv.FormatUint(n, 10)))
+}
+
+func formatContentType(format Format) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv"
+	case FormatJSON:
+		return "application/json"
+	case FormatInts:
+		return "text/plain"
+	}
+	return "application/octet-stream"
+}
+
+// clusterStatus returns the raft status of this node and its view of the cluster.
+func (s *HTTPService) clusterStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	status, err := s.s.ClusterStatus()
+	switch err {
+	case nil:
+	case ErrNotInCluster:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case ErrRaftNotReady:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// transferLeadership transfers leadership to the node, or the most up-to-date voter if the node is not set.
+func (s *HTTPService) transferLeadership(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var target uint64
+	if nodeID := ps.ByName("nodeID"); nodeID != "" {
+		id, err := strconv.ParseUint(nodeID, 0, 64)
+		if err != nil {
+			http.Error(w, "Failed on convert ID", http.StatusBadRequest)
+			return
+		}
+		target = id
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), transferTimeout)
+	defer cancel()
+	err := s.s.TransferLeadership(ctx, target)
+	switch err {
+	case nil:
+	case ErrNotInCluster, ErrNodeNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrNotVoter, ErrNoTransferee:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case context.DeadlineExceeded:
+		http.Error(w, "leadership transfer timed out", http.StatusGatewayTimeout)
+	default:
+		writeError(w, r, err)
+	}
+}
+
+// migrate moves the bitmap to another raft group, it returns after the bitmap is moved.
+func (s *HTTPService) migrate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	group, err := strconv.ParseUint(ps.ByName("group"), 10, 64)
+	if err != nil {
+		http.Error(w, "Failed on convert group", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), migrateTimeout)
+	defer cancel()
+	err = s.s.Migrate(ctx, ps.ByName("name"), group)
+	switch err {
+	case nil:
+	case context.DeadlineExceeded:
+		http.Error(w, "migration timed out", http.StatusGatewayTimeout)
+	default:
+		writeError(w, r, err)
+	}
+}
+
+// drain starts to drain this server, it returns before the server is drained.
+func (s *HTTPService) drain(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := s.s.startDrain(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func (s *HTTPService) addNode(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	nodeID := ps.ByName("nodeID")
 	url, err := ioutil.ReadAll(r.Body)
@@ -214,6 +798,10 @@ func (s *HTTPService) addNode(w http.ResponseWriter, r *http.Request, ps httprou
 
 	if s.confChangeCallback != nil {
 		err = s.confChangeCallback.AddNode(id, url)
+		if err == ErrMemberRemoved {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		if err != nil {
 			http.Error(w, "failed to add node: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -238,6 +826,112 @@ func (s *HTTPService) removeNode(w http.ResponseWriter, r *http.Request, ps http
 	}
 }
 
+// replaceNode replaces a member with a new node with the raft URL in the request body.
+func (s *HTTPService) replaceNode(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	url, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+	oldID, err := strconv.ParseUint(ps.ByName("nodeID"), 0, 64)
+	if err != nil {
+		http.Error(w, "Failed on convert ID", http.StatusBadRequest)
+		return
+	}
+	newID, err := strconv.ParseUint(ps.ByName("newID"), 0, 64)
+	if err != nil {
+		http.Error(w, "Failed on convert ID", http.StatusBadRequest)
+		return
+	}
+	if len(url) == 0 {
+		http.Error(w, ErrNoMemberURL.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.confChangeCallback != nil {
+		writeConfChangeError(w, r, s.confChangeCallback.ReplaceNode(oldID, newID, url))
+	}
+}
+
+// reconfigure changes voters of the cluster to the members in the request body,
+// which is a json object of node IDs to raft URLs, URLs of existing members can be empty.
+func (s *HTTPService) reconfigure(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var voters map[uint64]string
+	if err := json.NewDecoder(r.Body).Decode(&voters); err != nil {
+		http.Error(w, "Failed on decode members: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.confChangeCallback != nil {
+		writeConfChangeError(w, r, s.confChangeCallback.Reconfigure(voters))
+	}
+}
+
+// writeConfChangeError writes the error of a joint consensus membership change.
+func writeConfChangeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case err == nil:
+	case err == ErrNodeNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err == ErrNodeExists, err == ErrJointConfig, err == ErrMemberRemoved:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err == ErrNoVoters, errors.Is(err, ErrNoMemberURL):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		writeError(w, r, err)
+	}
+}
+
+// addLearner adds a learner with the raft URL in the request body.
+func (s *HTTPService) addLearner(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	nodeID := ps.ByName("nodeID")
+	url, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseUint(nodeID, 0, 64)
+	if err != nil {
+		http.Error(w, "Failed on convert ID", http.StatusBadRequest)
+		return
+	}
+
+	if s.confChangeCallback != nil {
+		err = s.confChangeCallback.AddLearner(id, url)
+		if err == ErrMemberRemoved {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to add learner: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// promoteLearner promotes a caught-up learner to voter, it is redirected to the leader if possible.
+func (s *HTTPService) promoteLearner(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	nodeID := ps.ByName("nodeID")
+	id, err := strconv.ParseUint(nodeID, 0, 64)
+	if err != nil {
+		http.Error(w, "Failed on convert ID", http.StatusBadRequest)
+		return
+	}
+
+	if s.confChangeCallback != nil {
+		err = s.confChangeCallback.PromoteLearner(id)
+		switch err {
+		case nil:
+		case ErrNodeNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case ErrNotLearner, ErrLearnerNotCaughtUp:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			writeError(w, r, err)
+		}
+	}
+}
+
 func ints2str(vs []uint32) string {
 	// return strings.Trim(strings.Join(strings.Fields(fmt.Sprint(vs)), ","), "[]")
 	return strings.Join(strings.Fields(fmt.Sprint(vs)), ",")
@@ -260,3 +954,23 @@ func str2uint32s(s string) ([]uint32, error) {
 	}
 	return rt, nil
 }
+
+// slowlog returns the latest count entries of the slow log, or all entries if the count is not set.
+func (s *HTTPService) slowlog(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	n := -1
+	if count := ps.ByName("count"); count != "" {
+		v, err := strconv.Atoi(count)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		n = v
+	}
+	l := s.s.slowlog
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SlowLogReply{Len: l.Len(), Entries: l.Get(n)})
+}
+
+func (s *HTTPService) resetSlowLog(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.s.slowlog.Reset()
+}
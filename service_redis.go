@@ -1,8 +1,14 @@
 package basalt
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tidwall/redcon"
 )
@@ -11,24 +17,319 @@ import (
 type RedisService struct {
 	s                  *Server
 	confChangeCallback ConfChange
+	handler            func(conn redcon.Conn, cmd redcon.Command) // redisHandler with metrics, for subscribers
+}
+
+// redisClient is the state of a redis connection.
+type redisClient struct {
+	id      uint64
+	addr    string
+	created time.Time
+
+	// fields below are read by CLIENT LIST, they are written with mu held
+	mu         sync.Mutex
+	user       *User       // authenticated user, or the default user
+	resp       int         // protocol version, switched by HELLO
+	name       string      // set by CLIENT SETNAME
+	cmd        string      // the last command
+	last       time.Time   // time of the last command
+	subscriber *subscriber // set when the connection subscribes first
+
+	multi   bool       // set by MULTI until EXEC or DISCARD
+	dirty   bool       // a command failed to be queued, EXEC aborts the transaction
+	queued  [][]string // commands queued by MULTI
+	watches []WatchedBitmap
+}
+
+// redisCommand is the ACL category of a command, its arity and the positions of its keys.
+type redisCommand struct {
+	category Category
+	arity    int // number of arguments including the name, negative for the minimum number
+	firstKey int // position of the first key, 0 if it has no keys
+	lastKey  int // position of the last key, negative positions count from the end
+}
+
+// redisCommands are commands of the redis service, which are checked by ACLs. Commands without a category
+// can be run by all users, unknown commands are admin commands. Commands queued in a transaction are
+// checked when they are queued. Commands of a raft group run by group are checked as well.
+var redisCommands = map[string]redisCommand{
+	"bmadd":        {CategoryWrite, 3, 1, 1},
+	"bmaddmany":    {CategoryWrite, -3, 1, 1},
+	"bmdel":        {CategoryWrite, 3, 1, 1},
+	"bmdrop":       {CategoryWrite, 2, 1, 1},
+	"bmclear":      {CategoryWrite, 2, 1, 1},
+	"bmfreeze":     {CategoryWrite, 2, 1, 1},
+	"bmthaw":       {CategoryWrite, 2, 1, 1},
+	"bmsetinfo":    {CategoryWrite, -4, 1, 1},
+	"bminterstore": {CategoryWrite, -4, 1, -1},
+	"bmunionstore": {CategoryWrite, -4, 1, -1},
+	"bmxorstore":   {CategoryWrite, 4, 1, 3},
+	"bmdiffstore":  {CategoryWrite, 4, 1, 3},
+
+	"bmcard":   {CategoryRead, 2, 1, 1},
+	"bmexists": {CategoryRead, 3, 1, 1},
+	"bminter":  {CategoryRead, -3, 1, -1},
+	"bmunion":  {CategoryRead, -3, 1, -1},
+	"bmxor":    {CategoryRead, 3, 1, 2},
+	"bmdiff":   {CategoryRead, 3, 1, 2},
+	"bmstats":  {CategoryRead, 2, 1, 1},
+	"bminfo":   {CategoryRead, 2, 1, 1},
+
+	"setbit":   {CategoryWrite, 4, 1, 1},
+	"bitop":    {CategoryWrite, -4, 2, -1},
+	"bitfield": {CategoryWrite, -2, 1, 1},
+	"getbit":   {CategoryRead, 3, 1, 1},
+	"bitcount": {CategoryRead, -2, 1, 1},
+	"bitpos":   {CategoryRead, -3, 1, 1},
+
+	"del":      {CategoryWrite, -2, 1, -1},
+	"unlink":   {CategoryWrite, -2, 1, -1},
+	"exists":   {CategoryRead, -2, 1, -1},
+	"type":     {CategoryRead, 2, 1, 1},
+	"scan":     {CategoryRead, -2, 0, 0},
+	"dbsize":   {CategoryRead, 1, 0, 0},
+	"flushdb":  {CategoryAdmin, -1, 0, 0},
+	"flushall": {CategoryAdmin, -1, 0, 0},
+
+	"bmsave":  {CategoryAdmin, 1, 0, 0},
+	"drain":   {CategoryAdmin, 1, 0, 0},
+	"migrate": {CategoryAdmin, 3, 1, 1},
+	"slowlog": {CategoryAdmin, -2, 0, 0},
+
+	"watch": {CategoryRead, -2, 1, -1},
+
+	// channels are not keys, subscribers only receive notifications of bitmaps they can read
+	"subscribe":    {CategoryRead, -2, 0, 0},
+	"psubscribe":   {CategoryRead, -2, 0, 0},
+	"unsubscribe":  {"", -1, 0, 0},
+	"punsubscribe": {"", -1, 0, 0},
+
+	"clusterinfo":    {CategoryCluster, 1, 0, 0},
+	"info":           {CategoryCluster, -1, 0, 0},
+	"transferleader": {CategoryCluster, -1, 0, 0},
+	"addnode":        {CategoryCluster, 3, 0, 0},
+	"removenode":     {CategoryCluster, 2, 0, 0},
+	"addlearner":     {CategoryCluster, 3, 0, 0},
+	"promotelearner": {CategoryCluster, 2, 0, 0},
+	"replacenode":    {CategoryCluster, 4, 0, 0},
+	"reconfigure":    {CategoryCluster, -2, 0, 0},
+
+	"ping":    {"", -1, 0, 0},
+	"echo":    {"", 2, 0, 0},
+	"hello":   {"", -1, 0, 0},
+	"quit":    {"", 1, 0, 0},
+	"auth":    {"", -2, 0, 0},
+	"select":  {"", 2, 0, 0},
+	"client":  {"", -2, 0, 0},
+	"command": {"", -1, 0, 0},
+	"group":   {"", -3, 0, 0},
+	"multi":   {"", 1, 0, 0},
+	"exec":    {"", 1, 0, 0},
+	"discard": {"", 1, 0, 0},
+	"unwatch": {"", 1, 0, 0},
+}
+
+// redisSubcommands are subcommands checked by ACLs in place of the category of their command.
+var redisSubcommands = map[string]redisCommand{
+	"client|list": {CategoryAdmin, 2, 0, 0},
+}
+
+// keys returns the keys in the arguments of the command.
+func (c redisCommand) keys(args [][]byte) []string {
+	if c.firstKey == 0 {
+		return nil
+	}
+	last := c.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []string
+	for i := c.firstKey; i <= last && i < len(args); i++ {
+		keys = append(keys, string(args[i]))
+	}
+	return keys
 }
 
 func (rs *RedisService) redisAccept(conn redcon.Conn) bool {
+	c := rs.client(conn)
+	rs.s.clientsMu.Lock()
+	rs.s.clients[c.id] = c
+	rs.s.clientsMu.Unlock()
+	atomic.AddInt64(&rs.s.redisClients, 1)
+	atomic.AddInt64(&rs.s.redisConns, 1)
 	return true
 }
+
+// client returns the state of the connection.
+func (rs *RedisService) client(conn redcon.Conn) *redisClient {
+	if c, ok := conn.Context().(*redisClient); ok {
+		return c
+	}
+	now := time.Now()
+	c := &redisClient{id: atomic.AddUint64(&rs.s.lastClientID, 1), addr: conn.RemoteAddr(), created: now, last: now, resp: 2}
+	if rs.s.acl != nil {
+		c.user = rs.s.acl.defaultUser()
+	}
+	conn.SetContext(c)
+	return c
+}
+
+// authorize checks that the user of the connection can run the command, if the server has an ACL.
+func (rs *RedisService) authorize(conn redcon.Conn, name string, args [][]byte) bool {
+	if rs.s.acl == nil {
+		return true
+	}
+	c, ok := redisCommands[name]
+	if !ok {
+		c = redisCommand{category: CategoryAdmin}
+	}
+	if len(args) > 1 {
+		if sub, ok := redisSubcommands[name+"|"+strings.ToLower(string(args[1]))]; ok {
+			c = sub
+		}
+	}
+	if c.category == "" {
+		return true
+	}
+	switch rs.client(conn).user.Allowed(c.category, c.keys(args)...) {
+	case nil:
+		return true
+	case ErrAuthRequired:
+		conn.WriteError("NOAUTH Authentication required.")
+	default:
+		conn.WriteError("NOPERM this user has no permissions to run the '" + name + "' command on the keys")
+	}
+	return false
+}
+
+// meter records metrics of redis commands handled by the handler.
+func (rs *RedisService) meter(handler func(conn redcon.Conn, cmd redcon.Command)) func(conn redcon.Conn, cmd redcon.Command) {
+	return func(conn redcon.Conn, cmd redcon.Command) {
+		start := time.Now()
+		mc := &meteredConn{Conn: conn}
+		handler(mc, cmd)
+		rs.s.metrics.observeCommand(protocolRedis, redisCommandLabel(cmd.Args[0]), start, mc.failed)
+		if d := time.Since(start); rs.s.slowlog.slow(d) {
+			args := make([]string, 0, len(cmd.Args)-1)
+			for _, arg := range cmd.Args[1:] {
+				args = append(args, string(arg))
+			}
+			redactSlowLogArgs(string(cmd.Args[0]), args)
+			rs.s.slowlog.add(SlowLogEntry{Time: start, Duration: d, Protocol: protocolRedis,
+				Command: string(cmd.Args[0]), Args: args, Client: conn.RemoteAddr(), ClientName: rs.client(conn).getName()})
+		}
+	}
+}
+
+// redisCommandLabel returns the name of the command in metrics, unknown commands share a label.
+func redisCommandLabel(arg []byte) string {
+	name := strings.ToLower(string(arg))
+	if _, ok := redisCommands[name]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// meteredConn records whether an error is replied.
+type meteredConn struct {
+	redcon.Conn
+	failed bool
+}
+
+func (c *meteredConn) WriteError(msg string) {
+	c.failed = true
+	c.Conn.WriteError(msg)
+}
+
 func (rs *RedisService) redisClose(conn redcon.Conn, err error) {
+	c := rs.client(conn)
+	if c.subscriber != nil {
+		// detached, it is removed when the subscriber is closed
+		return
+	}
+	rs.removeClient(c)
+}
+
+func (rs *RedisService) removeClient(c *redisClient) {
+	rs.s.clientsMu.Lock()
+	delete(rs.s.clients, c.id)
+	rs.s.clientsMu.Unlock()
+	atomic.AddInt64(&rs.s.redisClients, -1)
 }
 
 // redisHandler handles redis commands.
 func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
-	switch strings.ToLower(string(cmd.Args[0])) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	c := rs.client(conn)
+	c.mu.Lock()
+	c.cmd, c.last = name, time.Now()
+	c.mu.Unlock()
+	if c.multi {
+		switch name {
+		case "multi", "exec", "discard", "watch", "quit":
+		default:
+			rs.queue(conn, c, name, cmd.Args)
+			return
+		}
+	}
+	// like Redis, RESP3 connections can run any command while subscribing
+	subscribing := c.subscriber != nil && c.subscriber.count() > 0 && c.resp == 2
+	if subscribing {
+		switch name {
+		case "subscribe", "psubscribe", "unsubscribe", "punsubscribe", "ping", "quit":
+		default:
+			conn.WriteError("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context")
+			return
+		}
+	}
+	if !rs.authorize(conn, name, cmd.Args) {
+		return
+	}
+
+	switch name {
 	default:
 		conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
 	case "ping":
+		if subscribing {
+			conn.WriteArray(2)
+			conn.WriteBulkString("pong")
+			conn.WriteBulkString("")
+			return
+		}
 		conn.WriteString("PONG")
 	case "quit":
 		conn.WriteString("OK")
 		conn.Close()
+	case "auth": // authenticate the connection: auth [username] password
+		if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		if rs.s.acl == nil {
+			conn.WriteError("ERR AUTH called without any ACL configured")
+			return
+		}
+
+		user, password := DefaultUser, string(cmd.Args[1])
+		if len(cmd.Args) == 3 {
+			user, password = string(cmd.Args[1]), string(cmd.Args[2])
+		}
+		u, err := rs.s.acl.Authenticate(user, password)
+		if err != nil {
+			conn.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+			return
+		}
+		c := rs.client(conn)
+		c.mu.Lock()
+		c.user = u
+		c.mu.Unlock()
+		conn.WriteString("OK")
+	case "info": // information and statistics of the server: info [section ...]
+		var sections []string
+		for _, arg := range cmd.Args[1:] {
+			sections = append(sections, string(arg))
+		}
+		conn.WriteBulkString(rs.s.Info(sections...))
 	case "bmadd": // bitmap add
 		if len(cmd.Args) != 3 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
@@ -41,7 +342,14 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		rs.s.bitmaps.Add(string(cmd.Args[1]), v, true)
+		g := rs.route(conn, string(cmd.Args[1]))
+		if g == nil {
+			return
+		}
+		if err := g.bitmaps.Add(string(cmd.Args[1]), v, true); err != nil {
+			writeRedisError(conn, err)
+			return
+		}
 		conn.WriteInt(1)
 
 	case "bmaddmany": // bitmap addmany
@@ -56,7 +364,14 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		rs.s.bitmaps.AddMany(string(cmd.Args[1]), values, true)
+		g := rs.route(conn, string(cmd.Args[1]))
+		if g == nil {
+			return
+		}
+		if err := g.bitmaps.AddMany(string(cmd.Args[1]), values, true); err != nil {
+			writeRedisError(conn, err)
+			return
+		}
 		conn.WriteInt(len(values))
 
 	case "bmdel": // bitmap remove
@@ -71,7 +386,14 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		rs.s.bitmaps.Remove(string(cmd.Args[1]), v, true)
+		g := rs.route(conn, string(cmd.Args[1]))
+		if g == nil {
+			return
+		}
+		if err := g.bitmaps.Remove(string(cmd.Args[1]), v, true); err != nil {
+			writeRedisError(conn, err)
+			return
+		}
 		conn.WriteInt(1)
 
 	case "bmdrop": // bitmap remove_bitmap
@@ -80,7 +402,14 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		rs.s.bitmaps.RemoveBitmap(string(cmd.Args[1]), true)
+		g := rs.route(conn, string(cmd.Args[1]))
+		if g == nil {
+			return
+		}
+		if err := g.bitmaps.RemoveBitmap(string(cmd.Args[1]), true); err != nil {
+			writeRedisError(conn, err)
+			return
+		}
 		conn.WriteString("OK")
 
 	case "bmclear": // bitmap clear_bitmap
@@ -89,7 +418,44 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		rs.s.bitmaps.ClearBitmap(string(cmd.Args[1]), true)
+		g := rs.route(conn, string(cmd.Args[1]))
+		if g == nil {
+			return
+		}
+		if err := g.bitmaps.ClearBitmap(string(cmd.Args[1]), true); err != nil {
+			writeRedisError(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+	case "bmfreeze": // bitmap freeze
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		g := rs.route(conn, string(cmd.Args[1]))
+		if g == nil {
+			return
+		}
+		if err := g.bitmaps.Freeze(string(cmd.Args[1]), true); err != nil {
+			writeRedisError(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+	case "bmthaw": // bitmap thaw
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		g := rs.route(conn, string(cmd.Args[1]))
+		if g == nil {
+			return
+		}
+		if err := g.bitmaps.Thaw(string(cmd.Args[1]), true); err != nil {
+			writeRedisError(conn, err)
+			return
+		}
 		conn.WriteString("OK")
 	case "bmcard": // bitmap clear_bitmap
 		if len(cmd.Args) != 2 {
@@ -97,7 +463,11 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		count := rs.s.bitmaps.Card(string(cmd.Args[1]))
+		bs := rs.readBitmaps(conn, string(cmd.Args[1]))
+		if bs == nil {
+			return
+		}
+		count := bs.Card(string(cmd.Args[1]))
 		conn.WriteInt64(int64(count))
 
 	case "bmexists": // bitmap exists
@@ -112,12 +482,11 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		existed := rs.s.bitmaps.Exists(string(cmd.Args[1]), v)
-		if existed {
-			conn.WriteInt(1)
-		} else {
-			conn.WriteInt(0)
+		bs := rs.readBitmaps(conn, string(cmd.Args[1]))
+		if bs == nil {
+			return
 		}
+		writeBool(conn, bs.Exists(string(cmd.Args[1]), v))
 
 	case "bminter": // bitmap intersect
 		if len(cmd.Args) < 3 {
@@ -126,125 +495,380 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 		}
 
 		names := bytes2string(cmd.Args[1:])
-		rt := rs.s.bitmaps.Inter(names...)
-
-		conn.WriteArray(len(rt))
-		for _, v := range rt {
-			conn.WriteInt64(int64(v))
+		bs := rs.readBitmaps(conn, names...)
+		if bs == nil {
+			return
 		}
+		rt := bs.Inter(names...)
+
+		writeUint32Set(conn, rt)
 
-	case "bminterstore": // bitmap intersect store
-		if len(cmd.Args) < 4 {
+	case "bmunion": // bitmap union
+		if len(cmd.Args) < 3 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
 		names := bytes2string(cmd.Args[1:])
-		count := rs.s.bitmaps.InterStore(names[0], names[1:]...)
-		conn.WriteInt64(int64(count))
+		bs := rs.readBitmaps(conn, names...)
+		if bs == nil {
+			return
+		}
+		rt := bs.Union(names...)
 
-	case "bmunion": // bitmap union
-		if len(cmd.Args) < 3 {
+		writeUint32Set(conn, rt)
+	case "bmxor": // bitmap xor
+		if len(cmd.Args) != 3 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		names := bytes2string(cmd.Args[1:])
-		rt := rs.s.bitmaps.Union(names...)
+		bs := rs.readBitmaps(conn, string(cmd.Args[1]), string(cmd.Args[2]))
+		if bs == nil {
+			return
+		}
+		rt := bs.Xor(string(cmd.Args[1]), string(cmd.Args[2]))
+
+		writeUint32Set(conn, rt)
+	case "bmdiff": // bitmap diff
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
 
-		conn.WriteArray(len(rt))
-		for _, v := range rt {
-			conn.WriteInt64(int64(v))
+		bs := rs.readBitmaps(conn, string(cmd.Args[1]), string(cmd.Args[2]))
+		if bs == nil {
+			return
 		}
-	case "bmunionstore": // bitmap union store
-		if len(cmd.Args) < 4 {
+		rt := bs.Diff(string(cmd.Args[1]), string(cmd.Args[2]))
+
+		writeUint32Set(conn, rt)
+	case "bmstats": // bitmap diff store
+		if len(cmd.Args) != 2 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		names := bytes2string(cmd.Args[1:])
-		count := rs.s.bitmaps.UnionStore(names[0], names[1:]...)
-		conn.WriteInt64(int64(count))
+		bs := rs.readBitmaps(conn, string(cmd.Args[1]))
+		if bs == nil {
+			return
+		}
+		stats := bs.Stats(string(cmd.Args[1]))
 
-	case "bmxor": // bitmap xor
-		if len(cmd.Args) != 3 {
+		metrics := []struct {
+			name  string
+			value uint64
+		}{
+			{"cardinality", stats.Cardinality},
+			{"Containers", stats.Containers},
+			{"ArrayContainers", stats.ArrayContainers},
+			{"ArrayContainerBytes", stats.ArrayContainerBytes},
+			{"ArrayContainerValues", stats.ArrayContainerValues},
+			{"BitmapContainers", stats.BitmapContainers},
+			{"BitmapContainerBytes", stats.BitmapContainerBytes},
+			{"BitmapContainerValues", stats.BitmapContainerValues},
+			{"RunContainers", stats.RunContainers},
+			{"RunContainerBytes", stats.RunContainerBytes},
+			{"RunContainerValues", stats.RunContainerValues},
+		}
+		// a map of RESP3, or a bulk string of `name:value` lines of RESP2
+		if resp3(conn) {
+			writeMap(conn, len(metrics))
+			for _, m := range metrics {
+				conn.WriteBulkString(m.name)
+				conn.WriteInt64(int64(m.value))
+			}
+			return
+		}
+		var sb strings.Builder
+		for _, m := range metrics {
+			appendMetric(&sb, m.name, m.value)
+		}
+		conn.WriteBulkString(sb.String())
+	case "bminfo": // bitmap metadata
+		if len(cmd.Args) != 2 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		rt := rs.s.bitmaps.Xor(string(cmd.Args[1]), string(cmd.Args[2]))
+		bs := rs.readBitmaps(conn, string(cmd.Args[1]))
+		if bs == nil {
+			return
+		}
+		meta, ok := bs.Metadata(string(cmd.Args[1]))
+		if !ok {
+			writeNull(conn)
+			return
+		}
 
-		conn.WriteArray(len(rt))
-		for _, v := range rt {
-			conn.WriteInt64(int64(v))
+		pairs := meta.Pairs()
+		writeMap(conn, len(pairs)/2)
+		for _, v := range pairs {
+			conn.WriteBulkString(v)
 		}
-	case "bmxorstore": // bitmap xor store
-		if len(cmd.Args) != 4 {
+	case "bmsetinfo": // set bitmap metadata
+		if len(cmd.Args) < 4 || len(cmd.Args)%2 != 0 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		count := rs.s.bitmaps.XorStore(string(cmd.Args[1]), string(cmd.Args[2]), string(cmd.Args[3]))
-		conn.WriteInt64(int64(count))
+		update, err := ParseMetadataUpdate(bytes2string(cmd.Args[2:]))
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
 
-	case "bmdiff": // bitmap diff
-		if len(cmd.Args) != 3 {
+		g := rs.route(conn, string(cmd.Args[1]))
+		if g == nil {
+			return
+		}
+		err = g.bitmaps.SetMetadata(string(cmd.Args[1]), update, true)
+		if isLeaderError(err) {
+			writeRedisError(conn, err)
+			return
+		}
+		if err != nil {
+			conn.WriteError("ERR failed to set metadata because of " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	case "setbit", "getbit", "bitcount", "bitpos", "bitop", "bitfield": // bit commands of Redis
+		rs.runCommand(conn, name, cmd.Args)
+	case "bminterstore", "bmunionstore", "bmxorstore", "bmdiffstore": // bitmap set operations store
+		rs.runCommand(conn, name, cmd.Args)
+	case "bmsave": // bitmap persist
+		if len(cmd.Args) != 1 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		err := rs.s.Save()
+		if err != nil {
+			conn.WriteError("ERR save because of " + err.Error())
+			return
+		}
+
+		conn.WriteInt(1)
+	case "clusterinfo": // raft status of the cluster
+		if len(cmd.Args) != 1 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		rt := rs.s.bitmaps.Diff(string(cmd.Args[1]), string(cmd.Args[2]))
+		status, err := rs.s.ClusterStatus()
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteBulkString(formatClusterStatus(status))
+	case "multi": // start a transaction
+		c := rs.client(conn)
+		if c.multi {
+			conn.WriteError("ERR MULTI calls can not be nested")
+			return
+		}
+		c.multi = true
+		conn.WriteString("OK")
+	case "exec": // run commands queued since MULTI atomically
+		rs.exec(conn)
+	case "discard": // discard commands queued since MULTI
+		c := rs.client(conn)
+		if !c.multi {
+			conn.WriteError("ERR DISCARD without MULTI")
+			return
+		}
+		c.reset()
+		conn.WriteString("OK")
+	case "watch": // abort the next transaction if the bitmaps are modified: watch name [name ...]
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		c := rs.client(conn)
+		if c.multi {
+			conn.WriteError("ERR WATCH inside MULTI is not allowed")
+			return
+		}
 
-		conn.WriteArray(len(rt))
-		for _, v := range rt {
-			conn.WriteInt64(int64(v))
+		names := bytes2string(cmd.Args[1:])
+		g, err := rs.s.routeAll(names...)
+		if err != nil {
+			writeRedisError(conn, err)
+			return
 		}
-	case "bmdiffstore": // bitmap diff store
-		if len(cmd.Args) != 4 {
+		c.watches = append(c.watches, g.bitmaps.Watch(names...)...)
+		conn.WriteString("OK")
+	case "unwatch":
+		rs.client(conn).watches = nil
+		conn.WriteString("OK")
+	case "del", "unlink": // remove bitmaps: del name [name ...]
+		rs.runCommand(conn, name, cmd.Args)
+	case "exists": // number of existing bitmaps: exists name [name ...]
+		if len(cmd.Args) < 2 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		count := rs.s.bitmaps.DiffStore(string(cmd.Args[1]), string(cmd.Args[2]), string(cmd.Args[3]))
-		conn.WriteInt64(int64(count))
-	case "bmstats": // bitmap diff store
+		var n int64
+		for _, arg := range cmd.Args[1:] {
+			bs := rs.readBitmaps(conn, string(arg))
+			if bs == nil {
+				return
+			}
+			n += bs.Has(string(arg))
+		}
+		conn.WriteInt64(n)
+	case "type": // bitmaps are strings of bit commands
 		if len(cmd.Args) != 2 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		stats := rs.s.bitmaps.Stats(string(cmd.Args[1]))
+		bs := rs.readBitmaps(conn, string(cmd.Args[1]))
+		if bs == nil {
+			return
+		}
+		if bs.Has(string(cmd.Args[1])) == 0 {
+			conn.WriteString("none")
+			return
+		}
+		conn.WriteString("string")
+	case "scan": // iterate bitmaps: scan cursor [MATCH pattern] [COUNT count] [TYPE type]
+		rs.scan(conn, cmd)
+	case "dbsize": // number of bitmaps
+		if len(cmd.Args) != 1 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		conn.WriteInt64(rs.s.DBSize())
+	case "flushdb", "flushall": // remove all bitmaps: flushdb [ASYNC|SYNC]
+		if len(cmd.Args) > 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		if len(cmd.Args) == 2 {
+			if mode := strings.ToLower(string(cmd.Args[1])); mode != "async" && mode != "sync" {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+		}
 
-		var sb strings.Builder
-		appendMetric(&sb, "cardinality", stats.Cardinality)
-		appendMetric(&sb, "Containers", stats.Containers)
+		for _, bs := range rs.s.allBitmaps() {
+			if err := bs.Flush(true); err != nil {
+				writeRedisError(conn, err)
+				return
+			}
+		}
+		conn.WriteString("OK")
+	case "hello": // switch the protocol: hello [protover [AUTH username password] [SETNAME clientname]]
+		rs.hello(conn, cmd)
+	case "echo":
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		conn.WriteBulk(cmd.Args[1])
+	case "select": // only the database 0 exists
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
 
-		appendMetric(&sb, "ArrayContainers", stats.ArrayContainers)
-		appendMetric(&sb, "ArrayContainerBytes", stats.ArrayContainerBytes)
-		appendMetric(&sb, "ArrayContainerValues", stats.ArrayContainerValues)
+		db, err := strconv.Atoi(string(cmd.Args[1]))
+		if err != nil {
+			conn.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+		if db != 0 {
+			conn.WriteError("ERR DB index is out of range")
+			return
+		}
+		conn.WriteString("OK")
+	case "command": // information of commands: command [COUNT | INFO name [name ...] | DOCS [name ...] | LIST]
+		rs.command(conn, cmd)
+	case "client": // client setname name | getname | id | list
+		rs.clientCommand(conn, cmd)
+	case "subscribe", "psubscribe": // keyspace notifications: subscribe channel [channel ...]
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		rs.subscribe(conn, c, name, cmd.Args)
+	case "unsubscribe", "punsubscribe":
+		rs.subscribe(conn, c, name, cmd.Args)
+	case "slowlog": // slow commands: slowlog get [count] | len | reset
+		rs.slowlog(conn, cmd)
+	case "migrate": // move a bitmap to another raft group
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		group, err := strconv.ParseUint(string(cmd.Args[2]), 10, 64)
+		if err != nil {
+			conn.WriteError("ERR parse group because of " + err.Error())
+			return
+		}
 
-		appendMetric(&sb, "BitmapContainers", stats.BitmapContainers)
-		appendMetric(&sb, "BitmapContainerBytes", stats.BitmapContainerBytes)
-		appendMetric(&sb, "BitmapContainerValues", stats.BitmapContainerValues)
+		ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+		defer cancel()
+		if err := rs.s.Migrate(ctx, string(cmd.Args[1]), group); err != nil {
+			writeRedisError(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+	case "transferleader": // transfer raft leadership
+		if len(cmd.Args) > 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
 
-		appendMetric(&sb, "RunContainers", stats.RunContainers)
-		appendMetric(&sb, "RunContainerBytes", stats.RunContainerBytes)
-		appendMetric(&sb, "RunContainerValues", stats.RunContainerValues)
+		var target uint64
+		if len(cmd.Args) == 2 {
+			id, err := strconv.ParseUint(string(cmd.Args[1]), 0, 64)
+			if err != nil {
+				conn.WriteError("ERR parse id because of " + err.Error())
+				return
+			}
+			target = id
+		}
 
-		conn.WriteBulkString(sb.String())
-	case "bmsave": // bitmap persist
+		ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+		defer cancel()
+		if err := rs.s.TransferLeadership(ctx, target); err != nil {
+			writeRedisError(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+	case "drain": // drain this server
 		if len(cmd.Args) != 1 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		err := rs.s.Save()
+		if err := rs.s.startDrain(); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	case "group": // run a command on a raft group hosted by this process: group <id> <command> [arg ...]
+		if len(cmd.Args) < 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		id, err := strconv.ParseUint(string(cmd.Args[1]), 0, 64)
 		if err != nil {
-			conn.WriteError("ERR save because of " + err.Error())
+			conn.WriteError("ERR parse group because of " + err.Error())
+			return
+		}
+		g, err := rs.s.group(id)
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
 			return
 		}
 
-		conn.WriteInt(1)
+		gs := &RedisService{s: g, confChangeCallback: g.confChangeCallback}
+		gs.redisHandler(conn, redcon.Command{Raw: cmd.Raw, Args: cmd.Args[2:]})
 	case "addnode": // add raft node
 		if len(cmd.Args) != 3 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
@@ -294,9 +918,195 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 
 		}
 		conn.WriteInt(1)
+	case "addlearner": // add raft learner
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if rs.confChangeCallback != nil {
+			id, err := strconv.ParseUint(string(cmd.Args[1]), 0, 64)
+			if err != nil {
+				conn.WriteError("ERR parse id because of " + err.Error())
+				return
+			}
+
+			err = rs.confChangeCallback.AddLearner(id, cmd.Args[2])
+			if err != nil {
+				conn.WriteError("ERR failed to add learner because of " + err.Error())
+				return
+			}
+		}
+		conn.WriteInt(1)
+	case "promotelearner": // promote raft learner to voter
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if rs.confChangeCallback != nil {
+			id, err := strconv.ParseUint(string(cmd.Args[1]), 0, 64)
+			if err != nil {
+				conn.WriteError("ERR parse id because of " + err.Error())
+				return
+			}
+
+			err = rs.confChangeCallback.PromoteLearner(id)
+			if isLeaderError(err) {
+				writeRedisError(conn, err)
+				return
+			}
+			if err != nil {
+				conn.WriteError("ERR failed to promote learner because of " + err.Error())
+				return
+			}
+		}
+		conn.WriteInt(1)
+	case "replacenode": // replace a raft node with a new one using joint consensus
+		if len(cmd.Args) != 4 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if rs.confChangeCallback != nil {
+			oldID, err := strconv.ParseUint(string(cmd.Args[1]), 0, 64)
+			if err != nil {
+				conn.WriteError("ERR parse id because of " + err.Error())
+				return
+			}
+			newID, err := strconv.ParseUint(string(cmd.Args[2]), 0, 64)
+			if err != nil {
+				conn.WriteError("ERR parse id because of " + err.Error())
+				return
+			}
+
+			err = rs.confChangeCallback.ReplaceNode(oldID, newID, cmd.Args[3])
+			if err != nil {
+				conn.WriteError("ERR failed to replace node because of " + err.Error())
+				return
+			}
+		}
+		conn.WriteInt(1)
+	case "reconfigure": // change voters of the raft cluster: reconfigure id[=url] [id[=url] ...]
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if rs.confChangeCallback != nil {
+			voters := make(map[uint64]string, len(cmd.Args)-1)
+			for _, arg := range cmd.Args[1:] {
+				items := strings.SplitN(string(arg), "=", 2)
+				id, err := strconv.ParseUint(items[0], 0, 64)
+				if err != nil {
+					conn.WriteError("ERR parse id because of " + err.Error())
+					return
+				}
+				if len(items) == 2 {
+					voters[id] = items[1]
+				} else {
+					voters[id] = ""
+				}
+			}
+
+			err := rs.confChangeCallback.Reconfigure(voters)
+			if err != nil {
+				conn.WriteError("ERR failed to reconfigure because of " + err.Error())
+				return
+			}
+		}
+		conn.WriteInt(1)
 	}
 }
 
+// route returns the server holding the named bitmaps for writes, they must be in the same raft group.
+// It writes the error and returns nil if they can not be written by this process.
+func (rs *RedisService) route(conn redcon.Conn, names ...string) *Server {
+	g, err := rs.s.routeWrite(names...)
+	if err != nil {
+		writeRedisError(conn, err)
+		return nil
+	}
+	return g
+}
+
+// readBitmaps returns the bitmaps holding the named bitmaps for reads, which may run across shards.
+// It writes the error and returns nil if they can not be read by this process.
+func (rs *RedisService) readBitmaps(conn redcon.Conn, names ...string) *Bitmaps {
+	bs, err := rs.s.bitmapsOf(names...)
+	if err != nil {
+		writeRedisError(conn, err)
+		return nil
+	}
+	return bs
+}
+
+// writeRedisError writes err of a write command.
+// Writes to a follower in the redirect leader mode get a `MOVED 0 <leader address>` error,
+// bitmaps of a raft group hosted by another process get a `MOVED <shard> <address>` error
+// and bitmaps of different raft groups get a `CROSSSLOT` error like Redis Cluster.
+func writeRedisError(conn redcon.Conn, err error) {
+	switch e := err.(type) {
+	case *NotLeaderError:
+		if e.Addr != "" {
+			conn.WriteError("MOVED 0 " + e.Addr)
+			return
+		}
+	case *MovedError:
+		if e.Addr != "" {
+			conn.WriteError("MOVED " + strconv.Itoa(e.Shard) + " " + e.Addr)
+			return
+		}
+	}
+	switch err {
+	case ErrCrossShard:
+		conn.WriteError("CROSSSLOT " + err.Error())
+		return
+	case ErrMigrating:
+		conn.WriteError("TRYAGAIN " + err.Error())
+		return
+	}
+	conn.WriteError("ERR " + err.Error())
+}
+
+// formatClusterStatus formats the status as `field:value` lines, and a `peer<id>` line for each member.
+func formatClusterStatus(status *ClusterStatus) string {
+	var sb strings.Builder
+	appendMetric(&sb, "id", status.ID)
+	sb.WriteString("role:" + status.Role + "\r\n")
+	appendMetric(&sb, "leader", status.Leader)
+	appendMetric(&sb, "term", status.Term)
+	appendMetric(&sb, "commit_index", status.CommitIndex)
+	appendMetric(&sb, "applied_index", status.AppliedIndex)
+	appendMetric(&sb, "snapshot_index", status.SnapshotIndex)
+	appendMetric(&sb, "lag", status.Lag)
+	appendMetric(&sb, "peers", uint64(len(status.Peers)))
+	var learners uint64
+	for _, p := range status.Peers {
+		if p.Learner {
+			learners++
+		}
+	}
+	appendMetric(&sb, "learners", learners)
+	removed := make([]string, len(status.Removed))
+	for i, id := range status.Removed {
+		removed[i] = strconv.FormatUint(id, 10)
+	}
+	sb.WriteString("removed:" + strings.Join(removed, ",") + "\r\n")
+
+	for _, p := range status.Peers {
+		fmt.Fprintf(&sb, "peer%d:url=%s,learner=%t,active=%t", p.ID, p.URL, p.Learner, p.Active)
+		if p.State != "" {
+			fmt.Fprintf(&sb, ",state=%s,match=%d,next=%d,lag=%d", p.State, p.Match, p.Next, p.Lag)
+		}
+		if p.ID != status.ID {
+			fmt.Fprintf(&sb, ",unreachable=%d,snapshots_sent=%d,snapshots_failed=%d", p.Unreachable, p.SnapshotsSent, p.SnapshotsFailed)
+		}
+		sb.WriteString("\r\n")
+	}
+	return sb.String()
+}
+
 func appendMetric(sb *strings.Builder, name string, v uint64) {
 	sb.WriteString(name)
 	sb.WriteString(":")
@@ -328,3 +1138,395 @@ func bytes2string(b [][]byte) []string {
 	}
 	return rt
 }
+
+// slowlog replies entries of the slow log like Redis, each entry is an array of the ID, the unix time,
+// the duration in microseconds, the command and its arguments, the client address and the client name.
+// HTTP and rpcx clients have no names, so their entries are named by the protocol.
+func (rs *RedisService) slowlog(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	sub := strings.ToLower(string(cmd.Args[1]))
+	switch {
+	case sub == "get" && len(cmd.Args) <= 3:
+		n := 10
+		if len(cmd.Args) == 3 {
+			v, err := strconv.Atoi(string(cmd.Args[2]))
+			if err != nil {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			n = v
+		}
+		entries := rs.s.slowlog.Get(n)
+		conn.WriteArray(len(entries))
+		for _, e := range entries {
+			name := e.ClientName
+			if name == "" && e.Protocol != protocolRedis {
+				name = e.Protocol
+			}
+			conn.WriteArray(6)
+			conn.WriteUint64(e.ID)
+			conn.WriteInt64(e.Time.Unix())
+			conn.WriteInt64(e.Duration.Microseconds())
+			conn.WriteArray(len(e.Args) + 1)
+			conn.WriteBulkString(e.Command)
+			for _, arg := range e.Args {
+				conn.WriteBulkString(arg)
+			}
+			conn.WriteBulkString(e.Client)
+			conn.WriteBulkString(name)
+		}
+	case sub == "len" && len(cmd.Args) == 2:
+		conn.WriteInt(rs.s.slowlog.Len())
+	case sub == "reset" && len(cmd.Args) == 2:
+		rs.s.slowlog.Reset()
+		conn.WriteString("OK")
+	default:
+		conn.WriteError("ERR unknown subcommand or wrong number of arguments for '" + string(cmd.Args[1]) + "'. Try SLOWLOG GET, LEN or RESET.")
+	}
+}
+
+// reset discards the transaction and watched bitmaps of the client.
+func (c *redisClient) reset() {
+	c.multi, c.dirty, c.queued, c.watches = false, false, nil, nil
+}
+
+// queue queues a command of the transaction, EXEC aborts the transaction if it fails to be queued.
+func (rs *RedisService) queue(conn redcon.Conn, c *redisClient, name string, args [][]byte) {
+	if !rs.authorize(conn, name, args) {
+		c.dirty = true
+		return
+	}
+	cmdArgs := bytes2string(args)
+	cmdArgs[0] = name
+	if _, _, err := parseTxCommand(cmdArgs); err != nil {
+		c.dirty = true
+		switch err {
+		case ErrNotInTx:
+			conn.WriteError("ERR command '" + string(args[0]) + "' is not allowed in a transaction")
+		case errWrongArity:
+			conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		default:
+			conn.WriteError("ERR " + err.Error())
+		}
+		return
+	}
+	c.queued = append(c.queued, cmdArgs)
+	conn.WriteString("QUEUED")
+}
+
+// exec runs the queued commands as a transaction and replies their replies in an array, or a null array
+// if a watched bitmap is modified. All bitmaps of the transaction must be in the same raft group.
+func (rs *RedisService) exec(conn redcon.Conn) {
+	c := rs.client(conn)
+	if !c.multi {
+		conn.WriteError("ERR EXEC without MULTI")
+		return
+	}
+	tx := &Transaction{Watches: c.watches, Commands: c.queued}
+	dirty := c.dirty
+	c.reset()
+	if dirty {
+		conn.WriteError("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	g := rs.route(conn, tx.Keys()...)
+	if g == nil {
+		return
+	}
+	replies, err := g.bitmaps.Exec(tx, true)
+	if err == ErrTxAborted {
+		writeNullArray(conn)
+		return
+	}
+	if err != nil {
+		writeRedisError(conn, err)
+		return
+	}
+	conn.WriteArray(len(replies))
+	for _, r := range replies {
+		writeTxReply(conn, r)
+	}
+}
+
+// writeTxReply writes a reply of a command run by a transaction.
+func writeTxReply(conn redcon.Conn, r interface{}) {
+	switch r := r.(type) {
+	case int64:
+		conn.WriteInt64(r)
+	case []uint32:
+		writeUint32Set(conn, r)
+	case bool:
+		writeBool(conn, r)
+	case []interface{}:
+		conn.WriteArray(len(r))
+		for _, v := range r {
+			writeTxReply(conn, v)
+		}
+	case string:
+		conn.WriteString(r)
+	case error:
+		writeRedisError(conn, r)
+	case nil:
+		writeNull(conn)
+	}
+}
+
+// runCommand runs a command of transactions out of a transaction. Writes are run as transactions, so replies
+// like the original bit of SETBIT and the number of bitmaps removed by DEL are computed when they are applied.
+func (rs *RedisService) runCommand(conn redcon.Conn, name string, args [][]byte) {
+	cmdArgs := bytes2string(args)
+	cmdArgs[0] = name
+	c, parsed, err := parseTxCommand(cmdArgs)
+	switch err {
+	case nil:
+	case errWrongArity:
+		conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return
+	default:
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+
+	if c.lastWrite == 0 {
+		bs := rs.readBitmaps(conn, c.keys(cmdArgs)...)
+		if bs == nil {
+			return
+		}
+		writeTxReply(conn, c.run(bs, cmdArgs, parsed))
+		return
+	}
+	g := rs.route(conn, c.keys(cmdArgs)...)
+	if g == nil {
+		return
+	}
+	replies, err := g.bitmaps.Exec(&Transaction{Commands: [][]string{cmdArgs}}, true)
+	if err != nil {
+		writeRedisError(conn, err)
+		return
+	}
+	writeTxReply(conn, replies[0])
+}
+
+// scan writes a step of iterating bitmaps of this process, users of ACLs only see bitmaps they can read.
+func (rs *RedisService) scan(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	cursor, err := strconv.ParseUint(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		conn.WriteError("ERR invalid cursor")
+		return
+	}
+	count, pattern, typ := DefaultScanCount, "", ""
+	for i := 2; i < len(cmd.Args); i += 2 {
+		if i+1 >= len(cmd.Args) {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "match":
+			pattern = string(cmd.Args[i+1])
+		case "count":
+			count, err = strconv.Atoi(string(cmd.Args[i+1]))
+			if err != nil {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			if count < 1 {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+		case "type":
+			typ = strings.ToLower(string(cmd.Args[i+1]))
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	next, names := rs.s.Scan(cursor, count, pattern)
+	var visible []string
+	for _, name := range names {
+		if typ != "" && typ != "string" {
+			continue
+		}
+		if rs.s.acl != nil && rs.client(conn).user.Allowed(CategoryRead, name) != nil {
+			continue
+		}
+		visible = append(visible, name)
+	}
+	conn.WriteArray(2)
+	conn.WriteBulkString(strconv.FormatUint(next, 10))
+	conn.WriteArray(len(visible))
+	for _, name := range visible {
+		conn.WriteBulkString(name)
+	}
+}
+
+// command writes information of commands like COMMAND of Redis, each command is described by its name, arity,
+// flags, first key, last key, step of keys and ACL categories.
+func (rs *RedisService) command(conn redcon.Conn, cmd redcon.Command) {
+	sub := ""
+	if len(cmd.Args) > 1 {
+		sub = strings.ToLower(string(cmd.Args[1]))
+	}
+	switch sub {
+	case "":
+		names := redisCommandNames()
+		conn.WriteArray(len(names))
+		for _, name := range names {
+			writeCommandInfo(conn, name)
+		}
+	case "count":
+		conn.WriteInt(len(redisCommands))
+	case "list":
+		names := redisCommandNames()
+		conn.WriteArray(len(names))
+		for _, name := range names {
+			conn.WriteBulkString(name)
+		}
+	case "info":
+		conn.WriteArray(len(cmd.Args) - 2)
+		for _, arg := range cmd.Args[2:] {
+			name := strings.ToLower(string(arg))
+			if _, ok := redisCommands[name]; !ok {
+				writeNull(conn)
+				continue
+			}
+			writeCommandInfo(conn, name)
+		}
+	case "docs": // commands have no docs
+		conn.WriteArray(0)
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'. Try COMMAND HELP.")
+	}
+}
+
+// redisCommandNames returns the sorted names of redis commands.
+func redisCommandNames() []string {
+	names := make([]string, 0, len(redisCommands))
+	for name := range redisCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeCommandInfo(conn redcon.Conn, name string) {
+	c := redisCommands[name]
+	conn.WriteArray(7)
+	conn.WriteBulkString(name)
+	conn.WriteInt(c.arity)
+	switch c.category {
+	case CategoryWrite:
+		conn.WriteArray(1)
+		conn.WriteString("write")
+	case CategoryRead:
+		conn.WriteArray(1)
+		conn.WriteString("readonly")
+	case CategoryAdmin, CategoryCluster:
+		conn.WriteArray(1)
+		conn.WriteString("admin")
+	default:
+		conn.WriteArray(0)
+	}
+	conn.WriteInt(c.firstKey)
+	conn.WriteInt(c.lastKey)
+	if c.firstKey > 0 {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteInt(0)
+	}
+	if c.category == "" {
+		conn.WriteArray(0)
+		return
+	}
+	conn.WriteArray(1)
+	conn.WriteString("@" + string(c.category))
+}
+
+// clientCommand handles CLIENT subcommands of the connection.
+func (rs *RedisService) clientCommand(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	c := rs.client(conn)
+	switch sub := strings.ToLower(string(cmd.Args[1])); {
+	case sub == "setname" && len(cmd.Args) == 3:
+		name := string(cmd.Args[2])
+		if !validClientName(name) {
+			conn.WriteError("ERR Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		c.mu.Lock()
+		c.name = name
+		c.mu.Unlock()
+		conn.WriteString("OK")
+	case sub == "getname" && len(cmd.Args) == 2:
+		name := c.getName()
+		if name == "" {
+			writeNull(conn)
+			return
+		}
+		conn.WriteBulkString(name)
+	case sub == "id" && len(cmd.Args) == 2:
+		conn.WriteInt64(int64(c.id))
+	case sub == "list" && len(cmd.Args) == 2:
+		conn.WriteBulkString(rs.s.clientList())
+	case sub == "setname" || sub == "getname" || sub == "id" || sub == "list":
+		conn.WriteError("ERR wrong number of arguments for 'client|" + sub + "' command")
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'. Try CLIENT HELP.")
+	}
+}
+
+// validClientName returns whether the name of CLIENT SETNAME has no spaces, newlines or special characters.
+func validClientName(name string) bool {
+	for _, r := range name {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *redisClient) getName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+// clientList returns redis connections in the format of CLIENT LIST, one line for each connection.
+func (s *Server) clientList() string {
+	s.clientsMu.Lock()
+	clients := make([]*redisClient, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.clientsMu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+
+	now := time.Now()
+	var sb strings.Builder
+	for _, c := range clients {
+		c.mu.Lock()
+		var subs, psubs int
+		if c.subscriber != nil {
+			subs, psubs = len(c.subscriber.channels), len(c.subscriber.patterns)
+		}
+		fmt.Fprintf(&sb, "id=%d addr=%s name=%s age=%d idle=%d db=0 sub=%d psub=%d cmd=%s resp=%d", c.id, c.addr, c.name,
+			int64(now.Sub(c.created)/time.Second), int64(now.Sub(c.last)/time.Second), subs, psubs, c.cmd, c.resp)
+		if c.user != nil {
+			sb.WriteString(" user=" + c.user.Name)
+		}
+		c.mu.Unlock()
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -2,8 +2,13 @@ package basalt
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"time"
 
+	"github.com/smallnest/rpcx/protocol"
 	"github.com/smallnest/rpcx/server"
+	"github.com/smallnest/rpcx/share"
 )
 
 // ConfigRpcxOption defines the rpcx config function.
@@ -48,110 +53,251 @@ type BitmapDstAndPairRequest struct {
 
 // Add adds a value in the bitmap with name.
 func (s *RpcxBitmapService) Add(ctx context.Context, req *BitmapValueRequest, reply *bool) error {
-	s.s.bitmaps.Add(req.Name, req.Value, true)
+	g, err := s.s.routeWrite(req.Name)
+	if err != nil {
+		return err
+	}
+	if err = g.bitmaps.Add(req.Name, req.Value, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // AddMany adds multiple values in the bitmap with name.
 func (s *RpcxBitmapService) AddMany(ctx context.Context, req *BitmapValuesRequest, reply *bool) error {
-	s.s.bitmaps.AddMany(req.Name, req.Values, true)
+	g, err := s.s.routeWrite(req.Name)
+	if err != nil {
+		return err
+	}
+	if err = g.bitmaps.AddMany(req.Name, req.Values, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // Remove removes a value in the bitmap with name.
 func (s *RpcxBitmapService) Remove(ctx context.Context, req *BitmapValueRequest, reply *bool) error {
-	s.s.bitmaps.Remove(req.Name, req.Value, true)
+	g, err := s.s.routeWrite(req.Name)
+	if err != nil {
+		return err
+	}
+	if err = g.bitmaps.Remove(req.Name, req.Value, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // RemoveBitmap removes the bitmap.
 func (s *RpcxBitmapService) RemoveBitmap(ctx context.Context, name string, reply *bool) error {
-	s.s.bitmaps.RemoveBitmap(name, true)
+	g, err := s.s.routeWrite(name)
+	if err != nil {
+		return err
+	}
+	if err = g.bitmaps.RemoveBitmap(name, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // ClearBitmap clears the bitmap and set it to be empty.
 func (s *RpcxBitmapService) ClearBitmap(ctx context.Context, name string, reply *bool) error {
-	s.s.bitmaps.ClearBitmap(name, true)
+	g, err := s.s.routeWrite(name)
+	if err != nil {
+		return err
+	}
+	if err = g.bitmaps.ClearBitmap(name, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// Freeze makes the bitmap read-only and backed by a memory-mapped file.
+func (s *RpcxBitmapService) Freeze(ctx context.Context, name string, reply *bool) error {
+	g, err := s.s.routeWrite(name)
+	if err != nil {
+		return err
+	}
+	if err = g.bitmaps.Freeze(name, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// Thaw makes the frozen bitmap writable.
+func (s *RpcxBitmapService) Thaw(ctx context.Context, name string, reply *bool) error {
+	g, err := s.s.routeWrite(name)
+	if err != nil {
+		return err
+	}
+	if err = g.bitmaps.Thaw(name, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // Exists checks whether the value exists.
 func (s *RpcxBitmapService) Exists(ctx context.Context, req *BitmapValueRequest, reply *bool) error {
-	*reply = s.s.bitmaps.Exists(req.Name, req.Value)
+	bs, err := s.s.bitmapsOf(req.Name)
+	if err != nil {
+		return err
+	}
+	*reply = bs.Exists(req.Name, req.Value)
 	return nil
 }
 
 // Card gets number of integers in the bitmap.
 func (s *RpcxBitmapService) Card(ctx context.Context, name string, reply *uint64) error {
-	*reply = s.s.bitmaps.Card(name)
+	bs, err := s.s.bitmapsOf(name)
+	if err != nil {
+		return err
+	}
+	*reply = bs.Card(name)
 	return nil
 }
 
 // Inter gets the intersection of bitmaps.
 func (s *RpcxBitmapService) Inter(ctx context.Context, names []string, reply *[]uint32) error {
-	*reply = s.s.bitmaps.Inter(names...)
+	bs, err := s.s.bitmapsOf(names...)
+	if err != nil {
+		return err
+	}
+	*reply = bs.Inter(names...)
 	return nil
 }
 
 // InterStore gets the intersection of bitmaps and stores into destination.
 func (s *RpcxBitmapService) InterStore(ctx context.Context, req *BitmapStoreRequest, reply *bool) error {
-	s.s.bitmaps.InterStore(req.Destination, req.Names...)
+	g, err := s.s.routeWrite(append([]string{req.Destination}, req.Names...)...)
+	if err != nil {
+		return err
+	}
+	if _, err := g.bitmaps.execCommand(append([]string{"bminterstore", req.Destination}, req.Names...)...); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // Union gets the union of bitmaps.
 func (s *RpcxBitmapService) Union(ctx context.Context, names []string, reply *[]uint32) error {
-	*reply = s.s.bitmaps.Union(names...)
+	bs, err := s.s.bitmapsOf(names...)
+	if err != nil {
+		return err
+	}
+	*reply = bs.Union(names...)
 	return nil
 }
 
 // UnionStore gets the union of bitmaps and stores into destination.
 func (s *RpcxBitmapService) UnionStore(ctx context.Context, req *BitmapStoreRequest, reply *bool) error {
-	s.s.bitmaps.UnionStore(req.Destination, req.Names...)
+	g, err := s.s.routeWrite(append([]string{req.Destination}, req.Names...)...)
+	if err != nil {
+		return err
+	}
+	if _, err := g.bitmaps.execCommand(append([]string{"bmunionstore", req.Destination}, req.Names...)...); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // Xor gets the symmetric difference between bitmaps.
 func (s *RpcxBitmapService) Xor(ctx context.Context, names *BitmapPairRequest, reply *[]uint32) error {
-	*reply = s.s.bitmaps.Xor(names.Name1, names.Name2)
+	bs, err := s.s.bitmapsOf(names.Name1, names.Name2)
+	if err != nil {
+		return err
+	}
+	*reply = bs.Xor(names.Name1, names.Name2)
 	return nil
 }
 
 // XorStore gets the symmetric difference between bitmaps and stores into destination.
 func (s *RpcxBitmapService) XorStore(ctx context.Context, names *BitmapDstAndPairRequest, reply *bool) error {
-	s.s.bitmaps.XorStore(names.Destination, names.Name1, names.Name2)
+	g, err := s.s.routeWrite(names.Destination, names.Name1, names.Name2)
+	if err != nil {
+		return err
+	}
+	if _, err := g.bitmaps.execCommand("bmxorstore", names.Destination, names.Name1, names.Name2); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // Diff gets the difference between two bitmaps.
 func (s *RpcxBitmapService) Diff(ctx context.Context, names *BitmapPairRequest, reply *[]uint32) error {
-	*reply = s.s.bitmaps.Diff(names.Name1, names.Name2)
+	bs, err := s.s.bitmapsOf(names.Name1, names.Name2)
+	if err != nil {
+		return err
+	}
+	*reply = bs.Diff(names.Name1, names.Name2)
 	return nil
 }
 
 // DiffStore gets the difference between two bitmaps and stores into destination.
 func (s *RpcxBitmapService) DiffStore(ctx context.Context, names *BitmapDstAndPairRequest, reply *bool) error {
-	s.s.bitmaps.DiffStore(names.Destination, names.Name1, names.Name2)
+	g, err := s.s.routeWrite(names.Destination, names.Name1, names.Name2)
+	if err != nil {
+		return err
+	}
+	if _, err := g.bitmaps.execCommand("bmdiffstore", names.Destination, names.Name1, names.Name2); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // Stats get the stats of bitmap `name`.
 func (s *RpcxBitmapService) Stats(ctx context.Context, name string, reply *Stats) error {
-	stats := s.s.bitmaps.Stats(name)
+	bs, err := s.s.bitmapsOf(name)
+	if err != nil {
+		return err
+	}
+	stats := bs.Stats(name)
 	*reply = stats
 	return nil
 }
 
+// BitmapMetadataRequest contains the name of bitmap and the metadata to update.
+type BitmapMetadataRequest struct {
+	Name   string
+	Update MetadataUpdate
+}
+
+// Info gets the metadata of bitmap `name`.
+func (s *RpcxBitmapService) Info(ctx context.Context, name string, reply *Metadata) error {
+	bs, err := s.s.bitmapsOf(name)
+	if err != nil {
+		return err
+	}
+	meta, ok := bs.Metadata(name)
+	if !ok {
+		return ErrBitmapNotFound
+	}
+	*reply = meta
+	return nil
+}
+
+// SetInfo updates the metadata of bitmap.
+func (s *RpcxBitmapService) SetInfo(ctx context.Context, req *BitmapMetadataRequest, reply *bool) error {
+	g, err := s.s.routeWrite(req.Name)
+	if err != nil {
+		return err
+	}
+	err = g.bitmaps.SetMetadata(req.Name, req.Update, true)
+	if err == nil {
+		*reply = true
+	}
+	return err
+}
+
 // Save persists bitmaps.
 func (s *RpcxBitmapService) Save(ctx context.Context, dummy string, reply *bool) error {
 	err := s.s.Save()
@@ -161,15 +307,101 @@ func (s *RpcxBitmapService) Save(ctx context.Context, dummy string, reply *bool)
 	return err
 }
 
+// SlowLog returns the latest count entries of the slow log, or all entries if the count is negative.
+func (s *RpcxBitmapService) SlowLog(ctx context.Context, count int, reply *SlowLogReply) error {
+	l := s.s.slowlog
+	*reply = SlowLogReply{Len: l.Len(), Entries: l.Get(count)}
+	return nil
+}
+
+// ResetSlowLog removes all entries of the slow log.
+func (s *RpcxBitmapService) ResetSlowLog(ctx context.Context, dummy string, reply *bool) error {
+	s.s.slowlog.Reset()
+	*reply = true
+	return nil
+}
+
 type AddNodeRequest struct {
 	ID   uint64
 	Addr string
 }
 
+// ReplaceNodeRequest replaces node OldID with node NewID, whose raft URL is Addr.
+type ReplaceNodeRequest struct {
+	OldID uint64
+	NewID uint64
+	Addr  string
+}
+
+// MigrateRequest migrates bitmap Name to raft group Group.
+type MigrateRequest struct {
+	Name  string
+	Group uint64
+}
+
+// ClusterStatus returns the raft status of this node and its view of the cluster.
+func (s *RpcxBitmapService) ClusterStatus(ctx context.Context, dummy string, reply *ClusterStatus) error {
+	status, err := s.s.ClusterStatus()
+	if err != nil {
+		return err
+	}
+	*reply = *status
+	return nil
+}
+
+// Forward proposes a write forwarded by a follower, or replayed to this group by a migration.
+// Only writes accepted by forwardable are proposed.
+func (s *RpcxBitmapService) Forward(ctx context.Context, req *ForwardRequest, reply *bool) error {
+	if s.s.raft == nil {
+		return ErrNotInCluster
+	}
+	if !forwardable(req.OP, req.Value) {
+		return ErrNotForwardable
+	}
+	if err := s.s.raft.propose(req.OP, req.Value); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// TransferLeadership transfers raft leadership to the node, or the most up-to-date voter if it is 0.
+func (s *RpcxBitmapService) TransferLeadership(ctx context.Context, target uint64, reply *bool) error {
+	ctx, cancel := context.WithTimeout(ctx, transferTimeout)
+	defer cancel()
+	if err := s.s.TransferLeadership(ctx, target); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// Migrate moves a bitmap to another raft group, it returns after the bitmap is moved.
+func (s *RpcxBitmapService) Migrate(ctx context.Context, req *MigrateRequest, reply *bool) error {
+	ctx, cancel := context.WithTimeout(ctx, migrateTimeout)
+	defer cancel()
+	if err := s.s.Migrate(ctx, req.Name, req.Group); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// Drain starts to drain this server, it returns before the server is drained.
+func (s *RpcxBitmapService) Drain(ctx context.Context, dummy string, reply *bool) error {
+	if err := s.s.startDrain(); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
 // AddNode adds a raft node.
 func (s *RpcxBitmapService) AddNode(ctx context.Context, req *AddNodeRequest, reply *bool) error {
 	if s.confChangeCallback != nil {
-		s.confChangeCallback.AddNode(req.ID, []byte(req.Addr))
+		if err := s.confChangeCallback.AddNode(req.ID, []byte(req.Addr)); err != nil {
+			return err
+		}
 	}
 
 	*reply = true
@@ -185,3 +417,206 @@ func (s *RpcxBitmapService) RemoveNode(ctx context.Context, req uint64, reply *b
 	*reply = true
 	return nil
 }
+
+// AddLearner adds a raft learner.
+func (s *RpcxBitmapService) AddLearner(ctx context.Context, req *AddNodeRequest, reply *bool) error {
+	if s.confChangeCallback != nil {
+		if err := s.confChangeCallback.AddLearner(req.ID, []byte(req.Addr)); err != nil {
+			return err
+		}
+	}
+
+	*reply = true
+	return nil
+}
+
+// ReplaceNode replaces a raft node with a new one using joint consensus.
+func (s *RpcxBitmapService) ReplaceNode(ctx context.Context, req *ReplaceNodeRequest, reply *bool) error {
+	if s.confChangeCallback != nil {
+		if err := s.confChangeCallback.ReplaceNode(req.OldID, req.NewID, []byte(req.Addr)); err != nil {
+			return err
+		}
+	}
+
+	*reply = true
+	return nil
+}
+
+// Reconfigure changes voters of the raft cluster to the members, which map node IDs to raft URLs.
+// URLs of existing members can be empty.
+func (s *RpcxBitmapService) Reconfigure(ctx context.Context, req map[uint64]string, reply *bool) error {
+	if s.confChangeCallback != nil {
+		if err := s.confChangeCallback.Reconfigure(req); err != nil {
+			return err
+		}
+	}
+
+	*reply = true
+	return nil
+}
+
+// PromoteLearner promotes a caught-up raft learner to voter. It must be invoked on the leader.
+func (s *RpcxBitmapService) PromoteLearner(ctx context.Context, req uint64, reply *bool) error {
+	if s.confChangeCallback != nil {
+		if err := s.confChangeCallback.PromoteLearner(req); err != nil {
+			return err
+		}
+	}
+
+	*reply = true
+	return nil
+}
+
+// rpcxMethod is the ACL category of a rpcx method and its argument holding names of bitmaps.
+type rpcxMethod struct {
+	category Category
+	arg      func() interface{} // returns a pointer to decode the argument, nil if it has no keys
+}
+
+func newString() interface{}  { return new(string) }
+func newStrings() interface{} { return new([]string) }
+
+// rpcxMethods are methods checked by ACLs, the others are admin methods.
+var rpcxMethods = map[string]rpcxMethod{
+	"Add":          {CategoryWrite, func() interface{} { return new(BitmapValueRequest) }},
+	"AddMany":      {CategoryWrite, func() interface{} { return new(BitmapValuesRequest) }},
+	"Remove":       {CategoryWrite, func() interface{} { return new(BitmapValueRequest) }},
+	"RemoveBitmap": {CategoryWrite, newString},
+	"ClearBitmap":  {CategoryWrite, newString},
+	"Freeze":       {CategoryWrite, newString},
+	"Thaw":         {CategoryWrite, newString},
+	"SetInfo":      {CategoryWrite, func() interface{} { return new(BitmapMetadataRequest) }},
+	"InterStore":   {CategoryWrite, func() interface{} { return new(BitmapStoreRequest) }},
+	"UnionStore":   {CategoryWrite, func() interface{} { return new(BitmapStoreRequest) }},
+	"XorStore":     {CategoryWrite, func() interface{} { return new(BitmapDstAndPairRequest) }},
+	"DiffStore":    {CategoryWrite, func() interface{} { return new(BitmapDstAndPairRequest) }},
+
+	"Exists": {CategoryRead, func() interface{} { return new(BitmapValueRequest) }},
+	"Card":   {CategoryRead, newString},
+	"Inter":  {CategoryRead, newStrings},
+	"Union":  {CategoryRead, newStrings},
+	"Xor":    {CategoryRead, func() interface{} { return new(BitmapPairRequest) }},
+	"Diff":   {CategoryRead, func() interface{} { return new(BitmapPairRequest) }},
+	"Stats":  {CategoryRead, newString},
+	"Info":   {CategoryRead, newString},
+
+	"Save":         {CategoryAdmin, nil},
+	"Drain":        {CategoryAdmin, nil},
+	"SlowLog":      {CategoryAdmin, nil},
+	"ResetSlowLog": {CategoryAdmin, nil},
+	"Migrate":      {CategoryAdmin, func() interface{} { return new(MigrateRequest) }},
+
+	"ClusterStatus":      {CategoryCluster, nil},
+	"Forward":            {CategoryCluster, func() interface{} { return new(ForwardRequest) }},
+	"TransferLeadership": {CategoryCluster, nil},
+	"AddNode":            {CategoryCluster, nil},
+	"RemoveNode":         {CategoryCluster, nil},
+	"AddLearner":         {CategoryCluster, nil},
+	"PromoteLearner":     {CategoryCluster, nil},
+	"ReplaceNode":        {CategoryCluster, nil},
+	"Reconfigure":        {CategoryCluster, nil},
+}
+
+// rpcxKeys returns names of bitmaps in the decoded argument.
+func rpcxKeys(arg interface{}) []string {
+	switch a := arg.(type) {
+	case *string:
+		return []string{*a}
+	case *[]string:
+		return *a
+	case *BitmapValueRequest:
+		return []string{a.Name}
+	case *BitmapValuesRequest:
+		return []string{a.Name}
+	case *BitmapMetadataRequest:
+		return []string{a.Name}
+	case *BitmapStoreRequest:
+		return append([]string{a.Destination}, a.Names...)
+	case *BitmapPairRequest:
+		return []string{a.Name1, a.Name2}
+	case *BitmapDstAndPairRequest:
+		return []string{a.Destination, a.Name1, a.Name2}
+	case *MigrateRequest:
+		return []string{a.Name}
+	}
+	return nil
+}
+
+// rpcxAuth authenticates a rpcx request by its token and checks that the user can call the method
+// on bitmaps in its argument. rpcx closes the connection if it fails.
+func (s *Server) rpcxAuth(ctx context.Context, req *protocol.Message, token string) error {
+	u, err := s.acl.AuthenticateToken(token)
+	if err != nil {
+		return err
+	}
+
+	m, ok := rpcxMethods[req.ServiceMethod]
+	if !ok {
+		m = rpcxMethod{category: CategoryAdmin}
+	}
+	var keys []string
+	if m.arg != nil {
+		codec := share.Codecs[req.SerializeType()]
+		if codec == nil {
+			return fmt.Errorf("can not find codec for %d", req.SerializeType())
+		}
+		arg := m.arg()
+		if err := codec.Decode(req.Payload, arg); err != nil {
+			return err
+		}
+		// forwarded writes are checked as writes of their bitmaps as well, so they are not a way around ACLs
+		if req, ok := arg.(*ForwardRequest); ok {
+			if err := u.Allowed(m.category); err != nil {
+				return err
+			}
+			written, ok := forwardedKeys(req.OP, req.Value)
+			if !ok {
+				return ErrNotForwardable
+			}
+			return u.Allowed(CategoryWrite, written...)
+		}
+		keys = rpcxKeys(arg)
+	}
+	return u.Allowed(m.category, keys...)
+}
+
+// rpcxMetricsPlugin records metrics of rpcx requests and slow requests once their responses are written.
+type rpcxMetricsPlugin struct {
+	m       *serverMetrics
+	slowlog *SlowLog
+}
+
+func (p *rpcxMetricsPlugin) PostWriteResponse(ctx context.Context, req *protocol.Message, res *protocol.Message, err error) error {
+	start, ok := ctx.Value(server.StartRequestContextKey).(int64)
+	if !ok || req.IsHeartbeat() {
+		return nil
+	}
+	method := req.ServiceMethod
+	if _, ok := rpcxMethods[method]; !ok {
+		method = "unknown"
+	}
+	failed := err != nil || res == nil || res.MessageStatusType() == protocol.Error
+	p.m.observeCommand(protocolRpcx, method, time.Unix(0, start), failed)
+	if d := time.Since(time.Unix(0, start)); p.slowlog.slow(d) {
+		var client string
+		switch conn := ctx.Value(server.RemoteConnContextKey).(type) {
+		case net.Conn:
+			client = conn.RemoteAddr().String()
+		case string: // the http gateway
+			client = conn
+		}
+		p.slowlog.add(SlowLogEntry{Time: time.Unix(0, start), Duration: d, Protocol: protocolRpcx,
+			Command: req.ServiceMethod, Args: rpcxArgs(req), Client: client})
+	}
+	return nil
+}
+
+// rpcxArgs decodes the argument of the request as arguments of the slow log, or describes its size if it can't be decoded.
+func rpcxArgs(req *protocol.Message) []string {
+	var v interface{}
+	codec := share.Codecs[req.SerializeType()]
+	if codec == nil || codec.Decode(req.Payload, &v) != nil {
+		return []string{fmt.Sprintf("(%d bytes)", len(req.Payload))}
+	}
+	return slowLogValue(v)
+}
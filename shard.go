@@ -0,0 +1,310 @@
+package basalt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Modes of partitioning bitmap names into shards.
+const (
+	RoutingModeHash  = "hash"  // shard of a name is crc32 of its hash tag modulo the number of shards
+	RoutingModeRange = "range" // shard of a name is the range of split points its hash tag falls in
+)
+
+// Errors for sharding.
+var (
+	ErrCrossShard     = errors.New("keys in request don't belong to the same raft group")
+	ErrGroupNotFound  = errors.New("raft group not found")
+	ErrShardedServer  = errors.New("not supported by a sharded server, send it to a raft group")
+	ErrInvalidRouting = errors.New("invalid routing table")
+)
+
+// RoutingTable maps shards of bitmap names to raft groups.
+type RoutingTable struct {
+	Mode string `json:"mode"`
+	// Shards is the number of shards in the hash mode.
+	Shards int `json:"shards,omitempty"`
+	// Splits are sorted split points in the range mode, shard i holds names in [Splits[i-1], Splits[i]),
+	// so there are len(Splits)+1 shards.
+	Splits []string     `json:"splits,omitempty"`
+	Groups []GroupRoute `json:"groups"`
+
+	shardGroups []uint64 // ID of the group of each shard
+}
+
+// GroupRoute is a raft group and the shards it serves.
+type GroupRoute struct {
+	ID     uint64   `json:"id"`
+	Shards []int    `json:"shards"`
+	Peers  []string `json:"peers"` // raft URLs of members, the ID of member i+1 is at peers[i]
+	Addrs  []string `json:"addrs"` // service addresses of members, in the same order as peers
+}
+
+// MovedError is returned for a bitmap whose shard is served by a raft group not hosted by this process.
+type MovedError struct {
+	Shard int
+	Group uint64
+	Addr  string // service address of a member of the group, empty if it is unknown
+}
+
+func (e *MovedError) Error() string {
+	if e.Addr == "" {
+		return fmt.Sprintf("shard %d is served by raft group %d", e.Shard, e.Group)
+	}
+	return fmt.Sprintf("shard %d is served by raft group %d at %s", e.Shard, e.Group, e.Addr)
+}
+
+// LoadRoutingTable reads a routing table in JSON from the file.
+func LoadRoutingTable(path string) (*RoutingTable, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRoutingTable(data)
+}
+
+// ParseRoutingTable parses a routing table in JSON and validates it.
+func ParseRoutingTable(data []byte) (*RoutingTable, error) {
+	var rt RoutingTable
+	if err := json.Unmarshal(data, &rt); err != nil {
+		return nil, err
+	}
+	if err := rt.init(); err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
+
+// init validates the table and maps shards to groups. Every shard must be served by exactly one group.
+func (rt *RoutingTable) init() error {
+	var shards int
+	switch rt.Mode {
+	case RoutingModeHash:
+		shards = rt.Shards
+	case RoutingModeRange:
+		if !sort.StringsAreSorted(rt.Splits) {
+			return fmt.Errorf("%w: splits are not sorted", ErrInvalidRouting)
+		}
+		shards = len(rt.Splits) + 1
+	default:
+		return fmt.Errorf("%w: unknown mode %q", ErrInvalidRouting, rt.Mode)
+	}
+	if shards <= 0 {
+		return fmt.Errorf("%w: no shards", ErrInvalidRouting)
+	}
+
+	rt.shardGroups = make([]uint64, shards)
+	ids := make(map[uint64]struct{}, len(rt.Groups))
+	for _, g := range rt.Groups {
+		if g.ID == 0 {
+			return fmt.Errorf("%w: group ID must be positive", ErrInvalidRouting)
+		}
+		if _, ok := ids[g.ID]; ok {
+			return fmt.Errorf("%w: duplicated group %d", ErrInvalidRouting, g.ID)
+		}
+		ids[g.ID] = struct{}{}
+		if len(g.Addrs) > 0 && len(g.Addrs) != len(g.Peers) {
+			return fmt.Errorf("%w: group %d has %d peers but %d addrs", ErrInvalidRouting, g.ID, len(g.Peers), len(g.Addrs))
+		}
+
+		for _, shard := range g.Shards {
+			if shard < 0 || shard >= shards {
+				return fmt.Errorf("%w: shard %d of group %d is out of range", ErrInvalidRouting, shard, g.ID)
+			}
+			if rt.shardGroups[shard] != 0 {
+				return fmt.Errorf("%w: shard %d is served by groups %d and %d", ErrInvalidRouting, shard, rt.shardGroups[shard], g.ID)
+			}
+			rt.shardGroups[shard] = g.ID
+		}
+	}
+	for shard, id := range rt.shardGroups {
+		if id == 0 {
+			return fmt.Errorf("%w: shard %d is not served by any group", ErrInvalidRouting, shard)
+		}
+	}
+	return nil
+}
+
+// HashTag returns the part of name used to compute its shard. Like Redis Cluster, if name contains
+// a non-empty substring between the first `{` and the following `}`, only the substring is used,
+// so bitmaps with the same tag, such as `{user1000}.following` and `{user1000}.followers`, are in the same shard.
+func HashTag(name string) string {
+	start := strings.IndexByte(name, '{')
+	if start < 0 {
+		return name
+	}
+	end := strings.IndexByte(name[start+1:], '}')
+	if end <= 0 {
+		return name
+	}
+	return name[start+1 : start+1+end]
+}
+
+// Shard returns the shard of the named bitmap.
+func (rt *RoutingTable) Shard(name string) int {
+	tag := HashTag(name)
+	if rt.Mode == RoutingModeRange {
+		return sort.Search(len(rt.Splits), func(i int) bool { return rt.Splits[i] > tag })
+	}
+	return int(crc32.ChecksumIEEE([]byte(tag)) % uint32(len(rt.shardGroups)))
+}
+
+// GroupOf returns the ID of the group serving the named bitmap and its shard.
+func (rt *RoutingTable) GroupOf(name string) (uint64, int) {
+	shard := rt.Shard(name)
+	return rt.shardGroups[shard], shard
+}
+
+// Group returns the route of the group, or nil if it is not in the table.
+func (rt *RoutingTable) Group(id uint64) *GroupRoute {
+	for i := range rt.Groups {
+		if rt.Groups[i].ID == id {
+			return &rt.Groups[i]
+		}
+	}
+	return nil
+}
+
+// groupServicePath is the rpcx service path of bitmaps of a raft group, "Bitmap" is used by an unsharded server.
+func groupServicePath(group uint64) string {
+	if group == 0 {
+		return "Bitmap"
+	}
+	return "Bitmap.g" + strconv.FormatUint(group, 10)
+}
+
+// SetRoutingTable partitions bitmaps into shards of raft groups by the routing table.
+// It must be invoked before Serve.
+func (s *Server) SetRoutingTable(rt *RoutingTable) {
+	s.routing = rt
+}
+
+// AddGroup adds a raft group hosted by this process, g holds the bitmaps of the shards of the group.
+// It must be invoked before Serve.
+func (s *Server) AddGroup(id uint64, g *Server) {
+	if s.groups == nil {
+		s.groups = make(map[uint64]*Server)
+	}
+	g.acl = s.acl
+	g.metrics = s.metrics
+	g.slowlog = s.slowlog
+	g.pubsub = s.pubsub
+	g.bitmaps.setNotify(s.pubsub.notifyKeyspaceEvent)
+	s.groups[id] = g
+}
+
+// Groups returns the IDs of raft groups hosted by this process.
+func (s *Server) Groups() []uint64 {
+	ids := make([]uint64, 0, len(s.groups))
+	for id := range s.groups {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (s *Server) isSharded() bool {
+	return s.routing != nil
+}
+
+// group returns the hosted raft group.
+func (s *Server) group(id uint64) (*Server, error) {
+	g := s.groups[id]
+	if g == nil {
+		return nil, ErrGroupNotFound
+	}
+	return g, nil
+}
+
+// route returns the server holding the named bitmap, which is s itself if it is not sharded,
+// or a MovedError if the group of the bitmap is not hosted by this process.
+func (s *Server) route(name string) (*Server, error) {
+	if !s.isSharded() {
+		return s, nil
+	}
+
+	id, shard := s.routing.GroupOf(name)
+	g := s.groups[id]
+	// the bitmap may be migrated to other groups, follow its tombstones
+	for i := 0; g != nil && i < len(s.routing.Groups); i++ {
+		_, movedTo := g.bitmaps.migration(name)
+		if movedTo == 0 {
+			break
+		}
+		id, g = movedTo, s.groups[movedTo]
+	}
+	if g != nil {
+		return g, nil
+	}
+	e := &MovedError{Shard: shard, Group: id}
+	if r := s.routing.Group(id); r != nil && len(r.Addrs) > 0 {
+		e.Addr = r.Addrs[0]
+	}
+	return nil, e
+}
+
+// routeWrite returns the server holding all the named bitmaps for writes like routeAll,
+// writes to bitmaps being migrated are refused with ErrMigrating.
+func (s *Server) routeWrite(names ...string) (*Server, error) {
+	g, err := s.routeAll(names...)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if migrating, _ := g.bitmaps.migration(name); migrating != 0 {
+			return nil, ErrMigrating
+		}
+	}
+	return g, nil
+}
+
+// routeAll returns the server holding all the named bitmaps, they must be in the same raft group.
+// Writes of multiple bitmaps, such as InterStore, use it so they are applied by one raft group.
+func (s *Server) routeAll(names ...string) (*Server, error) {
+	var g *Server
+	for _, name := range names {
+		gn, err := s.route(name)
+		if err != nil {
+			return nil, err
+		}
+		if g != nil && gn != g {
+			return nil, ErrCrossShard
+		}
+		g = gn
+	}
+	if g == nil {
+		return s, nil
+	}
+	return g, nil
+}
+
+// bitmapsOf returns the bitmaps holding all the named bitmaps for reads. If they are in different
+// raft groups hosted by this process, it returns a temporary Bitmaps with copies of them,
+// so reads such as Inter and Union run across shards.
+func (s *Server) bitmapsOf(names ...string) (*Bitmaps, error) {
+	g, err := s.routeAll(names...)
+	if err == nil {
+		return g.bitmaps, nil
+	}
+	if err != ErrCrossShard {
+		return nil, err
+	}
+
+	bs := NewBitmaps()
+	for _, name := range names {
+		g, err := s.route(name)
+		if err != nil {
+			return nil, err
+		}
+		if bm := g.bitmaps.Clone(name); bm != nil {
+			bs.store(name, bm)
+		}
+	}
+	return bs, nil
+}
@@ -0,0 +1,103 @@
+package basalt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestHashTag(t *testing.T) {
+	cases := map[string]string{
+		"user1000":            "user1000",
+		"{user1000}.follower": "user1000",
+		"a{user1000}b{c}":     "user1000",
+		"{}.follower":         "{}.follower",
+		"{user1000.follower":  "{user1000.follower",
+		"}{user1000}":         "user1000",
+	}
+	for name, tag := range cases {
+		if got := HashTag(name); got != tag {
+			t.Errorf("expect tag %q of %q but got %q", tag, name, got)
+		}
+	}
+}
+
+func TestParseRoutingTable(t *testing.T) {
+	rt, err := ParseRoutingTable([]byte(`{"mode":"range","splits":["h","p"],"groups":[{"id":1,"shards":[0,2]},{"id":2,"shards":[1]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]uint64{"apple": 1, "h": 2, "orange": 2, "{apple}.pear": 1, "zoo": 1}
+	for name, group := range cases {
+		if got, _ := rt.GroupOf(name); got != group {
+			t.Errorf("expect group %d of %q but got %d", group, name, got)
+		}
+	}
+
+	rt, err = ParseRoutingTable([]byte(`{"mode":"hash","shards":16,"groups":[{"id":1,"shards":[0,1,2,3,4,5,6,7]},{"id":2,"shards":[8,9,10,11,12,13,14,15]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.Shard("{user1000}.following") != rt.Shard("{user1000}.followers") {
+		t.Errorf("bitmaps with the same hash tag are in different shards")
+	}
+
+	for _, data := range []string{
+		`{"mode":"hash","shards":2,"groups":[{"id":1,"shards":[0]}]}`,
+		`{"mode":"hash","shards":2,"groups":[{"id":1,"shards":[0,1]},{"id":2,"shards":[1]}]}`,
+		`{"mode":"hash","shards":2,"groups":[{"id":0,"shards":[0,1]}]}`,
+		`{"mode":"range","splits":["p","h"],"groups":[{"id":1,"shards":[0,1,2]}]}`,
+		`{"mode":"hash","shards":1,"groups":[{"id":1,"shards":[0],"peers":["http://127.0.0.1:12379"],"addrs":["a","b"]}]}`,
+		`{"mode":"slot","groups":[]}`,
+	} {
+		if _, err := ParseRoutingTable([]byte(data)); !errors.Is(err, ErrInvalidRouting) {
+			t.Errorf("expect ErrInvalidRouting for %s but got %v", data, err)
+		}
+	}
+}
+
+func TestServer_Route(t *testing.T) {
+	rt, err := ParseRoutingTable([]byte(`{"mode":"range","splits":["h","p"],"groups":[
+		{"id":1,"shards":[0]},{"id":2,"shards":[1]},{"id":3,"shards":[2],"addrs":["127.0.0.1:38972"],"peers":["http://127.0.0.1:32379"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("", NewBitmaps(), nil, "")
+	s.SetRoutingTable(rt)
+	g1 := NewServer("", NewBitmaps(), nil, "")
+	g2 := NewServer("", NewBitmaps(), nil, "")
+	s.AddGroup(1, g1)
+	s.AddGroup(2, g2)
+
+	g1.bitmaps.AddMany("apple", []uint32{1, 2, 3}, false)
+	g1.bitmaps.AddMany("banana", []uint32{2, 3, 4}, false)
+	g2.bitmaps.AddMany("kiwi", []uint32{3, 4, 5}, false)
+
+	if g, err := s.route("apple"); err != nil || g != g1 {
+		t.Fatalf("expect group 1 for apple but got %v", err)
+	}
+	if g, err := s.routeAll("apple", "{banana}.kiwi"); err != nil || g != g1 {
+		t.Fatalf("expect group 1 for co-located bitmaps but got %v", err)
+	}
+	if _, err := s.routeAll("apple", "kiwi"); err != ErrCrossShard {
+		t.Fatalf("expect ErrCrossShard but got %v", err)
+	}
+	_, err = s.route("zoo")
+	if e, ok := err.(*MovedError); !ok || e.Group != 3 || e.Shard != 2 || e.Addr != "127.0.0.1:38972" {
+		t.Fatalf("expect MovedError to group 3 but got %v", err)
+	}
+
+	bs, err := s.bitmapsOf("apple", "banana", "kiwi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt := bs.Inter("apple", "banana", "kiwi"); !reflect.DeepEqual(rt, []uint32{3}) {
+		t.Errorf("expect [3] across shards but got %v", rt)
+	}
+	if rt := bs.Union("apple", "kiwi", "missing"); !reflect.DeepEqual(rt, []uint32{1, 2, 3, 4, 5}) {
+		t.Errorf("expect [1 2 3 4 5] across shards but got %v", rt)
+	}
+	if _, err := s.bitmapsOf("apple", "zoo"); err == nil {
+		t.Errorf("expect an error for bitmaps of a group not hosted")
+	}
+}
@@ -0,0 +1,219 @@
+package basalt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the slow log, the same as Redis.
+const (
+	DefaultSlowLogThreshold = 10 * time.Millisecond
+	DefaultSlowLogMaxLen    = 128
+)
+
+// Like Redis, the slow log keeps at most slowLogMaxArgs arguments of a command and slowLogMaxArgLen bytes of an argument.
+const (
+	slowLogMaxArgs   = 32
+	slowLogMaxArgLen = 128
+)
+
+// SlowLogEntry is a command that took longer than the threshold of the slow log.
+type SlowLogEntry struct {
+	ID         uint64        `json:"id"`
+	Time       time.Time     `json:"time"`
+	Duration   time.Duration `json:"duration"`
+	Protocol   string        `json:"protocol"`
+	Command    string        `json:"command"`
+	Args       []string      `json:"args"`
+	Client     string        `json:"client"`
+	ClientName string        `json:"client_name,omitempty"`
+}
+
+// SlowLogReply is the length of the slow log and its latest entries.
+type SlowLogReply struct {
+	Len     int            `json:"len"`
+	Entries []SlowLogEntry `json:"entries"`
+}
+
+// SlowLog keeps the latest commands slower than its threshold, in memory.
+type SlowLog struct {
+	mu        sync.Mutex
+	threshold time.Duration
+	maxLen    int
+	entries   []SlowLogEntry // ring buffer, entries[next-1] is the latest
+	next      int
+	lastID    uint64
+}
+
+// NewSlowLog returns a slow log with the default threshold and max length.
+func NewSlowLog() *SlowLog {
+	return &SlowLog{threshold: DefaultSlowLogThreshold, maxLen: DefaultSlowLogMaxLen}
+}
+
+// Configure sets the threshold and the max length of the slow log, existing entries beyond the max length are dropped.
+// All commands are logged if the threshold is 0, and none if it is negative.
+func (l *SlowLog) Configure(threshold time.Duration, maxLen int) {
+	if maxLen < 0 {
+		maxLen = 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := l.latest(maxLen)
+	l.threshold = threshold
+	l.maxLen = maxLen
+	l.entries = make([]SlowLogEntry, len(entries), maxLen)
+	// latest returns the newest first, the ring keeps the oldest first
+	for i, e := range entries {
+		l.entries[len(entries)-1-i] = e
+	}
+	l.next = 0
+	if maxLen > 0 {
+		l.next = len(entries) % maxLen
+	}
+}
+
+// slow returns whether a command of the duration should be logged.
+func (l *SlowLog) slow(d time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.threshold >= 0 && d >= l.threshold && l.maxLen > 0
+}
+
+// add logs the command, its ID is assigned by the slow log and its arguments are truncated.
+func (l *SlowLog) add(e SlowLogEntry) {
+	e.Command = truncateSlowLogArg(e.Command)
+	e.Args = truncateSlowLogArgs(e.Args)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxLen == 0 {
+		return
+	}
+	l.lastID++
+	e.ID = l.lastID
+	if len(l.entries) < l.maxLen {
+		l.entries = append(l.entries, e)
+	} else {
+		l.entries[l.next] = e
+	}
+	l.next = (l.next + 1) % l.maxLen
+}
+
+// Get returns at most n latest entries, the latest first. All entries are returned if n is negative.
+func (l *SlowLog) Get(n int) []SlowLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.latest(n)
+}
+
+func (l *SlowLog) latest(n int) []SlowLogEntry {
+	if n < 0 || n > len(l.entries) {
+		n = len(l.entries)
+	}
+	entries := make([]SlowLogEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		idx := l.next - i
+		if idx < 0 {
+			idx += len(l.entries)
+		}
+		entries = append(entries, l.entries[idx])
+	}
+	return entries
+}
+
+// Len returns the number of entries in the slow log.
+func (l *SlowLog) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// Reset removes all entries, IDs of new entries keep increasing.
+func (l *SlowLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = nil
+	l.next = 0
+}
+
+func truncateSlowLogArgs(args []string) []string {
+	if len(args) > slowLogMaxArgs {
+		more := len(args) - slowLogMaxArgs + 1
+		args = append(args[:slowLogMaxArgs-1:slowLogMaxArgs-1], fmt.Sprintf("... (%d more arguments)", more))
+	}
+	truncated := make([]string, len(args))
+	for i, arg := range args {
+		truncated[i] = truncateSlowLogArg(arg)
+	}
+	return truncated
+}
+
+func truncateSlowLogArg(arg string) string {
+	if len(arg) <= slowLogMaxArgLen {
+		return arg
+	}
+	return fmt.Sprintf("%s... (%d more bytes)", arg[:slowLogMaxArgLen], len(arg)-slowLogMaxArgLen)
+}
+
+// slowLogValue formats a decoded argument of rpcx as arguments of the slow log, fields of a struct are sorted by name.
+func slowLogValue(v interface{}) []string {
+	switch a := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(a))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		args := make([]string, 0, len(keys))
+		for _, k := range keys {
+			args = append(args, fmt.Sprintf("%s=%v", k, a[k]))
+		}
+		return args
+	case []interface{}:
+		args := make([]string, 0, len(a))
+		for _, e := range a {
+			args = append(args, fmt.Sprint(e))
+		}
+		return args
+	case nil:
+		return nil
+	}
+	return []string{fmt.Sprint(v)}
+}
+
+// redactedArg replaces secrets in logged arguments, like Redis.
+const redactedArg = "(redacted)"
+
+// redactSlowLogArgs replaces the arguments of AUTH and the username and password of HELLO AUTH of a redis command,
+// so passwords are not logged.
+func redactSlowLogArgs(command string, args []string) {
+	switch strings.ToLower(command) {
+	case "auth":
+		for i := range args {
+			args[i] = redactedArg
+		}
+	case "hello":
+		for i := 1; i < len(args); i++ {
+			if !strings.EqualFold(args[i], "auth") {
+				continue
+			}
+			for j := i + 1; j <= i+2 && j < len(args); j++ {
+				args[j] = redactedArg
+			}
+			i += 2
+		}
+	}
+}
+
+// SetSlowLog sets the threshold and the max length of the slow log shared by all services and raft groups.
+func (s *Server) SetSlowLog(threshold time.Duration, maxLen int) {
+	s.slowlog.Configure(threshold, maxLen)
+}
+
+// SlowLog returns the slow log of the server.
+func (s *Server) SlowLog() *SlowLog {
+	return s.slowlog
+}
@@ -0,0 +1,185 @@
+package basalt
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowLog(t *testing.T) {
+	l := NewSlowLog()
+	l.Configure(time.Millisecond, 3)
+	if l.slow(time.Microsecond) || !l.slow(time.Millisecond) {
+		t.Fatal("unexpected threshold")
+	}
+	for i := 0; i < 5; i++ {
+		l.add(SlowLogEntry{Command: "bmadd", Args: []string{"a", strconv.Itoa(i)}})
+	}
+	entries := l.Get(-1)
+	if l.Len() != 3 || len(entries) != 3 {
+		t.Fatalf("expect 3 entries but got %d", len(entries))
+	}
+	for i, e := range entries {
+		if e.ID != uint64(5-i) || e.Args[1] != strconv.Itoa(4-i) {
+			t.Errorf("expect the latest entries first but got %+v", e)
+		}
+	}
+	if entries := l.Get(1); len(entries) != 1 || entries[0].ID != 5 {
+		t.Errorf("expect the latest entry but got %+v", entries)
+	}
+
+	l.Configure(time.Millisecond, 2)
+	if entries := l.Get(-1); len(entries) != 2 || entries[0].ID != 5 || entries[1].ID != 4 {
+		t.Errorf("expect the latest 2 entries kept but got %+v", entries)
+	}
+	l.add(SlowLogEntry{Command: "bmadd"})
+	if entries := l.Get(-1); len(entries) != 2 || entries[0].ID != 6 || entries[1].ID != 5 {
+		t.Errorf("expect the oldest entry replaced but got %+v", entries)
+	}
+
+	l.Reset()
+	args := make([]string, 40)
+	args[0] = strings.Repeat("x", 200)
+	l.add(SlowLogEntry{Command: "bmaddmany", Args: args})
+	e := l.Get(-1)[0]
+	if e.ID != 7 || len(e.Args) != slowLogMaxArgs {
+		t.Fatalf("expect arguments truncated but got %d", len(e.Args))
+	}
+	if e.Args[0] != strings.Repeat("x", 128)+"... (72 more bytes)" {
+		t.Errorf("unexpected truncated argument %s", e.Args[0])
+	}
+	if e.Args[slowLogMaxArgs-1] != "... (9 more arguments)" {
+		t.Errorf("unexpected last argument %s", e.Args[slowLogMaxArgs-1])
+	}
+
+	l.Configure(-1, 2)
+	if l.slow(time.Hour) {
+		t.Errorf("expect the slow log disabled")
+	}
+}
+
+func TestServer_SlowLog(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	s := NewServer(addr, NewBitmaps(), nil, "")
+	s.SetSlowLog(0, 10)
+	s.ln = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.configListener(ctx, ln)
+	<-s.started
+
+	// redis
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("*3\r\n$5\r\nbmadd\r\n$1\r\na\r\n$1\r\n1\r\n"))
+	if line, _ := r.ReadString('\n'); line != ":1\r\n" {
+		t.Fatalf("unexpected reply %q", line)
+	}
+
+	// http
+	resp, err := http.Post("http://"+addr+"/add/a/2", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// rpcx
+	var f forwarder
+	c, err := f.conn(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.call("Bitmap", "Add", "", &BitmapValueRequest{Name: "b", Value: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// rpcx requests are logged after their responses are written
+	waitSlowLog := func(n int) {
+		for i := 0; s.slowlog.Len() < n; i++ {
+			if i == 100 {
+				t.Fatalf("expect %d entries but got %d", n, s.slowlog.Len())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitSlowLog(3)
+
+	resp, err = http.Get("http://" + addr + "/slowlog/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply SlowLogReply
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Len != 3 || len(reply.Entries) != 3 {
+		t.Fatalf("expect 3 entries but got %+v", reply)
+	}
+	rpcx, web, redis := reply.Entries[0], reply.Entries[1], reply.Entries[2]
+	if rpcx.Protocol != protocolRpcx || rpcx.Command != "Add" || strings.Join(rpcx.Args, " ") != "Name=b Value=3" {
+		t.Errorf("unexpected rpcx entry %+v", rpcx)
+	}
+	if web.Protocol != protocolHTTP || web.Command != "add" || strings.Join(web.Args, " ") != "a 2" || web.Client == "" {
+		t.Errorf("unexpected http entry %+v", web)
+	}
+	if redis.Protocol != protocolRedis || redis.Command != "bmadd" || strings.Join(redis.Args, " ") != "a 1" ||
+		redis.Client != conn.LocalAddr().String() {
+		t.Errorf("unexpected redis entry %+v", redis)
+	}
+
+	// requests of the slow log are logged too, http entries are named by the protocol
+	conn.Write([]byte("*2\r\n$7\r\nslowlog\r\n$3\r\nlen\r\n*3\r\n$7\r\nSLOWLOG\r\n$3\r\nget\r\n$1\r\n2\r\n"))
+	var replies string
+	for !strings.HasSuffix(replies, "$4\r\nhttp\r\n") {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies += line
+	}
+	if !strings.HasPrefix(replies, ":4\r\n*2\r\n*6\r\n:5\r\n") || !strings.Contains(replies, "*2\r\n$7\r\nslowlog\r\n$3\r\nlen\r\n") ||
+		!strings.Contains(replies, "*2\r\n$7\r\nslowlog\r\n$1\r\n3\r\n") {
+		t.Errorf("unexpected slowlog replies %q", replies)
+	}
+
+	if err := c.call("Bitmap", "ResetSlowLog", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	waitSlowLog(1)
+	var rpcxReply SlowLogReply
+	if err := (&RpcxBitmapService{s: s}).SlowLog(ctx, -1, &rpcxReply); err != nil {
+		t.Fatal(err)
+	}
+	if rpcxReply.Len != 1 || rpcxReply.Entries[0].Command != "ResetSlowLog" || rpcxReply.Entries[0].ID != 7 {
+		t.Errorf("expect only the reset logged but got %+v", rpcxReply)
+	}
+
+	// passwords are redacted
+	conn.Write([]byte("*3\r\n$4\r\nAUTH\r\n$4\r\nuser\r\n$6\r\nsecret\r\n" +
+		"*6\r\n$5\r\nhello\r\n$1\r\n3\r\n$4\r\nauth\r\n$4\r\nuser\r\n$6\r\nsecret\r\n$7\r\nSETNAME\r\n"))
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := s.slowlog.Get(2)
+	if len(entries) != 2 || strings.Join(entries[1].Args, " ") != "(redacted) (redacted)" ||
+		strings.Join(entries[0].Args, " ") != "3 auth (redacted) (redacted) SETNAME" {
+		t.Errorf("expect passwords redacted but got %+v", entries)
+	}
+}
@@ -0,0 +1,85 @@
+package basalt
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/rpcxio/etcd/pkg/transport"
+)
+
+// TLSOptions configures TLS from PEM files. Certificates are loaded on every handshake,
+// so renewed certificates take effect without restarting the server.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// CAFile is the CA to verify certificates of the other side. A server with a CA requires
+	// clients to present certificates signed by it, which is mutual TLS.
+	CAFile string
+	// ClientCertAuth requires clients to present certificates even if CAFile is not set,
+	// they are verified by the system roots.
+	ClientCertAuth bool
+}
+
+// Empty returns true if TLS is not configured.
+func (o TLSOptions) Empty() bool {
+	return o.CertFile == "" && o.KeyFile == ""
+}
+
+func (o TLSOptions) info() transport.TLSInfo {
+	return transport.TLSInfo{
+		CertFile:       o.CertFile,
+		KeyFile:        o.KeyFile,
+		TrustedCAFile:  o.CAFile,
+		ClientCertAuth: o.ClientCertAuth,
+	}
+}
+
+// ServerConfig returns the config for servers.
+func (o TLSOptions) ServerConfig() (*tls.Config, error) {
+	cfg, err := o.info().ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	// services behind cmux see wrapped connections, so they can't speak HTTP/2
+	cfg.NextProtos = nil
+	return cfg, nil
+}
+
+// ClientConfig returns the config for clients, which present the certificate if it is set.
+func (o TLSOptions) ClientConfig() (*tls.Config, error) {
+	return o.info().ClientConfig()
+}
+
+// SetTLSConfig serves all services over TLS, it must be invoked before Serve.
+// TLS is terminated before connections are dispatched to rpcx, HTTP and redis, so plaintext is refused.
+func (s *Server) SetTLSConfig(cfg *tls.Config) {
+	s.tlsConfig = cfg
+}
+
+func (s *Server) tlsListener(ln net.Listener) net.Listener {
+	if s.tlsConfig == nil {
+		return ln
+	}
+	return tls.NewListener(ln, s.tlsConfig)
+}
+
+// redirectURL returns the URL of the request at another server, in the same scheme.
+func redirectURL(r *http.Request, addr string) string {
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + addr + r.URL.RequestURI()
+}
+
+// withScheme marks requests served over TLS, which is terminated before requests reach the HTTP server.
+func withScheme(h http.Handler, secure bool) http.Handler {
+	if !secure {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Scheme = "https"
+		h.ServeHTTP(w, r)
+	})
+}
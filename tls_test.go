@@ -0,0 +1,195 @@
+package basalt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "basalt test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for 127.0.0.1 and its key to dir/name.crt and dir/name.key.
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestServer_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basalt-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey := ca.issue(t, dir, "server", 2)
+	clientCert, clientKey := ca.issue(t, dir, "client", 3)
+
+	serverCfg, err := TLSOptions{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile}.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg, err := TLSOptions{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile}.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	s := NewServer(addr, NewBitmaps(), nil, "")
+	s.SetTLSConfig(serverCfg)
+	s.ln = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.configListener(ctx, s.tlsListener(ln))
+
+	// redis
+	conn, err := tls.Dial("tcp", addr, clientCfg)
+	if err != nil {
+		t.Fatalf("failed to dial over TLS: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "+PONG\r\n" {
+		t.Fatalf("failed to ping over TLS: %q, %v", buf[:n], err)
+	}
+
+	// http
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+	resp, err := client.Post("https://"+addr+"/add/test/1", "", nil)
+	if err != nil {
+		t.Fatalf("failed to add over TLS: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !s.bitmaps.Exists("test", 1) {
+		t.Fatalf("failed to add over TLS: %s", resp.Status)
+	}
+
+	// rpcx
+	f := &forwarder{tlsConfig: clientCfg}
+	if err := f.forward(addr, "Bitmap", BmOpAdd, "test,2"); err != ErrNotInCluster {
+		t.Fatalf("expect ErrNotInCluster from rpcx over TLS but got %v", err)
+	}
+
+	// plaintext and clients without certificates are refused
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.SetDeadline(time.Now().Add(time.Second))
+	plain.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	if n, _ := plain.Read(buf); string(buf[:n]) == "+PONG\r\n" {
+		t.Errorf("expect plaintext refused")
+	}
+	noCertCfg, err := TLSOptions{CAFile: caFile}.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: noCertCfg}}).Get("https://" + addr + "/card/test"); err == nil {
+		t.Errorf("expect clients without certificates refused")
+	}
+
+	// renewed certificates are loaded by new connections
+	ca.issue(t, dir, "server", 4)
+	conn2, err := tls.Dial("tcp", addr, clientCfg)
+	if err != nil {
+		t.Fatalf("failed to dial over TLS: %v", err)
+	}
+	defer conn2.Close()
+	if serial := conn2.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Errorf("expect the renewed certificate but got serial %d", serial)
+	}
+}
+
+func TestRedirectURL(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodPost, "/add/test/1?x=1", nil)
+	if u := redirectURL(r, "127.0.0.1:28972"); u != "http://127.0.0.1:28972/add/test/1?x=1" {
+		t.Errorf("unexpected redirect %s", u)
+	}
+	r.URL.Scheme = "https"
+	if u := redirectURL(r, "127.0.0.1:28972"); u != "https://127.0.0.1:28972/add/test/1?x=1" {
+		t.Errorf("unexpected redirect %s", u)
+	}
+}
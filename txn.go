@@ -0,0 +1,384 @@
+package basalt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// execTimeout is how long EXEC waits for its transaction to be applied by this node.
+const execTimeout = 2 * proposeTimeout
+
+// Errors for transactions.
+var (
+	ErrTxAborted  = errors.New("transaction is aborted because watched bitmaps are modified")
+	ErrTxTimeout  = errors.New("transaction is proposed but not applied in time")
+	ErrNotInTx    = errors.New("command is not allowed in a transaction")
+	errWrongArity = errors.New("wrong number of arguments")
+)
+
+// Transaction is a batch of commands run atomically. It is proposed to raft as one entry,
+// so every replica applies all of its writes or none of them.
+type Transaction struct {
+	ID       uint64 // assigned when it is proposed, so the proposing node gets its replies once it is applied
+	Watches  []WatchedBitmap
+	Commands [][]string // commands with their names and arguments
+}
+
+// WatchedBitmap is the version of a bitmap when it is watched, the transaction is aborted if it is modified since then.
+type WatchedBitmap struct {
+	Name    string
+	Version int64 // unix nano time of the last modification, 0 if the bitmap does not exist
+}
+
+// txCommand is a command that can be queued in a transaction.
+type txCommand struct {
+	arity     int // number of arguments including the name, negative for the minimum number
+	firstKey  int // position of the first key
+	lastKey   int // position of the last key, negative positions count from the end
+	lastWrite int // keys from the first one to this position are written, 0 if keys are not written
+	// parse parses arguments other than keys, nil if there are none
+	parse func(args []string) (interface{}, error)
+	run   func(bs *Bitmaps, args []string, parsed interface{}) interface{}
+}
+
+// txCommands are commands that can be queued in a transaction. They reply an int64, a bool, a []uint32,
+// an OK string, nil or an []interface{} of them.
+var txCommands = map[string]txCommand{
+	"bmadd": {3, 1, 1, 1, parseUint32Values, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		bs.Add(args[1], parsed.([]uint32)[0], false)
+		return int64(1)
+	}},
+	"bmaddmany": {-3, 1, 1, 1, parseUint32Values, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		values := parsed.([]uint32)
+		bs.AddMany(args[1], values, false)
+		return int64(len(values))
+	}},
+	"bmdel": {3, 1, 1, 1, parseUint32Values, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		bs.Remove(args[1], parsed.([]uint32)[0], false)
+		return int64(1)
+	}},
+	"bmdrop": {2, 1, 1, 1, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		bs.RemoveBitmap(args[1], false)
+		return "OK"
+	}},
+	"bmclear": {2, 1, 1, 1, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		bs.ClearBitmap(args[1], false)
+		return "OK"
+	}},
+	"bminterstore": {-4, 1, -1, 1, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return int64(bs.InterStore(args[1], args[2:]...))
+	}},
+	"bmunionstore": {-4, 1, -1, 1, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return int64(bs.UnionStore(args[1], args[2:]...))
+	}},
+	"bmxorstore": {4, 1, 3, 1, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return int64(bs.XorStore(args[1], args[2], args[3]))
+	}},
+	"bmdiffstore": {4, 1, 3, 1, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return int64(bs.DiffStore(args[1], args[2], args[3]))
+	}},
+
+	"exists": {-2, 1, -1, 0, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return bs.Has(args[1:]...)
+	}},
+	"bmcard": {2, 1, 1, 0, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return int64(bs.Card(args[1]))
+	}},
+	"bmexists": {3, 1, 1, 0, parseUint32Values, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return bs.Exists(args[1], parsed.([]uint32)[0])
+	}},
+	"bminter": {-3, 1, -1, 0, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return bs.Inter(args[1:]...)
+	}},
+	"bmunion": {-3, 1, -1, 0, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return bs.Union(args[1:]...)
+	}},
+	"bmxor": {3, 1, 2, 0, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return bs.Xor(args[1], args[2])
+	}},
+	"bmdiff": {3, 1, 2, 0, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return bs.Diff(args[1], args[2])
+	}},
+
+	// bit commands of Redis
+	"setbit": {4, 1, 1, 1, parseSetBit, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		a := parsed.(bitArgs)
+		return bs.SetBit(args[1], a.offset, a.bit)
+	}},
+	"bitop": {-4, 2, -1, 2, parseBitOp, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return bs.BitOp(parsed.(string), args[2], args[3:]...)
+	}},
+	"del": {-2, 1, -1, -1, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return bs.Del(args[1:]...)
+	}},
+	"unlink": {-2, 1, -1, -1, nil, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return bs.Del(args[1:]...)
+	}},
+	"bitfield": {-2, 1, 1, 1, parseBitField, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return bs.BitField(args[1], parsed.([]BitFieldOp))
+	}},
+	"getbit": {3, 1, 1, 0, parseGetBit, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return bs.GetBit(args[1], parsed.(uint32))
+	}},
+	"bitcount": {-2, 1, 1, 0, parseBitCount, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		return bs.BitCount(args[1], parsed.(*BitRange))
+	}},
+	"bitpos": {-3, 1, 1, 0, parseBitPos, func(bs *Bitmaps, args []string, parsed interface{}) interface{} {
+		a := parsed.(bitArgs)
+		return bs.BitPos(args[1], a.bit, a.r)
+	}},
+}
+
+// parseTxCommand checks the command can be queued in a transaction and parses its arguments.
+func parseTxCommand(args []string) (txCommand, interface{}, error) {
+	c, ok := txCommands[args[0]]
+	if !ok {
+		return c, nil, ErrNotInTx
+	}
+	if (c.arity > 0 && len(args) != c.arity) || (c.arity < 0 && len(args) < -c.arity) {
+		return c, nil, errWrongArity
+	}
+	if c.parse == nil {
+		return c, nil, nil
+	}
+	parsed, err := c.parse(args)
+	return c, parsed, err
+}
+
+// parseUint32Values parses the arguments after the key as uint32 values.
+func parseUint32Values(args []string) (interface{}, error) {
+	values := make([]uint32, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		v, err := str2uint32(arg)
+		if err != nil {
+			return nil, fmt.Errorf("wrong value for '%s' command because of %v", args[0], err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// keys returns names of bitmaps in the arguments of the command.
+func (c txCommand) keys(args []string) []string {
+	last := c.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	return args[c.firstKey : last+1]
+}
+
+// writes returns names of bitmaps written by the command.
+func (c txCommand) writes(args []string) []string {
+	last := c.lastWrite
+	if last == 0 {
+		return nil
+	}
+	if last < 0 {
+		last += len(args)
+	}
+	return args[c.firstKey : last+1]
+}
+
+// Keys returns names of bitmaps watched or used by commands of the transaction.
+func (tx *Transaction) Keys() []string {
+	var keys []string
+	for _, w := range tx.Watches {
+		keys = append(keys, w.Name)
+	}
+	for _, args := range tx.Commands {
+		keys = append(keys, txCommands[args[0]].keys(args)...)
+	}
+	return keys
+}
+
+// written returns names of bitmaps written by the transaction.
+func (tx *Transaction) written() []string {
+	var names []string
+	for _, args := range tx.Commands {
+		names = append(names, txCommands[args[0]].writes(args)...)
+	}
+	return names
+}
+
+// Watch returns the versions of the named bitmaps, a transaction watching them is aborted if they are modified.
+func (bs *Bitmaps) Watch(names ...string) []WatchedBitmap {
+	watches := make([]WatchedBitmap, len(names))
+	for i, name := range names {
+		watches[i] = WatchedBitmap{Name: name, Version: bs.version(name)}
+	}
+	return watches
+}
+
+func (bs *Bitmaps) version(name string) int64 {
+	bs.mu.RLock()
+	bm := bs.bitmaps[name]
+	bs.mu.RUnlock()
+	if bm == nil {
+		return 0
+	}
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	return bm.meta.Modified.UnixNano()
+}
+
+// execCommand runs a write command as a transaction of one command and returns its reply, so it is replicated
+// like the commands of MULTI.
+func (bs *Bitmaps) execCommand(args ...string) (interface{}, error) {
+	replies, err := bs.Exec(&Transaction{Commands: [][]string{args}}, true)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Exec runs the commands of the transaction atomically and returns their replies, or ErrTxAborted if a watched
+// bitmap is modified. With callback, a transaction with writes is proposed as one raft entry and Exec returns
+// the replies once it is applied by this node.
+func (bs *Bitmaps) Exec(tx *Transaction, callback bool) ([]interface{}, error) {
+	for _, args := range tx.Commands {
+		if _, _, err := parseTxCommand(args); err != nil {
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+	}
+	written := tx.written()
+	if callback {
+		for _, name := range written {
+			if err := bs.checkWritable(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !callback || bs.writeCallback == nil || len(written) == 0 {
+		return bs.runTransaction(tx)
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	tx.ID = binary.LittleEndian.Uint64(id[:])
+	data, err := json.Marshal(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan txResult, 1)
+	bs.txMu.Lock()
+	if bs.txWaiters == nil {
+		bs.txWaiters = make(map[uint64]chan txResult)
+	}
+	bs.txWaiters[tx.ID] = done
+	bs.txMu.Unlock()
+	defer func() {
+		bs.txMu.Lock()
+		delete(bs.txWaiters, tx.ID)
+		bs.txMu.Unlock()
+	}()
+
+	if err := bs.writeCallback(BmOpMulti, string(data)); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(execTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.replies, r.err
+	case <-timer.C:
+		return nil, ErrTxTimeout
+	}
+}
+
+// txResult is the replies of an applied transaction.
+type txResult struct {
+	replies []interface{}
+	err     error
+}
+
+// runTransaction runs the commands of the transaction unless a watched bitmap is modified.
+// Transactions run one by one, writes out of transactions of a standalone server may interleave with them.
+func (bs *Bitmaps) runTransaction(tx *Transaction) ([]interface{}, error) {
+	bs.execMu.Lock()
+	defer bs.execMu.Unlock()
+
+	for _, w := range tx.Watches {
+		if bs.version(w.Name) != w.Version {
+			return nil, ErrTxAborted
+		}
+	}
+	replies := make([]interface{}, 0, len(tx.Commands))
+	for _, args := range tx.Commands {
+		c, parsed, err := parseTxCommand(args)
+		if err != nil {
+			replies = append(replies, err)
+			continue
+		}
+		replies = append(replies, c.run(bs, args, parsed))
+	}
+	return replies, nil
+}
+
+// transactionDone sends the result of the transaction to EXEC waiting for it on this node.
+func (bs *Bitmaps) transactionDone(id uint64, replies []interface{}, err error) {
+	bs.txMu.Lock()
+	done := bs.txWaiters[id]
+	bs.txMu.Unlock()
+	if done == nil {
+		return
+	}
+	select {
+	case done <- txResult{replies, err}:
+	default:
+	}
+}
+
+// applyTransaction applies a transaction, it is aborted if any of its bitmaps is fenced or moved by a migration.
+// The caller must hold s.mu.
+func (s *RaftServer) applyTransaction(op operaton) {
+	var tx Transaction
+	if err := json.Unmarshal([]byte(op.Val), &tx); err != nil {
+		log.Printf("wrong request: %+v", op)
+		return
+	}
+	bs := s.bmServer.bitmaps
+	for _, name := range tx.Keys() {
+		if migrating, movedTo := bs.migration(name); migrating != 0 || movedTo != 0 {
+			bs.transactionDone(tx.ID, nil, ErrMigrating)
+			return
+		}
+	}
+
+	replies, err := bs.runTransaction(&tx)
+	if err == nil {
+		s.captureTransaction(&tx, op.Time)
+	}
+	bs.transactionDone(tx.ID, replies, err)
+}
+
+// captureTransaction captures bitmaps written by the transaction if they are being migrated by this node.
+// The caller must hold s.mu.
+func (s *RaftServer) captureTransaction(tx *Transaction, t int64) {
+	bs := s.bmServer.bitmaps
+	s.migrationsMu.Lock()
+	defer s.migrationsMu.Unlock()
+	for _, name := range tx.written() {
+		m := s.migrations[name]
+		if m == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		switch err := bs.saveBitmaps(&buf, name); err {
+		case nil:
+			m.ops = append(m.ops, operaton{OP: BmOpPut, Val: buf.String(), Time: t})
+		case ErrBitmapNotFound:
+			m.ops = append(m.ops, operaton{OP: BmOpDrop, Val: name, Time: t})
+		default:
+			log.Printf("failed to capture %s written by a transaction: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package basalt
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBitmaps_Exec(t *testing.T) {
+	bs := NewBitmaps()
+	bs.AddMany("a", []uint32{1, 2, 3}, false)
+	bs.AddMany("b", []uint32{2, 3, 4}, false)
+
+	tx := &Transaction{Commands: [][]string{
+		{"bmdiffstore", "tmp", "a", "b"},
+		{"bmaddmany", "tmp", "7", "8"},
+		{"bmexists", "tmp", "7"},
+		{"bmunion", "tmp", "b"},
+		{"bmdrop", "a"},
+		{"bmcard", "a"},
+	}}
+	replies, err := bs.Exec(tx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{int64(1), int64(2), true, []uint32{1, 2, 3, 4, 7, 8}, "OK", int64(0)}
+	if !reflect.DeepEqual(replies, expected) {
+		t.Errorf("expect %v but got %v", expected, replies)
+	}
+
+	watches := bs.Watch("b", "missing")
+	if watches[1].Version != 0 {
+		t.Errorf("expect version 0 of a missing bitmap")
+	}
+	tx = &Transaction{Watches: watches, Commands: [][]string{{"bmadd", "b", "10"}}}
+	if _, err := bs.Exec(tx, true); err != nil {
+		t.Fatalf("expect the transaction applied if watched bitmaps are not modified but got %v", err)
+	}
+	tx = &Transaction{Watches: watches, Commands: [][]string{{"bmadd", "b", "11"}}}
+	if _, err := bs.Exec(tx, true); err != ErrTxAborted {
+		t.Errorf("expect ErrTxAborted but got %v", err)
+	}
+	tx = &Transaction{Watches: bs.Watch("missing"), Commands: [][]string{{"bmadd", "missing", "1"}}}
+	bs.Add("missing", 2, false)
+	if _, err := bs.Exec(tx, true); err != ErrTxAborted || bs.Exists("missing", 1) {
+		t.Errorf("expect ErrTxAborted if a missing bitmap is created but got %v", err)
+	}
+
+	for _, args := range [][]string{{"bmsave"}, {"bmadd", "a"}, {"bmadd", "a", "x"}, {"bminter", "a"}} {
+		if _, err := bs.Exec(&Transaction{Commands: [][]string{args}}, true); err == nil {
+			t.Errorf("expect an error for %v", args)
+		}
+	}
+}
+
+func TestBitmaps_ExecThroughRaft(t *testing.T) {
+	s := NewServer("", NewBitmaps(), nil, "")
+	rs := &RaftServer{bmServer: s, migrations: make(map[string]*migration)}
+	bs := s.bitmaps
+	var proposed int
+	bs.writeCallback = func(op OP, value string) error {
+		if op != BmOpMulti {
+			t.Fatalf("expect a transaction but got %s", op)
+		}
+		proposed++
+		go rs.applyTransaction(operaton{OP: op, Val: value})
+		return nil
+	}
+
+	replies, err := bs.Exec(&Transaction{Commands: [][]string{{"bmadd", "a", "1"}, {"bmcard", "a"}}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replies, []interface{}{int64(1), int64(1)}) || proposed != 1 {
+		t.Errorf("unexpected replies %v", replies)
+	}
+	if _, err := bs.Exec(&Transaction{Commands: [][]string{{"bmcard", "a"}}}, true); err != nil || proposed != 1 {
+		t.Errorf("expect reads run locally but got %v", err)
+	}
+
+	// bitmaps written during a migration are captured as a whole
+	m := &migration{name: "a"}
+	rs.migrations["a"] = m
+	if _, err := bs.Exec(&Transaction{Commands: [][]string{{"bmadd", "a", "2"}, {"bmadd", "b", "3"}}}, true); err != nil {
+		t.Fatal(err)
+	}
+	ops := rs.takeMigrationOps(m)
+	if len(ops) != 1 || ops[0].OP != BmOpPut {
+		t.Fatalf("expect a put captured but got %+v", ops)
+	}
+	dst := NewBitmaps()
+	if err := dst.put([]byte(ops[0].Val)); err != nil {
+		t.Fatal(err)
+	}
+	if rt := dst.Union("a"); !reflect.DeepEqual(rt, []uint32{1, 2}) {
+		t.Errorf("expect [1 2] captured but got %v", rt)
+	}
+
+	bs.fence("a", 2)
+	if _, err := bs.Exec(&Transaction{Commands: [][]string{{"bmadd", "b", "4"}, {"bmadd", "a", "3"}}}, true); err != ErrMigrating {
+		t.Errorf("expect ErrMigrating but got %v", err)
+	}
+	if bs.Exists("b", 4) {
+		t.Errorf("expect no writes of the aborted transaction")
+	}
+}
+
+func TestServer_Transaction(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	s := NewServer(addr, NewBitmaps(), nil, "")
+	s.ln = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.configListener(ctx, ln)
+	<-s.started
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	redis := func(args ...string) string {
+		var sb strings.Builder
+		sb.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+		for _, arg := range args {
+			sb.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+		}
+		if _, err := conn.Write([]byte(sb.String())); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(line)
+	}
+
+	s.bitmaps.AddMany("a", []uint32{1, 2, 3}, false)
+	s.bitmaps.AddMany("b", []uint32{3}, false)
+	for _, c := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"exec"}, "-ERR EXEC without MULTI"},
+		{[]string{"watch", "a"}, "+OK"},
+		{[]string{"multi"}, "+OK"},
+		{[]string{"multi"}, "-ERR MULTI calls can not be nested"},
+		{[]string{"watch", "b"}, "-ERR WATCH inside MULTI"},
+		{[]string{"bmdiffstore", "tmp", "a", "b"}, "+QUEUED"},
+		{[]string{"BMADD", "tmp", "9"}, "+QUEUED"},
+		{[]string{"bmcard", "tmp"}, "+QUEUED"},
+		{[]string{"exec"}, "*3"},
+		{[]string{"", ""}, ""}, // replies of exec
+		{[]string{"multi"}, "+OK"},
+		{[]string{"bmadd", "a", "x"}, "-ERR wrong value"},
+		{[]string{"bmsave"}, "-ERR command 'bmsave' is not allowed"},
+		{[]string{"exec"}, "-EXECABORT"},
+		{[]string{"multi"}, "+OK"},
+		{[]string{"bmadd", "a", "4"}, "+QUEUED"},
+		{[]string{"discard"}, "+OK"},
+		{[]string{"discard"}, "-ERR DISCARD without MULTI"},
+	} {
+		if c.args[0] == "" {
+			var replies []string
+			for i := 0; i < 3; i++ {
+				line, _ := r.ReadString('\n')
+				replies = append(replies, strings.TrimSpace(line))
+			}
+			if strings.Join(replies, " ") != ":2 :1 :3" {
+				t.Errorf("unexpected replies of exec: %v", replies)
+			}
+			continue
+		}
+		if reply := redis(c.args...); !strings.HasPrefix(reply, c.reply) {
+			t.Errorf("expect %s for %v but got %s", c.reply, c.args, reply)
+		}
+	}
+	if !reflect.DeepEqual(s.bitmaps.Union("tmp"), []uint32{1, 2, 9}) || s.bitmaps.Exists("a", 4) {
+		t.Errorf("unexpected bitmaps after transactions")
+	}
+
+	// the watched bitmap is modified by another client
+	if reply := redis("watch", "a"); reply != "+OK" {
+		t.Fatalf("unexpected reply %s", reply)
+	}
+	s.bitmaps.Add("a", 5, false)
+	redis("multi")
+	redis("bmadd", "a", "6")
+	if reply := redis("exec"); reply != "*-1" {
+		t.Errorf("expect a null array if the watched bitmap is modified but got %s", reply)
+	}
+	if s.bitmaps.Exists("a", 6) {
+		t.Errorf("expect the aborted transaction not applied")
+	}
+	// exec unwatches bitmaps
+	redis("multi")
+	redis("bmadd", "a", "6")
+	if reply := redis("exec"); reply != "*1" || !s.bitmaps.Exists("a", 6) {
+		t.Errorf("expect the transaction applied but got %s", reply)
+	}
+}
+
+func TestRpcxBitmapService_StoreThroughRaft(t *testing.T) {
+	s := NewServer("", NewBitmaps(), nil, "")
+	rs := &RaftServer{bmServer: s, migrations: make(map[string]*migration)}
+	bs := s.bitmaps
+	bs.AddMany("a", []uint32{1, 2}, false)
+	bs.AddMany("b", []uint32{2, 3}, false)
+	var proposed []string
+	bs.writeCallback = func(op OP, value string) error {
+		if op != BmOpMulti {
+			t.Fatalf("expect a transaction but got %s", op)
+		}
+		proposed = append(proposed, value)
+		go rs.applyTransaction(operaton{OP: op, Val: value})
+		return nil
+	}
+
+	ctx := context.Background()
+	svc := &RpcxBitmapService{s: s}
+	var reply bool
+	if err := svc.InterStore(ctx, &BitmapStoreRequest{Destination: "inter", Names: []string{"a", "b"}}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.UnionStore(ctx, &BitmapStoreRequest{Destination: "union", Names: []string{"a", "b"}}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.XorStore(ctx, &BitmapDstAndPairRequest{Destination: "xor", Name1: "a", Name2: "b"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.DiffStore(ctx, &BitmapDstAndPairRequest{Destination: "diff", Name1: "a", Name2: "b"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(proposed) != 4 {
+		t.Fatalf("expect 4 transactions proposed but got %d", len(proposed))
+	}
+	for name, expected := range map[string][]uint32{"inter": {2}, "union": {1, 2, 3}, "xor": {1, 3}, "diff": {1}} {
+		if rt := bs.Union(name); !reflect.DeepEqual(rt, expected) {
+			t.Errorf("expect %v stored into %s but got %v", expected, name, rt)
+		}
+	}
+}